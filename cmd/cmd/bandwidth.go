@@ -0,0 +1,233 @@
+package cmd
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/johnnyipcom/tgdownloader/internal/downloader"
+	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
+	"github.com/spf13/cobra"
+)
+
+// bandwidthSteps are the limits the prompt steps through with + and -.
+var bandwidthSteps = []int64{
+	256 << 10,
+	512 << 10,
+	1 << 20,
+	2 << 20,
+	5 << 20,
+	10 << 20,
+	20 << 20,
+	50 << 20,
+}
+
+func (r *Root) newBandwidthCmd() *cobra.Command {
+	bandwidthCmd := &cobra.Command{
+		Use:   "bandwidth [limit|reset]",
+		Short: "Show or change the download bandwidth limit",
+		Long: `Show the download bandwidth limit in effect, or replace it for the rest of
+the session. The limit is shared by all downloads, from Telegram and Yandex
+Disk alike, and applies to the ones in progress as well.
+
+"reset" goes back to downloader.bandwidth and downloader.bandwidth_schedule
+from the config. While a command runs in the prompt, + and - step the limit
+up and down.`,
+		Example: `  tgdownloader bandwidth
+  tgdownloader bandwidth 2MiB/s
+  tgdownloader bandwidth unlimited
+  tgdownloader bandwidth reset`,
+		Args: cobra.MaximumNArgs(1),
+		Annotations: map[string]string{
+			"prompt_history": "off",
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			limiter, err := r.bandwidthLimiter()
+			if err != nil {
+				return err
+			}
+
+			if len(args) == 1 {
+				if strings.EqualFold(strings.TrimSpace(args[0]), "reset") {
+					limiter.Reset()
+				} else {
+					limit, err := parseBandwidth(args[0])
+					if err != nil {
+						return apperr.New("cmd.bandwidth", apperr.KindConfig, err)
+					}
+					limiter.Set(limit)
+				}
+			}
+
+			_, _ = fmt.Fprintln(cmd.OutOrStdout(), describeBandwidth(limiter))
+			return nil
+		},
+	}
+
+	r.setupRuntimeForCmd(bandwidthCmd)
+	return bandwidthCmd
+}
+
+// bandwidthLimiter returns the limiter shared by all downloads of the
+// session, creating it from the config the first time.
+func (r *Root) bandwidthLimiter() (*downloader.BandwidthLimiter, error) {
+	r.bandwidthMu.Lock()
+	defer r.bandwidthMu.Unlock()
+
+	if r.bandwidth != nil {
+		return r.bandwidth, nil
+	}
+
+	dCfg := r.cfg.Sub("downloader")
+	limit, err := parseBandwidth(dCfg.GetString("bandwidth"))
+	if err != nil {
+		return nil, apperr.New("cmd.bandwidth.config", apperr.KindConfig, fmt.Errorf("invalid downloader.bandwidth: %w", err))
+	}
+
+	schedule, err := parseBandwidthSchedule(dCfg.GetStringSlice("bandwidth_schedule"))
+	if err != nil {
+		return nil, apperr.New("cmd.bandwidth.config", apperr.KindConfig, fmt.Errorf("invalid downloader.bandwidth_schedule: %w", err))
+	}
+
+	r.bandwidth = downloader.NewBandwidthLimiter(limit, schedule...)
+	return r.bandwidth, nil
+}
+
+// stepBandwidth changes the limit of the session to the next step up or down
+// and describes the result.
+func (r *Root) stepBandwidth(faster bool) string {
+	limiter, err := r.bandwidthLimiter()
+	if err != nil {
+		return fmt.Sprintf("Error: %v", err)
+	}
+
+	limiter.Set(nextBandwidthStep(limiter.Limit(), faster))
+	return describeBandwidth(limiter)
+}
+
+func nextBandwidthStep(limit int64, faster bool) int64 {
+	if faster {
+		if limit <= 0 {
+			return 0
+		}
+
+		for _, step := range bandwidthSteps {
+			if step > limit {
+				return step
+			}
+		}
+
+		return 0
+	}
+
+	if limit <= 0 {
+		return bandwidthSteps[len(bandwidthSteps)-1]
+	}
+
+	for i := len(bandwidthSteps) - 1; i >= 0; i-- {
+		if bandwidthSteps[i] < limit {
+			return bandwidthSteps[i]
+		}
+	}
+
+	return bandwidthSteps[0]
+}
+
+func describeBandwidth(limiter *downloader.BandwidthLimiter) string {
+	source := "config"
+	if limiter.Overridden() {
+		source = "set for this session"
+	}
+
+	return fmt.Sprintf("Bandwidth limit: %s (%s)", formatBandwidth(limiter.Limit()), source)
+}
+
+// parseBandwidth parses rates such as "5MiB/s" or "700KB". An empty value,
+// zero, "off" and "unlimited" disable the limit.
+func parseBandwidth(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	switch strings.ToLower(value) {
+	case "", "0", "off", "unlimited":
+		return 0, nil
+	}
+
+	if strings.HasSuffix(strings.ToLower(value), "/s") {
+		value = value[:len(value)-len("/s")]
+	}
+
+	return parseByteSize(value)
+}
+
+// formatBandwidth formats a limit so that parseBandwidth reads it back.
+func formatBandwidth(limit int64) string {
+	if limit <= 0 {
+		return "unlimited"
+	}
+
+	units := []struct {
+		size int64
+		name string
+	}{
+		{1 << 30, "GiB"},
+		{1 << 20, "MiB"},
+		{1 << 10, "KiB"},
+	}
+	for _, unit := range units {
+		if limit >= unit.size {
+			amount := math.Round(float64(limit)/float64(unit.size)*100) / 100
+			return strconv.FormatFloat(amount, 'f', -1, 64) + unit.name + "/s"
+		}
+	}
+
+	return fmt.Sprintf("%dB/s", limit)
+}
+
+// parseBandwidthSchedule parses windows such as "09:00-18:00 1MiB/s". The
+// first window that contains the current time wins.
+func parseBandwidthSchedule(entries []string) ([]downloader.BandwidthWindow, error) {
+	schedule := make([]downloader.BandwidthWindow, 0, len(entries))
+	for _, entry := range entries {
+		fields := strings.Fields(entry)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("window %q is not in the form \"HH:MM-HH:MM limit\"", entry)
+		}
+
+		from, to, ok := strings.Cut(fields[0], "-")
+		if !ok {
+			return nil, fmt.Errorf("window %q has no time range", entry)
+		}
+
+		var window downloader.BandwidthWindow
+		var err error
+		if window.From, err = parseTimeOfDay(from); err != nil {
+			return nil, fmt.Errorf("window %q: %w", entry, err)
+		}
+		if window.To, err = parseTimeOfDay(to); err != nil {
+			return nil, fmt.Errorf("window %q: %w", entry, err)
+		}
+		if window.Limit, err = parseBandwidth(fields[1]); err != nil {
+			return nil, fmt.Errorf("window %q: %w", entry, err)
+		}
+
+		schedule = append(schedule, window)
+	}
+
+	return schedule, nil
+}
+
+// parseTimeOfDay parses "HH:MM" into the time since midnight. "24:00" is the
+// end of the day.
+func parseTimeOfDay(value string) (time.Duration, error) {
+	if value == "24:00" {
+		return 24 * time.Hour, nil
+	}
+
+	parsed, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", value)
+	}
+
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/johnnyipcom/tgdownloader/internal/downloader"
+)
+
+func TestParseBandwidth(t *testing.T) {
+	tests := map[string]int64{
+		"":          0,
+		"off":       0,
+		"Unlimited": 0,
+		"5MiB/s":    5 << 20,
+		"700KB/S":   700_000,
+		"1.5MiB":    3 << 19,
+		"512":       512,
+	}
+	for input, want := range tests {
+		got, err := parseBandwidth(input)
+		if err != nil || got != want {
+			t.Fatalf("parseBandwidth(%q) = %d, %v; want %d", input, got, err, want)
+		}
+	}
+
+	if _, err := parseBandwidth("fast"); err == nil {
+		t.Fatal("parseBandwidth(fast) succeeded, want error")
+	}
+}
+
+func TestFormatBandwidthRoundTrips(t *testing.T) {
+	for _, limit := range []int64{0, 512, 256 << 10, 3 << 19, 5 << 20, 2 << 30} {
+		got, err := parseBandwidth(formatBandwidth(limit))
+		if err != nil || got != limit {
+			t.Fatalf("round trip of %d via %q = %d, %v", limit, formatBandwidth(limit), got, err)
+		}
+	}
+}
+
+func TestNextBandwidthStep(t *testing.T) {
+	tests := []struct {
+		limit  int64
+		faster bool
+		want   int64
+	}{
+		{limit: 0, faster: true, want: 0},
+		{limit: 0, faster: false, want: 50 << 20},
+		{limit: 50 << 20, faster: true, want: 0},
+		{limit: 3 << 20, faster: true, want: 5 << 20},
+		{limit: 3 << 20, faster: false, want: 2 << 20},
+		{limit: 256 << 10, faster: false, want: 256 << 10},
+		{limit: 1 << 10, faster: true, want: 256 << 10},
+	}
+	for _, tt := range tests {
+		if got := nextBandwidthStep(tt.limit, tt.faster); got != tt.want {
+			t.Fatalf("nextBandwidthStep(%d, %v) = %d, want %d", tt.limit, tt.faster, got, tt.want)
+		}
+	}
+}
+
+func TestParseBandwidthSchedule(t *testing.T) {
+	schedule, err := parseBandwidthSchedule([]string{"09:00-18:00 1MiB/s", "22:00-24:00 unlimited"})
+	if err != nil {
+		t.Fatalf("parseBandwidthSchedule() error = %v", err)
+	}
+
+	want := []downloader.BandwidthWindow{
+		{From: 9 * time.Hour, To: 18 * time.Hour, Limit: 1 << 20},
+		{From: 22 * time.Hour, To: 24 * time.Hour},
+	}
+	if !reflect.DeepEqual(schedule, want) {
+		t.Fatalf("schedule = %+v, want %+v", schedule, want)
+	}
+
+	for _, entry := range []string{"09:00 1MiB/s", "9-18 1MiB/s", "09:00-18:00", "09:00-25:00 1MiB/s"} {
+		if _, err := parseBandwidthSchedule([]string{entry}); err == nil {
+			t.Fatalf("parseBandwidthSchedule(%q) succeeded, want error", entry)
+		}
+	}
+}
@@ -18,9 +18,28 @@ func (r *Root) newDownloadCmd() *cobra.Command {
 	downloadHistoryCmd := &cobra.Command{
 		Use:   "history",
 		Short: "Download files from a peer history",
-		Long:  `Download files from a chat, channel or user history.`,
+		Long: `Download files from a chat, channel or user history.
+
+Files are saved under a folder named after the peer. --path-template, or the
+downloader.dir.template setting, lays them out differently; every path
+component is sanitized and a template without a file name gets the Telegram
+file name appended.
+
+` + pathTemplateHelp(),
 		Example: `  tgdownloader download history "Cherry Channel"
-  tgdownloader download history 0xFFFFFF000000007B --limit 25`,
+  tgdownloader download history 0xFFFFFF000000007B --limit 25
+  tgdownloader download history "Cherry Channel" --since 2025-01-01 --until 2025-03-31
+  tgdownloader download history "Cherry Channel" --from-id 1200 --to-id 1800
+  tgdownloader download history "Cherry Channel" --oldest-first --after-id 1800 --limit 50
+  tgdownloader download history "Cherry Channel" --since 7d --type video,animation
+  tgdownloader download history "Cherry Channel" --mime "application/pdf" --ext zip,rar
+  tgdownloader download history "Cherry Channel" --min-size 100KB --max-size 4GB --max-total 20GB
+  tgdownloader download history "Go Forum" --topic 251015
+  tgdownloader download history "Go Forum" --topic https://t.me/c/1492447836/251015/251021
+  tgdownloader download history "Go Forum" --by-topic
+  tgdownloader download history "Cherry Channel" --with-comments
+  tgdownloader download history "Cherry Channel" --path-template "{peer}/{date:2006/01}/{msg_id}_{name}"
+  tgdownloader download history "Cherry Channel" --path-template "{sender}/{media_type}/{name}"`,
 		Args: peerInputArgs,
 		Annotations: map[string]string{
 			"prompt_suggest": "any",
@@ -39,21 +58,93 @@ func (r *Root) newDownloadCmd() *cobra.Command {
 	downloadHistoryCmd.Flags().IntVarP(&opts.limit, "limit", "l", 0, "Limit of files to download")
 	downloadHistoryCmd.Flags().Int64VarP(&opts.user, "user", "u", 0, "User ID to download from")
 	downloadHistoryCmd.Flags().StringVarP(&opts.offsetDate, "offset-date", "d", "", "Offset date to download from, format: 2006-01-02 15:04:05")
+	addRangeFlags(downloadHistoryCmd, &opts)
+	addFilterFlags(downloadHistoryCmd, &opts)
+	addSizeFlags(downloadHistoryCmd, &opts)
+	downloadHistoryCmd.Flags().StringVar(&opts.topic, "topic", "", "Download only this forum topic, by ID or by a message link inside it")
+	downloadHistoryCmd.Flags().BoolVar(&opts.byTopic, "by-topic", false, "Save files of a forum into a folder per topic")
+	downloadHistoryCmd.Flags().BoolVar(&opts.comments, "with-comments", false, "Also download files from the comments under channel posts, into a folder per post")
 	downloadHistoryCmd.Flags().BoolVar(&opts.hashtags, "hashtags", false, "Save hashtags as folders")
 	downloadHistoryCmd.Flags().BoolVar(&opts.rewrite, "rewrite", false, "Rewrite files if they already exist")
-	downloadHistoryCmd.Flags().BoolVar(&opts.dryRun, "dry-run", false, "Do not download files, just print what would be downloaded")
+	downloadHistoryCmd.Flags().BoolVar(&opts.dryRun, "dry-run", false, "Do not download files, just print what would be downloaded and the space it needs")
+	downloadHistoryCmd.Flags().BoolVar(&opts.verify, "verify", false, "Check downloaded files against Telegram's hashes before saving them")
+	addPathTemplateFlag(downloadHistoryCmd, &opts)
+	addOrderFlag(downloadHistoryCmd, &opts)
 	addStatusFlags(downloadHistoryCmd, &opts.ps)
 
+	var resetSync bool
+	downloadSyncCmd := &cobra.Command{
+		Use:   "sync",
+		Short: "Download new files since the last sync of a peer",
+		Long: `Download files from messages newer than the peer's sync checkpoint.
+The checkpoint is advanced only past messages whose files finished successfully.`,
+		Example: `  tgdownloader download sync "Cherry Channel"
+  tgdownloader download sync "Cherry Channel" --type video --reset`,
+		Args: peerInputArgs,
+		Annotations: map[string]string{
+			"prompt_suggest": "any",
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			peer, err := r.resolvePeer(cmd.Context(), peerInputArg(args))
+			if err != nil {
+				r.log.Error(err, "failed to parse peer")
+				return err
+			}
+
+			return r.syncFilesFromPeer(cmd.Context(), cmd.OutOrStdout(), peer, opts, resetSync)
+		},
+	}
+
+	downloadSyncCmd.Flags().IntVarP(&opts.limit, "limit", "l", 0, "Limit of files to download")
+	downloadSyncCmd.Flags().BoolVar(&resetSync, "reset", false, "Forget the sync checkpoint and scan the whole history")
+	addFilterFlags(downloadSyncCmd, &opts)
+	addSizeFlags(downloadSyncCmd, &opts)
+	downloadSyncCmd.Flags().BoolVar(&opts.hashtags, "hashtags", false, "Save hashtags as folders")
+	downloadSyncCmd.Flags().BoolVar(&opts.rewrite, "rewrite", false, "Rewrite files if they already exist")
+	downloadSyncCmd.Flags().BoolVar(&opts.dryRun, "dry-run", false, "Do not download files, just print what would be downloaded and the space it needs")
+	downloadSyncCmd.Flags().BoolVar(&opts.verify, "verify", false, "Check downloaded files against Telegram's hashes before saving them")
+	addPathTemplateFlag(downloadSyncCmd, &opts)
+	addOrderFlag(downloadSyncCmd, &opts)
+	addStatusFlags(downloadSyncCmd, &opts.ps)
+
 	downloadWatcherCmd := &cobra.Command{
-		Use:     "watcher",
-		Short:   "Watch a peer for new files",
-		Long:    `Watch a peer for new files.`,
-		Example: `  tgdownloader download watcher "Cherry Channel" --status`,
-		Args:    peerInputArgs,
+		Use:   "watcher",
+		Short: "Watch peers for new files",
+		Long: `Watch a peer for new files.
+
+With --from-file, every peer listed in a YAML watch list is watched at once
+through one connection and one download queue. Each entry may set its own
+output subdirectory, hashtags, type/size filters, path template and priority;
+unset fields fall back to the command line flags. Files of peers with a
+higher priority are downloaded first, the others take turns with --order
+peers:
+
+  peers:
+    - peer: "Cherry Channel"
+      output: cherry
+      type: video
+      max_size: 2GB
+      priority: 1
+    - peer: "@photos"
+      ext: jpg,png
+      path_template: "{date:2006/01}/{name}"`,
+		Example: `  tgdownloader download watcher "Cherry Channel" --status
+  tgdownloader download watcher --from-file watch.yaml --max-total 50GB`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if opts.watchFile != "" {
+				return cobra.NoArgs(cmd, args)
+			}
+
+			return peerInputArgs(cmd, args)
+		},
 		Annotations: map[string]string{
 			"prompt_suggest": "any",
 		},
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if opts.watchFile != "" {
+				return r.downloadFilesFromWatchList(cmd.Context(), cmd.OutOrStdout(), opts.watchFile, opts)
+			}
+
 			peer, err := r.resolvePeer(cmd.Context(), peerInputArg(args))
 			if err != nil {
 				r.log.Error(err, "failed to parse peer")
@@ -64,9 +155,15 @@ func (r *Root) newDownloadCmd() *cobra.Command {
 		},
 	}
 
+	addFilterFlags(downloadWatcherCmd, &opts)
+	addSizeFlags(downloadWatcherCmd, &opts)
+	downloadWatcherCmd.Flags().StringVar(&opts.watchFile, "from-file", "", "Watch every peer listed in this YAML watch list")
 	downloadWatcherCmd.Flags().BoolVar(&opts.hashtags, "hashtags", false, "Save hashtags as folders")
 	downloadWatcherCmd.Flags().BoolVar(&opts.rewrite, "rewrite", false, "Rewrite files if they already exist")
-	downloadWatcherCmd.Flags().BoolVar(&opts.dryRun, "dry-run", false, "Do not download files, just print what would be downloaded")
+	downloadWatcherCmd.Flags().BoolVar(&opts.dryRun, "dry-run", false, "Do not download files, just print what would be downloaded and the space it needs")
+	downloadWatcherCmd.Flags().BoolVar(&opts.verify, "verify", false, "Check downloaded files against Telegram's hashes before saving them")
+	addPathTemplateFlag(downloadWatcherCmd, &opts)
+	addOrderFlag(downloadWatcherCmd, &opts)
 	addStatusFlags(downloadWatcherCmd, &opts.ps)
 
 	downloadMessageCmd := &cobra.Command{
@@ -86,11 +183,45 @@ func (r *Root) newDownloadCmd() *cobra.Command {
 	}
 
 	downloadMessageCmd.Flags().BoolVar(&opts.single, "single", false, "Download only one file")
+	addFilterFlags(downloadMessageCmd, &opts)
+	addSizeFlags(downloadMessageCmd, &opts)
 	downloadMessageCmd.Flags().BoolVar(&opts.hashtags, "hashtags", false, "Save hashtags as folders")
 	downloadMessageCmd.Flags().BoolVar(&opts.rewrite, "rewrite", false, "Rewrite files if they already exist")
-	downloadMessageCmd.Flags().BoolVar(&opts.dryRun, "dry-run", false, "Do not download files, just print what would be downloaded")
+	downloadMessageCmd.Flags().BoolVar(&opts.dryRun, "dry-run", false, "Do not download files, just print what would be downloaded and the space it needs")
+	downloadMessageCmd.Flags().BoolVar(&opts.verify, "verify", false, "Check downloaded files against Telegram's hashes before saving them")
+	addPathTemplateFlag(downloadMessageCmd, &opts)
+	addOrderFlag(downloadMessageCmd, &opts)
 	addStatusFlags(downloadMessageCmd, &opts.ps)
 
+	var retryPeer, retryKind string
+	downloadRetryFailedCmd := &cobra.Command{
+		Use:   "retry-failed",
+		Short: "Download the files that failed in earlier runs again",
+		Long: `Download again only the files whose download failed in earlier runs.
+
+Failed files are remembered until they are downloaded. Their messages are
+fetched again by ID, which refreshes expired file references, and the files
+are saved at the paths they were meant for.`,
+		Example: `  tgdownloader download retry-failed
+  tgdownloader download retry-failed --peer "Cherry Channel" --kind network`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := validateFailedDownloadKind(retryKind); err != nil {
+				return err
+			}
+
+			return r.retryFailedDownloads(cmd.Context(), cmd.OutOrStdout(), retryPeer, retryKind, opts)
+		},
+	}
+
+	downloadRetryFailedCmd.Flags().StringVar(&retryPeer, "peer", "", "Retry only the files of this peer")
+	downloadRetryFailedCmd.Flags().StringVar(&retryKind, "kind", "", "Retry only files that failed with this kind of error (network, io, auth, ...)")
+	downloadRetryFailedCmd.Flags().BoolVar(&opts.rewrite, "rewrite", false, "Rewrite files if they already exist")
+	downloadRetryFailedCmd.Flags().BoolVar(&opts.dryRun, "dry-run", false, "Do not download files, just print what would be downloaded and the space it needs")
+	downloadRetryFailedCmd.Flags().BoolVar(&opts.verify, "verify", false, "Check downloaded files against Telegram's hashes before saving them")
+	addOrderFlag(downloadRetryFailedCmd, &opts)
+	addStatusFlags(downloadRetryFailedCmd, &opts.ps)
+
 	downloadYandexDiskCmd := &cobra.Command{
 		Use:   "yadisk",
 		Short: "Download files from Yandex Disk links in peer history",
@@ -113,6 +244,7 @@ func (r *Root) newDownloadCmd() *cobra.Command {
 	downloadYandexDiskCmd.Flags().IntVarP(&opts.limit, "limit", "l", 0, "Limit of links to download")
 	downloadYandexDiskCmd.Flags().Int64VarP(&opts.user, "user", "u", 0, "User ID to download from")
 	downloadYandexDiskCmd.Flags().StringVarP(&opts.offsetDate, "offset-date", "d", "", "Offset date to download from, format: 2006-01-02 15:04:05")
+	addRangeFlags(downloadYandexDiskCmd, &opts)
 	downloadYandexDiskCmd.Flags().BoolVar(&opts.hashtags, "hashtags", false, "Save hashtags as folders")
 	downloadYandexDiskCmd.Flags().BoolVar(&opts.rewrite, "rewrite", false, "Rewrite files if they already exist")
 	downloadYandexDiskCmd.Flags().BoolVar(&opts.dryRun, "dry-run", false, "Do not download files, just print what would be downloaded")
@@ -120,20 +252,54 @@ func (r *Root) newDownloadCmd() *cobra.Command {
 
 	downloadCmd.AddCommand(
 		downloadHistoryCmd,
+		downloadSyncCmd,
 		downloadWatcherCmd,
 		downloadMessageCmd,
+		downloadRetryFailedCmd,
 		downloadYandexDiskCmd,
 	)
 
 	r.setupConnectionForCmd(
 		downloadHistoryCmd,
+		downloadSyncCmd,
 		downloadWatcherCmd,
 		downloadMessageCmd,
+		downloadRetryFailedCmd,
 		downloadYandexDiskCmd,
 	)
 	return downloadCmd
 }
 
+func addRangeFlags(cmd *cobra.Command, opts *downloadOptions) {
+	cmd.Flags().StringVar(&opts.since, "since", "", "Only messages sent at or after this time, e.g. 2025-01-01 or 7d (relative units: m minutes, h, d, w)")
+	cmd.Flags().StringVar(&opts.until, "until", "", "Only messages sent up to this time, e.g. 2025-03-31 or 12h (relative units: m minutes, h, d, w); can't be combined with --offset-date")
+	cmd.Flags().IntVar(&opts.fromID, "from-id", 0, "Only messages with ID greater than or equal to this one")
+	cmd.Flags().IntVar(&opts.toID, "to-id", 0, "Only messages with ID less than or equal to this one")
+	cmd.Flags().IntVar(&opts.afterID, "after-id", 0, "Only messages newer than this ID, e.g. the last one already archived")
+	cmd.Flags().BoolVar(&opts.oldest, "oldest-first", false, "Walk history in publication order, starting from the oldest message")
+	cmd.Flags().BoolVar(&opts.oldest, "reverse", false, "Walk history in publication order, starting from the oldest message")
+}
+
+func addFilterFlags(cmd *cobra.Command, opts *downloadOptions) {
+	cmd.Flags().StringVar(&opts.mediaTypes, "type", "", "Comma-separated media types to download (photo, video, audio, voice, round, sticker, animation, document)")
+	cmd.Flags().StringVar(&opts.mimeTypes, "mime", "", "Comma-separated MIME type globs to download, e.g. video/*,application/pdf")
+	cmd.Flags().StringVar(&opts.extensions, "ext", "", "Comma-separated file extensions to download, e.g. pdf,zip")
+}
+
+func addSizeFlags(cmd *cobra.Command, opts *downloadOptions) {
+	cmd.Flags().StringVar(&opts.minSize, "min-size", "", "Skip files smaller than this size, e.g. 100KB")
+	cmd.Flags().StringVar(&opts.maxSize, "max-size", "", "Skip files larger than this size, e.g. 4GB")
+	cmd.Flags().StringVar(&opts.maxTotal, "max-total", "", "Stop queuing files once their total size reaches this budget, e.g. 20GB")
+}
+
+func addPathTemplateFlag(cmd *cobra.Command, opts *downloadOptions) {
+	cmd.Flags().StringVar(&opts.pathTemplate, "path-template", "", "Output path template, e.g. {peer}/{date:2006/01}/{msg_id}_{name}; see download history --help")
+}
+
+func addOrderFlag(cmd *cobra.Command, opts *downloadOptions) {
+	cmd.Flags().StringVar(&opts.order, "order", "", "Order of queued files: fifo, smallest, newest or peers (default downloader.queue.order)")
+}
+
 func addStatusFlags(cmd *cobra.Command, enabled *bool) {
 	cmd.Flags().BoolVar(enabled, "status", false, "Enable status information")
 	cmd.Flags().BoolVar(enabled, "ps", false, "Enable status information")
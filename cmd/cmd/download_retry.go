@@ -0,0 +1,242 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/go-logr/logr"
+	"github.com/gotd/td/constant"
+	"github.com/gotd/td/telegram/peers"
+	"github.com/johnnyipcom/tgdownloader/internal/downloader"
+	"github.com/johnnyipcom/tgdownloader/internal/renderer"
+	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
+	"github.com/johnnyipcom/tgdownloader/pkg/telegram"
+)
+
+// failedDownloadKey identifies a file of a message.
+type failedDownloadKey struct {
+	peerID    int64
+	messageID int
+	identity  string
+}
+
+func failedDownloadKeyOf(failed telegram.FailedDownload) failedDownloadKey {
+	return failedDownloadKey{peerID: failed.PeerID, messageID: failed.MessageID, identity: failed.Identity}
+}
+
+// failedDownloadRecorder persists failed files and forgets them once they
+// are downloaded.
+type failedDownloadRecorder struct {
+	ctx   context.Context
+	store telegram.FailedDownloadStore
+	log   logr.Logger
+
+	mu    sync.Mutex
+	known map[failedDownloadKey]telegram.FailedDownload
+}
+
+func newFailedDownloadRecorder(ctx context.Context, store telegram.FailedDownloadStore, log logr.Logger) *failedDownloadRecorder {
+	recorder := &failedDownloadRecorder{
+		ctx:   ctx,
+		store: store,
+		log:   log,
+		known: make(map[failedDownloadKey]telegram.FailedDownload),
+	}
+
+	failed, err := store.List(ctx)
+	if err != nil {
+		log.Error(err, "failed to load failed downloads")
+	}
+	for _, entry := range failed {
+		recorder.known[failedDownloadKeyOf(entry)] = entry
+	}
+
+	return recorder
+}
+
+func (r *failedDownloadRecorder) FileDone(file downloader.File, err error) {
+	if errors.Is(err, downloader.ErrBudgetExhausted) || file.PeerID() == 0 || file.MessageID() == 0 {
+		return
+	}
+
+	r.record(telegram.FailedDownload{
+		PeerID:    int64(file.PeerID()),
+		MessageID: file.MessageID(),
+		Identity:  file.Identity(),
+		Name:      file.Name(),
+		Paths:     file.OutputPaths(),
+	}, err)
+}
+
+func (r *failedDownloadRecorder) record(entry telegram.FailedDownload, err error) {
+	key := failedDownloadKeyOf(entry)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	previous, known := r.known[key]
+	if err == nil {
+		if !known {
+			return
+		}
+
+		if err := r.store.Delete(r.ctx, entry); err != nil {
+			r.log.Error(err, "failed to forget failed download", "filename", entry.Name)
+			return
+		}
+		delete(r.known, key)
+		return
+	}
+
+	entry.Kind = apperr.KindOf(err)
+	entry.Error = err.Error()
+	entry.Attempts = previous.Attempts + 1
+	if err := r.store.Put(r.ctx, entry); err != nil {
+		r.log.Error(err, "failed to record failed download", "filename", entry.Name)
+		return
+	}
+	r.known[key] = entry
+}
+
+// retryFailedDownloads fetches the messages of the recorded failed downloads
+// again, which refreshes their file references, and downloads only the files
+// that failed into the paths they were meant for.
+func (r *Root) retryFailedDownloads(ctx context.Context, writer io.Writer, peerInput, kind string, opts downloadOptions) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	failed, err := r.client.FailedDownloads.List(ctx)
+	if err != nil {
+		return apperr.Wrap("cmd.download.retry_failed.list", err)
+	}
+
+	var peerID int64
+	if peerInput != "" {
+		peer, err := r.resolvePeer(ctx, peerInput)
+		if err != nil {
+			return apperr.Wrap("cmd.download.retry_failed.peer", err)
+		}
+		peerID = int64(peer.TDLibPeerID())
+	}
+
+	failed = filterFailedDownloads(failed, peerID, apperr.Kind(kind))
+	if len(failed) == 0 {
+		renderer.RenderRetryFailedEmpty(writer)
+		return nil
+	}
+
+	r.log.Info("retrying failed downloads", "files", len(failed))
+
+	paths := make(map[string][]string, len(failed))
+	for _, entry := range failed {
+		paths[entry.Identity] = entry.Paths
+	}
+
+	source := downloadSource{
+		files: r.refetchFailedDownloads(ctx, failed),
+		paths: func(file telegram.File) []string { return paths[file.Identity()] },
+	}
+
+	return apperr.Wrap(
+		"cmd.download.retry_failed",
+		r.downloadSources(ctx, writer, []downloadSource{source}, opts),
+	)
+}
+
+func filterFailedDownloads(failed []telegram.FailedDownload, peerID int64, kind apperr.Kind) []telegram.FailedDownload {
+	var filtered []telegram.FailedDownload
+	for _, entry := range failed {
+		if peerID != 0 && entry.PeerID != peerID {
+			continue
+		}
+
+		if kind != "" && entry.Kind != kind {
+			continue
+		}
+
+		filtered = append(filtered, entry)
+	}
+
+	return filtered
+}
+
+// refetchFailedDownloads streams fresh copies of the failed files. Files
+// that are no longer in their message are forgotten.
+func (r *Root) refetchFailedDownloads(ctx context.Context, failed []telegram.FailedDownload) <-chan telegram.File {
+	files := make(chan telegram.File)
+	go func() {
+		defer close(files)
+
+		resolved := make(map[int64]peers.Peer)
+		for _, entry := range failed {
+			peer, ok := resolved[entry.PeerID]
+			if !ok {
+				var err error
+				peer, err = r.client.PeerService.ResolveTDLibID(ctx, constant.TDLibPeerID(entry.PeerID))
+				if err != nil {
+					r.log.Error(err, "failed to resolve peer of failed download", "peer_id", entry.PeerID, "filename", entry.Name)
+					continue
+				}
+				resolved[entry.PeerID] = peer
+			}
+
+			file, err := r.refetchFailedDownload(ctx, peer, entry)
+			if err != nil {
+				r.log.Error(err, "failed to fetch message of failed download", "message_id", entry.MessageID, "filename", entry.Name)
+				if ctx.Err() != nil {
+					return
+				}
+				continue
+			}
+
+			if file == nil {
+				r.log.Info("failed download is no longer in its message, forgetting it", "message_id", entry.MessageID, "filename", entry.Name)
+				if err := r.client.FailedDownloads.Delete(ctx, entry); err != nil {
+					r.log.Error(err, "failed to forget failed download", "filename", entry.Name)
+				}
+				continue
+			}
+
+			select {
+			case files <- *file:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return files
+}
+
+// refetchFailedDownload returns the file of the failed download from a fresh
+// copy of its message, or nil when the message no longer has it.
+func (r *Root) refetchFailedDownload(ctx context.Context, peer peers.Peer, entry telegram.FailedDownload) (*telegram.File, error) {
+	files, err := r.client.FileService.GetFilesFromMessage(ctx, peer, entry.MessageID, telegram.GetFileWithGrouped(false))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		if file == nil || file.MessageID() != entry.MessageID {
+			continue
+		}
+
+		if file.Identity() == entry.Identity {
+			return file, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func validateFailedDownloadKind(kind string) error {
+	switch apperr.Kind(kind) {
+	case "", apperr.KindUnknown, apperr.KindConfig, apperr.KindAuth, apperr.KindNetwork, apperr.KindIO, apperr.KindCancel, apperr.KindInternal:
+		return nil
+	default:
+		return apperr.New("cmd.download.retry_failed.kind", apperr.KindConfig, fmt.Errorf("invalid error kind %q", kind))
+	}
+}
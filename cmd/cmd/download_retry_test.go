@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
+	"github.com/johnnyipcom/tgdownloader/pkg/telegram"
+)
+
+type memoryFailedDownloadStore struct {
+	entries map[failedDownloadKey]telegram.FailedDownload
+}
+
+func (s *memoryFailedDownloadStore) List(context.Context) ([]telegram.FailedDownload, error) {
+	var failed []telegram.FailedDownload
+	for _, entry := range s.entries {
+		failed = append(failed, entry)
+	}
+	return failed, nil
+}
+
+func (s *memoryFailedDownloadStore) Put(_ context.Context, failed telegram.FailedDownload) error {
+	s.entries[failedDownloadKeyOf(failed)] = failed
+	return nil
+}
+
+func (s *memoryFailedDownloadStore) Delete(_ context.Context, failed telegram.FailedDownload) error {
+	delete(s.entries, failedDownloadKeyOf(failed))
+	return nil
+}
+
+func TestFailedDownloadRecorderKeepsFailuresUntilTheySucceed(t *testing.T) {
+	store := &memoryFailedDownloadStore{entries: make(map[failedDownloadKey]telegram.FailedDownload)}
+	video := telegram.FailedDownload{PeerID: -1001, MessageID: 42, Identity: "101", Name: "video.mp4"}
+	_ = store.Put(context.Background(), video)
+
+	recorder := newFailedDownloadRecorder(context.Background(), store, logr.Discard())
+	recorder.record(video, apperr.New("downloader.download", apperr.KindNetwork, errors.New("timeout")))
+
+	got := store.entries[failedDownloadKeyOf(video)]
+	if got.Kind != apperr.KindNetwork || got.Attempts != 1 || got.Error == "" {
+		t.Fatalf("recorded failure = %+v", got)
+	}
+
+	recorder.record(video, errors.New("disk full"))
+	if got := store.entries[failedDownloadKeyOf(video)]; got.Kind != apperr.KindUnknown || got.Attempts != 2 {
+		t.Fatalf("recorded second failure = %+v", got)
+	}
+
+	recorder.record(video, nil)
+	if _, ok := store.entries[failedDownloadKeyOf(video)]; ok {
+		t.Fatal("failure still recorded after the file was downloaded")
+	}
+}
+
+func TestFilterFailedDownloadsByPeerAndKind(t *testing.T) {
+	failed := []telegram.FailedDownload{
+		{PeerID: -1001, MessageID: 1, Kind: apperr.KindNetwork},
+		{PeerID: -1001, MessageID: 2, Kind: apperr.KindIO},
+		{PeerID: -1002, MessageID: 3, Kind: apperr.KindNetwork},
+	}
+
+	if got := filterFailedDownloads(failed, 0, ""); len(got) != 3 {
+		t.Fatalf("filterFailedDownloads() without filters = %+v", got)
+	}
+	if got := filterFailedDownloads(failed, -1001, apperr.KindNetwork); len(got) != 1 || got[0].MessageID != 1 {
+		t.Fatalf("filterFailedDownloads(-1001, network) = %+v", got)
+	}
+	if got := filterFailedDownloads(failed, 0, apperr.KindNetwork); len(got) != 2 {
+		t.Fatalf("filterFailedDownloads(network) = %+v", got)
+	}
+}
@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/gotd/td/telegram/peers"
+	"github.com/johnnyipcom/tgdownloader/internal/downloader"
+	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
+	"github.com/johnnyipcom/tgdownloader/pkg/telegram"
+)
+
+// syncCheckpointTracker derives the next sync checkpoint from per-file
+// results. Sync walks history oldest first, so the checkpoint may advance up
+// to the last handled message, but never past a message with a failed file.
+type syncCheckpointTracker struct {
+	mu       sync.Mutex
+	lastDone int
+	// failed holds the files that failed and haven't succeeded since.
+	failed map[trackedFile]struct{}
+}
+
+type trackedFile struct {
+	messageID int
+	identity  string
+}
+
+func (t *syncCheckpointTracker) FileDone(file downloader.File, err error) {
+	t.record(file.MessageID(), file.Identity(), err)
+}
+
+func (t *syncCheckpointTracker) record(id int, identity string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := trackedFile{messageID: id, identity: identity}
+	if err != nil {
+		if t.failed == nil {
+			t.failed = map[trackedFile]struct{}{}
+		}
+		t.failed[key] = struct{}{}
+		return
+	}
+
+	// A retry that succeeds lifts the floor its failure set.
+	delete(t.failed, key)
+	if id > t.lastDone {
+		t.lastDone = id
+	}
+}
+
+// Checkpoint returns the message ID the checkpoint can be advanced to.
+func (t *syncCheckpointTracker) Checkpoint(previous int) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	next := t.lastDone
+	for file := range t.failed {
+		if file.messageID-1 < next {
+			next = file.messageID - 1
+		}
+	}
+
+	return max(next, previous)
+}
+
+// syncFingerprint describes the options that decide which files a sync
+// downloads. A checkpoint made with other options does not cover this run.
+func (o downloadOptions) syncFingerprint() string {
+	normalize := func(value string) string {
+		return strings.ToLower(strings.Join(splitOptionList(value), ","))
+	}
+
+	fingerprint := fmt.Sprintf(
+		"type=%s;mime=%s;ext=%s;min-size=%s;max-size=%s;hashtags=%t",
+		normalize(o.mediaTypes),
+		normalize(o.mimeTypes),
+		normalize(o.extensions),
+		strings.TrimSpace(o.minSize),
+		strings.TrimSpace(o.maxSize),
+		o.hashtags,
+	)
+
+	// Files already downloaded under another layout are downloaded again.
+	// Checkpoints made without a template stay valid.
+	if template := strings.TrimSpace(o.pathTemplate); template != "" {
+		fingerprint += ";path-template=" + template
+	}
+
+	return fingerprint
+}
+
+// syncFilesFromPeer downloads files from messages newer than the peer's sync
+// checkpoint and advances the checkpoint past the files that finished.
+func (r *Root) syncFilesFromPeer(ctx context.Context, writer io.Writer, peer peers.Peer, opts downloadOptions, reset bool) error {
+	store := r.client.SyncCheckpoints
+	peerID := int64(peer.TDLibPeerID())
+	opts.pathTemplate = r.pathTemplateText(opts)
+	fingerprint := opts.syncFingerprint()
+
+	if reset {
+		if err := store.Delete(ctx, peerID); err != nil {
+			return apperr.Wrap("cmd.download.sync.reset", err)
+		}
+	}
+
+	checkpoint, found, err := store.Get(ctx, peerID)
+	if err != nil {
+		return apperr.Wrap("cmd.download.sync.checkpoint", err)
+	}
+
+	after := 0
+	switch {
+	case found && checkpoint.Options == fingerprint:
+		after = checkpoint.MessageID
+		r.log.Info("resuming sync from checkpoint", "peer", peer.VisibleName(), "message_id", after)
+	case found:
+		r.log.Info("download options changed since last sync, scanning from the beginning", "peer", peer.VisibleName(), "previous", checkpoint.Options, "current", fingerprint)
+	}
+
+	opts.since, opts.until, opts.offsetDate = "", "", ""
+	opts.fromID, opts.toID = 0, 0
+	opts.afterID = after
+	opts.oldest = true
+
+	tracker := &syncCheckpointTracker{}
+	downloadErr := r.downloadFilesFromPeer(ctx, writer, peer, opts, downloader.WithOnFileDone(tracker.FileDone))
+
+	if opts.dryRun {
+		return apperr.Wrap("cmd.download.sync", downloadErr)
+	}
+
+	if next := tracker.Checkpoint(after); next > after || (found && checkpoint.Options != fingerprint) {
+		if err := store.Put(ctx, telegram.SyncCheckpoint{
+			PeerID:    peerID,
+			MessageID: next,
+			Options:   fingerprint,
+		}); err != nil {
+			r.log.Error(err, "failed to store sync checkpoint", "peer", peer.VisibleName(), "message_id", next)
+			if downloadErr == nil {
+				downloadErr = err
+			}
+		} else {
+			r.log.Info("sync checkpoint advanced", "peer", peer.VisibleName(), "message_id", next)
+		}
+	}
+
+	return apperr.Wrap("cmd.download.sync", downloadErr)
+}
@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSyncCheckpointTrackerStopsBeforeFirstFailure(t *testing.T) {
+	tracker := &syncCheckpointTracker{}
+	tracker.record(105, "", nil)
+	tracker.record(103, "", nil)
+	tracker.record(104, "", errors.New("network"))
+	tracker.record(107, "", nil)
+
+	if got := tracker.Checkpoint(100); got != 103 {
+		t.Fatalf("Checkpoint() = %d, want 103", got)
+	}
+}
+
+func TestSyncCheckpointTrackerNeverMovesBackwards(t *testing.T) {
+	tracker := &syncCheckpointTracker{}
+	if got := tracker.Checkpoint(100); got != 100 {
+		t.Fatalf("Checkpoint() without files = %d, want 100", got)
+	}
+
+	tracker.record(101, "", errors.New("network"))
+	if got := tracker.Checkpoint(100); got != 100 {
+		t.Fatalf("Checkpoint() after failure = %d, want 100", got)
+	}
+}
+
+func TestSyncFingerprintNormalizesLists(t *testing.T) {
+	a := downloadOptions{mediaTypes: "Video, photo", extensions: " zip"}
+	b := downloadOptions{mediaTypes: "video,photo", extensions: "ZIP"}
+	if a.syncFingerprint() != b.syncFingerprint() {
+		t.Fatalf("fingerprints differ: %q vs %q", a.syncFingerprint(), b.syncFingerprint())
+	}
+
+	c := downloadOptions{mediaTypes: "video"}
+	if a.syncFingerprint() == c.syncFingerprint() {
+		t.Fatal("different filters produced the same fingerprint")
+	}
+}
+
+func TestSyncFingerprintIncludesPathTemplate(t *testing.T) {
+	plain := downloadOptions{mediaTypes: "video"}
+	byMonth := downloadOptions{mediaTypes: "video", pathTemplate: "{date:2006/01}/{name}"}
+	byPeer := downloadOptions{mediaTypes: "video", pathTemplate: "{peer}/{name}"}
+
+	if plain.syncFingerprint() == byMonth.syncFingerprint() || byMonth.syncFingerprint() == byPeer.syncFingerprint() {
+		t.Fatalf("path templates produced the same fingerprint: %q, %q, %q", plain.syncFingerprint(), byMonth.syncFingerprint(), byPeer.syncFingerprint())
+	}
+	if want := "type=video;mime=;ext=;min-size=;max-size=;hashtags=false"; plain.syncFingerprint() != want {
+		t.Fatalf("fingerprint without a template = %q, want %q", plain.syncFingerprint(), want)
+	}
+}
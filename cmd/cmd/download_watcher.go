@@ -0,0 +1,342 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/gotd/td/telegram/peers"
+	"github.com/johnnyipcom/tgdownloader/internal/downloader"
+	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
+	"github.com/johnnyipcom/tgdownloader/pkg/telegram"
+	"gopkg.in/yaml.v3"
+)
+
+// watchCheckpointer persists the last message a watcher handled, so the next
+// start can backfill what was posted in between.
+//
+// A watcher runs for days, so a failed file must not hold its checkpoint back
+// until the next start. With recorded set, failures are kept in the failed
+// downloads store for `download retry-failed` and the checkpoint moves past
+// them. Files that stop because watching stops or the budget runs out aren't
+// kept there and are backfilled by the next start instead.
+type watchCheckpointer struct {
+	store    telegram.SyncCheckpointStore
+	peerID   int64
+	tracker  syncCheckpointTracker
+	recorded bool
+
+	mu     sync.Mutex
+	stored int
+	err    error
+}
+
+func (w *watchCheckpointer) FileDone(ctx context.Context, file downloader.File, err error) {
+	w.record(ctx, file.MessageID(), file.Identity(), err)
+}
+
+func (w *watchCheckpointer) record(ctx context.Context, id int, identity string, err error) {
+	if w.recorded && err != nil && !errors.Is(err, downloader.ErrBudgetExhausted) && !isCancelError(ctx, err) {
+		err = nil
+	}
+	w.tracker.record(id, identity, err)
+	w.persist(ctx)
+}
+
+func (w *watchCheckpointer) persist(ctx context.Context) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	next := w.tracker.Checkpoint(w.stored)
+	if next <= w.stored {
+		return
+	}
+
+	if err := w.store.Put(ctx, telegram.SyncCheckpoint{PeerID: w.peerID, MessageID: next}); err != nil {
+		w.err = err
+		return
+	}
+
+	w.stored = next
+}
+
+// isCancelError tells whether err stopped a file because watching stopped.
+func isCancelError(ctx context.Context, err error) bool {
+	return ctx.Err() != nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || apperr.IsKind(err, apperr.KindCancel)
+}
+
+func (w *watchCheckpointer) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// watchEntry is one peer of a watch list file. Empty fields fall back to the
+// values given on the command line.
+type watchEntry struct {
+	Peer     string `yaml:"peer"`
+	Output   string `yaml:"output"`
+	Hashtags *bool  `yaml:"hashtags"`
+	Type     string `yaml:"type"`
+	MIME     string `yaml:"mime"`
+	Ext      string `yaml:"ext"`
+	MinSize  string `yaml:"min_size"`
+	MaxSize  string `yaml:"max_size"`
+	// PathTemplate lays out the files inside Output, see --path-template.
+	PathTemplate string `yaml:"path_template"`
+	// Priority puts the files of the peer ahead of peers with a lower one.
+	Priority int `yaml:"priority"`
+}
+
+type watchList struct {
+	Peers []watchEntry `yaml:"peers"`
+}
+
+func loadWatchList(filename string) (watchList, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return watchList{}, apperr.New("cmd.download.watcher.watch_list.read", apperr.KindIO, err)
+	}
+
+	var list watchList
+	if err := yaml.Unmarshal(data, &list); err != nil {
+		return watchList{}, apperr.New("cmd.download.watcher.watch_list.parse", apperr.KindConfig, fmt.Errorf("parse %s: %w", filename, err))
+	}
+
+	if len(list.Peers) == 0 {
+		return watchList{}, apperr.New("cmd.download.watcher.watch_list.parse", apperr.KindConfig, fmt.Errorf("%s does not list any peers", filename))
+	}
+
+	for i, entry := range list.Peers {
+		if strings.TrimSpace(entry.Peer) == "" {
+			return watchList{}, apperr.New("cmd.download.watcher.watch_list.parse", apperr.KindConfig, fmt.Errorf("%s: entry %d has no peer", filename, i+1))
+		}
+
+		if _, ok := cleanWatchOutput(entry.Output); !ok {
+			return watchList{}, apperr.New("cmd.download.watcher.watch_list.parse", apperr.KindConfig, fmt.Errorf("%s: output %q of %s must be a relative path inside the output directory", filename, entry.Output, entry.Peer))
+		}
+	}
+
+	return list, nil
+}
+
+// cleanWatchOutput normalizes an output subdirectory relative to the
+// downloader output directory.
+func cleanWatchOutput(output string) (string, bool) {
+	output = strings.TrimSpace(filepath.ToSlash(output))
+	if output == "" {
+		return "", true
+	}
+
+	cleaned := path.Clean(output)
+	if path.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", false
+	}
+
+	return cleaned, true
+}
+
+// options applies the entry's overrides to the command line options.
+func (e watchEntry) options(base downloadOptions) downloadOptions {
+	opts := base
+	if e.Hashtags != nil {
+		opts.hashtags = *e.Hashtags
+	}
+	if e.Type != "" {
+		opts.mediaTypes = e.Type
+	}
+	if e.MIME != "" {
+		opts.mimeTypes = e.MIME
+	}
+	if e.Ext != "" {
+		opts.extensions = e.Ext
+	}
+	if e.MinSize != "" {
+		opts.minSize = e.MinSize
+	}
+	if e.MaxSize != "" {
+		opts.maxSize = e.MaxSize
+	}
+	if e.PathTemplate != "" {
+		opts.pathTemplate = e.PathTemplate
+	}
+
+	return opts
+}
+
+// watchTarget is a resolved peer to watch with its own options.
+type watchTarget struct {
+	peer peers.Peer
+	opts downloadOptions
+	// output is the folder the watch list assigned to the peer, if any.
+	output   string
+	priority int
+}
+
+func (t watchTarget) subdir() string {
+	if t.output != "" {
+		return t.output
+	}
+
+	return dialogDownloadDirectory(t.peer)
+}
+
+func (r *Root) downloadFilesFromNewMessages(ctx context.Context, writer io.Writer, peer peers.Peer, opts downloadOptions) error {
+	return r.watchTargets(ctx, writer, []watchTarget{{peer: peer, opts: opts}}, opts)
+}
+
+// downloadFilesFromWatchList watches every peer of the watch list file with a
+// shared client and downloader.
+func (r *Root) downloadFilesFromWatchList(ctx context.Context, writer io.Writer, filename string, opts downloadOptions) error {
+	list, err := loadWatchList(filename)
+	if err != nil {
+		return err
+	}
+
+	targets := make([]watchTarget, 0, len(list.Peers))
+	seen := map[int64]string{}
+	for _, entry := range list.Peers {
+		peer, err := r.resolvePeer(ctx, entry.Peer)
+		if err != nil {
+			return apperr.Wrap("cmd.download.watcher.watch_list.resolve", err)
+		}
+
+		peerID := int64(peer.TDLibPeerID())
+		if previous, ok := seen[peerID]; ok {
+			return apperr.New("cmd.download.watcher.watch_list.resolve", apperr.KindConfig, fmt.Errorf("%q and %q refer to the same peer", previous, entry.Peer))
+		}
+		seen[peerID] = entry.Peer
+
+		output, _ := cleanWatchOutput(entry.Output)
+		targets = append(targets, watchTarget{peer: peer, opts: entry.options(opts), output: output, priority: entry.Priority})
+	}
+
+	return r.watchTargets(ctx, writer, targets, opts)
+}
+
+func (r *Root) watchTargets(ctx context.Context, writer io.Writer, targets []watchTarget, opts downloadOptions) error {
+	// Drops the update subscriptions of all targets when watching stops.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	maxTotal, err := parseOptionalByteSize("max-total", opts.maxTotal)
+	if err != nil {
+		return apperr.Wrap("cmd.download.watcher.options", err)
+	}
+
+	var extra []downloader.Option
+	if maxTotal > 0 {
+		extra = append(extra, downloader.WithMaxTotalSize(maxTotal))
+	}
+
+	checkpointers := map[int64]*watchCheckpointer{}
+	sources := make([]downloadSource, 0, len(targets))
+	for _, target := range targets {
+		getFileOptions, err := target.opts.newGetAllFilesOptions()
+		if err != nil {
+			return apperr.Wrap("cmd.download.watcher.options", err)
+		}
+
+		minSize, maxSize, err := target.opts.sizeLimits()
+		if err != nil {
+			return apperr.Wrap("cmd.download.watcher.options", err)
+		}
+
+		template, err := r.pathTemplate(target.opts)
+		if err != nil {
+			return apperr.Wrap("cmd.download.watcher.options", err)
+		}
+
+		if !opts.dryRun {
+			checkpointer, backfill, err := r.newWatchCheckpointer(ctx, target.peer)
+			if err != nil {
+				return apperr.Wrap("cmd.download.watcher.checkpoint", err)
+			}
+
+			if backfill {
+				getFileOptions = append(getFileOptions, telegram.GetFileWithBackfillAfter(checkpointer.stored))
+			}
+			checkpointer.recorded = r.client.FailedDownloads != nil
+			checkpointers[checkpointer.peerID] = checkpointer
+		}
+
+		files, err := r.client.FileService.GetAllFilesFromNewMessages(ctx, target.peer, getFileOptions...)
+		if err != nil {
+			return apperr.Wrap("cmd.download.watcher.get_new_files", err)
+		}
+
+		source := downloadSource{
+			files:    files,
+			priority: target.priority,
+			fileOptions: []downloader.FileOption{
+				downloader.WithSubdirs(target.subdir()),
+				downloader.WithSaveByHashtags(target.opts.hashtags),
+				downloader.WithFileSizeLimits(minSize, maxSize),
+			},
+		}
+		if template != nil {
+			peer, output := target.peer, target.output
+			source.paths = func(file telegram.File) []string {
+				paths := template.Paths(peer, file)
+				for i := range paths {
+					paths[i] = path.Join(output, paths[i])
+				}
+				return paths
+			}
+		}
+		sources = append(sources, source)
+	}
+
+	if len(checkpointers) > 0 {
+		extra = append(extra, downloader.WithOnFileDone(func(file downloader.File, err error) {
+			if checkpointer, ok := checkpointers[int64(file.PeerID())]; ok {
+				checkpointer.FileDone(ctx, file, err)
+			}
+		}))
+		defer func() {
+			for _, target := range targets {
+				if checkpointer, ok := checkpointers[int64(target.peer.TDLibPeerID())]; ok && checkpointer.Err() != nil {
+					r.log.Error(checkpointer.Err(), "failed to store watcher checkpoint", "peer", target.peer.VisibleName())
+				}
+			}
+		}()
+	}
+
+	return apperr.Wrap("cmd.download.watcher.download", r.downloadSources(ctx, writer, sources, opts, extra...))
+}
+
+// newWatchCheckpointer loads the watcher checkpoint of the peer and reports
+// whether to backfill the messages after it. On the first run it starts from
+// the newest message, so nothing older is backfilled, but messages posted
+// before the subscription starts still are.
+func (r *Root) newWatchCheckpointer(ctx context.Context, peer peers.Peer) (*watchCheckpointer, bool, error) {
+	store := r.client.WatchCheckpoints
+	peerID := int64(peer.TDLibPeerID())
+
+	checkpoint, found, err := store.Get(ctx, peerID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if found {
+		r.log.Info("backfilling messages missed since last watch", "peer", peer.VisibleName(), "after_id", checkpoint.MessageID)
+		return &watchCheckpointer{store: store, peerID: peerID, stored: checkpoint.MessageID}, true, nil
+	}
+
+	latest, err := r.client.LatestMessageID(ctx, peer)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err := store.Put(ctx, telegram.SyncCheckpoint{PeerID: peerID, MessageID: latest}); err != nil {
+		return nil, false, err
+	}
+
+	return &watchCheckpointer{store: store, peerID: peerID, stored: latest}, true, nil
+}
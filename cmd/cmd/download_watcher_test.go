@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/johnnyipcom/tgdownloader/internal/downloader"
+	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
+	"github.com/johnnyipcom/tgdownloader/pkg/telegram"
+)
+
+type memoryCheckpointStore struct {
+	checkpoints map[int64]telegram.SyncCheckpoint
+	puts        int
+}
+
+func (s *memoryCheckpointStore) Get(_ context.Context, peerID int64) (telegram.SyncCheckpoint, bool, error) {
+	checkpoint, ok := s.checkpoints[peerID]
+	return checkpoint, ok, nil
+}
+
+func (s *memoryCheckpointStore) Put(_ context.Context, checkpoint telegram.SyncCheckpoint) error {
+	if s.checkpoints == nil {
+		s.checkpoints = map[int64]telegram.SyncCheckpoint{}
+	}
+	s.checkpoints[checkpoint.PeerID] = checkpoint
+	s.puts++
+	return nil
+}
+
+func (s *memoryCheckpointStore) Delete(_ context.Context, peerID int64) error {
+	delete(s.checkpoints, peerID)
+	return nil
+}
+
+func TestWatchCheckpointerPersistsOnlyAdvances(t *testing.T) {
+	store := &memoryCheckpointStore{}
+	w := &watchCheckpointer{store: store, peerID: 7, stored: 100}
+
+	w.tracker.record(101, "", nil)
+	w.persist(context.Background())
+	w.tracker.record(99, "", nil)
+	w.persist(context.Background())
+	w.tracker.record(102, "", errors.New("network"))
+	w.tracker.record(103, "", nil)
+	w.persist(context.Background())
+
+	if got := store.checkpoints[7].MessageID; got != 101 || store.puts != 1 {
+		t.Fatalf("checkpoint = %d after %d puts, want 101 after 1", got, store.puts)
+	}
+}
+
+func TestWatchCheckpointerMovesPastRecordedFailures(t *testing.T) {
+	ctx := context.Background()
+	store := &memoryCheckpointStore{}
+	w := &watchCheckpointer{store: store, peerID: 7, stored: 100, recorded: true}
+
+	w.record(ctx, 101, "a", apperr.New("test", apperr.KindNetwork, errors.New("network")))
+	w.record(ctx, 102, "b", nil)
+	if got := store.checkpoints[7].MessageID; got != 102 {
+		t.Fatalf("checkpoint = %d, want 102 past the recorded failure", got)
+	}
+
+	w.record(ctx, 103, "c", downloader.ErrBudgetExhausted)
+	w.record(ctx, 104, "d", context.Canceled)
+	w.record(ctx, 105, "e", nil)
+	if got := store.checkpoints[7].MessageID; got != 102 {
+		t.Fatalf("checkpoint = %d, want 102 before the unrecorded stops", got)
+	}
+}
+
+func TestWatchCheckpointerAdvancesAfterRetrySucceeds(t *testing.T) {
+	ctx := context.Background()
+	store := &memoryCheckpointStore{}
+	w := &watchCheckpointer{store: store, peerID: 7, stored: 100}
+
+	w.record(ctx, 101, "a", errors.New("network"))
+	w.record(ctx, 102, "b", nil)
+	if got := store.checkpoints[7].MessageID; got != 0 {
+		t.Fatalf("checkpoint = %d, want none while 101 fails", got)
+	}
+
+	w.record(ctx, 101, "a", nil)
+	if got := store.checkpoints[7].MessageID; got != 102 {
+		t.Fatalf("checkpoint = %d, want 102 after the retry", got)
+	}
+}
+
+func writeWatchList(t *testing.T, content string) string {
+	t.Helper()
+
+	filename := filepath.Join(t.TempDir(), "watch.yaml")
+	if err := os.WriteFile(filename, []byte(content), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	return filename
+}
+
+func TestLoadWatchListAppliesEntryOverrides(t *testing.T) {
+	filename := writeWatchList(t, `
+peers:
+  - peer: "Cherry Channel"
+    output: cherry/videos
+    type: video
+    max_size: 2GB
+    priority: 2
+  - peer: "@photos"
+    hashtags: false
+`)
+
+	list, err := loadWatchList(filename)
+	if err != nil {
+		t.Fatalf("loadWatchList() error = %v", err)
+	}
+	if len(list.Peers) != 2 {
+		t.Fatalf("peers = %d, want 2", len(list.Peers))
+	}
+
+	base := downloadOptions{mediaTypes: "photo", maxSize: "1GB", minSize: "1KB", hashtags: true}
+
+	first := list.Peers[0].options(base)
+	if first.mediaTypes != "video" || first.maxSize != "2GB" || first.minSize != "1KB" || !first.hashtags {
+		t.Fatalf("first entry options = %+v", first)
+	}
+	if list.Peers[0].Priority != 2 || list.Peers[1].Priority != 0 {
+		t.Fatalf("priorities = %d, %d; want 2, 0", list.Peers[0].Priority, list.Peers[1].Priority)
+	}
+	if subdir, ok := cleanWatchOutput(list.Peers[0].Output); !ok || subdir != "cherry/videos" {
+		t.Fatalf("cleanWatchOutput() = %q, %v", subdir, ok)
+	}
+
+	second := list.Peers[1].options(base)
+	if second.mediaTypes != "photo" || second.hashtags {
+		t.Fatalf("second entry options = %+v", second)
+	}
+}
+
+func TestLoadWatchListRejectsInvalidEntries(t *testing.T) {
+	tests := map[string]string{
+		"no peers":        "peers: []\n",
+		"empty peer":      "peers:\n  - output: x\n",
+		"absolute output": "peers:\n  - peer: a\n    output: /tmp/x\n",
+		"escaping output": "peers:\n  - peer: a\n    output: ../x\n",
+		"malformed":       "peers: [\n",
+	}
+
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := loadWatchList(writeWatchList(t, content))
+			if !apperr.IsKind(err, apperr.KindConfig) {
+				t.Fatalf("loadWatchList() error = %v, want config error", err)
+			}
+		})
+	}
+
+	_, err := loadWatchList(filepath.Join(t.TempDir(), "missing.yaml"))
+	if !apperr.IsKind(err, apperr.KindIO) || !strings.Contains(err.Error(), "missing.yaml") {
+		t.Fatalf("loadWatchList() missing file error = %v", err)
+	}
+}
@@ -187,6 +187,12 @@ func (r *Root) downloadSingleYandexDiskLink(
 		r.log.Error(err, "download error")
 	})
 
+	bandwidth, err := r.bandwidthLimiter()
+	if err != nil {
+		tracker.Fail()
+		return linkDownloaded, linkSkipped, err
+	}
+
 	// Download each file
 	for _, item := range filteredFiles {
 		itemDir := targetDir
@@ -215,7 +221,9 @@ func (r *Root) downloadSingleYandexDiskLink(
 		bytesTracker := p.BytesTracker(nil, item.Name, fileSize)
 
 		// Download the file
-		downloaded, err := downloader.DownloadFile(ctx, externalLink.URL, item, targetPath, bytesTracker)
+		// The progress writer is written right after the file, so waiting
+		// for the shared limiter there throttles the download itself.
+		downloaded, err := downloader.DownloadFile(ctx, externalLink.URL, item, targetPath, bandwidth.Writer(ctx, bytesTracker))
 		if err != nil {
 			bytesTracker.Fail()
 			tracker.Fail()
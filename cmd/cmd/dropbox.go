@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/johnnyipcom/tgdownloader/internal/downloader"
+
+	"github.com/spf13/cobra"
+)
+
+func (r *Root) newDropboxCmd() *cobra.Command {
+	dropboxCmd := &cobra.Command{
+		Use:   "dropbox",
+		Short: "Manage Dropbox storage",
+		Long:  "Manage the Dropbox storage downloads are saved to",
+		Run: func(cmd *cobra.Command, args []string) {
+			cmd.HelpFunc()(cmd, []string{})
+		},
+	}
+
+	dropboxLogoutCmd := &cobra.Command{
+		Use:     "logout",
+		Short:   "Forget the Dropbox token",
+		Long:    "Forget the saved Dropbox token, the next download asks to authorize the client again",
+		Example: "  tgdownloader dropbox logout",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := downloader.LogoutDropbox(cmd.Context(), r.client.OAuth2Tokens); err != nil {
+				return err
+			}
+
+			_, err := fmt.Fprintln(cmd.OutOrStdout(), "Logged out of Dropbox")
+			return err
+		},
+	}
+
+	dropboxCmd.AddCommand(dropboxLogoutCmd)
+
+	r.setupRuntimeForCmd(dropboxLogoutCmd)
+	return dropboxCmd
+}
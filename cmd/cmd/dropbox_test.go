@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/johnnyipcom/tgdownloader/pkg/telegram"
+	"golang.org/x/oauth2"
+)
+
+type tokenStoreStub struct {
+	deleted []string
+}
+
+func (s *tokenStoreStub) Get(context.Context, string) (*oauth2.Token, bool, error) {
+	return nil, false, nil
+}
+
+func (s *tokenStoreStub) Put(context.Context, string, *oauth2.Token) error {
+	return nil
+}
+
+func (s *tokenStoreStub) Delete(_ context.Context, name string) error {
+	s.deleted = append(s.deleted, name)
+	return nil
+}
+
+func TestDropboxLogoutForgetsToken(t *testing.T) {
+	tokens := &tokenStoreStub{}
+	r := &Root{client: &telegram.Client{OAuth2Tokens: tokens}}
+	cmd := r.newDropboxCmd()
+	logout, _, err := cmd.Find([]string{"logout"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	logout.SetOut(&out)
+	logout.SetContext(context.Background())
+
+	if err := logout.RunE(logout, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens.deleted) != 1 || tokens.deleted[0] != "dropbox" {
+		t.Fatalf("deleted tokens = %v, want dropbox", tokens.deleted)
+	}
+	if out.String() != "Logged out of Dropbox\n" {
+		t.Fatalf("output = %q", out.String())
+	}
+}
@@ -2,10 +2,13 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unicode"
 
@@ -19,14 +22,33 @@ import (
 )
 
 type downloadOptions struct {
-	limit      int
-	user       int64
-	offsetDate string
-	single     bool
-	hashtags   bool
-	rewrite    bool
-	dryRun     bool
-	ps         bool
+	limit        int
+	user         int64
+	offsetDate   string
+	since        string
+	until        string
+	fromID       int
+	toID         int
+	afterID      int
+	oldest       bool
+	mediaTypes   string
+	mimeTypes    string
+	extensions   string
+	minSize      string
+	maxSize      string
+	maxTotal     string
+	watchFile    string
+	topic        string
+	byTopic      bool
+	comments     bool
+	pathTemplate string
+	order        string
+	single       bool
+	hashtags     bool
+	rewrite      bool
+	dryRun       bool
+	verify       bool
+	ps           bool
 }
 
 func (o *downloadOptions) newGetAllFilesOptions() ([]telegram.GetAllFilesOption, error) {
@@ -40,6 +62,10 @@ func (o *downloadOptions) newGetAllFilesOptions() ([]telegram.GetAllFilesOption,
 		opts = append(opts, telegram.GetFileWithLimit(o.limit))
 	}
 
+	if o.offsetDate != "" && o.until != "" {
+		return nil, apperr.New("cmd.download.options.range", apperr.KindConfig, errors.New("--until and --offset-date can't be combined, both set the newest message to start from"))
+	}
+
 	if o.offsetDate != "" {
 		offsetDate, err := time.Parse("2006-01-02 15:04:05", o.offsetDate)
 		if err != nil {
@@ -49,9 +75,240 @@ func (o *downloadOptions) newGetAllFilesOptions() ([]telegram.GetAllFilesOption,
 		opts = append(opts, telegram.GetFileWithOffsetDate(int(offsetDate.Unix())))
 	}
 
+	if o.since != "" || o.until != "" {
+		now := time.Now()
+
+		since, err := parseTimeBound("since", o.since, now, false)
+		if err != nil {
+			return nil, err
+		}
+
+		until, err := parseTimeBound("until", o.until, now, true)
+		if err != nil {
+			return nil, err
+		}
+
+		opts = append(opts, telegram.GetFileWithDateRange(since, until))
+	}
+
+	fromID := o.fromID
+	if o.afterID > 0 && o.afterID >= fromID {
+		fromID = o.afterID + 1
+	}
+
+	if fromID > 0 || o.toID > 0 {
+		opts = append(opts, telegram.GetFileWithIDRange(fromID, o.toID))
+	}
+
+	if o.oldest {
+		opts = append(opts, telegram.GetFileWithOldestFirst())
+	}
+
+	filter, err := o.newFileFilter()
+	if err != nil {
+		return nil, err
+	}
+
+	if !filter.IsEmpty() {
+		opts = append(opts, telegram.GetFileWithFilter(filter))
+	}
+
 	return opts, nil
 }
 
+var timeBoundLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+var relativeTimeUnits = map[byte]time.Duration{
+	'm': time.Minute,
+	'h': time.Hour,
+	'd': 24 * time.Hour,
+	'w': 7 * 24 * time.Hour,
+}
+
+// parseTimeBound parses an absolute date or a relative age such as 7d or 12h.
+// The relative units are m (minutes, not months), h, d and w.
+// A date without a time of day covers the whole day, so as an upper bound it
+// resolves to the start of the following day.
+func parseTimeBound(name, value string, now time.Time, upper bool) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if unit, ok := relativeTimeUnits[value[len(value)-1]]; ok {
+		if amount, err := strconv.Atoi(value[:len(value)-1]); err == nil && amount > 0 {
+			return now.Add(-time.Duration(amount) * unit), nil
+		}
+	}
+
+	for _, layout := range timeBoundLayouts {
+		parsed, err := time.Parse(layout, value)
+		if err != nil {
+			continue
+		}
+
+		if upper && layout == "2006-01-02" {
+			parsed = parsed.AddDate(0, 0, 1)
+		}
+
+		return parsed, nil
+	}
+
+	return time.Time{}, apperr.New("cmd.download.options.range", apperr.KindConfig, fmt.Errorf("invalid %s %q: use 2006-01-02, \"2006-01-02 15:04:05\" or a relative age like 30m, 12h, 7d or 2w", name, value))
+}
+
+func (o *downloadOptions) newFileFilter() (telegram.FileFilter, error) {
+	var filter telegram.FileFilter
+
+	for _, name := range splitOptionList(o.mediaTypes) {
+		kind, err := telegram.ParseMediaKind(name)
+		if err != nil {
+			return telegram.FileFilter{}, err
+		}
+
+		filter.Kinds = append(filter.Kinds, kind)
+	}
+
+	filter.MIMETypes = splitOptionList(o.mimeTypes)
+	filter.Extensions = splitOptionList(o.extensions)
+
+	if err := filter.Validate(); err != nil {
+		return telegram.FileFilter{}, err
+	}
+
+	return filter, nil
+}
+
+func (o *downloadOptions) newSizeOptions() ([]downloader.Option, error) {
+	minSize, maxSize, err := o.sizeLimits()
+	if err != nil {
+		return nil, err
+	}
+
+	maxTotal, err := parseOptionalByteSize("max-total", o.maxTotal)
+	if err != nil {
+		return nil, err
+	}
+
+	var opts []downloader.Option
+	if minSize > 0 || maxSize > 0 {
+		opts = append(opts, downloader.WithSizeLimits(minSize, maxSize))
+	}
+
+	if maxTotal > 0 {
+		opts = append(opts, downloader.WithMaxTotalSize(maxTotal))
+	}
+
+	return opts, nil
+}
+
+// sizeLimits parses the per-file size bounds; zero means unbounded.
+func (o *downloadOptions) sizeLimits() (int64, int64, error) {
+	minSize, err := parseOptionalByteSize("min-size", o.minSize)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	maxSize, err := parseOptionalByteSize("max-size", o.maxSize)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if minSize > 0 && maxSize > 0 && minSize > maxSize {
+		return 0, 0, apperr.New("cmd.download.options.size", apperr.KindConfig, fmt.Errorf("min-size %s is greater than max-size %s", o.minSize, o.maxSize))
+	}
+
+	return minSize, maxSize, nil
+}
+
+func parseOptionalByteSize(name, value string) (int64, error) {
+	if strings.TrimSpace(value) == "" {
+		return 0, nil
+	}
+
+	size, err := parseByteSize(value)
+	if err != nil {
+		return 0, apperr.New("cmd.download.options.size", apperr.KindConfig, fmt.Errorf("invalid %s: %w", name, err))
+	}
+
+	return size, nil
+}
+
+var byteSizeUnits = map[string]int64{
+	"":    1,
+	"b":   1,
+	"k":   1_000,
+	"kb":  1_000,
+	"m":   1_000_000,
+	"mb":  1_000_000,
+	"g":   1_000_000_000,
+	"gb":  1_000_000_000,
+	"t":   1_000_000_000_000,
+	"tb":  1_000_000_000_000,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+	"tib": 1 << 40,
+}
+
+// parseByteSize parses sizes such as "512", "700KB", "1.5GB" or "20GiB".
+// Decimal suffixes are powers of 1000, binary suffixes are powers of 1024.
+func parseByteSize(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	split := strings.IndexFunc(value, func(r rune) bool {
+		return !unicode.IsDigit(r) && r != '.'
+	})
+	if split < 0 {
+		split = len(value)
+	}
+
+	number, unit := value[:split], strings.ToLower(strings.TrimSpace(value[split:]))
+	multiplier, ok := byteSizeUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("unknown size unit %q", value[split:])
+	}
+
+	amount, err := strconv.ParseFloat(number, 64)
+	if err != nil || amount < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+
+	return int64(amount * float64(multiplier)), nil
+}
+
+// splitOptionList splits a comma-separated flag value into trimmed, non-empty items.
+func splitOptionList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+func filterFiles(files []*telegram.File, filter telegram.FileFilter) []*telegram.File {
+	if filter.IsEmpty() {
+		return files
+	}
+
+	filtered := make([]*telegram.File, 0, len(files))
+	for _, file := range files {
+		if file != nil && filter.Match(*file) {
+			filtered = append(filtered, file)
+		}
+	}
+
+	return filtered
+}
+
 func (o *downloadOptions) newGetFileOptions() ([]telegram.GetFileOption, error) {
 	var opts []telegram.GetFileOption
 
@@ -62,7 +319,12 @@ func (o *downloadOptions) newGetFileOptions() ([]telegram.GetFileOption, error)
 	return opts, nil
 }
 
-func (r *Root) downloadFilesFromPeer(ctx context.Context, writer io.Writer, peer peers.Peer, opts downloadOptions) error {
+func (r *Root) downloadFilesFromPeer(ctx context.Context, writer io.Writer, peer peers.Peer, opts downloadOptions, extra ...downloader.Option) error {
+	// Stops the history scan once the download finishes early, e.g. when the
+	// size budget is exhausted.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	if renderer.HasEventSink(ctx) {
 		renderer.RenderDownloadPlan(writer, renderer.DownloadPlan{
 			Name:      peer.VisibleName(),
@@ -79,26 +341,37 @@ func (r *Root) downloadFilesFromPeer(ctx context.Context, writer io.Writer, peer
 		return apperr.Wrap("cmd.download.history.options", err)
 	}
 
-	files, err := r.client.FileService.GetAllFiles(ctx, peer, getFileOptions...)
+	topicID, err := r.resolveTopicID(ctx, peer, opts.topic)
 	if err != nil {
-		return apperr.Wrap("cmd.download.history.get_all_files", err)
+		return apperr.Wrap("cmd.download.history.topic", err)
 	}
 
-	return apperr.Wrap(
-		"cmd.download.history.download",
-		r.downloadFiles(ctx, writer, files, []string{dialogDownloadDirectory(peer)}, opts),
-	)
-}
+	if topicID > 0 {
+		getFileOptions = append(getFileOptions, telegram.GetFileWithTopic(topicID))
+	}
+
+	subdirs := func(telegram.File) []string {
+		return []string{dialogDownloadDirectory(peer)}
+	}
+	if opts.byTopic {
+		if subdirs, err = r.topicSubdirs(ctx, peer); err != nil {
+			return apperr.Wrap("cmd.download.history.topics", err)
+		}
+	}
 
-func (r *Root) downloadFilesFromNewMessages(ctx context.Context, writer io.Writer, peer peers.Peer, opts downloadOptions) error {
-	files, err := r.client.FileService.GetAllFilesFromNewMessages(ctx, peer)
+	if opts.comments {
+		getFileOptions = append(getFileOptions, telegram.GetFileWithComments())
+		subdirs = commentSubdirs(dialogDownloadDirectory(peer), subdirs)
+	}
+
+	files, err := r.client.FileService.GetAllFiles(ctx, peer, getFileOptions...)
 	if err != nil {
-		return apperr.Wrap("cmd.download.watcher.get_new_files", err)
+		return apperr.Wrap("cmd.download.history.get_all_files", err)
 	}
 
 	return apperr.Wrap(
-		"cmd.download.watcher.download",
-		r.downloadFiles(ctx, writer, files, []string{dialogDownloadDirectory(peer)}, opts),
+		"cmd.download.history.download",
+		r.downloadFilesInto(ctx, writer, peer, files, subdirs, opts, extra...),
 	)
 }
 
@@ -107,8 +380,10 @@ type trackerAdapter struct {
 }
 
 type downloadScanProgress struct {
+	mu      sync.Mutex
 	tracker renderer.Tracker
 	found   int64
+	done    bool
 }
 
 func newDownloadScanProgress(tracker renderer.Tracker) *downloadScanProgress {
@@ -116,18 +391,30 @@ func newDownloadScanProgress(tracker renderer.Tracker) *downloadScanProgress {
 }
 
 func (p *downloadScanProgress) FileFound(stats downloader.Stats) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	p.found++
 	p.tracker.Increment(1)
 	p.updateMessage("Scanning history", stats)
 }
 
 func (p *downloadScanProgress) ScanningDone(stats downloader.Stats) {
-	p.updateMessage("Scanning history complete", stats)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.done {
+		p.updateMessage("Scanning history complete", stats)
+	}
 }
 
 func (p *downloadScanProgress) Finish(stats downloader.Stats) {
-	p.ScanningDone(stats)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.updateMessage("Scanning history complete", stats)
 	p.tracker.Done()
+	p.done = true
 }
 
 func (p *downloadScanProgress) updateMessage(prefix string, stats downloader.Stats) {
@@ -150,14 +437,74 @@ func newTrackerAdapter(p renderer.Progress) *trackerAdapter {
 	return &trackerAdapter{p}
 }
 
+// downloadSource is a stream of files together with how to store them.
+type downloadSource struct {
+	files       <-chan telegram.File
+	fileOptions []downloader.FileOption
+	// subdirs, when set, picks the subdirectories of every file.
+	subdirs func(telegram.File) []string
+	// paths, when set, picks the output paths of every file and takes
+	// precedence over subdirs.
+	paths func(telegram.File) []string
+	// priority puts the files ahead of those of sources with a lower one.
+	priority int
+}
+
 func (r *Root) downloadFiles(
 	ctx context.Context,
 	writer io.Writer,
+	peer peers.Peer,
 	files <-chan telegram.File,
-	subdirs []string,
 	opts downloadOptions,
+	extra ...downloader.Option,
+) error {
+	subdirs := []string{dialogDownloadDirectory(peer)}
+	return r.downloadFilesInto(ctx, writer, peer, files, func(telegram.File) []string { return subdirs }, opts, extra...)
+}
+
+// downloadFilesInto is downloadFiles with the subdirectories chosen per file.
+// A path template replaces the subdirectories.
+func (r *Root) downloadFilesInto(
+	ctx context.Context,
+	writer io.Writer,
+	peer peers.Peer,
+	files <-chan telegram.File,
+	subdirs func(telegram.File) []string,
+	opts downloadOptions,
+	extra ...downloader.Option,
+) error {
+	sizeOptions, err := opts.newSizeOptions()
+	if err != nil {
+		return apperr.Wrap("cmd.download.options", err)
+	}
+
+	template, err := r.pathTemplate(opts)
+	if err != nil {
+		return apperr.Wrap("cmd.download.options", err)
+	}
+
+	source := downloadSource{
+		files:       files,
+		fileOptions: []downloader.FileOption{downloader.WithSaveByHashtags(opts.hashtags)},
+		subdirs:     subdirs,
+	}
+	if template != nil {
+		source.paths = func(file telegram.File) []string { return template.Paths(peer, file) }
+	}
+
+	return r.downloadSources(ctx, writer, []downloadSource{source}, opts, append(sizeOptions, extra...)...)
+}
+
+// downloadSources downloads files from all sources with a single downloader.
+func (r *Root) downloadSources(
+	ctx context.Context,
+	writer io.Writer,
+	sources []downloadSource,
+	opts downloadOptions,
+	extra ...downloader.Option,
 ) error {
 	startedAt := time.Now()
+
 	p := renderer.NewProgressForContext(ctx)
 	if opts.ps {
 		p.EnablePS(ctx)
@@ -167,69 +514,142 @@ func (r *Root) downloadFiles(
 	var scanProgress *downloadScanProgress
 	downloaderOptions = append(downloaderOptions, downloader.WithRewrite(opts.rewrite))
 	downloaderOptions = append(downloaderOptions, downloader.WithDryRun(opts.dryRun))
+	if opts.verify {
+		downloaderOptions = append(downloaderOptions, downloader.WithVerify(true))
+	}
+	if opts.order != "" {
+		order, err := downloader.ParseQueueOrder(opts.order)
+		if err != nil {
+			return apperr.Wrap("cmd.download.options", err)
+		}
+		downloaderOptions = append(downloaderOptions, downloader.WithQueueOrder(order))
+	}
 	downloaderOptions = append(downloaderOptions, downloader.WithTracker(newTrackerAdapter(p)))
 	downloaderOptions = append(downloaderOptions, downloader.WithOnComplete(func(stats downloader.Stats) {
 		if scanProgress != nil {
 			scanProgress.Finish(stats)
 		}
 	}))
+	if !opts.dryRun && r.client != nil && r.client.FailedDownloads != nil {
+		recorder := newFailedDownloadRecorder(ctx, r.client.FailedDownloads, r.log)
+		downloaderOptions = append(downloaderOptions, downloader.WithOnFileDone(recorder.FileDone))
+	}
+	downloaderOptions = append(downloaderOptions, extra...)
 
 	d, err := r.newDownloader(ctx, writer, downloaderOptions...)
 	if err != nil {
 		return apperr.Wrap("cmd.download.new_downloader", err)
 	}
 	scanProgress = newDownloadScanProgress(p.UnitsTracker("Scanning history", 0))
-	queue := make(chan downloader.File)
-	go func() {
-		defer func() {
-			close(queue)
-			scanProgress.ScanningDone(d.Stats())
-		}()
 
-		for {
-			select {
-			case <-ctx.Done():
-				return
+	var forwarders sync.WaitGroup
+	queues := make([]chan downloader.File, 0, len(sources))
+	priorities := make([]int, 0, len(sources))
+	for _, source := range sources {
+		priorities = append(priorities, source.priority)
+		queue := make(chan downloader.File)
+		queues = append(queues, queue)
+
+		forwarders.Add(1)
+		go func(source downloadSource) {
+			defer func() {
+				close(queue)
+				forwarders.Done()
+			}()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
 
-			case file, ok := <-files:
-				if !ok {
+				case <-d.BudgetExhausted():
 					return
-				}
 
-				scanProgress.FileFound(d.Stats())
-				downloadFile := downloader.NewFile(
-					file,
-					downloader.WithSubdirs(subdirs...),
-					downloader.WithSaveByHashtags(opts.hashtags),
-				)
-				select {
-				case queue <- downloadFile:
-				case <-ctx.Done():
+				case <-d.OutOfSpace():
 					return
+
+				case file, ok := <-source.files:
+					if !ok {
+						return
+					}
+
+					scanProgress.FileFound(d.Stats())
+
+					fileOptions := source.fileOptions
+					switch {
+					case source.paths != nil:
+						fileOptions = append(fileOptions[:len(fileOptions):len(fileOptions)], downloader.WithOutputPaths(source.paths(file)...))
+					case source.subdirs != nil:
+						fileOptions = append(fileOptions[:len(fileOptions):len(fileOptions)], downloader.WithSubdirs(source.subdirs(file)...))
+					}
+
+					downloadFile := downloader.NewFile(file, fileOptions...)
+					select {
+					case queue <- downloadFile:
+					case <-d.BudgetExhausted():
+						return
+					case <-d.OutOfSpace():
+						return
+					case <-ctx.Done():
+						return
+					}
 				}
 			}
-		}
+		}(source)
+	}
+
+	go func() {
+		forwarders.Wait()
+		scanProgress.ScanningDone(d.Stats())
 	}()
 
 	d.Start(ctx)
-	d.AddDownloadQueue(ctx, queue)
+	for i, queue := range queues {
+		d.AddDownloadQueue(ctx, queue, downloader.WithQueuePriority(priorities[i]))
+	}
 	err = d.Stop(ctx)
 	stats := d.Stats()
 	if renderer.HasEventSink(ctx) {
-		renderer.RenderDownloadSummaryDetails(
-			writer,
-			stats.Downloaded,
-			stats.Skipped,
-			stats.Failed,
-			time.Since(startedAt),
-			r.cfg.GetString("downloader.dir.output"),
-		)
+		renderer.RenderDownloadSummaryDetails(writer, renderer.DownloadSummary{
+			Downloaded:     stats.Downloaded,
+			Skipped:        stats.Skipped,
+			Failed:         stats.Failed,
+			ExcludedBySize: stats.ExcludedBySize,
+			BudgetUsed:     stats.BudgetUsed,
+			Budget:         stats.Budget,
+			Deduplicated:   stats.Deduplicated,
+			SavedBytes:     stats.SavedBytes,
+			DryRun:         opts.dryRun,
+			Needed:         stats.Needed,
+			FreeSpace:      stats.FreeSpace,
+			Shortfall:      stats.Shortfall,
+			Elapsed:        time.Since(startedAt),
+			OutputDir:      r.cfg.GetString("downloader.dir.output"),
+		})
 	} else {
 		renderer.RenderDownloadSummary(writer, stats.Downloaded, stats.Skipped, stats.Failed)
+		if stats.Deduplicated > 0 {
+			renderer.RenderDedupSummary(writer, stats.Deduplicated, stats.SavedBytes)
+		}
+		if opts.dryRun {
+			renderer.RenderSpaceEstimate(writer, stats.Needed, stats.FreeSpace, stats.Shortfall)
+		}
 	}
 	return apperr.Wrap("cmd.download.stop", err)
 }
 
+// commentSubdirs puts comment files into a folder per channel post and
+// leaves the subdirectories of other files to next.
+func commentSubdirs(dialogDir string, next func(telegram.File) []string) func(telegram.File) []string {
+	return func(file telegram.File) []string {
+		if postID := file.PostID(); postID > 0 {
+			return []string{path.Join(dialogDir, "comments", strconv.Itoa(postID))}
+		}
+
+		return next(file)
+	}
+}
+
 func promptResolvedPeerType(peer peers.Peer) string {
 	switch {
 	case peer.TDLibPeerID().IsUser():
@@ -309,18 +729,24 @@ func (r *Root) downloadFilesFromMessage(ctx context.Context, writer io.Writer, p
 		return apperr.Wrap("cmd.download.message.options", err)
 	}
 
+	filter, err := opts.newFileFilter()
+	if err != nil {
+		return apperr.Wrap("cmd.download.message.options", err)
+	}
+
 	files, err := r.client.FileService.GetFilesFromMessage(ctx, peer, msgID, getFileOptions...)
 	if err != nil {
 		return apperr.Wrap("cmd.download.message.get_files", err)
 	}
+	files = filterFiles(files, filter)
 
 	return apperr.Wrap(
 		"cmd.download.message.download",
 		r.downloadFiles(
 			ctx,
 			writer,
+			peer,
 			sendSliceToChannel(ctx, files),
-			[]string{dialogDownloadDirectory(peer)},
 			opts,
 		),
 	)
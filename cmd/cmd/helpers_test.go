@@ -1,6 +1,13 @@
 package cmd
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
+	"github.com/johnnyipcom/tgdownloader/pkg/telegram"
+)
 
 func TestSanitizeDownloadDirectoryComponent(t *testing.T) {
 	tests := []struct {
@@ -49,3 +56,125 @@ func TestSanitizeDownloadDirectoryComponent(t *testing.T) {
 		})
 	}
 }
+
+func TestDownloadOptionsFileFilter(t *testing.T) {
+	opts := downloadOptions{
+		mediaTypes: "video, animation",
+		mimeTypes:  "application/pdf,",
+		extensions: "zip , rar",
+	}
+
+	filter, err := opts.newFileFilter()
+	if err != nil {
+		t.Fatalf("newFileFilter() error = %v", err)
+	}
+
+	if len(filter.Kinds) != 2 || filter.Kinds[0] != telegram.MediaKindVideo || filter.Kinds[1] != telegram.MediaKindAnimation {
+		t.Fatalf("kinds = %q", filter.Kinds)
+	}
+	if len(filter.MIMETypes) != 1 || filter.MIMETypes[0] != "application/pdf" {
+		t.Fatalf("MIME types = %q", filter.MIMETypes)
+	}
+	if len(filter.Extensions) != 2 || filter.Extensions[0] != "zip" || filter.Extensions[1] != "rar" {
+		t.Fatalf("extensions = %q", filter.Extensions)
+	}
+
+	opts.mediaTypes = "hologram"
+	if _, err := opts.newFileFilter(); err == nil {
+		t.Fatal("newFileFilter() accepted unknown media type")
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		input string
+		want  int64
+	}{
+		{input: "512", want: 512},
+		{input: "700KB", want: 700_000},
+		{input: "1.5 GB", want: 1_500_000_000},
+		{input: "20gib", want: 20 << 30},
+		{input: "5MiB", want: 5 << 20},
+	}
+
+	for _, tt := range tests {
+		got, err := parseByteSize(tt.input)
+		if err != nil {
+			t.Fatalf("parseByteSize(%q) error = %v", tt.input, err)
+		}
+		if got != tt.want {
+			t.Fatalf("parseByteSize(%q) = %d, want %d", tt.input, got, tt.want)
+		}
+	}
+
+	for _, input := range []string{"", "GB", "10 parsecs", "-1MB"} {
+		if _, err := parseByteSize(input); err == nil {
+			t.Fatalf("parseByteSize(%q) succeeded", input)
+		}
+	}
+}
+
+func TestDownloadOptionsRejectInvertedSizeLimits(t *testing.T) {
+	opts := downloadOptions{minSize: "2GB", maxSize: "1GB"}
+	if _, err := opts.newSizeOptions(); err == nil {
+		t.Fatal("newSizeOptions() accepted min-size greater than max-size")
+	}
+}
+
+func TestParseTimeBound(t *testing.T) {
+	now := time.Date(2025, 4, 10, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		input string
+		upper bool
+		want  time.Time
+	}{
+		{input: "", want: time.Time{}},
+		{input: "2025-01-01", want: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{input: "2025-03-31", upper: true, want: time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{input: "2025-03-31 18:30:00", upper: true, want: time.Date(2025, 3, 31, 18, 30, 0, 0, time.UTC)},
+		{input: "7d", want: now.Add(-7 * 24 * time.Hour)},
+		{input: "12h", upper: true, want: now.Add(-12 * time.Hour)},
+		{input: "2w", want: now.Add(-14 * 24 * time.Hour)},
+		{input: "30m", want: now.Add(-30 * time.Minute)},
+	}
+
+	for _, tt := range tests {
+		got, err := parseTimeBound("since", tt.input, now, tt.upper)
+		if err != nil {
+			t.Fatalf("parseTimeBound(%q) error = %v", tt.input, err)
+		}
+		if !got.Equal(tt.want) {
+			t.Fatalf("parseTimeBound(%q) = %s, want %s", tt.input, got, tt.want)
+		}
+	}
+
+	for _, input := range []string{"yesterday", "0d", "-3d", "2025-13-01"} {
+		if _, err := parseTimeBound("since", input, now, false); !apperr.IsKind(err, apperr.KindConfig) {
+			t.Fatalf("parseTimeBound(%q) error = %v, want config kind", input, err)
+		}
+	}
+}
+
+func TestDownloadOptionsRejectOffsetDateWithUntil(t *testing.T) {
+	opts := downloadOptions{offsetDate: "2025-03-31 00:00:00", until: "2025-03-01"}
+	if _, err := opts.newGetAllFilesOptions(); !apperr.IsKind(err, apperr.KindConfig) {
+		t.Fatalf("newGetAllFilesOptions() error = %v, want config kind", err)
+	}
+}
+
+func TestDownloadOptionsAfterIDStartsAfterArchivedMessage(t *testing.T) {
+	opts := downloadOptions{afterID: 1800, oldest: true}
+	getFileOptions, err := opts.newGetAllFilesOptions()
+	if err != nil {
+		t.Fatalf("newGetAllFilesOptions() error = %v", err)
+	}
+
+	want := []telegram.GetAllFilesOption{
+		telegram.GetFileWithIDRange(1801, 0),
+		telegram.GetFileWithOldestFirst(),
+	}
+	if !reflect.DeepEqual(getFileOptions, want) {
+		t.Fatalf("options = %#v, want %#v", getFileOptions, want)
+	}
+}
@@ -0,0 +1,278 @@
+package cmd
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gotd/td/telegram/peers"
+	"github.com/johnnyipcom/tgdownloader/internal/renderer"
+	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
+	"github.com/johnnyipcom/tgdownloader/pkg/telegram"
+)
+
+const defaultTemplateDateLayout = "2006-01-02"
+
+// pathTemplateFields lists the placeholders an output path template may use.
+var pathTemplateFields = []struct {
+	name        string
+	description string
+}{
+	{"peer", "name of the chat the file comes from"},
+	{"peer_id", "TDLib ID of the chat"},
+	{"sender", "name of the message author"},
+	{"sender_id", "ID of the message author"},
+	{"msg_id", "message ID"},
+	{"date", "message date; {date:<Go layout>} for other formats than 2006-01-02"},
+	{"grouped_id", "album ID, empty outside of albums"},
+	{"hashtag", "each hashtag of the message; the file is saved once per hashtag"},
+	{"media_type", "photo, video, audio, voice, animation, sticker or document"},
+	{"mime", "MIME type with / replaced by -"},
+	{"ext", "file extension without the dot"},
+	{"name", "Telegram file name"},
+	{"id", "stable file identity"},
+	{"topic_id", "forum topic ID, empty outside of forums"},
+	{"post_id", "channel post a comment belongs to, empty for other files"},
+}
+
+func isPathTemplateField(name string) bool {
+	for _, field := range pathTemplateFields {
+		if field.name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pathTemplateHelp describes the template placeholders for command help.
+func pathTemplateHelp() string {
+	var help strings.Builder
+	help.WriteString("Path template placeholders:\n")
+	for _, field := range pathTemplateFields {
+		fmt.Fprintf(&help, "  %-14s %s\n", "{"+field.name+"}", field.description)
+	}
+
+	return help.String()
+}
+
+// pathTemplateFile is the file metadata a template can refer to.
+type pathTemplateFile interface {
+	Name() string
+	Kind() telegram.MediaKind
+	MIMEType() string
+	Identity() string
+	MessageID() int
+	Date() time.Time
+	GroupedID() int64
+	SenderID() int64
+	Sender() string
+	Hashtags() []string
+	TopicID() int
+	PostID() int
+}
+
+var _ pathTemplateFile = telegram.File{}
+
+type pathTemplatePart struct {
+	literal string
+	field   string
+	layout  string
+}
+
+// pathTemplate lays out downloaded files, e.g. {peer}/{date:2006/01}/{msg_id}_{name}.
+type pathTemplate struct {
+	parts []pathTemplatePart
+}
+
+func parsePathTemplate(text string) (*pathTemplate, error) {
+	invalid := func(format string, args ...any) error {
+		return apperr.New("cmd.download.options.path_template", apperr.KindConfig, fmt.Errorf("path template %q: %s", text, fmt.Sprintf(format, args...)))
+	}
+
+	t := &pathTemplate{}
+	rest := text
+	for rest != "" {
+		open := strings.IndexAny(rest, "{}")
+		if open < 0 {
+			t.parts = append(t.parts, pathTemplatePart{literal: rest})
+			break
+		}
+
+		if rest[open] == '}' {
+			return nil, invalid("unexpected }")
+		}
+
+		if open > 0 {
+			t.parts = append(t.parts, pathTemplatePart{literal: rest[:open]})
+		}
+
+		end := strings.IndexAny(rest[open+1:], "{}")
+		if end < 0 || rest[open+1+end] != '}' {
+			return nil, invalid("unterminated {")
+		}
+
+		field, layout, hasLayout := strings.Cut(rest[open+1:open+1+end], ":")
+		if !isPathTemplateField(field) {
+			return nil, invalid("unknown placeholder {%s}", field)
+		}
+
+		switch {
+		case hasLayout && field != "date":
+			return nil, invalid("{%s} does not take a format", field)
+		case hasLayout && layout == "":
+			return nil, invalid("empty date format")
+		case field == "date" && !hasLayout:
+			layout = defaultTemplateDateLayout
+		}
+
+		t.parts = append(t.parts, pathTemplatePart{field: field, layout: layout})
+		rest = rest[open+1+end+1:]
+	}
+
+	if len(t.parts) == 0 {
+		return nil, invalid("template is empty")
+	}
+
+	return t, nil
+}
+
+func (t *pathTemplate) usesHashtags() bool {
+	for _, part := range t.parts {
+		if part.field == "hashtag" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Paths expands the template for a file of peer into paths relative to the
+// output directory. Every path component is sanitized like dialog
+// directories, and a template without a file name component gets the
+// Telegram file name appended.
+func (t *pathTemplate) Paths(peer peers.Peer, file pathTemplateFile) []string {
+	hashtags := []string{""}
+	if t.usesHashtags() && len(file.Hashtags()) > 0 {
+		hashtags = file.Hashtags()
+	}
+
+	seen := make(map[string]struct{}, len(hashtags))
+	paths := make([]string, 0, len(hashtags))
+	for _, hashtag := range hashtags {
+		expanded := t.expand(peer, file, hashtag)
+		if _, ok := seen[expanded]; ok {
+			continue
+		}
+
+		seen[expanded] = struct{}{}
+		paths = append(paths, expanded)
+	}
+
+	return paths
+}
+
+func (t *pathTemplate) expand(peer peers.Peer, file pathTemplateFile, hashtag string) string {
+	var raw strings.Builder
+	for _, part := range t.parts {
+		if part.field == "" {
+			raw.WriteString(part.literal)
+			continue
+		}
+
+		value := pathTemplateValue(part, peer, file, hashtag)
+		if part.field != "date" {
+			// Only date formats may introduce directories.
+			value = strings.NewReplacer("/", "", "\\", "").Replace(value)
+		}
+		raw.WriteString(value)
+	}
+
+	components := strings.Split(strings.ReplaceAll(raw.String(), "\\", "/"), "/")
+	name := components[len(components)-1]
+
+	var sanitized []string
+	for _, component := range components[:len(components)-1] {
+		if component = sanitizeDownloadDirectoryComponent(component, ""); component != "" {
+			sanitized = append(sanitized, component)
+		}
+	}
+
+	fallback := sanitizeDownloadDirectoryComponent(file.Name(), file.Identity())
+	sanitized = append(sanitized, sanitizeDownloadDirectoryComponent(name, fallback))
+
+	return path.Join(sanitized...)
+}
+
+func pathTemplateValue(part pathTemplatePart, peer peers.Peer, file pathTemplateFile, hashtag string) string {
+	optional := func(id int64) string {
+		if id == 0 {
+			return ""
+		}
+
+		return strconv.FormatInt(id, 10)
+	}
+
+	switch part.field {
+	case "peer":
+		return dialogDownloadDirectory(peer)
+	case "peer_id":
+		return renderer.RenderTDLibPeerID(peer.TDLibPeerID())
+	case "sender":
+		return file.Sender()
+	case "sender_id":
+		return optional(file.SenderID())
+	case "msg_id":
+		return optional(int64(file.MessageID()))
+	case "date":
+		return file.Date().Format(part.layout)
+	case "grouped_id":
+		return optional(file.GroupedID())
+	case "hashtag":
+		return hashtag
+	case "media_type":
+		return string(file.Kind())
+	case "mime":
+		return strings.ReplaceAll(file.MIMEType(), "/", "-")
+	case "ext":
+		return strings.TrimPrefix(path.Ext(file.Name()), ".")
+	case "name":
+		return file.Name()
+	case "id":
+		return file.Identity()
+	case "topic_id":
+		return optional(int64(file.TopicID()))
+	case "post_id":
+		return optional(int64(file.PostID()))
+	default:
+		return ""
+	}
+}
+
+// pathTemplate returns the output path template from the command line or
+// the downloader.dir.template setting, or nil for the default layout.
+func (r *Root) pathTemplate(opts downloadOptions) (*pathTemplate, error) {
+	text := r.pathTemplateText(opts)
+	if text == "" {
+		return nil, nil
+	}
+
+	if opts.hashtags || opts.byTopic {
+		return nil, apperr.New("cmd.download.options.path_template", apperr.KindConfig, fmt.Errorf("--hashtags and --by-topic do not apply to path templates, use {hashtag} or {topic_id} instead"))
+	}
+
+	return parsePathTemplate(text)
+}
+
+// pathTemplateText returns the template from the options or, without one,
+// from downloader.dir.template.
+func (r *Root) pathTemplateText(opts downloadOptions) string {
+	text := strings.TrimSpace(opts.pathTemplate)
+	if text == "" && r.cfg != nil {
+		text = strings.TrimSpace(r.cfg.GetString("downloader.dir.template"))
+	}
+
+	return text
+}
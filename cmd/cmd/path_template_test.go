@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gotd/td/telegram/peers"
+	"github.com/gotd/td/tg"
+	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
+	"github.com/johnnyipcom/tgdownloader/pkg/telegram"
+)
+
+type templateTestFile struct {
+	name      string
+	kind      telegram.MediaKind
+	mime      string
+	messageID int
+	date      time.Time
+	groupedID int64
+	senderID  int64
+	sender    string
+	hashtags  []string
+}
+
+func (f templateTestFile) Name() string             { return f.name }
+func (f templateTestFile) Kind() telegram.MediaKind { return f.kind }
+func (f templateTestFile) MIMEType() string         { return f.mime }
+func (f templateTestFile) Identity() string         { return "5005" }
+func (f templateTestFile) MessageID() int           { return f.messageID }
+func (f templateTestFile) Date() time.Time          { return f.date }
+func (f templateTestFile) GroupedID() int64         { return f.groupedID }
+func (f templateTestFile) SenderID() int64          { return f.senderID }
+func (f templateTestFile) Sender() string           { return f.sender }
+func (f templateTestFile) Hashtags() []string       { return f.hashtags }
+func (f templateTestFile) TopicID() int             { return 0 }
+func (f templateTestFile) PostID() int              { return 0 }
+
+func TestPathTemplatePaths(t *testing.T) {
+	var manager peers.Manager
+	peer := manager.User(&tg.User{ID: 7, FirstName: "Cherry: Channel"})
+
+	file := templateTestFile{
+		name:      "clip.mp4",
+		kind:      telegram.MediaKindVideo,
+		mime:      "video/mp4",
+		messageID: 42,
+		date:      time.Date(2025, 3, 9, 12, 0, 0, 0, time.Local),
+		senderID:  9,
+		sender:    "Alice/Bob",
+		hashtags:  []string{"news", "..", "news"},
+	}
+
+	tests := []struct {
+		template string
+		want     []string
+	}{
+		{template: "{peer}/{date:2006/01}/{msg_id}_{name}", want: []string{"Cherry Channel/2025/03/42_clip.mp4"}},
+		{template: "{sender}/{media_type}/{name}", want: []string{"AliceBob/video/clip.mp4"}},
+		{template: "{mime}/{ext}/{grouped_id}/{id}.{ext}", want: []string{"video-mp4/mp4/5005.mp4"}},
+		{template: "{hashtag}/{name}", want: []string{"news/clip.mp4", "clip.mp4"}},
+		{template: "../{peer}/", want: []string{"Cherry Channel/clip.mp4"}},
+		{template: "{date}/CON", want: []string{"2025-03-09/clip.mp4"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			template, err := parsePathTemplate(tt.template)
+			if err != nil {
+				t.Fatalf("parsePathTemplate() error = %v", err)
+			}
+
+			if got := template.Paths(peer, file); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("Paths() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePathTemplateRejectsInvalidTemplates(t *testing.T) {
+	for _, template := range []string{"", "{peer", "peer}", "{nope}/{name}", "{name:x}", "{date:}", "{pe{er}}"} {
+		if _, err := parsePathTemplate(template); !apperr.IsKind(err, apperr.KindConfig) {
+			t.Fatalf("parsePathTemplate(%q) error = %v, want config error", template, err)
+		}
+	}
+}
+
+func TestPathTemplateRejectsFolderFlags(t *testing.T) {
+	r := &Root{}
+	if _, err := r.pathTemplate(downloadOptions{pathTemplate: "{name}", hashtags: true}); !apperr.IsKind(err, apperr.KindConfig) {
+		t.Fatalf("pathTemplate() error = %v, want config error", err)
+	}
+}
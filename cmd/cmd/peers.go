@@ -157,11 +157,39 @@ func (r *Root) newPeerCmd() *cobra.Command {
 		},
 	}
 
+	peerTopicsCmd := &cobra.Command{
+		Use:     "topics",
+		Short:   "List topics of a forum",
+		Long:    `List topic IDs and titles of a forum supergroup.`,
+		Example: `  tgdownloader peer topics "Go Forum"`,
+		Args:    peerInputArgs,
+		Annotations: map[string]string{
+			"prompt_suggest": "channel",
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			peer, err := r.resolvePeer(cmd.Context(), peerInputArg(args))
+			if err != nil {
+				r.log.Error(err, "failed to parse peer")
+				return err
+			}
+
+			topics, err := r.client.GetForumTopics(cmd.Context(), peer)
+			if err != nil {
+				r.log.Error(err, "failed to get topics")
+				return err
+			}
+
+			renderer.RenderTopicsTable(cmd.OutOrStdout(), topics)
+			return nil
+		},
+	}
+
 	peerCmd.AddCommand(
 		peerListCmd,
 		peerResolveCmd,
 		peerFindCmd,
 		peerFromHistoryCmd,
+		peerTopicsCmd,
 	)
 
 	r.setupConnectionForCmd(
@@ -169,6 +197,7 @@ func (r *Root) newPeerCmd() *cobra.Command {
 		peerResolveCmd,
 		peerFindCmd,
 		peerFromHistoryCmd,
+		peerTopicsCmd,
 	)
 	return peerCmd
 }
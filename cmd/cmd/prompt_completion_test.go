@@ -25,7 +25,7 @@ func TestCompletePromptSuggestsRootAndNestedCommands(t *testing.T) {
 	for i, candidate := range rootResult.Candidates {
 		rootValues[i] = candidate.Value
 	}
-	if want := []string{"dialog", "download"}; !reflect.DeepEqual(rootValues, want) {
+	if want := []string{"dialog", "download", "dropbox"}; !reflect.DeepEqual(rootValues, want) {
 		t.Fatalf("root candidates = %q, want %q", rootValues, want)
 	}
 
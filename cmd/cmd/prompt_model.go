@@ -18,6 +18,10 @@ type promptCompleteFunc func(context.Context, string, int) completionResult
 
 type promptSubmitFunc func(context.Context, string) tea.Cmd
 
+// promptBandwidthFunc steps the bandwidth limit up or down and describes the
+// new one.
+type promptBandwidthFunc func(faster bool) string
+
 type promptModelOptions struct {
 	Context       context.Context
 	Lifetime      context.Context
@@ -26,6 +30,7 @@ type promptModelOptions struct {
 	Connected     bool
 	Complete      promptCompleteFunc
 	Submit        promptSubmitFunc
+	Bandwidth     promptBandwidthFunc
 	Events        <-chan renderer.Event
 	History       []string
 	HistoryLimit  int
@@ -56,6 +61,7 @@ type promptModel struct {
 	progressTicking   bool
 	complete          promptCompleteFunc
 	submit            promptSubmitFunc
+	bandwidth         promptBandwidthFunc
 	events            <-chan renderer.Event
 	completions       []promptCandidate
 	selected          int
@@ -175,6 +181,7 @@ func newPromptModel(options promptModelOptions) *promptModel {
 		viewport:            viewport.New(),
 		complete:            options.Complete,
 		submit:              options.Submit,
+		bandwidth:           options.Bandwidth,
 		events:              options.Events,
 		history:             append([]string(nil), options.History...),
 		historyIndex:        len(options.History),
@@ -355,8 +362,16 @@ func (m *promptModel) updateKey(msg tea.KeyPressMsg) (tea.Model, tea.Cmd) {
 	}
 
 	if m.running {
-		if msg.Keystroke() == "ctrl+c" && m.cancel != nil {
-			m.cancel()
+		switch msg.String() {
+		case "ctrl+c":
+			if m.cancel != nil {
+				m.cancel()
+			}
+		case "+", "=", "-":
+			if m.bandwidth != nil {
+				m.appendTranscriptText(m.bandwidth(msg.String() != "-"))
+				m.syncViewportContent()
+			}
 		}
 		return m, nil
 	}
@@ -812,6 +827,8 @@ func (m *promptModel) renderHint() string {
 		hint = "ctrl+c cancel"
 	} else if m.state == promptStateFailed {
 		hint = "ctrl+c exit"
+	} else if m.running && m.bandwidth != nil {
+		hint = "ctrl+c cancel  +/- bandwidth  ctrl+up/down scroll"
 	} else if m.running {
 		hint = "ctrl+c cancel  ctrl+up/down scroll"
 	} else if len(m.completions) > 0 {
@@ -814,3 +814,28 @@ func updateKey(t *testing.T, m *promptModel, msg tea.Msg) *promptModel {
 	}
 	return model
 }
+
+func TestPromptModelStepsBandwidthWhileCommandRuns(t *testing.T) {
+	var steps []bool
+	m := newPromptModel(promptModelOptions{
+		Submit: func(context.Context, string) tea.Cmd { return nil },
+		Bandwidth: func(faster bool) string {
+			steps = append(steps, faster)
+			return fmt.Sprintf("Bandwidth limit: step %d", len(steps))
+		},
+	})
+	m.editor.SetValue("version")
+	m = updateKey(t, m, tea.KeyPressMsg{Code: tea.KeyEnter})
+
+	m = updateKeys(t, m, "-+")
+
+	if !reflect.DeepEqual(steps, []bool{false, true}) {
+		t.Fatalf("steps = %v, want [false true]", steps)
+	}
+	if got := strings.Join(m.transcript, "\n"); !strings.Contains(got, "Bandwidth limit: step 2") {
+		t.Fatalf("transcript = %q, want the new limit", got)
+	}
+	if got := m.editor.Value(); got != "" {
+		t.Fatalf("editor value = %q, want empty", got)
+	}
+}
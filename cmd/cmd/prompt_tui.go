@@ -57,6 +57,7 @@ func (r *Root) runPromptTUI(ctx context.Context) error {
 		Submit: func(commandCtx context.Context, line string) tea.Cmd {
 			return r.submitPromptCommand(commandCtx, line, sink, history)
 		},
+		Bandwidth: r.stepBandwidth,
 	})
 
 	runErr := r.runPromptProgram(model)
@@ -143,6 +144,7 @@ func (r *Root) newPromptTUIModel(
 		Submit: func(commandCtx context.Context, line string) tea.Cmd {
 			return r.submitPromptCommand(commandCtx, line, sink, history)
 		},
+		Bandwidth:    r.stepBandwidth,
 		Events:       events,
 		History:      historyEntries(history),
 		HistoryLimit: historyLimit(history),
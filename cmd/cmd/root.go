@@ -15,8 +15,10 @@ import (
 	"github.com/johnnyipcom/tgdownloader/cmd/version"
 	"github.com/johnnyipcom/tgdownloader/internal/downloader"
 	"github.com/johnnyipcom/tgdownloader/internal/renderer"
+	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
 	"github.com/johnnyipcom/tgdownloader/pkg/config"
 	"github.com/johnnyipcom/tgdownloader/pkg/config/viper"
+	"github.com/johnnyipcom/tgdownloader/pkg/ps"
 	"github.com/johnnyipcom/tgdownloader/pkg/telegram"
 
 	cc "github.com/ivanpirog/coloredcobra"
@@ -41,6 +43,9 @@ type Root struct {
 	log      logr.Logger
 	level    zap.AtomicLevel
 
+	bandwidthMu sync.Mutex
+	bandwidth   *downloader.BandwidthLimiter
+
 	runtimeMu            sync.Mutex
 	runtimeInitialized   bool
 	runtimeErr           error
@@ -257,6 +262,9 @@ func (r *Root) newRootCmdWithPrompt(includePrompt bool) *cobra.Command {
 	rootCmd.AddCommand(r.newPeerCmd())
 	rootCmd.AddCommand(r.newDialogsCmd())
 	rootCmd.AddCommand(r.newDownloadCmd())
+	rootCmd.AddCommand(r.newVerifyCmd())
+	rootCmd.AddCommand(r.newBandwidthCmd())
+	rootCmd.AddCommand(r.newDropboxCmd())
 	rootCmd.AddCommand(r.newExitCmd())
 
 	if includePrompt {
@@ -366,18 +374,78 @@ func (r *Root) setupRuntimeForCmd(cmds ...*cobra.Command) {
 func (r *Root) newDownloader(ctx context.Context, writer io.Writer, opts ...downloader.Option) (*downloader.Downloader, error) {
 	dCfg := r.cfg.Sub("downloader")
 
+	// Prepended, so that --order of a command overrides the config.
+	order, err := downloader.ParseQueueOrder(dCfg.GetString("queue.order"))
+	if err != nil {
+		return nil, err
+	}
+	queueOptions := []downloader.Option{downloader.WithQueueOrder(order)}
+	if buffer := dCfg.GetInt("queue.buffer"); buffer > 0 {
+		queueOptions = append(queueOptions, downloader.WithQueueBuffer(buffer))
+	}
+	opts = append(queueOptions, opts...)
+
 	workers := dCfg.GetInt("workers")
 	if workers > 1 {
 		opts = append(opts, downloader.WithNumWorkers(workers))
 	}
 
-	retryCount := dCfg.GetInt("retry.count")
-	retryDelay := dCfg.GetDuration("retry.delay")
-	if retryCount > 0 || retryDelay > 0 {
-		opts = append(opts, downloader.WithRetry(retryCount, retryDelay))
+	retry := downloader.DefaultRetryPolicy()
+	if count := dCfg.GetInt("retry.count"); count > 0 {
+		retry.MaxAttempts = count
+	}
+	if delay := dCfg.GetDuration("retry.delay"); delay > 0 {
+		retry.Initial = delay
+	}
+	if maxDelay := dCfg.GetDuration("retry.max_delay"); maxDelay > 0 {
+		retry.Max = maxDelay
+	}
+	if multiplier := dCfg.GetFloat64("retry.multiplier"); multiplier > 0 {
+		retry.Multiplier = multiplier
+	}
+	if dCfg.IsSet("retry.jitter") {
+		retry.Jitter = dCfg.GetFloat64("retry.jitter")
+	}
+	opts = append(opts, downloader.WithRetryPolicy(retry))
+
+	dedup, err := downloader.ParseDedupMode(dCfg.GetString("dedup"))
+	if err != nil {
+		return nil, err
+	}
+	if dedup != downloader.DedupOff {
+		opts = append(opts, downloader.WithDedup(dedup))
+	}
+
+	if dCfg.GetBool("verify") {
+		opts = append(opts, downloader.WithVerify(true))
+	}
+
+	bandwidth, err := r.bandwidthLimiter()
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, downloader.WithBandwidthLimiter(bandwidth))
+
+	if strings.EqualFold(dCfg.GetString("type"), "local") {
+		var reserve int64
+		if value := dCfg.GetString("min_free_space"); value != "" {
+			if reserve, err = parseByteSize(value); err != nil {
+				return nil, apperr.New("cmd.downloader.config", apperr.KindConfig, fmt.Errorf("invalid downloader.min_free_space: %w", err))
+			}
+		}
+		opts = append(opts, downloader.WithFreeSpace(ps.GetDiskFree, reserve))
+	}
+
+	if threads := r.cfg.GetInt("telegram.download.threads"); threads > 1 {
+		opts = append(opts, downloader.WithThreads(threads))
+	}
+
+	var tokens telegram.OAuth2TokenStore
+	if r.client != nil {
+		tokens = r.client.OAuth2Tokens
 	}
 
-	fs, err := downloader.GetFS(ctx, dCfg, zap.NewStdLog(r.zap), writer)
+	fs, err := downloader.GetFS(ctx, dCfg, zap.NewStdLog(r.zap), writer, tokens)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gotd/td/telegram/peers"
+	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
+	"github.com/johnnyipcom/tgdownloader/pkg/telegram"
+)
+
+// resolveTopicID parses a --topic value: either a topic ID or a link to a
+// message inside the topic, e.g. https://t.me/c/1492447836/251015/251021.
+func (r *Root) resolveTopicID(ctx context.Context, peer peers.Peer, value string) (int, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+
+	if id, err := strconv.Atoi(value); err == nil {
+		if id <= 0 {
+			return 0, apperr.New("cmd.download.options.topic", apperr.KindConfig, fmt.Errorf("invalid topic ID %d", id))
+		}
+
+		return id, nil
+	}
+
+	link, err := r.client.ParseLink(ctx, value)
+	if err != nil {
+		return 0, apperr.New("cmd.download.options.topic", apperr.KindConfig, fmt.Errorf("topic must be an ID or a message link: %w", err))
+	}
+
+	if link.TopicID == 0 {
+		return 0, apperr.New("cmd.download.options.topic", apperr.KindConfig, fmt.Errorf("link %s does not point into a forum topic", value))
+	}
+
+	if link.Peer.TDLibPeerID() != peer.TDLibPeerID() {
+		return 0, apperr.New("cmd.download.options.topic", apperr.KindConfig, fmt.Errorf("link %s belongs to %s, not %s", value, link.Peer.VisibleName(), peer.VisibleName()))
+	}
+
+	return link.TopicID, nil
+}
+
+// topicSubdirs places files of a forum into a subdirectory per topic, named
+// after the topic title.
+func (r *Root) topicSubdirs(ctx context.Context, peer peers.Peer) (func(telegram.File) []string, error) {
+	topics, err := r.client.GetForumTopics(ctx, peer)
+	if err != nil {
+		return nil, err
+	}
+
+	return newTopicSubdirs(dialogDownloadDirectory(peer), topics), nil
+}
+
+func newTopicSubdirs(dialogDir string, topics []telegram.ForumTopic) func(telegram.File) []string {
+	dirs := make(map[int]string, len(topics))
+	for _, topic := range topics {
+		dirs[topic.ID] = sanitizeDownloadDirectoryComponent(topic.Title, strconv.Itoa(topic.ID))
+	}
+
+	return func(file telegram.File) []string {
+		topicID := file.TopicID()
+		if topicID == 0 {
+			return []string{dialogDir}
+		}
+
+		dir, ok := dirs[topicID]
+		if !ok {
+			// Topics created after the listing or deleted since.
+			dir = strconv.Itoa(topicID)
+		}
+
+		return []string{path.Join(dialogDir, dir)}
+	}
+}
@@ -0,0 +1,26 @@
+package cmd
+
+import (
+	"context"
+	"testing"
+
+	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
+)
+
+func TestResolveTopicIDAcceptsNumericIDs(t *testing.T) {
+	r := &Root{}
+
+	id, err := r.resolveTopicID(context.Background(), nil, " 251015 ")
+	if err != nil || id != 251015 {
+		t.Fatalf("resolveTopicID() = %d, %v, want 251015", id, err)
+	}
+
+	id, err = r.resolveTopicID(context.Background(), nil, "")
+	if err != nil || id != 0 {
+		t.Fatalf("resolveTopicID(empty) = %d, %v, want 0", id, err)
+	}
+
+	if _, err := r.resolveTopicID(context.Background(), nil, "-3"); !apperr.IsKind(err, apperr.KindConfig) {
+		t.Fatalf("resolveTopicID(-3) error = %v, want config error", err)
+	}
+}
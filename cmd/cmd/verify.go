@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/gotd/td/telegram/peers"
+	"github.com/johnnyipcom/tgdownloader/internal/downloader"
+	"github.com/johnnyipcom/tgdownloader/internal/renderer"
+	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
+	"github.com/johnnyipcom/tgdownloader/pkg/telegram"
+	"github.com/spf13/cobra"
+)
+
+func (r *Root) newVerifyCmd() *cobra.Command {
+	var (
+		requeue bool
+		status  bool
+	)
+
+	verifyCmd := &cobra.Command{
+		Use:   "verify",
+		Short: "Check downloaded files of a peer against Telegram",
+		Long: `Check every file of a peer recorded in the file manifest of the output
+directory. Documents are compared with the SHA-256 hashes Telegram keeps for
+them, other files only by their size.
+
+Corrupt and missing files are reported, and downloaded again with --requeue.`,
+		Example: `  tgdownloader verify "Cherry Channel"
+  tgdownloader verify "Cherry Channel" --requeue --status`,
+		Args: peerInputArgs,
+		Annotations: map[string]string{
+			"prompt_suggest": "any",
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			peer, err := r.resolvePeer(cmd.Context(), peerInputArg(args))
+			if err != nil {
+				r.log.Error(err, "failed to parse peer")
+				return err
+			}
+
+			return r.verifyFilesFromPeer(cmd.Context(), cmd.OutOrStdout(), peer, requeue, status)
+		},
+	}
+
+	verifyCmd.Flags().BoolVar(&requeue, "requeue", false, "Download corrupt and missing files again")
+	addStatusFlags(verifyCmd, &status)
+
+	r.setupConnectionForCmd(verifyCmd)
+	return verifyCmd
+}
+
+// verifyFilesFromPeer checks the recorded downloads of every file in the
+// peer history and, with requeue, downloads the broken ones again in place.
+func (r *Root) verifyFilesFromPeer(ctx context.Context, writer io.Writer, peer peers.Peer, requeue, status bool) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	d, err := r.newDownloader(ctx, writer)
+	if err != nil {
+		return apperr.Wrap("cmd.verify.new_downloader", err)
+	}
+
+	files, err := r.client.FileService.GetAllFiles(ctx, peer)
+	if err != nil {
+		return apperr.Wrap("cmd.verify.get_all_files", err)
+	}
+
+	var (
+		problems []renderer.VerifiedFile
+		counts   = make(map[downloader.VerifyStatus]int)
+		broken   []telegram.File
+		paths    = make(map[string][]string)
+	)
+	for file := range files {
+		verifications, err := d.Verify(ctx, file)
+		if err != nil {
+			return apperr.Wrap("cmd.verify", err)
+		}
+
+		for _, verification := range verifications {
+			counts[verification.Status]++
+			if verification.Status != downloader.VerifyCorrupt && verification.Status != downloader.VerifyMissing {
+				continue
+			}
+
+			problems = append(problems, renderer.VerifiedFile{
+				Path:   verification.Path,
+				Status: string(verification.Status),
+				Detail: fmt.Sprint(verification.Err),
+			})
+
+			identity := file.Identity()
+			if _, ok := paths[identity]; !ok {
+				broken = append(broken, file)
+			}
+			paths[identity] = append(paths[identity], verification.LogicalPath)
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if len(problems) > 0 {
+		renderer.RenderVerifyTable(writer, problems)
+	}
+	renderer.RenderVerifySummary(
+		writer,
+		counts[downloader.VerifyOK],
+		counts[downloader.VerifyUnverified],
+		counts[downloader.VerifyCorrupt],
+		counts[downloader.VerifyMissing],
+	)
+
+	if len(broken) == 0 {
+		return nil
+	}
+
+	if !requeue {
+		return apperr.New("cmd.verify", apperr.KindIO, fmt.Errorf("%d files do not match Telegram, run with --requeue to download them again", len(problems)))
+	}
+
+	queue := make(chan telegram.File, len(broken))
+	for _, file := range broken {
+		queue <- file
+	}
+	close(queue)
+
+	source := downloadSource{
+		files: queue,
+		paths: func(file telegram.File) []string { return paths[file.Identity()] },
+	}
+
+	return apperr.Wrap(
+		"cmd.verify.requeue",
+		r.downloadSources(ctx, writer, []downloadSource{source}, downloadOptions{rewrite: true, verify: true, ps: status}),
+	)
+}
@@ -0,0 +1,179 @@
+package downloader
+
+import (
+	"context"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// bandwidthChunk bounds how many bytes a single wait reserves, so that a
+// changed limit applies to the next chunk instead of after a long write.
+const bandwidthChunk = 32 << 10
+
+// BandwidthWindow applies Limit from From until To, both measured from local
+// midnight. A window that ends before it starts wraps around midnight.
+type BandwidthWindow struct {
+	From  time.Duration
+	To    time.Duration
+	Limit int64
+}
+
+func (w BandwidthWindow) contains(now time.Time) bool {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	offset := now.Sub(midnight)
+
+	if w.From <= w.To {
+		return offset >= w.From && offset < w.To
+	}
+
+	return offset >= w.From || offset < w.To
+}
+
+// BandwidthLimiter caps the rate, in bytes per second, at which all downloads
+// sharing it receive data. A limit of zero or less is unlimited.
+type BandwidthLimiter struct {
+	mu         sync.Mutex
+	limiter    *rate.Limiter
+	current    int64
+	limit      int64
+	schedule   []BandwidthWindow
+	override   int64
+	overridden bool
+	now        func() time.Time
+}
+
+// NewBandwidthLimiter returns a limiter that allows limit bytes per second
+// outside of the windows of schedule. The first window containing the
+// current time takes precedence.
+func NewBandwidthLimiter(limit int64, schedule ...BandwidthWindow) *BandwidthLimiter {
+	return &BandwidthLimiter{
+		limiter:  rate.NewLimiter(rate.Inf, bandwidthChunk),
+		limit:    limit,
+		schedule: schedule,
+		now:      time.Now,
+	}
+}
+
+// Limit returns the limit in effect right now.
+func (b *BandwidthLimiter) Limit() int64 {
+	if b == nil {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.limitLocked(b.now())
+}
+
+func (b *BandwidthLimiter) limitLocked(now time.Time) int64 {
+	if b.overridden {
+		return b.override
+	}
+
+	for _, window := range b.schedule {
+		if window.contains(now) {
+			return window.Limit
+		}
+	}
+
+	return b.limit
+}
+
+// Overridden reports whether the configured limit and schedule are replaced
+// by one set with Set.
+func (b *BandwidthLimiter) Overridden() bool {
+	if b == nil {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.overridden
+}
+
+// Set replaces the configured limit and schedule with limit until Reset is
+// called. Downloads in progress pick it up with their next chunk.
+func (b *BandwidthLimiter) Set(limit int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.override = max(limit, 0)
+	b.overridden = true
+}
+
+// Reset goes back to the configured limit and schedule.
+func (b *BandwidthLimiter) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.overridden = false
+}
+
+// WaitN blocks until n more bytes may be received or ctx is done. A nil
+// limiter never blocks.
+func (b *BandwidthLimiter) WaitN(ctx context.Context, n int) error {
+	if b == nil {
+		return nil
+	}
+
+	for n > 0 {
+		chunk := min(n, bandwidthChunk)
+		if err := b.sync().WaitN(ctx, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+
+	return nil
+}
+
+// sync applies the limit in effect right now to the underlying limiter.
+func (b *BandwidthLimiter) sync() *rate.Limiter {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	limit := b.limitLocked(now)
+	if limit == b.current {
+		return b.limiter
+	}
+	b.current = limit
+
+	if limit <= 0 {
+		b.limiter.SetLimitAt(now, rate.Inf)
+		return b.limiter
+	}
+
+	// The burst is a tenth of a second of data, but at least one chunk so
+	// that every wait can be satisfied.
+	burst := int(min(max(limit/10, bandwidthChunk), math.MaxInt32))
+	b.limiter.SetLimitAt(now, rate.Limit(limit))
+	b.limiter.SetBurstAt(now, burst)
+	return b.limiter
+}
+
+// Writer returns a writer that waits for the limiter before every write to
+// w. A nil limiter returns w.
+func (b *BandwidthLimiter) Writer(ctx context.Context, w io.Writer) io.Writer {
+	if b == nil {
+		return w
+	}
+
+	return writerFunc(func(p []byte) (int, error) {
+		if err := b.WaitN(ctx, len(p)); err != nil {
+			return 0, err
+		}
+
+		return w.Write(p)
+	})
+}
+
+// WithBandwidthLimiter makes every download wait for limiter before writing
+// what it received.
+func WithBandwidthLimiter(limiter *BandwidthLimiter) Option {
+	return func(s *settings) {
+		s.bandwidth = limiter
+	}
+}
@@ -0,0 +1,80 @@
+package downloader
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBandwidthLimiterFollowsSchedule(t *testing.T) {
+	limiter := NewBandwidthLimiter(5<<20,
+		BandwidthWindow{From: 9 * time.Hour, To: 18 * time.Hour, Limit: 1 << 20},
+		BandwidthWindow{From: 22 * time.Hour, To: 7 * time.Hour, Limit: 0},
+	)
+
+	tests := map[int]int64{
+		10: 1 << 20,
+		19: 5 << 20,
+		23: 0,
+		3:  0,
+		8:  5 << 20,
+	}
+	for hour, want := range tests {
+		limiter.now = func() time.Time { return time.Date(2024, 5, 1, hour, 30, 0, 0, time.Local) }
+		if got := limiter.Limit(); got != want {
+			t.Fatalf("limit at %02d:30 = %d, want %d", hour, got, want)
+		}
+	}
+}
+
+func TestBandwidthLimiterOverrideAndReset(t *testing.T) {
+	limiter := NewBandwidthLimiter(5<<20, BandwidthWindow{From: 0, To: 24 * time.Hour, Limit: 1 << 20})
+
+	limiter.Set(2 << 20)
+	if got := limiter.Limit(); got != 2<<20 || !limiter.Overridden() {
+		t.Fatalf("limit = %d overridden = %v, want 2MiB overridden", got, limiter.Overridden())
+	}
+
+	limiter.Reset()
+	if got := limiter.Limit(); got != 1<<20 || limiter.Overridden() {
+		t.Fatalf("limit = %d overridden = %v, want the scheduled 1MiB", got, limiter.Overridden())
+	}
+}
+
+func TestBandwidthLimiterThrottlesWrites(t *testing.T) {
+	limiter := NewBandwidthLimiter(bandwidthChunk * 10)
+	ctx := context.Background()
+
+	// The first burst is free, the rest arrives at the limit.
+	start := time.Now()
+	if err := limiter.WaitN(ctx, bandwidthChunk*3); err != nil {
+		t.Fatalf("WaitN() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatalf("WaitN() took %v, want at least 150ms", elapsed)
+	}
+
+	limiter.Set(0)
+	start = time.Now()
+	if err := limiter.WaitN(ctx, bandwidthChunk*100); err != nil {
+		t.Fatalf("WaitN() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Fatalf("unlimited WaitN() took %v", elapsed)
+	}
+}
+
+func TestBandwidthLimiterWaitStopsWithContext(t *testing.T) {
+	limiter := NewBandwidthLimiter(1 << 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := limiter.WaitN(ctx, 1<<20); err == nil {
+		t.Fatal("WaitN() succeeded with a cancelled context")
+	}
+
+	var nilLimiter *BandwidthLimiter
+	if err := nilLimiter.WaitN(ctx, 1<<20); err != nil {
+		t.Fatalf("nil limiter WaitN() error = %v", err)
+	}
+}
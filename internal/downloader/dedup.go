@@ -0,0 +1,345 @@
+package downloader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+
+	"github.com/go-logr/logr"
+	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
+	"github.com/spf13/afero"
+)
+
+const (
+	dedupIndexName    = ".tgdownloader-dedup.json"
+	dedupIndexVersion = 1
+)
+
+// DedupMode says how a file whose content was downloaded before is saved
+// again.
+type DedupMode string
+
+const (
+	// DedupOff downloads every copy.
+	DedupOff DedupMode = ""
+	// DedupHardlink hardlinks the earlier copy. Local file systems only.
+	DedupHardlink DedupMode = "hardlink"
+	// DedupSymlink symlinks the earlier copy with a relative link.
+	DedupSymlink DedupMode = "symlink"
+	// DedupReflink clones the earlier copy on file systems with copy-on-write
+	// support, like Btrfs or XFS.
+	DedupReflink DedupMode = "reflink"
+	// DedupPointer writes nothing and points the file manifest at the earlier
+	// copy. It works on every backend but only recognizes reposts of the same
+	// Telegram document, as the content is never read back.
+	DedupPointer DedupMode = "pointer"
+)
+
+// ParseDedupMode parses the downloader.dedup setting. An empty value and
+// "off" disable deduplication.
+func ParseDedupMode(value string) (DedupMode, error) {
+	switch mode := DedupMode(strings.ToLower(strings.TrimSpace(value))); mode {
+	case DedupOff, "off":
+		return DedupOff, nil
+	case DedupHardlink, DedupSymlink, DedupReflink, DedupPointer:
+		return mode, nil
+	default:
+		return DedupOff, apperr.New("downloader.dedup.mode", apperr.KindConfig, fmt.Errorf("invalid dedup mode %q, use off, hardlink, symlink, reflink or pointer", value))
+	}
+}
+
+// WithDedup saves files that were downloaded before, from this or another
+// peer, as links to the earlier copy instead of downloading them again.
+func WithDedup(mode DedupMode) Option {
+	return func(s *settings) {
+		s.dedup = mode
+	}
+}
+
+// dedupEntry is a downloaded copy, relative to the output directory.
+type dedupEntry struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	Hash string `json:"hash,omitempty"`
+}
+
+// dedupIndex is the content-addressed store of the output directory.
+type dedupIndex struct {
+	Version int `json:"version"`
+	// Files maps a file identity to its first downloaded copy.
+	Files map[string]dedupEntry `json:"files"`
+	// Contents maps the SHA-256 of a file to the first copy with that content.
+	Contents map[string]dedupEntry `json:"contents"`
+}
+
+func newDedupIndex() dedupIndex {
+	return dedupIndex{
+		Version:  dedupIndexVersion,
+		Files:    make(map[string]dedupEntry),
+		Contents: make(map[string]dedupEntry),
+	}
+}
+
+func loadDedupIndex(fs afero.Fs, filename string) (dedupIndex, error) {
+	index := newDedupIndex()
+	data, err := afero.ReadFile(fs, filename)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return index, nil
+		}
+		return index, apperr.New("downloader.dedup.load", apperr.KindIO, fmt.Errorf("read dedup index: %w", err))
+	}
+
+	if err := json.Unmarshal(data, &index); err != nil {
+		return newDedupIndex(), apperr.New("downloader.dedup.load", apperr.KindIO, fmt.Errorf("decode dedup index: %w", err))
+	}
+	if index.Version != dedupIndexVersion {
+		return newDedupIndex(), apperr.New("downloader.dedup.load", apperr.KindConfig, fmt.Errorf("unsupported dedup index version %d", index.Version))
+	}
+	if index.Files == nil {
+		index.Files = make(map[string]dedupEntry)
+	}
+	if index.Contents == nil {
+		index.Contents = make(map[string]dedupEntry)
+	}
+
+	return index, nil
+}
+
+func saveDedupIndex(fs afero.Fs, filename string, index dedupIndex) error {
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return apperr.New("downloader.dedup.save", apperr.KindInternal, fmt.Errorf("encode dedup index: %w", err))
+	}
+	data = append(data, '\n')
+
+	if err := writeFileAtomically(fs, filename, data); err != nil {
+		return apperr.New("downloader.dedup.save", apperr.KindIO, err)
+	}
+
+	return nil
+}
+
+// dedupKnownFile saves the outputs of a file that was downloaded before as
+// copies of it. It reports false when the file has to be downloaded.
+func (p *Downloader) dedupKnownFile(file File, log logr.Logger) bool {
+	if p.dedup == DedupOff || p.dryRun {
+		return false
+	}
+
+	p.manifestMu.Lock()
+	entry, ok := p.dedupIndex.Files[file.Identity()]
+	p.manifestMu.Unlock()
+
+	if !ok || !p.dedupEntryExists(entry) {
+		return false
+	}
+
+	targets, err := p.dedupTargets(file)
+	if err != nil || len(targets) == 0 {
+		return false
+	}
+
+	for _, i := range targets {
+		if err := p.saveCopy(entry, file, i); err != nil {
+			log.Error(err, "failed to deduplicate file, downloading it", "filename", file.Name(), "copy", entry.Path)
+			return false
+		}
+	}
+
+	atomic.AddInt64(&p.deduplicated, 1)
+	atomic.AddInt64(&p.savedBytes, entry.Size*int64(len(targets)))
+	p.manifestDone(file, entry.Hash)
+	log.Info("deduplicated file", "filename", file.Name(), "copy", entry.Path, "mode", p.dedup)
+	return true
+}
+
+// dedupTargets returns the indexes of the output paths that need to be
+// written.
+func (p *Downloader) dedupTargets(file File) ([]int, error) {
+	var targets []int
+	for i, outputPath := range file.outputPaths {
+		exists, err := afero.Exists(p.fs, outputPath)
+		if err != nil {
+			return nil, err
+		}
+
+		if !exists || p.rewrite {
+			targets = append(targets, i)
+		}
+	}
+
+	return targets, nil
+}
+
+// dedupDownloadedFile records a finished download with the SHA-256 hash of
+// its content in the dedup index. A file whose content was already downloaded
+// under another identity is replaced with a copy of the earlier download.
+func (p *Downloader) dedupDownloadedFile(file File, hash string, log logr.Logger) {
+	if p.dedup == DedupOff || p.dryRun || len(file.outputPaths) == 0 {
+		return
+	}
+
+	entry := dedupEntry{Path: p.relativeOutputPath(file.outputPaths[0]), Size: file.Size()}
+	if p.dedup != DedupPointer && hash != "" {
+		entry.Hash = hash
+
+		p.manifestMu.Lock()
+		existing, ok := p.dedupIndex.Contents[hash]
+		p.manifestMu.Unlock()
+
+		if ok && existing.Path != entry.Path && p.dedupEntryExists(existing) && p.replaceWithCopies(existing, file, log) {
+			entry = existing
+		}
+	}
+
+	p.manifestMu.Lock()
+	defer p.manifestMu.Unlock()
+
+	p.dedupIndex.Files[file.Identity()] = entry
+	if _, ok := p.dedupIndex.Contents[entry.Hash]; entry.Hash != "" && !ok {
+		p.dedupIndex.Contents[entry.Hash] = entry
+	}
+	p.dedupDirty = true
+}
+
+func (p *Downloader) replaceWithCopies(entry dedupEntry, file File, log logr.Logger) bool {
+	for i := range file.outputPaths {
+		if err := p.saveCopy(entry, file, i); err != nil {
+			log.Error(err, "failed to replace file with a copy", "filename", file.Name(), "copy", entry.Path)
+			return false
+		}
+	}
+
+	atomic.AddInt64(&p.deduplicated, 1)
+	atomic.AddInt64(&p.savedBytes, entry.Size*int64(len(file.outputPaths)))
+	log.Info("replaced file with a copy of the same content", "filename", file.Name(), "copy", entry.Path, "mode", p.dedup)
+	return true
+}
+
+// saveCopy saves output path i of file as a copy of entry. Links are made
+// under the part name and renamed into place, like downloads.
+func (p *Downloader) saveCopy(entry dedupEntry, file File, i int) error {
+	source := path.Join(p.outputDir, entry.Path)
+	target := file.outputPaths[i]
+	if source == target {
+		return nil
+	}
+
+	if p.dedup == DedupPointer {
+		p.manifestMu.Lock()
+		defer p.manifestMu.Unlock()
+
+		p.manifest.assign(file.logicalPaths[i], file.Identity(), entry.Path)
+		p.manifestDirty = true
+		return nil
+	}
+
+	part := partPath(target)
+	if err := p.fs.Remove(part); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if err := p.link(source, part); err != nil {
+		return apperr.New("downloader.dedup.link", apperr.KindIO, fmt.Errorf("%s %q to %q: %w", p.dedup, source, target, err))
+	}
+
+	saver := &aferoSaver{fs: p.fs, closed: true}
+	if err := saver.rename(part, target); err != nil {
+		_ = p.fs.Remove(part)
+		return apperr.New("downloader.dedup.rename", apperr.KindIO, err)
+	}
+
+	return nil
+}
+
+func (p *Downloader) link(source, target string) error {
+	if p.dedup == DedupSymlink {
+		linker, ok := p.fs.(afero.Linker)
+		if !ok {
+			return errors.ErrUnsupported
+		}
+
+		relative, err := relativeLink(path.Dir(target), source)
+		if err != nil {
+			return err
+		}
+
+		return linker.SymlinkIfPossible(relative, target)
+	}
+
+	if _, ok := p.fs.(*afero.OsFs); !ok {
+		return errors.ErrUnsupported
+	}
+
+	if p.dedup == DedupReflink {
+		return reflink(source, target)
+	}
+
+	return os.Link(source, target)
+}
+
+// relativeLink returns the path of target as seen from dir, so symlinks keep
+// working when the output directory moves.
+func relativeLink(dir, target string) (string, error) {
+	dirParts := strings.Split(path.Clean(dir), "/")
+	targetParts := strings.Split(path.Clean(target), "/")
+	if path.IsAbs(dir) != path.IsAbs(target) {
+		return "", fmt.Errorf("cannot link %q from %q", target, dir)
+	}
+
+	common := 0
+	for common < len(dirParts) && common < len(targetParts) && dirParts[common] == targetParts[common] {
+		common++
+	}
+
+	parts := make([]string, 0, len(dirParts)-common+len(targetParts)-common)
+	for range dirParts[common:] {
+		parts = append(parts, "..")
+	}
+	parts = append(parts, targetParts[common:]...)
+
+	return path.Join(parts...), nil
+}
+
+func (p *Downloader) dedupEntryExists(entry dedupEntry) bool {
+	cleaned, ok := cleanManifestPath(entry.Path)
+	if !ok {
+		return false
+	}
+
+	info, err := p.fs.Stat(path.Join(p.outputDir, cleaned))
+	return err == nil && !info.IsDir() && (entry.Size <= 0 || info.Size() == entry.Size)
+}
+
+// isLocalFs reports whether files of fs are read back without a transfer.
+func isLocalFs(fs afero.Fs) bool {
+	switch fs.(type) {
+	case *afero.OsFs, *afero.MemMapFs:
+		return true
+	default:
+		return false
+	}
+}
+
+func hashFile(fs afero.Fs, filename string) (string, error) {
+	f, err := fs.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	sum := sha256.New()
+	if _, err := io.Copy(sum, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
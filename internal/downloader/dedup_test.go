@@ -0,0 +1,127 @@
+package downloader
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+func TestParseDedupMode(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]DedupMode{
+		"":          DedupOff,
+		"off":       DedupOff,
+		" Hardlink": DedupHardlink,
+		"symlink":   DedupSymlink,
+		"reflink":   DedupReflink,
+		"pointer":   DedupPointer,
+	}
+	for value, want := range tests {
+		got, err := ParseDedupMode(value)
+		if err != nil || got != want {
+			t.Errorf("ParseDedupMode(%q) = %q, %v, want %q", value, got, err, want)
+		}
+	}
+
+	if _, err := ParseDedupMode("copy"); err == nil {
+		t.Error("ParseDedupMode(copy) succeeded")
+	}
+}
+
+func TestDownloaderPointsRepostsAtEarlierCopy(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	fs := afero.NewMemMapFs()
+	svc := &fakeFileService{}
+	d := New(fs, svc, WithNumWorkers(1), WithRetry(1, time.Millisecond), WithDedup(DedupPointer))
+	d.SetOutputDir("/downloads")
+
+	q := make(chan File)
+	d.Start(ctx)
+	d.AddDownloadQueue(ctx, q)
+	q <- NewFile(makeTelegramDocument("meme.jpg", 101), WithSubdirs("first"))
+	q <- NewFile(makeTelegramDocument("meme.jpg", 101), WithSubdirs("second"))
+	close(q)
+
+	if err := d.Stop(ctx); err != nil {
+		t.Fatalf("Stop() unexpected error: %v", err)
+	}
+
+	if calls := svc.Calls(); calls != 1 {
+		t.Fatalf("Download() calls = %d, want 1", calls)
+	}
+	if exists, _ := afero.Exists(fs, "/downloads/second/meme.jpg"); exists {
+		t.Fatal("repost was written despite pointer deduplication")
+	}
+
+	stats := d.Stats()
+	if stats.Downloaded != 1 || stats.Deduplicated != 1 || stats.SavedBytes != 2 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	reloaded := New(fs, svc, WithDedup(DedupPointer))
+	reloaded.SetOutputDir("/downloads")
+	if actualPath, ok := reloaded.manifest.lookup("second/meme.jpg", "101"); !ok || actualPath != "first/meme.jpg" {
+		t.Fatalf("manifest entry = %q, %v, want first/meme.jpg", actualPath, ok)
+	}
+	if entry, ok := reloaded.dedupIndex.Files["101"]; !ok || entry.Path != "first/meme.jpg" {
+		t.Fatalf("dedup index entry = %+v, %v", entry, ok)
+	}
+}
+
+func TestDownloaderHardlinksFilesWithSameContent(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	fs := afero.NewOsFs()
+	svc := &fakeFileService{content: []byte("same bytes")}
+	d := New(fs, svc, WithNumWorkers(1), WithRetry(1, time.Millisecond), WithDedup(DedupHardlink))
+	d.SetOutputDir(dir)
+
+	first := makeTelegramDocument("video.mp4", 101)
+	repost := makeTelegramDocument("video.mp4", 202)
+	setUnexportedField(&first, "size", int64(len(svc.content)))
+	setUnexportedField(&repost, "size", int64(len(svc.content)))
+
+	q := make(chan File)
+	d.Start(ctx)
+	d.AddDownloadQueue(ctx, q)
+	q <- NewFile(first, WithSubdirs("first"))
+	q <- NewFile(repost, WithSubdirs("second"))
+	q <- NewFile(first, WithSubdirs("third"))
+	close(q)
+
+	if err := d.Stop(ctx); err != nil {
+		t.Fatalf("Stop() unexpected error: %v", err)
+	}
+
+	if calls := svc.Calls(); calls != 2 {
+		t.Fatalf("Download() calls = %d, want 2", calls)
+	}
+
+	original, err := os.Stat(filepath.Join(dir, "first", "video.mp4"))
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	for _, name := range []string{"second", "third"} {
+		info, err := os.Stat(filepath.Join(dir, name, "video.mp4"))
+		if err != nil {
+			t.Fatalf("Stat(%s) error = %v", name, err)
+		}
+		if !os.SameFile(original, info) {
+			t.Errorf("%s/video.mp4 is not a hardlink of the first copy", name)
+		}
+	}
+
+	stats := d.Stats()
+	if stats.Downloaded != 2 || stats.Deduplicated != 2 || stats.SavedBytes != 2*int64(len(svc.content)) {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
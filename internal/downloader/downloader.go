@@ -2,6 +2,8 @@ package downloader
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -21,13 +23,24 @@ import (
 )
 
 type settings struct {
-	numWorkers int
-	tracker    Tracker
-	rewrite    bool
-	dryRun     bool
-	retryCount int
-	retryDelay time.Duration
-	onComplete func(Stats)
+	numWorkers   int
+	tracker      Tracker
+	rewrite      bool
+	dryRun       bool
+	retry        RetryPolicy
+	threads      int
+	verify       bool
+	dedup        DedupMode
+	minSize      int64
+	maxSize      int64
+	maxTotal     int64
+	bandwidth    *BandwidthLimiter
+	freeSpace    FreeSpaceFunc
+	spaceReserve int64
+	queueOrder   QueueOrder
+	queueBuffer  int
+	onComplete   func(Stats)
+	onFileDone   func(File, error)
 }
 
 func (s *settings) setDefaults() {
@@ -35,8 +48,9 @@ func (s *settings) setDefaults() {
 	s.tracker = NewNullTracker()
 	s.rewrite = false
 	s.dryRun = false
-	s.retryCount = 3
-	s.retryDelay = 400 * time.Millisecond
+	s.retry = DefaultRetryPolicy()
+	s.queueOrder = OrderFIFO
+	s.queueBuffer = defaultQueueBuffer
 }
 
 type Option func(*settings)
@@ -65,15 +79,51 @@ func WithTracker(tracker Tracker) Option {
 	}
 }
 
+// WithRetry sets the number of attempts and the delay before the first retry
+// of the retry policy. Non-positive values keep the current ones.
 func WithRetry(count int, delay time.Duration) Option {
 	return func(s *settings) {
 		if count > 0 {
-			s.retryCount = count
+			s.retry.MaxAttempts = count
 		}
 
 		if delay > 0 {
-			s.retryDelay = delay
+			s.retry.Initial = delay
 		}
+		s.retry = s.retry.normalize()
+	}
+}
+
+// WithThreads downloads every file with up to threads parallel part requests
+// when the output supports random access. One or less streams files.
+func WithThreads(threads int) Option {
+	return func(s *settings) {
+		s.threads = threads
+	}
+}
+
+// WithVerify checks every finished download against the hashes Telegram
+// keeps for it before it is moved into place.
+func WithVerify(verify bool) Option {
+	return func(s *settings) {
+		s.verify = verify
+	}
+}
+
+// WithSizeLimits excludes files smaller than minSize or larger than maxSize.
+// A non-positive bound is not enforced.
+func WithSizeLimits(minSize, maxSize int64) Option {
+	return func(s *settings) {
+		s.minSize = minSize
+		s.maxSize = maxSize
+	}
+}
+
+// WithMaxTotalSize stops queuing new files once the sizes of the queued files,
+// including the ones already present on disk, reach maxTotal bytes.
+func WithMaxTotalSize(maxTotal int64) Option {
+	return func(s *settings) {
+		s.maxTotal = maxTotal
 	}
 }
 
@@ -83,6 +133,29 @@ func WithOnComplete(fn func(Stats)) Option {
 	}
 }
 
+// WithOnFileDone registers a callback that is called once for every file taken
+// from the queue: with nil after it was downloaded, skipped or excluded by
+// size, and with the failure otherwise. Callbacks are called in the order they
+// were registered.
+func WithOnFileDone(fn func(File, error)) Option {
+	return func(s *settings) {
+		previous := s.onFileDone
+		if previous == nil {
+			s.onFileDone = fn
+			return
+		}
+
+		s.onFileDone = func(file File, err error) {
+			previous(file, err)
+			fn(file, err)
+		}
+	}
+}
+
+// ErrBudgetExhausted is reported for a file that was not queued because it did
+// not fit into the total size budget.
+var ErrBudgetExhausted = errors.New("download size budget exhausted")
+
 // Pool is a pool of workers that download files
 type Downloader struct {
 	fs      afero.Fs
@@ -93,29 +166,69 @@ type Downloader struct {
 	tracker       Tracker
 	rewrite       bool
 	dryRun        bool
-	retryCount    int
-	retryDelay    time.Duration
+	retry         RetryPolicy
+	threads       int
+	verify        bool
+	dedup         DedupMode
+	manifestMu    sync.Mutex
 	pathClaims    map[string]string
 	manifest      fileManifest
 	manifestDirty bool
+	dedupIndex    dedupIndex
+	dedupDirty    bool
+	minSize       int64
+	maxSize       int64
+	maxTotal      int64
+	bandwidth     *BandwidthLimiter
+	freeSpace     FreeSpaceFunc
+	spaceReserve  int64
 	onComplete    func(Stats)
+	onFileDone    func(File, error)
 
-	files   chan File
+	budgetMu        sync.Mutex
+	budgetUsed      int64
+	budgetExhausted chan struct{}
+	budgetOnce      sync.Once
+
+	spaceMu      sync.Mutex
+	writing      int64
+	outOfSpace   chan struct{}
+	spaceOnce    sync.Once
+	needed       int64
+	measuredFree int64
+
+	queue   *scheduler
 	queueWG sync.WaitGroup
 	workerG *errgroup.Group
 
 	errMu       sync.Mutex
 	downloadErr error
 
-	downloaded int64
-	skipped    int64
-	failed     int64
+	downloaded     int64
+	skipped        int64
+	failed         int64
+	excludedBySize int64
+	deduplicated   int64
+	savedBytes     int64
 }
 
 type Stats struct {
-	Downloaded int64
-	Skipped    int64
-	Failed     int64
+	Downloaded     int64
+	Skipped        int64
+	Failed         int64
+	ExcludedBySize int64
+	BudgetUsed     int64
+	Budget         int64
+	// Deduplicated files were saved as copies of an earlier download, which
+	// spared SavedBytes of disk space.
+	Deduplicated int64
+	SavedBytes   int64
+	// Needed is what a dry run would download, against FreeSpace on the
+	// output filesystem, which is negative when it is unknown. Shortfall is
+	// what is missing, the reserve included.
+	Needed    int64
+	FreeSpace int64
+	Shortfall int64
 }
 
 // NewDownloader creates a new pool of workers.
@@ -132,14 +245,29 @@ func New(fs afero.Fs, service telegram.FileService, opts ...Option) *Downloader
 		tracker:    s.tracker,
 		rewrite:    s.rewrite,
 		dryRun:     s.dryRun,
-		retryCount: s.retryCount,
-		retryDelay: s.retryDelay,
+		retry:      s.retry,
+		threads:    s.threads,
+		verify:     s.verify,
+		dedup:      s.dedup,
 		pathClaims: make(map[string]string),
 		manifest:   newFileManifest(),
+		dedupIndex: newDedupIndex(),
+		minSize:    s.minSize,
+		maxSize:    s.maxSize,
+		maxTotal:   s.maxTotal,
+		bandwidth:  s.bandwidth,
+		freeSpace:  s.freeSpace,
 		onComplete: s.onComplete,
+		onFileDone: s.onFileDone,
+
+		spaceReserve: s.spaceReserve,
+
+		budgetExhausted: make(chan struct{}),
+		outOfSpace:      make(chan struct{}),
+		measuredFree:    -1,
 
 		fs:      fs,
-		files:   make(chan File),
+		queue:   newScheduler(s.queueOrder, s.queueBuffer),
 		service: service,
 	}
 }
@@ -155,6 +283,7 @@ func (p *Downloader) SetOutputDir(dir string) {
 		return
 	}
 	p.manifest = manifest
+	p.manifestDirty = manifest.migrated
 	for _, identities := range manifest.Paths {
 		for identity, actualPath := range identities {
 			if actualPath, ok := cleanManifestPath(actualPath); ok {
@@ -162,6 +291,17 @@ func (p *Downloader) SetOutputDir(dir string) {
 			}
 		}
 	}
+
+	if p.dedup == DedupOff {
+		return
+	}
+
+	index, err := loadDedupIndex(p.fs, path.Join(dir, dedupIndexName))
+	if err != nil {
+		p.recordError(err)
+		return
+	}
+	p.dedupIndex = index
 }
 
 // Start starts the pool of workers.
@@ -169,6 +309,12 @@ func (d *Downloader) Start(ctx context.Context) {
 	log := logr.FromContextOrDiscard(ctx).WithName("downloader")
 	log.Info("Downloader started", "workers", d.numWorkers)
 
+	if err := d.checkFreeSpace(ctx); err != nil {
+		log.Error(err, "not starting downloads")
+		d.recordError(err)
+		d.stopOnSpace()
+	}
+
 	d.workerG, ctx = errgroup.WithContext(ctx)
 	for i := 0; i < d.numWorkers; i++ {
 		func(i int) {
@@ -189,49 +335,249 @@ type resumeFileService interface {
 	DownloadFromOffset(ctx context.Context, file telegram.File, out io.Writer, offset int64) (int64, error)
 }
 
+type parallelFileService interface {
+	DownloadParallel(ctx context.Context, file telegram.File, out io.WriterAt, threads int) error
+}
+
+// trackedWriterAt reports parts written out of order to a TrackedWriter.
+type trackedWriterAt struct {
+	ctx       context.Context
+	out       io.WriterAt
+	bandwidth *BandwidthLimiter
+	progress  *attemptProgress
+}
+
+func (w *trackedWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	if err := w.bandwidth.WaitN(w.ctx, len(p)); err != nil {
+		return 0, err
+	}
+
+	n, err := w.out.WriteAt(p, off)
+	if trackErr := w.progress.add(p[:n]); trackErr != nil && err == nil {
+		err = trackErr
+	}
+
+	return n, err
+}
+
+// attemptProgress reports the bytes of a download to a TrackedWriter once,
+// also when a retry downloads some of them again.
+type attemptProgress struct {
+	mu       sync.Mutex
+	tracked  TrackedWriter
+	attempt  int64 // bytes the current attempt got to
+	reported int64
+}
+
+func (a *attemptProgress) add(p []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.attempt += int64(len(p))
+	if a.attempt <= a.reported {
+		return nil
+	}
+
+	fresh := a.attempt - a.reported
+	a.reported = a.attempt
+	_, err := a.tracked.Write(p[int64(len(p))-fresh:])
+	return err
+}
+
+// restart starts the next attempt at offset.
+func (a *attemptProgress) restart(offset int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.attempt = offset
+}
+
+// prepareRetry readies the output of a streamed download for another attempt
+// and returns the offset it continues from. Resumable downloads keep the
+// bytes already written; the others, or outputs that can't be cut back to
+// them, start over.
+func prepareRetry(saver MultiSaver, written int64, resumable bool) (int64, error) {
+	files, ok := saver.(*aferoSaver)
+	if !ok {
+		return 0, nil
+	}
+
+	if resumable && written > 0 && files.rewind(written) == nil {
+		return written, nil
+	}
+
+	if files.rewind(0) == nil {
+		return 0, nil
+	}
+
+	return 0, files.recreate()
+}
+
 // worker is a worker that downloads files.
 func (d *Downloader) worker(ctx context.Context, log logr.Logger) error {
 	defer log.Info("worker stopped")
 	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-
-		case f, ok := <-d.files:
-			if !ok {
-				log.Info("no more jobs")
-				return nil
+		f, ok := d.queue.pop(ctx)
+		if !ok {
+			if err := ctx.Err(); err != nil {
+				return err
 			}
 
-			log.Info("found job", "file", f.String())
-			if err := d.downloadFile(ctx, f, log); err != nil {
-				atomic.AddInt64(&d.failed, 1)
-				d.recordError(err)
-			}
+			log.Info("no more jobs")
+			return nil
 		}
+
+		log.Info("found job", "file", f.String())
+		err := d.downloadFile(ctx, f, log)
+		if err != nil {
+			atomic.AddInt64(&d.failed, 1)
+			d.manifestFailed(f, err)
+			d.recordError(err)
+		}
+		d.fileDone(f, err)
+
+		if errors.Is(err, ErrInsufficientSpace) {
+			d.failWaiting(err)
+		}
+	}
+}
+
+// failWaiting fails the given files and the ones still waiting for a worker
+// with err, which was reported already.
+func (d *Downloader) failWaiting(err error, files ...File) {
+	for _, file := range append(files, d.queue.drain()...) {
+		atomic.AddInt64(&d.failed, 1)
+		d.manifestFailed(file, err)
+		d.fileDone(file, err)
 	}
 }
 
 func (d *Downloader) Stats() Stats {
-	return Stats{
-		Downloaded: atomic.LoadInt64(&d.downloaded),
-		Skipped:    atomic.LoadInt64(&d.skipped),
-		Failed:     atomic.LoadInt64(&d.failed),
+	d.budgetMu.Lock()
+	budgetUsed := d.budgetUsed
+	d.budgetMu.Unlock()
+
+	stats := Stats{
+		Downloaded:     atomic.LoadInt64(&d.downloaded),
+		Skipped:        atomic.LoadInt64(&d.skipped),
+		Failed:         atomic.LoadInt64(&d.failed),
+		ExcludedBySize: atomic.LoadInt64(&d.excludedBySize),
+		BudgetUsed:     budgetUsed,
+		Budget:         d.maxTotal,
+		Deduplicated:   atomic.LoadInt64(&d.deduplicated),
+		SavedBytes:     atomic.LoadInt64(&d.savedBytes),
+	}
+	d.spaceStats(&stats)
+
+	return stats
+}
+
+// BudgetExhausted returns a channel that is closed once the total size budget
+// has been used up and no more files will be queued.
+func (d *Downloader) BudgetExhausted() <-chan struct{} {
+	return d.budgetExhausted
+}
+
+func (d *Downloader) withinSizeLimits(file File) bool {
+	return inSizeRange(file.Size(), d.minSize, d.maxSize) && inSizeRange(file.Size(), file.minSize, file.maxSize)
+}
+
+func inSizeRange(size, minSize, maxSize int64) bool {
+	if minSize > 0 && size < minSize {
+		return false
+	}
+
+	if maxSize > 0 && size > maxSize {
+		return false
+	}
+
+	return true
+}
+
+// reserveBudget accounts the file against the total size budget. It returns
+// false when the file does not fit, which also exhausts the budget.
+func (d *Downloader) reserveBudget(file File) bool {
+	if d.maxTotal <= 0 {
+		return true
+	}
+
+	d.budgetMu.Lock()
+	defer d.budgetMu.Unlock()
+
+	select {
+	case <-d.budgetExhausted:
+		return false
+	default:
+	}
+
+	if d.budgetUsed+file.Size() > d.maxTotal {
+		d.exhaustBudget()
+		return false
+	}
+
+	d.budgetUsed += file.Size()
+	if d.budgetUsed >= d.maxTotal {
+		d.exhaustBudget()
+	}
+
+	return true
+}
+
+// refundBudget returns the size of a file that won't be downloaded to the
+// total size budget.
+func (d *Downloader) refundBudget(file File) {
+	if d.maxTotal <= 0 {
+		return
+	}
+
+	d.budgetMu.Lock()
+	defer d.budgetMu.Unlock()
+
+	d.budgetUsed -= file.Size()
+}
+
+// cancelQueued gives up files that were queued, but never taken by a worker,
+// because their producer stopped with err.
+func (d *Downloader) cancelQueued(err error, files ...File) {
+	for _, file := range files {
+		d.refundBudget(file)
+		d.manifestCanceled(file, err)
+		d.fileDone(file, err)
 	}
 }
 
+func (d *Downloader) exhaustBudget() {
+	d.budgetOnce.Do(func() {
+		close(d.budgetExhausted)
+	})
+}
+
 // Stop stops the pool of workers and waits for them to finish.
 func (p *Downloader) Stop(ctx context.Context) error {
 	p.queueWG.Wait()
+	p.queue.close()
+	if err := p.workerG.Wait(); err != nil {
+		p.recordError(err)
+		// Workers stop with their context, before taking every waiting file.
+		p.cancelQueued(err, p.queue.drain()...)
+	}
+
+	// Workers record deduplicated copies, so the indexes are saved after
+	// they are done.
 	if p.manifestDirty {
 		if err := saveFileManifest(p.fs, path.Join(p.outputDir, fileManifestName), p.manifest); err != nil {
 			p.recordError(err)
 		}
 	}
-
-	close(p.files)
-	if err := p.workerG.Wait(); err != nil {
-		p.recordError(err)
+	p.measureFreeSpace(ctx)
+	if p.dedupDirty {
+		if err := saveDedupIndex(p.fs, path.Join(p.outputDir, dedupIndexName), p.dedupIndex); err != nil {
+			p.recordError(err)
+		}
 	}
 	if p.onComplete != nil {
 		p.onComplete(p.Stats())
@@ -244,6 +590,12 @@ func (p *Downloader) Stop(ctx context.Context) error {
 	return p.downloadErr
 }
 
+func (d *Downloader) fileDone(file File, err error) {
+	if d.onFileDone != nil {
+		d.onFileDone(file, err)
+	}
+}
+
 func (d *Downloader) recordError(err error) {
 	if err == nil {
 		return
@@ -260,8 +612,16 @@ func (d *Downloader) recordError(err error) {
 	d.downloadErr = errors.Join(d.downloadErr, err)
 }
 
-// AddDownloadQueue adds a channel of files to the download queue.
-func (p *Downloader) AddDownloadQueue(ctx context.Context, files <-chan File) {
+// AddDownloadQueue adds a channel of files to the download queue. Files wait
+// for a worker in a buffer of their own, from which workers take them in the
+// configured order.
+func (p *Downloader) AddDownloadQueue(ctx context.Context, files <-chan File, opts ...QueueOption) {
+	var s queueSettings
+	for _, opt := range opts {
+		opt(&s)
+	}
+	queue := &fileQueue{priority: s.priority}
+
 	p.queueWG.Add(1)
 	go func() {
 		defer p.queueWG.Done()
@@ -269,6 +629,10 @@ func (p *Downloader) AddDownloadQueue(ctx context.Context, files <-chan File) {
 		for {
 			select {
 			case <-ctx.Done():
+				p.cancelQueued(ctx.Err(), p.queue.drop(queue)...)
+				return
+
+			case <-p.outOfSpace:
 				return
 
 			case file, ok := <-files:
@@ -276,10 +640,24 @@ func (p *Downloader) AddDownloadQueue(ctx context.Context, files <-chan File) {
 					return
 				}
 
+				if !p.withinSizeLimits(file) {
+					atomic.AddInt64(&p.excludedBySize, 1)
+					p.fileDone(file, nil)
+					continue
+				}
+
+				if !p.reserveBudget(file) {
+					p.fileDone(file, ErrBudgetExhausted)
+					return
+				}
+
 				reserved := p.reserveOutputPaths(file)
-				select {
-				case p.files <- reserved:
-				case <-ctx.Done():
+				if !p.queue.push(ctx, p.outOfSpace, queue, reserved) {
+					if err := ctx.Err(); err != nil {
+						p.cancelQueued(err, append(p.queue.drop(queue), reserved)...)
+					} else {
+						p.failWaiting(ErrInsufficientSpace, reserved)
+					}
 					return
 				}
 			}
@@ -288,17 +666,27 @@ func (p *Downloader) AddDownloadQueue(ctx context.Context, files <-chan File) {
 }
 
 func (p *Downloader) reserveOutputPaths(file File) File {
-	paths := make([]string, 0, len(file.subdirs)+1)
-	for _, subdir := range file.subdirs {
-		paths = append(paths, path.Join(p.outputDir, subdir, file.Name()))
+	p.manifestMu.Lock()
+	defer p.manifestMu.Unlock()
+
+	paths := make([]string, 0, len(file.subdirs)+len(file.relativePaths)+1)
+	for _, relativePath := range file.relativePaths {
+		paths = append(paths, path.Join(p.outputDir, relativePath))
+	}
+	if len(paths) == 0 {
+		for _, subdir := range file.subdirs {
+			paths = append(paths, path.Join(p.outputDir, subdir, file.Name()))
+		}
 	}
 	if len(paths) == 0 {
 		paths = append(paths, path.Join(p.outputDir, file.Name()))
 	}
 
 	identity := file.Identity()
+	logicalPaths := make([]string, len(paths))
 	for i, outputPath := range paths {
 		logicalPath := p.relativeOutputPath(outputPath)
+		logicalPaths[i] = logicalPath
 		if actualPath, ok := p.manifest.lookup(logicalPath, identity); ok {
 			if actualPath, valid := cleanManifestPath(actualPath); valid {
 				paths[i] = path.Join(p.outputDir, actualPath)
@@ -322,8 +710,12 @@ func (p *Downloader) reserveOutputPaths(file File) File {
 			p.manifestDirty = true
 		}
 	}
+	if !p.dryRun {
+		p.manifestQueued(file)
+	}
 
 	file.outputPaths = paths
+	file.logicalPaths = logicalPaths
 	return file
 }
 
@@ -375,13 +767,33 @@ func (p *Downloader) downloadFile(ctx context.Context, file File, log logr.Logge
 		}
 	}
 
+	if p.dedupKnownFile(file, log) {
+		return nil
+	}
+
 	if resumeSvc, ok := p.service.(resumeFileService); ok {
 		resumed, resumeErr := p.resumeExistingPartialFile(ctx, file, outputPaths, resumeSvc, log)
 		if resumed {
+			if resumeErr == nil {
+				p.completeFile(file, "", log)
+			}
 			return resumeErr
 		}
 	}
 
+	// Checked before the part files are created, so that a full disk leaves
+	// nothing behind.
+	needed, err := p.spaceNeeded(file, outputPaths)
+	if err != nil {
+		return apperr.New("downloader.prepare_output", apperr.KindIO, fmt.Errorf("prepare output file %q: %w", file.Name(), err))
+	}
+	releaseSpace, err := p.reserveSpace(ctx, file, needed)
+	if err != nil {
+		log.Error(err, "not enough space for file", "filename", file.Name())
+		return err
+	}
+	defer releaseSpace()
+
 	saver := NewAferoSaver(p.fs)
 	if p.dryRun {
 		saver = NewNullSaver()
@@ -397,25 +809,82 @@ func (p *Downloader) downloadFile(ctx context.Context, file File, log logr.Logge
 	if !saver.IsValid() {
 		log.Info("no valid files to write to")
 		atomic.AddInt64(&p.skipped, 1)
+		p.manifestDone(file, "")
 		return nil
 	}
 
 	displayName := path.Base(outputPaths[0])
-	writer := p.tracker.WrapWriter(saver, displayName, file.Size())
+	writer := p.tracker.WrapWriter(io.Discard, displayName, file.Size())
+	progress := &attemptProgress{tracked: writer}
+
+	// Streamed content is hashed as it is written. A retry continues from
+	// the bytes already written when it can and starts over otherwise, see
+	// prepareRetry.
+	sum := sha256.New()
+	var written int64
+	streamed := true
+	bandwidth := p.bandwidth
+	out := writerFunc(func(p []byte) (int, error) {
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
 
-	var err error
-	for attempt := 1; attempt <= p.retryCount; attempt++ {
-		err = p.service.Download(ctx, file.File, writerFunc(func(p []byte) (int, error) {
-			select {
-			case <-ctx.Done():
-				writer.Fail()
-				return 0, ctx.Err()
+		default:
+		}
+
+		if err := bandwidth.WaitN(ctx, len(p)); err != nil {
+			return 0, err
+		}
 
-			default:
+		n, err := saver.Write(p)
+		sum.Write(p[:n])
+		written += int64(n)
+		if trackErr := progress.add(p[:n]); trackErr != nil && err == nil {
+			err = trackErr
+		}
+		return n, err
+	})
+
+	resumeSvc, resumable := p.service.(resumeFileService)
+	download := func() error {
+		if written > 0 {
+			_, err := resumeSvc.DownloadFromOffset(ctx, file.File, out, written)
+			return err
+		}
+
+		return p.service.Download(ctx, file.File, out)
+	}
+
+	if parallelSvc, out, ok := p.parallelOutput(saver, file); ok {
+		log.Info("downloading in parallel", "filename", file.Name(), "threads", p.threads)
+
+		out := &trackedWriterAt{ctx: ctx, out: out, bandwidth: p.bandwidth, progress: progress}
+		streamed = false
+		download = func() error {
+			return parallelSvc.DownloadParallel(ctx, file.File, out, p.threads)
+		}
+	}
+
+	retry := p.retry.newBackOff()
+	for attempt := 1; attempt <= p.retry.MaxAttempts; attempt++ {
+		if attempt > 1 {
+			// Parallel downloads write every part again.
+			offset := int64(0)
+			if streamed {
+				if offset, err = prepareRetry(saver, written, resumable); err != nil {
+					err = apperr.New("downloader.retry", apperr.KindIO, fmt.Errorf("prepare output file %q for a retry: %w", file.Name(), err))
+					break
+				}
+				if offset == 0 {
+					sum.Reset()
+				}
+				written = offset
 			}
+			progress.restart(offset)
+		}
 
-			return writer.Write(p)
-		}))
+		p.manifestAttempt(file)
+		err = download()
 		if err == nil {
 			break
 		}
@@ -425,9 +894,20 @@ func (p *Downloader) downloadFile(ctx context.Context, file File, log logr.Logge
 			break
 		}
 
-		if attempt < p.retryCount {
-			log.Info("download retry scheduled", "filename", file.Name(), "attempt", attempt+1, "max_attempts", p.retryCount)
-			time.Sleep(p.retryDelay)
+		if attempt == p.retry.MaxAttempts {
+			break
+		}
+
+		delay, ok := p.retry.delay(retry, err)
+		if !ok {
+			log.Info("download error is not retried", "filename", file.Name(), "error", err.Error())
+			break
+		}
+
+		log.Info("download retry scheduled", "filename", file.Name(), "attempt", attempt+1, "max_attempts", p.retry.MaxAttempts, "delay", delay)
+		if sleepErr := sleepContext(ctx, delay); sleepErr != nil {
+			err = sleepErr
+			break
 		}
 	}
 
@@ -435,24 +915,135 @@ func (p *Downloader) downloadFile(ctx context.Context, file File, log logr.Logge
 		writer.Fail()
 
 		log.Error(err, "failed to download file", "filename", file.Name())
-		if removeErr := saver.Remove(); removeErr != nil {
+		if removeErr := removeParts(ctx, saver, err); removeErr != nil {
 			return apperr.New("downloader.download", apperr.KindIO, errors.Join(
 				fmt.Errorf("download file %q: %w", file.Name(), err),
 				apperr.New("downloader.cleanup_failed_file", apperr.KindIO, fmt.Errorf("cleanup failed file %q: %w", file.Name(), removeErr)),
 			))
 		}
 
-		return apperr.New("downloader.download", apperr.KindNetwork, fmt.Errorf("download file %q: %w", file.Name(), err))
+		return downloadError("downloader.download", fmt.Errorf("download file %q: %w", file.Name(), err))
+	}
+
+	if err := p.verifyDownload(ctx, file, saver); err != nil {
+		writer.Fail()
+
+		log.Error(err, "failed to verify file", "filename", file.Name())
+		if errors.Is(err, ErrCorruptFile) {
+			if removeErr := saver.Remove(); removeErr != nil {
+				return apperr.New("downloader.verify", apperr.KindIO, errors.Join(err, removeErr))
+			}
+		}
+
+		return err
+	}
+
+	if err := saver.Commit(file.Size()); err != nil {
+		writer.Fail()
+
+		log.Error(err, "failed to complete file", "filename", file.Name())
+		if !errors.Is(err, errIncompleteFile) {
+			return apperr.New("downloader.complete", apperr.KindIO, fmt.Errorf("complete file %q: %w", file.Name(), err))
+		}
+
+		if removeErr := saver.Remove(); removeErr != nil {
+			return apperr.New("downloader.complete", apperr.KindIO, errors.Join(
+				fmt.Errorf("complete file %q: %w", file.Name(), err),
+				apperr.New("downloader.cleanup_failed_file", apperr.KindIO, fmt.Errorf("cleanup failed file %q: %w", file.Name(), removeErr)),
+			))
+		}
+
+		return downloadError("downloader.complete", fmt.Errorf("complete file %q: %w", file.Name(), err))
 	}
 
-	saver.Close()
 	writer.Done()
 	atomic.AddInt64(&p.downloaded, 1)
 
 	log.Info("downloaded document", "filename", file.Name())
+	hash := ""
+	if streamed {
+		hash = hex.EncodeToString(sum.Sum(nil))
+	}
+	p.completeFile(file, hash, log)
 	return nil
 }
 
+// removeParts removes the part files of a failed download. A canceled
+// download keeps them, closed, for the next run to resume from, unless they
+// were preallocated and their size isn't what was downloaded.
+func removeParts(ctx context.Context, saver MultiSaver, err error) error {
+	canceled := ctx.Err() != nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || apperr.IsKind(err, apperr.KindCancel)
+	if canceled && !errors.Is(err, ErrCorruptFile) {
+		if files, ok := saver.(*aferoSaver); !ok || !files.preallocated {
+			return saver.Close()
+		}
+	}
+
+	return saver.Remove()
+}
+
+// downloadError keeps the kind of the error a download failed with, so
+// failed downloads can be told apart by cause. Errors without a kind are
+// network errors.
+func downloadError(op string, err error) error {
+	switch {
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		return apperr.New(op, apperr.KindCancel, err)
+	case apperr.KindOf(err) == apperr.KindUnknown:
+		return apperr.New(op, apperr.KindNetwork, err)
+	default:
+		return apperr.Wrap(op, err)
+	}
+}
+
+// completeFile records a finished download of file with the SHA-256 hash of
+// its content. An empty hash is read back from the first output when that is
+// cheap, or when dedup needs it: on remote storage it downloads the file
+// again.
+func (p *Downloader) completeFile(file File, hash string, log logr.Logger) {
+	if p.dryRun {
+		return
+	}
+
+	if hash == "" && len(file.outputPaths) > 0 && (p.dedup != DedupOff || isLocalFs(p.fs)) {
+		var err error
+		if hash, err = hashFile(p.fs, file.outputPaths[0]); err != nil {
+			log.Error(err, "failed to hash file", "filename", file.Name())
+		}
+	}
+
+	p.manifestDone(file, hash)
+	p.dedupDownloadedFile(file, hash, log)
+}
+
+// parallelOutput returns the service and output for a chunked download of
+// file, or false when the file has to be streamed.
+func (p *Downloader) parallelOutput(saver MultiSaver, file File) (parallelFileService, io.WriterAt, bool) {
+	if p.threads <= 1 || file.Size() <= 0 {
+		return nil, nil, false
+	}
+
+	service, ok := p.service.(parallelFileService)
+	if !ok {
+		return nil, nil, false
+	}
+
+	files, ok := saver.(*aferoSaver)
+	if !ok {
+		return nil, nil, false
+	}
+
+	out, ok := files.writerAt(file.Size())
+	if !ok {
+		return nil, nil, false
+	}
+
+	return service, out, true
+}
+
+// resumeExistingPartialFile continues the part files an interrupted run left
+// for the output paths that are not complete yet. It reports false when there
+// is nothing to resume and the file has to be downloaded from the start.
 func (p *Downloader) resumeExistingPartialFile(
 	ctx context.Context,
 	file File,
@@ -460,59 +1051,66 @@ func (p *Downloader) resumeExistingPartialFile(
 	service resumeFileService,
 	log logr.Logger,
 ) (bool, error) {
-	if p.dryRun || p.rewrite || len(outputPaths) != 1 {
+	if p.dryRun || p.rewrite || file.Size() <= 0 {
 		return false, nil
 	}
 
-	targetPath := outputPaths[0]
-	if file.Size() <= 0 {
-		return false, nil
-	}
+	var pending []string
+	for _, outputPath := range outputPaths {
+		exists, err := afero.Exists(p.fs, outputPath)
+		if err != nil {
+			return true, apperr.New("downloader.resume.stat", apperr.KindIO, fmt.Errorf("stat output file %q: %w", outputPath, err))
+		}
 
-	info, err := p.fs.Stat(targetPath)
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			return false, nil
+		if !exists {
+			pending = append(pending, outputPath)
 		}
+	}
 
-		return true, apperr.New("downloader.resume.stat", apperr.KindIO, fmt.Errorf("stat partial file %q: %w", targetPath, err))
+	offset, err := p.partialOffset(pending, file.Size())
+	if err != nil {
+		return true, err
 	}
 
-	currentOffset := info.Size()
-	if currentOffset <= 0 || currentOffset >= file.Size() {
+	if offset <= 0 {
 		return false, nil
 	}
 
-	log.Info("resuming partial telegram file", "filename", file.Name(), "path", targetPath, "offset", currentOffset, "size", file.Size())
+	releaseSpace, err := p.reserveSpace(ctx, file, (file.Size()-offset)*int64(len(pending)))
+	if err != nil {
+		log.Error(err, "not enough space to resume file", "filename", file.Name())
+		return true, err
+	}
+	defer releaseSpace()
+
+	targetPath := pending[0]
+	log.Info("resuming partial telegram file", "filename", file.Name(), "path", targetPath, "offset", offset, "size", file.Size())
 
-	for attempt := 1; attempt <= p.retryCount; attempt++ {
+	var resumeErr error
+	retry := p.retry.newBackOff()
+	for attempt := 1; attempt <= p.retry.MaxAttempts; attempt++ {
 		if err := ctx.Err(); err != nil {
 			return true, err
 		}
 
-		info, statErr := p.fs.Stat(targetPath)
-		if statErr != nil {
-			return true, apperr.New("downloader.resume.stat", apperr.KindIO, fmt.Errorf("stat partial file %q: %w", targetPath, statErr))
-		}
-
-		currentOffset = info.Size()
-		if currentOffset >= file.Size() {
-			atomic.AddInt64(&p.downloaded, 1)
-			log.Info("resume already complete", "filename", file.Name(), "path", targetPath)
-			return true, nil
+		if attempt > 1 {
+			if offset, err = p.partialOffset(pending, file.Size()); err != nil {
+				return true, err
+			}
 		}
+		p.manifestAttempt(file)
 
-		fileHandle, openErr := p.fs.OpenFile(targetPath, os.O_WRONLY|os.O_APPEND, 0644)
-		if openErr != nil {
-			return true, apperr.New("downloader.resume.open", apperr.KindIO, fmt.Errorf("open partial file %q: %w", targetPath, openErr))
+		saver := &aferoSaver{fs: p.fs}
+		if err := saver.resumeFiles(pending, offset); err != nil {
+			saver.Close()
+			return true, apperr.New("downloader.resume.open", apperr.KindIO, fmt.Errorf("open partial file %q: %w", partPath(targetPath), err))
 		}
 
-		remaining := file.Size() - currentOffset
-		displayName := path.Base(outputPaths[0])
-		writer := p.tracker.WrapWriter(fileHandle, displayName, remaining)
+		writer := p.tracker.WrapWriter(saver, path.Base(targetPath), file.Size()-offset)
 
-		resumeErr := func() error {
-			_, err := service.DownloadFromOffset(ctx, file.File, writerFunc(func(data []byte) (int, error) {
+		resumeErr = nil
+		if offset < file.Size() {
+			_, resumeErr = service.DownloadFromOffset(ctx, file.File, writerFunc(func(data []byte) (int, error) {
 				select {
 				case <-ctx.Done():
 					writer.Fail()
@@ -520,32 +1118,44 @@ func (p *Downloader) resumeExistingPartialFile(
 				default:
 				}
 
-				return writer.Write(data)
-			}), currentOffset)
-			return err
-		}()
+				if err := p.bandwidth.WaitN(ctx, len(data)); err != nil {
+					writer.Fail()
+					return 0, err
+				}
 
-		closeErr := fileHandle.Close()
-		if closeErr != nil {
-			writer.Fail()
-			return true, apperr.New("downloader.resume.close", apperr.KindIO, fmt.Errorf("close partial file %q: %w", targetPath, closeErr))
+				return writer.Write(data)
+			}), offset)
 		}
 
 		if resumeErr == nil {
-			writer.Done()
+			if err := p.verifyDownload(ctx, file, saver); err != nil {
+				writer.Fail()
+				if errors.Is(err, ErrCorruptFile) {
+					if removeErr := removeParts(ctx, saver, err); removeErr != nil {
+						return true, apperr.New("downloader.verify", apperr.KindIO, errors.Join(err, removeErr))
+					}
+				}
 
-			finalInfo, finalErr := p.fs.Stat(targetPath)
-			if finalErr != nil {
-				return true, apperr.New("downloader.resume.final_stat", apperr.KindIO, fmt.Errorf("stat resumed file %q: %w", targetPath, finalErr))
+				return true, err
 			}
 
-			if finalInfo.Size() < file.Size() {
-				resumeErr = apperr.New("downloader.resume.incomplete", apperr.KindNetwork, fmt.Errorf("resume incomplete: got %d of %d bytes", finalInfo.Size(), file.Size()))
-			} else {
+			resumeErr = saver.Commit(file.Size())
+			if resumeErr == nil {
+				writer.Done()
 				atomic.AddInt64(&p.downloaded, 1)
-				log.Info("resumed telegram file", "filename", file.Name(), "path", targetPath, "size", finalInfo.Size())
+				log.Info("resumed telegram file", "filename", file.Name(), "path", targetPath, "size", file.Size())
 				return true, nil
 			}
+
+			if !errors.Is(resumeErr, errIncompleteFile) {
+				writer.Fail()
+				return true, apperr.New("downloader.resume.complete", apperr.KindIO, fmt.Errorf("complete file %q: %w", file.Name(), resumeErr))
+			}
+		}
+
+		if closeErr := saver.Close(); closeErr != nil {
+			writer.Fail()
+			return true, apperr.New("downloader.resume.close", apperr.KindIO, fmt.Errorf("close partial file %q: %w", partPath(targetPath), closeErr))
 		}
 
 		writer.Fail()
@@ -554,16 +1164,68 @@ func (p *Downloader) resumeExistingPartialFile(
 			return true, ctx.Err()
 		}
 
-		if attempt < p.retryCount {
-			log.Info("resume retry scheduled", "filename", file.Name(), "attempt", attempt+1, "max_attempts", p.retryCount)
-			time.Sleep(p.retryDelay)
-			continue
+		if attempt == p.retry.MaxAttempts {
+			break
 		}
 
-		return true, apperr.New("downloader.resume", apperr.KindNetwork, fmt.Errorf("resume file %q from offset %d: %w", file.Name(), currentOffset, resumeErr))
+		delay, ok := p.retry.delay(retry, resumeErr)
+		if !ok {
+			log.Info("resume error is not retried", "filename", file.Name(), "error", resumeErr.Error())
+			break
+		}
+
+		log.Info("resume retry scheduled", "filename", file.Name(), "attempt", attempt+1, "max_attempts", p.retry.MaxAttempts, "delay", delay)
+		if err := sleepContext(ctx, delay); err != nil {
+			return true, err
+		}
+	}
+
+	return true, downloadError("downloader.resume", fmt.Errorf("resume file %q from offset %d: %w", file.Name(), offset, resumeErr))
+}
+
+// partialOffset returns the number of bytes every part file of outputPaths
+// already holds, capped at size. It is zero unless all of them have one.
+// Part files preallocated by an interrupted parallel download are removed:
+// their size isn't what was downloaded.
+func (p *Downloader) partialOffset(outputPaths []string, size int64) (int64, error) {
+	if len(outputPaths) == 0 {
+		return 0, nil
 	}
 
-	return true, apperr.New("downloader.resume", apperr.KindNetwork, fmt.Errorf("resume file %q exceeded retry limit", file.Name()))
+	offset := size
+	for _, outputPath := range outputPaths {
+		info, err := p.fs.Stat(partPath(outputPath))
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, apperr.New("downloader.resume.stat", apperr.KindIO, fmt.Errorf("stat partial file %q: %w", partPath(outputPath), err))
+		}
+
+		preallocated, err := afero.Exists(p.fs, preallocPath(outputPath))
+		if err != nil {
+			return 0, apperr.New("downloader.resume.stat", apperr.KindIO, fmt.Errorf("stat partial file marker %q: %w", preallocPath(outputPath), err))
+		}
+		if preallocated {
+			return 0, p.removePreallocated(outputPath)
+		}
+
+		offset = min(offset, info.Size())
+	}
+
+	return offset, nil
+}
+
+// removePreallocated removes the part file of outputPath and then its
+// marker, so the part file is never left without it.
+func (p *Downloader) removePreallocated(outputPath string) error {
+	for _, name := range []string{partPath(outputPath), preallocPath(outputPath)} {
+		if err := p.fs.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return apperr.New("downloader.resume.remove", apperr.KindIO, fmt.Errorf("remove preallocated partial file %q: %w", name, err))
+		}
+	}
+
+	return nil
 }
 
 // addFileToSaver adds a file to the saver if it does not exist or if it should be rewritten.
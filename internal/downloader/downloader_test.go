@@ -3,9 +3,18 @@ package downloader
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -14,7 +23,9 @@ import (
 	"github.com/gotd/td/telegram/peers"
 	"github.com/gotd/td/tg"
 	"github.com/johnnyipcom/tgdownloader/pkg/telegram"
+	"github.com/johnnyipcom/tgdownloader/pkg/webdav"
 	"github.com/spf13/afero"
+	xwebdav "golang.org/x/net/webdav"
 )
 
 type fakeFileService struct {
@@ -77,7 +88,7 @@ func (f *fakeFileService) Download(ctx context.Context, file telegram.File, out
 
 	payload := f.content
 	if len(payload) == 0 {
-		payload = []byte("ok")
+		payload = bytes.Repeat([]byte("o"), int(file.Size()))
 	}
 
 	n, writeErr := out.Write(payload)
@@ -306,7 +317,7 @@ func TestDownloaderResumesExistingPartialFile(t *testing.T) {
 	}
 
 	partial := payload[:5]
-	if err := afero.WriteFile(fs, "/downloads/resume.bin", partial, 0644); err != nil {
+	if err := afero.WriteFile(fs, "/downloads/resume.bin.part", partial, 0644); err != nil {
 		t.Fatalf("WriteFile() partial error = %v", err)
 	}
 
@@ -336,6 +347,10 @@ func TestDownloaderResumesExistingPartialFile(t *testing.T) {
 		t.Fatalf("expected 0 full Download() calls when resume path is used, got %d", calls)
 	}
 
+	if exists, _ := afero.Exists(fs, "/downloads/resume.bin.part"); exists {
+		t.Fatal("part file was left behind after resume")
+	}
+
 	stats := d.Stats()
 	if stats.Downloaded != 1 || stats.Skipped != 0 || stats.Failed != 0 {
 		t.Fatalf("unexpected stats after resume: %+v", stats)
@@ -383,6 +398,36 @@ func TestDownloaderUsesTelegramIDForDuplicateNames(t *testing.T) {
 	}
 }
 
+func TestDownloaderClaimsTemplatedOutputPaths(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	fs := afero.NewMemMapFs()
+	svc := &fakeFileService{}
+	d := New(fs, svc, WithNumWorkers(1), WithRetry(1, time.Millisecond))
+	d.SetOutputDir("/downloads")
+
+	q := make(chan File)
+	d.Start(ctx)
+	d.AddDownloadQueue(ctx, q)
+	q <- NewFile(makeTelegramDocument("a.mp4", 101), WithSubdirs("ignored"), WithOutputPaths("2025/03/video.mp4"))
+	q <- NewFile(makeTelegramDocument("b.mp4", 202), WithOutputPaths("2025/03/video.mp4"))
+	close(q)
+
+	if err := d.Stop(ctx); err != nil {
+		t.Fatalf("Stop() unexpected error: %v", err)
+	}
+
+	for _, filename := range []string{"2025/03/video.mp4", "2025/03/video_202.mp4"} {
+		if exists, _ := afero.Exists(fs, "/downloads/"+filename); !exists {
+			t.Errorf("expected %q to be downloaded", filename)
+		}
+	}
+	if exists, _ := afero.Exists(fs, "/downloads/ignored/a.mp4"); exists {
+		t.Error("subdirectories were used despite explicit output paths")
+	}
+}
+
 func TestDownloaderManifestKeepsNamesStableWhenOrderChanges(t *testing.T) {
 	t.Parallel()
 
@@ -506,3 +551,769 @@ func TestDownloaderCanceledBlockedFeederDoesNotBlockStop(t *testing.T) {
 		t.Fatal("Stop remained blocked after feeder context cancellation")
 	}
 }
+
+func TestDownloaderExcludesFilesOutsideSizeLimits(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	fs := afero.NewMemMapFs()
+	svc := &fakeFileService{}
+	d := New(fs, svc, WithNumWorkers(1), WithRetry(1, time.Millisecond), WithSizeLimits(10, 100))
+	d.SetOutputDir("/downloads")
+
+	small := makeTelegramDocument("small.bin", 1)
+	setUnexportedField(&small, "size", int64(5))
+	fits := makeTelegramDocument("fits.bin", 2)
+	setUnexportedField(&fits, "size", int64(50))
+	large := makeTelegramDocument("large.bin", 3)
+	setUnexportedField(&large, "size", int64(500))
+
+	q := make(chan File)
+	d.Start(ctx)
+	d.AddDownloadQueue(ctx, q)
+	q <- File{File: small}
+	q <- File{File: fits}
+	q <- File{File: large}
+	close(q)
+
+	if err := d.Stop(ctx); err != nil {
+		t.Fatalf("Stop() unexpected error: %v", err)
+	}
+
+	stats := d.Stats()
+	if stats.Downloaded != 1 || stats.ExcludedBySize != 2 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	if got := svc.Calls(); got != 1 {
+		t.Fatalf("download calls = %d, want 1", got)
+	}
+}
+
+func TestDownloaderAppliesPerFileSizeLimits(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	fs := afero.NewMemMapFs()
+	svc := &fakeFileService{}
+	d := New(fs, svc, WithNumWorkers(1), WithRetry(1, time.Millisecond), WithSizeLimits(0, 1000))
+	d.SetOutputDir("/downloads")
+
+	strict := makeTelegramDocument("strict.bin", 1)
+	setUnexportedField(&strict, "size", int64(50))
+	loose := makeTelegramDocument("loose.bin", 2)
+	setUnexportedField(&loose, "size", int64(50))
+
+	q := make(chan File, 2)
+	q <- NewFile(strict, WithFileSizeLimits(0, 10))
+	q <- NewFile(loose, WithFileSizeLimits(10, 100))
+	close(q)
+
+	d.Start(ctx)
+	d.AddDownloadQueue(ctx, q)
+	if err := d.Stop(ctx); err != nil {
+		t.Fatalf("Stop() unexpected error: %v", err)
+	}
+
+	stats := d.Stats()
+	if stats.Downloaded != 1 || stats.ExcludedBySize != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	if exists, _ := afero.Exists(fs, "/downloads/loose.bin"); !exists {
+		t.Fatal("file inside its own size limits was not downloaded")
+	}
+}
+
+func TestDownloaderStopsQueuingWhenBudgetIsExhausted(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	fs := afero.NewMemMapFs()
+	if err := afero.WriteFile(fs, "/downloads/existing.bin", []byte("0123456789"), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	svc := &fakeFileService{}
+	d := New(fs, svc, WithNumWorkers(1), WithRetry(1, time.Millisecond), WithMaxTotalSize(25))
+	d.SetOutputDir("/downloads")
+
+	existing := makeTelegramDocument("existing.bin", 1)
+	setUnexportedField(&existing, "size", int64(10))
+	fresh := makeTelegramDocument("fresh.bin", 2)
+	setUnexportedField(&fresh, "size", int64(10))
+	overflow := makeTelegramDocument("overflow.bin", 3)
+	setUnexportedField(&overflow, "size", int64(10))
+
+	q := make(chan File, 3)
+	q <- File{File: existing}
+	q <- File{File: fresh}
+	q <- File{File: overflow}
+	close(q)
+
+	d.Start(ctx)
+	d.AddDownloadQueue(ctx, q)
+	if err := d.Stop(ctx); err != nil {
+		t.Fatalf("Stop() unexpected error: %v", err)
+	}
+
+	select {
+	case <-d.BudgetExhausted():
+	default:
+		t.Fatal("budget was not reported as exhausted")
+	}
+
+	stats := d.Stats()
+	if stats.Downloaded != 1 || stats.Skipped != 1 || stats.BudgetUsed != 20 || stats.Budget != 25 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	if exists, _ := afero.Exists(fs, "/downloads/overflow.bin"); exists {
+		t.Fatal("file beyond the budget was downloaded")
+	}
+}
+
+func TestDownloaderReportsEveryQueuedFileOnce(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	fs := afero.NewMemMapFs()
+	svc := &fakeFileService{errSeq: []error{nil, errors.New("fail")}}
+
+	var (
+		mu      sync.Mutex
+		results = map[string]error{}
+	)
+	d := New(fs, svc, WithNumWorkers(1), WithRetry(1, time.Millisecond), WithSizeLimits(0, 100), WithOnFileDone(func(file File, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if _, seen := results[file.Name()]; seen {
+			t.Errorf("file %s reported twice", file.Name())
+		}
+		results[file.Name()] = err
+	}))
+	d.SetOutputDir("/downloads")
+
+	ok := makeTelegramDocument("ok.bin", 1)
+	setUnexportedField(&ok, "size", int64(10))
+	failing := makeTelegramDocument("failing.bin", 2)
+	setUnexportedField(&failing, "size", int64(10))
+	large := makeTelegramDocument("large.bin", 3)
+	setUnexportedField(&large, "size", int64(500))
+
+	q := make(chan File)
+	d.Start(ctx)
+	d.AddDownloadQueue(ctx, q)
+	q <- File{File: ok}
+	q <- File{File: failing}
+	q <- File{File: large}
+	close(q)
+
+	if err := d.Stop(ctx); err == nil {
+		t.Fatal("expected Stop() error for the failed file")
+	}
+
+	if len(results) != 3 || results["ok.bin"] != nil || results["failing.bin"] == nil || results["large.bin"] != nil {
+		t.Fatalf("unexpected results: %v", results)
+	}
+}
+
+type fakeParallelFileService struct {
+	fakeFileService
+	parallelCalls int
+}
+
+// DownloadParallel writes the content back to front in two byte parts.
+func (f *fakeParallelFileService) DownloadParallel(ctx context.Context, file telegram.File, out io.WriterAt, threads int) error {
+	f.mu.Lock()
+	f.parallelCalls++
+	f.mu.Unlock()
+
+	for off := (len(f.content) - 1) / 2 * 2; off >= 0; off -= 2 {
+		end := min(off+2, len(f.content))
+		if _, err := out.WriteAt(f.content[off:end], int64(off)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type countingTracker struct {
+	mu      sync.Mutex
+	written int64
+}
+
+func (t *countingTracker) WrapWriter(w io.Writer, _ string, _ int64) TrackedWriter {
+	return &nullTrackedWriter{w: writerFunc(func(p []byte) (int, error) {
+		t.mu.Lock()
+		t.written += int64(len(p))
+		t.mu.Unlock()
+		return w.Write(p)
+	})}
+}
+
+func (t *countingTracker) WaitAndStop(context.Context) {}
+
+// streamOnlyFs creates files that can't seek, like Dropbox upload streams.
+type streamOnlyFs struct {
+	afero.Fs
+}
+
+type streamOnlyFile struct {
+	afero.File
+}
+
+func (fs streamOnlyFs) Create(name string) (afero.File, error) {
+	file, err := fs.Fs.Create(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return streamOnlyFile{File: file}, nil
+}
+
+func (streamOnlyFile) Seek(int64, int) (int64, error) {
+	return 0, errors.New("seek not supported")
+}
+
+func TestDownloaderWritesParallelPartsInPlace(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	fs := afero.NewMemMapFs()
+
+	payload := []byte("parallel-chunked-download")
+	svc := &fakeParallelFileService{fakeFileService: fakeFileService{content: payload}}
+	tracker := &countingTracker{}
+
+	d := New(fs, svc, WithNumWorkers(1), WithThreads(4), WithTracker(tracker))
+	d.SetOutputDir("/downloads")
+
+	file := makeTelegramDocument("video.mp4", 101)
+	setUnexportedField(&file, "size", int64(len(payload)))
+
+	q := make(chan File)
+	d.Start(ctx)
+	d.AddDownloadQueue(ctx, q)
+	q <- NewFile(file, WithSubdirs("a", "b"))
+	close(q)
+
+	if err := d.Stop(ctx); err != nil {
+		t.Fatalf("Stop() unexpected error: %v", err)
+	}
+
+	for _, name := range []string{"/downloads/a/video.mp4", "/downloads/b/video.mp4"} {
+		got, err := afero.ReadFile(fs, name)
+		if err != nil {
+			t.Fatalf("ReadFile(%q) error = %v", name, err)
+		}
+
+		if !bytes.Equal(got, payload) {
+			t.Fatalf("unexpected payload in %q: got %q, want %q", name, got, payload)
+		}
+	}
+
+	if svc.parallelCalls != 1 || svc.Calls() != 0 {
+		t.Fatalf("expected one parallel download and no streams, got %d and %d", svc.parallelCalls, svc.Calls())
+	}
+
+	if tracker.written != int64(len(payload)) {
+		t.Fatalf("tracked %d bytes, want %d", tracker.written, len(payload))
+	}
+
+	for _, name := range []string{"/downloads/a/video.mp4.part.prealloc", "/downloads/b/video.mp4.part.prealloc"} {
+		if exists, _ := afero.Exists(fs, name); exists {
+			t.Fatalf("%q was left behind after the download", name)
+		}
+	}
+}
+
+func TestDownloaderRestartsPreallocatedPartFile(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	fs := afero.NewMemMapFs()
+
+	payload := []byte("parallel-chunked-download")
+	svc := &fakeFileService{content: payload}
+
+	d := New(fs, svc, WithNumWorkers(1), WithRetry(1, time.Millisecond))
+	d.SetOutputDir("/downloads")
+
+	// An interrupted parallel download leaves a full-size part file that is
+	// mostly zeros, with its marker.
+	sparse := make([]byte, len(payload))
+	copy(sparse[len(sparse)-4:], payload[len(payload)-4:])
+	if err := afero.WriteFile(fs, "/downloads/video.mp4.part", sparse, 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if err := afero.WriteFile(fs, "/downloads/video.mp4.part.prealloc", nil, 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	file := makeTelegramDocument("video.mp4", 101)
+	setUnexportedField(&file, "size", int64(len(payload)))
+
+	q := make(chan File)
+	d.Start(ctx)
+	d.AddDownloadQueue(ctx, q)
+	q <- File{File: file}
+	close(q)
+
+	if err := d.Stop(ctx); err != nil {
+		t.Fatalf("Stop() unexpected error: %v", err)
+	}
+
+	got, err := afero.ReadFile(fs, "/downloads/video.mp4")
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("unexpected payload: got %q, want %q", got, payload)
+	}
+
+	if calls := svc.Calls(); calls != 1 {
+		t.Fatalf("expected the file to be downloaded again, got %d Download() calls", calls)
+	}
+	if exists, _ := afero.Exists(fs, "/downloads/video.mp4.part.prealloc"); exists {
+		t.Fatal("the marker was left behind")
+	}
+}
+
+func TestDownloaderStreamsWhenOutputCannotSeek(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	fs := streamOnlyFs{Fs: afero.NewMemMapFs()}
+
+	payload := []byte("streamed")
+	svc := &fakeParallelFileService{fakeFileService: fakeFileService{content: payload}}
+
+	d := New(fs, svc, WithNumWorkers(1), WithThreads(4))
+	d.SetOutputDir("/downloads")
+
+	file := makeTelegramDocument("video.mp4", 101)
+	setUnexportedField(&file, "size", int64(len(payload)))
+
+	q := make(chan File)
+	d.Start(ctx)
+	d.AddDownloadQueue(ctx, q)
+	q <- File{File: file}
+	close(q)
+
+	if err := d.Stop(ctx); err != nil {
+		t.Fatalf("Stop() unexpected error: %v", err)
+	}
+
+	got, err := afero.ReadFile(fs, "/downloads/video.mp4")
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("unexpected payload: got %q, want %q", got, payload)
+	}
+
+	if svc.parallelCalls != 0 || svc.Calls() != 1 {
+		t.Fatalf("expected one stream and no parallel downloads, got %d and %d", svc.Calls(), svc.parallelCalls)
+	}
+}
+
+func TestDownloaderKeepsShortDownloadsOutOfPlace(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	fs := afero.NewMemMapFs()
+	svc := &fakeFileService{content: []byte("short")}
+
+	d := New(fs, svc, WithNumWorkers(1), WithRetry(1, time.Millisecond))
+	d.SetOutputDir("/downloads")
+
+	file := makeTelegramDocument("video.mp4", 101)
+	setUnexportedField(&file, "size", int64(100))
+
+	q := make(chan File)
+	d.Start(ctx)
+	d.AddDownloadQueue(ctx, q)
+	q <- File{File: file}
+	close(q)
+
+	if err := d.Stop(ctx); err == nil {
+		t.Fatal("Stop() error = nil, want incomplete file error")
+	}
+
+	for _, name := range []string{"/downloads/video.mp4", "/downloads/video.mp4.part"} {
+		if exists, _ := afero.Exists(fs, name); exists {
+			t.Fatalf("%q exists after an incomplete download", name)
+		}
+	}
+}
+
+func TestDownloaderResumesPartFilesOfEveryOutputPath(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	fs := afero.NewMemMapFs()
+
+	payload := []byte("hello-resume-world")
+	svc := &fakeFileService{content: payload}
+
+	d := New(fs, svc, WithNumWorkers(1), WithRetry(1, time.Millisecond))
+	d.SetOutputDir("/downloads")
+
+	// The second copy got further before the process died.
+	if err := afero.WriteFile(fs, "/downloads/a/resume.bin.part", payload[:5], 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if err := afero.WriteFile(fs, "/downloads/b/resume.bin.part", payload[:8], 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	file := makeTelegramFile("resume.bin")
+	setUnexportedField(&file, "size", int64(len(payload)))
+
+	q := make(chan File)
+	d.Start(ctx)
+	d.AddDownloadQueue(ctx, q)
+	q <- NewFile(file, WithSubdirs("a", "b"))
+	close(q)
+
+	if err := d.Stop(ctx); err != nil {
+		t.Fatalf("Stop() unexpected error: %v", err)
+	}
+
+	for _, name := range []string{"/downloads/a/resume.bin", "/downloads/b/resume.bin"} {
+		got, err := afero.ReadFile(fs, name)
+		if err != nil {
+			t.Fatalf("ReadFile(%q) error = %v", name, err)
+		}
+
+		if !bytes.Equal(got, payload) {
+			t.Fatalf("unexpected payload in %q: got %q, want %q", name, got, payload)
+		}
+	}
+
+	if calls := svc.Calls(); calls != 0 {
+		t.Fatalf("expected 0 full Download() calls when part files exist, got %d", calls)
+	}
+}
+
+// blockingFileService holds the first download until release is closed.
+type blockingFileService struct {
+	fakeFileService
+	started chan struct{}
+	release chan struct{}
+}
+
+func (f *blockingFileService) Download(ctx context.Context, file telegram.File, out io.Writer) error {
+	f.mu.Lock()
+	f.calls++
+	first := f.calls == 1
+	f.mu.Unlock()
+
+	if first {
+		close(f.started)
+		<-f.release
+	}
+
+	_, err := out.Write(bytes.Repeat([]byte("o"), int(file.Size())))
+	return err
+}
+
+func TestDownloaderReportsFilesDroppedFromTheQueue(t *testing.T) {
+	t.Parallel()
+
+	fs := afero.NewMemMapFs()
+	svc := &blockingFileService{started: make(chan struct{}), release: make(chan struct{})}
+
+	var (
+		mu      sync.Mutex
+		results = map[string]error{}
+		dropped = make(chan struct{}, 4)
+	)
+	d := New(fs, svc,
+		WithNumWorkers(1),
+		WithQueueOrder(OrderSmallest),
+		WithMaxTotalSize(1000),
+		WithOnFileDone(func(f File, err error) {
+			mu.Lock()
+			results[f.Name()] = err
+			mu.Unlock()
+			if err != nil {
+				dropped <- struct{}{}
+			}
+		}),
+	)
+	d.SetOutputDir("/downloads")
+
+	files := make([]File, 0, 4)
+	for i, size := range []int64{40, 30, 10, 20} {
+		file := makeTelegramDocument(fmt.Sprintf("file-%d.bin", i), int64(301+i))
+		setUnexportedField(&file, "size", size)
+		files = append(files, NewFile(file))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	q := make(chan File)
+	d.Start(context.Background())
+	d.AddDownloadQueue(ctx, q)
+
+	q <- files[0]
+	<-svc.started
+	// The producer takes the last file only after queuing the others.
+	for _, file := range files[1:] {
+		q <- file
+	}
+	cancel()
+
+	for range files[1:] {
+		select {
+		case <-dropped:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the queued files were dropped without being reported")
+		}
+	}
+
+	if stats := d.Stats(); stats.BudgetUsed != files[0].Size() {
+		t.Fatalf("budget used = %d, want only the downloading file's %d", stats.BudgetUsed, files[0].Size())
+	}
+
+	close(svc.release)
+	if err := d.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop() unexpected error: %v", err)
+	}
+
+	manifest, err := loadFileManifest(fs, "/downloads/"+fileManifestName)
+	if err != nil {
+		t.Fatalf("loadFileManifest() error = %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i, file := range files {
+		entry := manifest.Files[file.Identity()]
+		if i == 0 {
+			if results[file.Name()] != nil || entry == nil || entry.State != fileDone {
+				t.Fatalf("%s: err = %v, manifest entry = %+v, want it downloaded", file.Name(), results[file.Name()], entry)
+			}
+			continue
+		}
+
+		if !errors.Is(results[file.Name()], context.Canceled) {
+			t.Fatalf("%s: err = %v, want it reported as canceled", file.Name(), results[file.Name()])
+		}
+		if entry == nil || entry.State != fileFailed || entry.LastError == "" {
+			t.Fatalf("%s: manifest entry = %+v, want it unfinished", file.Name(), entry)
+		}
+	}
+}
+
+func TestDownloaderStreamsToWebDAVWithoutPreallocating(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	handler := &xwebdav.Handler{FileSystem: xwebdav.Dir(dir), LockSystem: xwebdav.NewMemLS()}
+
+	var (
+		mu   sync.Mutex
+		puts []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			mu.Lock()
+			puts = append(puts, r.URL.Path)
+			mu.Unlock()
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	fs, err := webdav.NewFs(webdav.Config{URL: server.URL + "/"}, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewFs() error = %v", err)
+	}
+
+	payload := []byte("parallel-chunked-download")
+	svc := &fakeParallelFileService{fakeFileService: fakeFileService{content: payload}}
+
+	d := New(fs, svc, WithNumWorkers(1), WithThreads(4), WithRetry(1, time.Millisecond))
+	d.SetOutputDir("/downloads")
+
+	file := makeTelegramDocument("video.mp4", 101)
+	setUnexportedField(&file, "size", int64(len(payload)))
+
+	q := make(chan File)
+	d.Start(ctx)
+	d.AddDownloadQueue(ctx, q)
+	q <- File{File: file}
+	close(q)
+
+	if err := d.Stop(ctx); err != nil {
+		t.Fatalf("Stop() unexpected error: %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "downloads", "video.mp4"))
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("unexpected payload: got %q, want %q", got, payload)
+	}
+
+	if svc.parallelCalls != 0 || svc.Calls() != 1 {
+		t.Fatalf("expected the file to be streamed, got %d parallel downloads and %d streams", svc.parallelCalls, svc.Calls())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, put := range puts {
+		if strings.HasSuffix(put, preallocSuffix) {
+			t.Fatalf("uploaded the marker %q for a streamed download", put)
+		}
+	}
+}
+
+// stallingFileService streams half of the content and waits for the download
+// to be canceled.
+type stallingFileService struct {
+	fakeFileService
+	stalled chan struct{}
+}
+
+func (f *stallingFileService) Download(ctx context.Context, file telegram.File, out io.Writer) error {
+	if _, err := out.Write(f.content[:len(f.content)/2]); err != nil {
+		return err
+	}
+
+	close(f.stalled)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestDownloaderKeepsPartFilesOfCanceledDownloads(t *testing.T) {
+	t.Parallel()
+
+	fs := afero.NewMemMapFs()
+	payload := []byte("a download that is canceled halfway")
+
+	file := makeTelegramDocument("video.mp4", 101)
+	setUnexportedField(&file, "size", int64(len(payload)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stalling := &stallingFileService{fakeFileService: fakeFileService{content: payload}, stalled: make(chan struct{})}
+	d := New(fs, stalling, WithNumWorkers(1))
+	d.SetOutputDir("/downloads")
+
+	q := make(chan File)
+	d.Start(ctx)
+	d.AddDownloadQueue(ctx, q)
+	q <- File{File: file}
+	<-stalling.stalled
+	cancel()
+	_ = d.Stop(context.Background())
+
+	part, err := afero.ReadFile(fs, "/downloads/video.mp4.part")
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v, want the part file kept", err)
+	}
+	if !bytes.Equal(part, payload[:len(payload)/2]) {
+		t.Fatalf("part file = %q, want %q", part, payload[:len(payload)/2])
+	}
+
+	ctx = context.Background()
+	svc := &fakeFileService{content: payload}
+	d = New(fs, svc, WithNumWorkers(1))
+	d.SetOutputDir("/downloads")
+
+	q = make(chan File)
+	d.Start(ctx)
+	d.AddDownloadQueue(ctx, q)
+	q <- File{File: file}
+	close(q)
+
+	if err := d.Stop(ctx); err != nil {
+		t.Fatalf("Stop() unexpected error: %v", err)
+	}
+
+	got, err := afero.ReadFile(fs, "/downloads/video.mp4")
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("unexpected payload: got %q, want %q", got, payload)
+	}
+	if calls := svc.Calls(); calls != 0 {
+		t.Fatalf("expected the download to resume, got %d Download() calls", calls)
+	}
+}
+
+// remoteFs counts the files opened for reading, like downloads from a
+// remote storage.
+type remoteFs struct {
+	afero.Fs
+	mu     sync.Mutex
+	opened []string
+}
+
+func (fs *remoteFs) Open(name string) (afero.File, error) {
+	fs.mu.Lock()
+	fs.opened = append(fs.opened, name)
+	fs.mu.Unlock()
+	return fs.Fs.Open(name)
+}
+
+func TestDownloaderHashesParallelDownloadsOnlyWhenCheap(t *testing.T) {
+	t.Parallel()
+
+	payload := []byte("parallel-chunked-download")
+	sum := sha256.Sum256(payload)
+
+	tests := []struct {
+		name     string
+		fs       afero.Fs
+		dedup    DedupMode
+		wantHash string
+	}{
+		{name: "local", fs: afero.NewMemMapFs(), wantHash: hex.EncodeToString(sum[:])},
+		{name: "remote", fs: &remoteFs{Fs: afero.NewMemMapFs()}},
+		{name: "remote with dedup", fs: &remoteFs{Fs: afero.NewMemMapFs()}, dedup: DedupPointer, wantHash: hex.EncodeToString(sum[:])},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			svc := &fakeParallelFileService{fakeFileService: fakeFileService{content: payload}}
+
+			d := New(tt.fs, svc, WithNumWorkers(1), WithThreads(4), WithDedup(tt.dedup))
+			d.SetOutputDir("/downloads")
+
+			file := makeTelegramDocument("video.mp4", 101)
+			setUnexportedField(&file, "size", int64(len(payload)))
+
+			q := make(chan File)
+			d.Start(ctx)
+			d.AddDownloadQueue(ctx, q)
+			q <- File{File: file}
+			close(q)
+
+			if err := d.Stop(ctx); err != nil {
+				t.Fatalf("Stop() unexpected error: %v", err)
+			}
+
+			manifest, err := loadFileManifest(tt.fs, "/downloads/"+fileManifestName)
+			if err != nil {
+				t.Fatalf("loadFileManifest() error = %v", err)
+			}
+			if entry := manifest.Files["101"]; entry == nil || entry.State != fileDone || entry.Hash != tt.wantHash {
+				t.Fatalf("manifest entry = %+v, want a finished download with hash %q", entry, tt.wantHash)
+			}
+
+			if remote, ok := tt.fs.(*remoteFs); ok && tt.dedup == DedupOff {
+				for _, name := range remote.opened {
+					if name == "/downloads/video.mp4" {
+						t.Fatal("the download was read back to hash it")
+					}
+				}
+			}
+		})
+	}
+}
@@ -1,7 +1,10 @@
 package downloader
 
 import (
+	"errors"
+	"fmt"
 	"io"
+	"os"
 
 	"github.com/johnnyipcom/tgdownloader/pkg/telegram"
 	"github.com/spf13/afero"
@@ -11,8 +14,18 @@ type File struct {
 	telegram.File
 
 	subdirs        []string
+	relativePaths  []string
 	saveByHashtags bool
 	outputPaths    []string
+	logicalPaths   []string
+	minSize        int64
+	maxSize        int64
+}
+
+// OutputPaths returns the paths a queued file is saved at, relative to the
+// output directory. They are empty until the file is queued.
+func (f File) OutputPaths() []string {
+	return f.logicalPaths
 }
 
 type FileOption func(*File)
@@ -35,12 +48,29 @@ func WithSubdirs(subdirs ...string) FileOption {
 	}
 }
 
+// WithOutputPaths saves the file at the given paths relative to the output
+// directory instead of under its subdirectories by its Telegram name.
+func WithOutputPaths(paths ...string) FileOption {
+	return func(o *File) {
+		o.relativePaths = append(o.relativePaths, paths...)
+	}
+}
+
 func WithSaveByHashtags(saveByHashtags bool) FileOption {
 	return func(o *File) {
 		o.saveByHashtags = saveByHashtags
 	}
 }
 
+// WithFileSizeLimits excludes the file when it is smaller than minSize or
+// larger than maxSize, on top of the downloader-wide limits.
+func WithFileSizeLimits(minSize, maxSize int64) FileOption {
+	return func(o *File) {
+		o.minSize = minSize
+		o.maxSize = maxSize
+	}
+}
+
 func NewFile(file telegram.File, opts ...FileOption) File {
 	f := File{
 		File: file,
@@ -62,12 +92,36 @@ func NewFile(file telegram.File, opts ...FileOption) File {
 	return f
 }
 
+// partSuffix marks files that are still being downloaded. A file only gets
+// its real name once it is complete.
+const partSuffix = ".part"
+
+// preallocSuffix marks part files preallocated for a parallel download. Their
+// size doesn't tell how much was downloaded, so they are never resumed.
+const preallocSuffix = ".prealloc"
+
+// errIncompleteFile is returned by Commit when a file holds fewer or more
+// bytes than expected.
+var errIncompleteFile = errors.New("incomplete file")
+
+func partPath(filename string) string {
+	return filename + partSuffix
+}
+
+func preallocPath(filename string) string {
+	return partPath(filename) + preallocSuffix
+}
+
 type Saver interface {
 	io.WriteCloser
 
 	// IsValid returns true if there are files to write to
 	IsValid() bool
 
+	// Commit closes the files and moves them to their final names. A positive
+	// size is checked against the number of bytes written first.
+	Commit(size int64) error
+
 	// Remove removes all files created by this MultiSaver
 	Remove() error
 }
@@ -86,8 +140,11 @@ type MultiSaver interface {
 //
 
 type aferoSaver struct {
-	fs    afero.Fs
-	files []afero.File
+	fs           afero.Fs
+	files        []afero.File
+	names        []string
+	closed       bool
+	preallocated bool
 }
 
 var _ MultiSaver = &aferoSaver{}
@@ -99,13 +156,39 @@ func NewAferoSaver(fs afero.Fs) MultiSaver {
 	}
 }
 
+// AddFile creates the part file of filename.
 func (m *aferoSaver) AddFile(filename string) error {
-	file, err := m.fs.Create(filename)
+	file, err := m.fs.Create(partPath(filename))
 	if err != nil {
 		return err
 	}
 
 	m.files = append(m.files, file)
+	m.names = append(m.names, filename)
+	return nil
+}
+
+// resumeFiles reopens the existing part files of filenames for appending,
+// cut to offset bytes first.
+func (m *aferoSaver) resumeFiles(filenames []string, offset int64) error {
+	for _, filename := range filenames {
+		file, err := m.fs.OpenFile(partPath(filename), os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+
+		m.files = append(m.files, file)
+		m.names = append(m.names, filename)
+
+		if err := file.Truncate(offset); err != nil {
+			return err
+		}
+
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -113,22 +196,136 @@ func (m *aferoSaver) IsValid() bool {
 	return len(m.files) > 0
 }
 
+// Write writes p to every file. It reports len(p) only when all of them took
+// all of it, and 0 otherwise.
 func (m *aferoSaver) Write(p []byte) (n int, err error) {
 	for _, file := range m.files {
 		written, err := file.Write(p)
 		if err != nil {
-			return n, err
+			return 0, err
 		}
 		if written != len(p) {
-			return n, io.ErrShortWrite
+			return 0, io.ErrShortWrite
 		}
-		n += written
 	}
 
-	return n, nil
+	return len(p), nil
+}
+
+// rewind cuts every file to offset and continues writing there.
+func (m *aferoSaver) rewind(offset int64) error {
+	for _, file := range m.files {
+		if err := file.Truncate(offset); err != nil {
+			return err
+		}
+
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// recreate removes the files and creates them again, empty, for outputs
+// that can't be cut.
+func (m *aferoSaver) recreate() error {
+	if err := m.Remove(); err != nil {
+		return err
+	}
+
+	names := m.names
+	m.files, m.names = nil, nil
+	m.closed, m.preallocated = false, false
+
+	for _, name := range names {
+		if err := m.AddFile(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writerAt preallocates every file to size and returns them as a single
+// io.WriterAt. It reports false when a file can't write at an offset, e.g. a
+// Dropbox or WebDAV upload stream, and the download has to be streamed
+// instead. Each file is marked as preallocated before it grows, so an
+// interrupted download isn't resumed from its size.
+func (m *aferoSaver) writerAt(size int64) (io.WriterAt, bool) {
+	offsets := make([]int64, len(m.files))
+	for i, file := range m.files {
+		offset, err := file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, false
+		}
+
+		// Streams that seek can still refuse to write out of order.
+		if _, err := file.WriteAt(nil, offset); err != nil {
+			return nil, false
+		}
+		offsets[i] = offset
+	}
+
+	m.preallocated = true
+	for _, name := range m.names {
+		marker, err := m.fs.Create(preallocPath(name))
+		if err == nil {
+			err = marker.Close()
+		}
+		if err != nil {
+			m.undoPreallocation(nil)
+			return nil, false
+		}
+	}
+
+	writers := make(multiWriterAt, 0, len(m.files))
+	for i, file := range m.files {
+		if err := file.Truncate(size); err != nil {
+			m.undoPreallocation(offsets[:i])
+			return nil, false
+		}
+
+		writers = append(writers, file)
+	}
+
+	return writers, true
+}
+
+// undoPreallocation cuts the files grown so far back to their offsets and
+// removes the markers, for a download that is streamed after all.
+func (m *aferoSaver) undoPreallocation(offsets []int64) {
+	for i, offset := range offsets {
+		_ = m.files[i].Truncate(offset)
+	}
+
+	m.removeMarkers()
+	m.preallocated = false
+}
+
+// multiWriterAt duplicates WriteAt calls to all of its writers.
+type multiWriterAt []io.WriterAt
+
+func (w multiWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	for _, writer := range w {
+		written, err := writer.WriteAt(p, off)
+		if err != nil {
+			return 0, err
+		}
+		if written != len(p) {
+			return 0, io.ErrShortWrite
+		}
+	}
+
+	return len(p), nil
 }
 
 func (m *aferoSaver) Close() error {
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+
 	var err error
 	for _, file := range m.files {
 		if cerr := file.Close(); cerr != nil && err == nil {
@@ -138,6 +335,65 @@ func (m *aferoSaver) Close() error {
 	return err
 }
 
+func (m *aferoSaver) Commit(size int64) error {
+	if err := m.Close(); err != nil {
+		return err
+	}
+
+	if size > 0 {
+		for _, file := range m.files {
+			info, err := m.fs.Stat(file.Name())
+			if err != nil {
+				return err
+			}
+
+			if info.Size() != size {
+				return fmt.Errorf("%w: %q has %d of %d bytes", errIncompleteFile, file.Name(), info.Size(), size)
+			}
+		}
+	}
+
+	for i, file := range m.files {
+		if err := m.rename(file.Name(), m.names[i]); err != nil {
+			return err
+		}
+	}
+
+	m.removeMarkers()
+	return nil
+}
+
+// removeMarkers removes the preallocation markers of the files. A marker
+// left behind only makes a later download start over.
+func (m *aferoSaver) removeMarkers() {
+	if !m.preallocated {
+		return
+	}
+
+	for _, name := range m.names {
+		_ = m.fs.Remove(preallocPath(name))
+	}
+}
+
+// rename moves a part file into place. Backends like Dropbox refuse to
+// overwrite, so a file that is being rewritten is removed first.
+func (m *aferoSaver) rename(from, to string) error {
+	err := m.fs.Rename(from, to)
+	if err == nil {
+		return nil
+	}
+
+	if exists, existsErr := afero.Exists(m.fs, to); existsErr != nil || !exists {
+		return err
+	}
+
+	if err := m.fs.Remove(to); err != nil {
+		return err
+	}
+
+	return m.fs.Rename(from, to)
+}
+
 func (m *aferoSaver) Remove() error {
 	if err := m.Close(); err != nil {
 		return err
@@ -149,6 +405,7 @@ func (m *aferoSaver) Remove() error {
 			err = cerr
 		}
 	}
+	m.removeMarkers()
 
 	return err
 }
@@ -177,6 +434,10 @@ func (s *nullSaver) Close() error {
 	return nil
 }
 
+func (s *nullSaver) Commit(int64) error {
+	return nil
+}
+
 func (s *nullSaver) IsValid() bool {
 	return true
 }
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"strings"
 	"sync"
 
@@ -13,6 +14,9 @@ import (
 	"github.com/johnnyipcom/tgdownloader/pkg/config"
 	"github.com/johnnyipcom/tgdownloader/pkg/dropbox"
 	"github.com/johnnyipcom/tgdownloader/pkg/oauth2server"
+	"github.com/johnnyipcom/tgdownloader/pkg/s3"
+	"github.com/johnnyipcom/tgdownloader/pkg/sftp"
+	"github.com/johnnyipcom/tgdownloader/pkg/webdav"
 	"github.com/spf13/afero"
 	"golang.org/x/oauth2"
 )
@@ -22,7 +26,13 @@ var (
 	fs   afero.Fs
 )
 
-func GetFS(ctx context.Context, cfg config.Config, log *log.Logger, writer io.Writer) (afero.Fs, error) {
+// dropboxTokenName is the name the Dropbox token is saved under.
+const dropboxTokenName = "dropbox"
+
+// GetFS returns the filesystem downloads are saved to, creating it on the
+// first call. OAuth2 tokens are saved to tokens and reused by later runs; a
+// nil tokens asks for authorization every time.
+func GetFS(ctx context.Context, cfg config.Config, log *log.Logger, writer io.Writer, tokens oauth2server.TokenStore) (afero.Fs, error) {
 	fsMu.Lock()
 	defer fsMu.Unlock()
 	if fs != nil {
@@ -35,19 +45,35 @@ func GetFS(ctx context.Context, cfg config.Config, log *log.Logger, writer io.Wr
 
 	case "dropbox":
 		port := cfg.GetInt("dropbox.port")
-		client, err := oauth2server.RunOAuth2Server(ctx, writer, port, oauth2.Config{
-			ClientID:     cfg.GetString("dropbox.oauth2.id"),
+		oauthCfg := oauth2.Config{
+			ClientID: cfg.GetString("dropbox.oauth2.id"),
+			// The secret is optional, PKCE protects the authorization.
 			ClientSecret: cfg.GetString("dropbox.oauth2.secret"),
 			RedirectURL:  fmt.Sprintf("http://localhost:%d/oauth2/callback", port),
 			Endpoint: oauth2.Endpoint{
-				AuthURL:  "https://www.dropbox.com/oauth2/authorize",
-				TokenURL: "https://api.dropboxapi.com/oauth2/token",
+				AuthURL:   "https://www.dropbox.com/oauth2/authorize",
+				TokenURL:  "https://api.dropboxapi.com/oauth2/token",
+				AuthStyle: oauth2.AuthStyleInParams,
 			},
-		})
+		}
+
+		var (
+			client *http.Client
+			err    error
+		)
+		if tokens != nil {
+			// Dropbox issues refresh tokens only for offline access.
+			client, err = oauth2server.PersistentClient(ctx, writer, port, oauthCfg, tokens, dropboxTokenName, oauth2.SetAuthURLParam("token_access_type", "offline"))
+		} else {
+			client, err = oauth2server.RunOAuth2Server(ctx, writer, port, oauthCfg)
+		}
 		if err != nil {
-			kind := apperr.KindAuth
-			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			kind := apperr.KindOf(err)
+			switch {
+			case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
 				kind = apperr.KindCancel
+			case kind == apperr.KindUnknown:
+				kind = apperr.KindAuth
 			}
 			return nil, apperr.New("downloader.get_fs.oauth2", kind, err)
 		}
@@ -61,6 +87,51 @@ func GetFS(ctx context.Context, cfg config.Config, log *log.Logger, writer io.Wr
 		}
 		fs = dfs
 
+	case "s3":
+		sfs, err := s3.NewFs(ctx, s3.Config{
+			Endpoint:     cfg.GetString("s3.endpoint"),
+			Bucket:       cfg.GetString("s3.bucket"),
+			Prefix:       cfg.GetString("s3.prefix"),
+			Region:       cfg.GetString("s3.region"),
+			AccessKey:    cfg.GetString("s3.access_key"),
+			SecretKey:    cfg.GetString("s3.secret_key"),
+			SessionToken: cfg.GetString("s3.session_token"),
+			PathStyle:    cfg.GetBool("s3.path_style"),
+			PartSize:     int64(cfg.GetSizeInBytes("s3.part_size")),
+		}, log)
+		if err != nil {
+			return nil, apperr.Wrap("downloader.get_fs.s3", fmt.Errorf("create s3 filesystem: %w", err))
+		}
+		fs = sfs
+
+	case "sftp":
+		sfs, err := sftp.NewFs(ctx, sftp.Config{
+			Host:                  cfg.GetString("sftp.host"),
+			User:                  cfg.GetString("sftp.user"),
+			Password:              cfg.GetString("sftp.password"),
+			KeyFile:               cfg.GetString("sftp.key_file"),
+			KeyPassphrase:         cfg.GetString("sftp.key_passphrase"),
+			KnownHostsFile:        cfg.GetString("sftp.known_hosts"),
+			InsecureIgnoreHostKey: cfg.GetBool("sftp.insecure_ignore_host_key"),
+			Root:                  cfg.GetString("sftp.root"),
+			Timeout:               cfg.GetDuration("sftp.timeout"),
+		}, log)
+		if err != nil {
+			return nil, apperr.Wrap("downloader.get_fs.sftp", fmt.Errorf("create sftp filesystem: %w", err))
+		}
+		fs = sfs
+
+	case "webdav":
+		wfs, err := webdav.NewFs(webdav.Config{
+			URL:      cfg.GetString("webdav.url"),
+			User:     cfg.GetString("webdav.user"),
+			Password: cfg.GetString("webdav.password"),
+		}, log)
+		if err != nil {
+			return nil, apperr.Wrap("downloader.get_fs.webdav", fmt.Errorf("create webdav filesystem: %w", err))
+		}
+		fs = wfs
+
 	default:
 		return nil, apperr.New("downloader.get_fs.type", apperr.KindConfig, fmt.Errorf("invalid downloader type %q", cfg.GetString("type")))
 	}
@@ -71,3 +142,26 @@ func GetFS(ctx context.Context, cfg config.Config, log *log.Logger, writer io.Wr
 
 	return fs, nil
 }
+
+// LogoutDropbox forgets the saved Dropbox token, so the next download asks
+// for authorization again.
+func LogoutDropbox(ctx context.Context, tokens oauth2server.TokenStore) error {
+	if err := tokens.Delete(ctx, dropboxTokenName); err != nil {
+		return apperr.Wrap("downloader.logout_dropbox", err)
+	}
+
+	ResetFS()
+	return nil
+}
+
+// ResetFS closes the filesystem created by GetFS, if it holds a connection,
+// and makes the next call create it again.
+func ResetFS() {
+	fsMu.Lock()
+	defer fsMu.Unlock()
+
+	if closer, ok := fs.(io.Closer); ok {
+		_ = closer.Close()
+	}
+	fs = nil
+}
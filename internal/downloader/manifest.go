@@ -7,24 +7,57 @@ import (
 	"os"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/spf13/afero"
 )
 
 const (
 	fileManifestName    = ".tgdownloader-files.json"
-	fileManifestVersion = 1
+	fileManifestVersion = 2
+)
+
+// fileState is how far the download of a file got.
+type fileState string
+
+const (
+	fileQueued  fileState = "queued"
+	filePartial fileState = "partial"
+	fileDone    fileState = "done"
+	fileFailed  fileState = "failed"
 )
 
 type fileManifest struct {
 	Version int                          `json:"version"`
 	Paths   map[string]map[string]string `json:"paths"`
+	// Files maps a file identity to the state of its download.
+	Files map[string]*manifestFile `json:"files"`
+
+	// migrated is set when the manifest was read in an older version and has
+	// to be saved again.
+	migrated bool
+}
+
+// manifestFile is the source message and download state of a file.
+type manifestFile struct {
+	PeerID      int64     `json:"peer_id,omitempty"`
+	MessageID   int       `json:"message_id,omitempty"`
+	Date        time.Time `json:"date,omitzero"`
+	Size        int64     `json:"size"`
+	MIMEType    string    `json:"mime_type,omitempty"`
+	State       fileState `json:"state"`
+	LastError   string    `json:"last_error,omitempty"`
+	Attempts    int       `json:"attempts,omitempty"`
+	Hash        string    `json:"hash,omitempty"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	CompletedAt time.Time `json:"completed_at,omitzero"`
 }
 
 func newFileManifest() fileManifest {
 	return fileManifest{
 		Version: fileManifestVersion,
 		Paths:   make(map[string]map[string]string),
+		Files:   make(map[string]*manifestFile),
 	}
 }
 
@@ -41,16 +74,51 @@ func loadFileManifest(fs afero.Fs, filename string) (fileManifest, error) {
 	if err := json.Unmarshal(data, &manifest); err != nil {
 		return newFileManifest(), fmt.Errorf("decode file manifest: %w", err)
 	}
-	if manifest.Version != fileManifestVersion {
+	if manifest.Version < 1 || manifest.Version > fileManifestVersion {
 		return newFileManifest(), fmt.Errorf("unsupported file manifest version %d", manifest.Version)
 	}
 	if manifest.Paths == nil {
 		manifest.Paths = make(map[string]map[string]string)
 	}
+	if manifest.Files == nil {
+		manifest.Files = make(map[string]*manifestFile)
+	}
+	if manifest.Version == 1 {
+		migrateFileManifest(fs, path.Dir(filename), &manifest)
+	}
 
 	return manifest, nil
 }
 
+// migrateFileManifest upgrades a version 1 manifest, which only knew the
+// paths, by recording the files found on disk as done.
+func migrateFileManifest(fs afero.Fs, dir string, manifest *fileManifest) {
+	now := time.Now()
+	for _, identities := range manifest.Paths {
+		for identity, actualPath := range identities {
+			actualPath, ok := cleanManifestPath(actualPath)
+			if !ok {
+				continue
+			}
+
+			info, err := fs.Stat(path.Join(dir, actualPath))
+			if err != nil || info.IsDir() {
+				continue
+			}
+
+			manifest.Files[identity] = &manifestFile{
+				Size:        info.Size(),
+				State:       fileDone,
+				UpdatedAt:   now,
+				CompletedAt: info.ModTime(),
+			}
+		}
+	}
+
+	manifest.Version = fileManifestVersion
+	manifest.migrated = true
+}
+
 func saveFileManifest(fs afero.Fs, filename string, manifest fileManifest) error {
 	data, err := json.MarshalIndent(manifest, "", "  ")
 	if err != nil {
@@ -58,15 +126,21 @@ func saveFileManifest(fs afero.Fs, filename string, manifest fileManifest) error
 	}
 	data = append(data, '\n')
 
+	return writeFileAtomically(fs, filename, data)
+}
+
+// writeFileAtomically replaces filename with data through a temporary file,
+// so an interrupted write never leaves a truncated index behind.
+func writeFileAtomically(fs afero.Fs, filename string, data []byte) error {
 	temporary := filename + ".tmp"
 	if err := afero.WriteFile(fs, temporary, data, 0600); err != nil {
-		return fmt.Errorf("write temporary file manifest: %w", err)
+		return fmt.Errorf("write temporary %s: %w", path.Base(filename), err)
 	}
 	if err := fs.Remove(filename); err != nil && !errors.Is(err, os.ErrNotExist) {
-		return fmt.Errorf("replace file manifest: %w", err)
+		return fmt.Errorf("replace %s: %w", path.Base(filename), err)
 	}
 	if err := fs.Rename(temporary, filename); err != nil {
-		return fmt.Errorf("rename file manifest: %w", err)
+		return fmt.Errorf("rename %s: %w", path.Base(filename), err)
 	}
 	return nil
 }
@@ -96,3 +170,102 @@ func cleanManifestPath(filename string) (string, bool) {
 	}
 	return cleaned, true
 }
+
+// manifestQueued records the source of a file that is about to be
+// downloaded. Callers hold manifestMu.
+func (p *Downloader) manifestQueued(file File) {
+	entry, ok := p.manifest.Files[file.Identity()]
+	if !ok {
+		entry = &manifestFile{}
+		p.manifest.Files[file.Identity()] = entry
+	}
+
+	entry.PeerID = int64(file.PeerID())
+	entry.MessageID = file.MessageID()
+	if file.MessageID() != 0 {
+		entry.Date = file.Date().UTC()
+	}
+	entry.Size = file.Size()
+	entry.MIMEType = file.MIMEType()
+	if entry.State != fileDone {
+		entry.State = fileQueued
+	}
+	entry.UpdatedAt = time.Now().UTC()
+}
+
+// updateManifestFile applies fn to the manifest entry of file unless this is
+// a dry run.
+func (p *Downloader) updateManifestFile(file File, fn func(*manifestFile)) {
+	if p.dryRun {
+		return
+	}
+
+	p.manifestMu.Lock()
+	defer p.manifestMu.Unlock()
+
+	entry, ok := p.manifest.Files[file.Identity()]
+	if !ok {
+		p.manifestQueued(file)
+		entry = p.manifest.Files[file.Identity()]
+	}
+
+	fn(entry)
+	entry.UpdatedAt = time.Now().UTC()
+	p.manifestDirty = true
+}
+
+// manifestAttempt counts a request for the content of file.
+func (p *Downloader) manifestAttempt(file File) {
+	p.updateManifestFile(file, func(entry *manifestFile) {
+		entry.Attempts++
+	})
+}
+
+// manifestDone records that every output of file is in place. An empty hash
+// keeps the one recorded before.
+func (p *Downloader) manifestDone(file File, hash string) {
+	p.updateManifestFile(file, func(entry *manifestFile) {
+		entry.State = fileDone
+		entry.LastError = ""
+		if hash != "" {
+			entry.Hash = hash
+		}
+		entry.CompletedAt = time.Now().UTC()
+	})
+}
+
+// manifestFailed records the error of file. A failed download that left part
+// files behind to resume from is partial.
+func (p *Downloader) manifestFailed(file File, err error) {
+	state := p.unfinishedState(file)
+	p.updateManifestFile(file, func(entry *manifestFile) {
+		entry.State = state
+		entry.LastError = err.Error()
+	})
+}
+
+// manifestCanceled records that file was queued but not downloaded. Files
+// downloaded before stay done.
+func (p *Downloader) manifestCanceled(file File, err error) {
+	state := p.unfinishedState(file)
+	p.updateManifestFile(file, func(entry *manifestFile) {
+		if entry.State == fileDone {
+			return
+		}
+
+		entry.State = state
+		entry.LastError = err.Error()
+	})
+}
+
+// unfinishedState is the state of a file that isn't downloaded: partial when
+// it left part files behind to resume from, failed otherwise.
+func (p *Downloader) unfinishedState(file File) fileState {
+	for _, outputPath := range file.outputPaths {
+		if exists, _ := afero.Exists(p.fs, partPath(outputPath)); exists {
+			return filePartial
+		}
+	}
+
+	return fileFailed
+}
@@ -0,0 +1,92 @@
+package downloader
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+func TestDownloaderMigratesVersion1Manifest(t *testing.T) {
+	t.Parallel()
+
+	fs := afero.NewMemMapFs()
+	v1 := `{"version": 1, "paths": {"video.mp4": {"101": "video.mp4"}, "gone.mp4": {"202": "gone.mp4"}}}`
+	if err := afero.WriteFile(fs, "/downloads/"+fileManifestName, []byte(v1), 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if err := afero.WriteFile(fs, "/downloads/video.mp4", []byte("video"), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	d := New(fs, &fakeFileService{}, WithNumWorkers(1))
+	d.SetOutputDir("/downloads")
+	d.Start(context.Background())
+	if err := d.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop() unexpected error: %v", err)
+	}
+
+	manifest, err := loadFileManifest(fs, "/downloads/"+fileManifestName)
+	if err != nil {
+		t.Fatalf("loadFileManifest() error = %v", err)
+	}
+	if manifest.Version != fileManifestVersion || manifest.migrated {
+		t.Fatalf("saved manifest version = %d, migrated = %v", manifest.Version, manifest.migrated)
+	}
+	if actualPath, ok := manifest.lookup("video.mp4", "101"); !ok || actualPath != "video.mp4" {
+		t.Fatalf("migrated path = %q, %v", actualPath, ok)
+	}
+	if entry := manifest.Files["101"]; entry == nil || entry.State != fileDone || entry.Size != 5 {
+		t.Fatalf("migrated file = %+v", entry)
+	}
+	if entry, ok := manifest.Files["202"]; ok {
+		t.Fatalf("missing file was migrated as %+v", entry)
+	}
+}
+
+func TestDownloaderRecordsFileStatesInManifest(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	fs := afero.NewMemMapFs()
+	svc := &fakeFileService{errSeq: []error{nil, errors.New("boom"), errors.New("boom")}}
+	d := New(fs, svc, WithNumWorkers(1), WithRetry(2, time.Millisecond))
+	d.SetOutputDir("/downloads")
+
+	good := makeTelegramDocument("good.bin", 101)
+	bad := makeTelegramDocument("bad.bin", 202)
+	setUnexportedField(&good, "messageID", 7)
+	setUnexportedField(&good, "date", 1700000000)
+
+	q := make(chan File)
+	d.Start(ctx)
+	d.AddDownloadQueue(ctx, q)
+	q <- File{File: good}
+	q <- File{File: bad}
+	close(q)
+
+	if err := d.Stop(ctx); err == nil {
+		t.Fatal("Stop() succeeded despite a failed download")
+	}
+
+	manifest, err := loadFileManifest(fs, "/downloads/"+fileManifestName)
+	if err != nil {
+		t.Fatalf("loadFileManifest() error = %v", err)
+	}
+
+	sum := sha256.Sum256([]byte("oo"))
+	done := manifest.Files["101"]
+	if done == nil || done.State != fileDone || done.Attempts != 1 || done.MessageID != 7 ||
+		!done.Date.Equal(time.Unix(1700000000, 0)) || done.Hash != hex.EncodeToString(sum[:]) || done.CompletedAt.IsZero() {
+		t.Fatalf("downloaded file = %+v", done)
+	}
+
+	failed := manifest.Files["202"]
+	if failed == nil || failed.State != fileFailed || failed.Attempts != 2 || failed.LastError == "" || !failed.CompletedAt.IsZero() {
+		t.Fatalf("failed file = %+v", failed)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package downloader
+
+import "errors"
+
+// reflink is only implemented for Linux file systems.
+func reflink(source, target string) error {
+	return errors.ErrUnsupported
+}
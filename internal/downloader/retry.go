@@ -0,0 +1,116 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	backoff "github.com/cenkalti/backoff/v4"
+	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
+	"github.com/johnnyipcom/tgdownloader/pkg/telegram"
+)
+
+// RetryPolicy says how often a failed download is tried and how long to wait
+// in between. Delays grow exponentially from Initial up to Max.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts, including the first one.
+	MaxAttempts int
+	Initial     time.Duration
+	Max         time.Duration
+	Multiplier  float64
+	// Jitter randomizes every delay by up to this fraction of it, so workers
+	// that failed together do not retry together.
+	Jitter float64
+}
+
+// DefaultRetryPolicy returns the policy used unless another one is set.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 3,
+		Initial:     400 * time.Millisecond,
+		Max:         30 * time.Second,
+		Multiplier:  2,
+		Jitter:      0.2,
+	}
+}
+
+// normalize replaces settings that cannot work with the closest ones that
+// do.
+func (p RetryPolicy) normalize() RetryPolicy {
+	p.MaxAttempts = max(p.MaxAttempts, 1)
+	p.Initial = max(p.Initial, 0)
+	p.Max = max(p.Max, p.Initial)
+	p.Multiplier = max(p.Multiplier, 1)
+	p.Jitter = min(max(p.Jitter, 0), 1)
+	return p
+}
+
+func (p RetryPolicy) newBackOff() backoff.BackOff {
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = p.Initial
+	b.MaxInterval = p.Max
+	b.Multiplier = p.Multiplier
+	b.RandomizationFactor = p.Jitter
+	b.MaxElapsedTime = 0
+	b.Reset()
+	return b
+}
+
+// delay returns how long to wait before trying again after err, or false when
+// err will not go away by trying again. Telegram's FLOOD_WAIT takes precedence
+// over the backoff.
+func (p RetryPolicy) delay(b backoff.BackOff, err error) (time.Duration, bool) {
+	if !retryable(err) {
+		return 0, false
+	}
+
+	next := b.NextBackOff()
+	if wait, ok := telegram.AsFloodWait(err); ok {
+		return max(wait, next), true
+	}
+
+	return next, true
+}
+
+// retryable reports whether err may go away when the download is tried
+// again. Configuration, authorization and cancellation errors never do.
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	for err != nil {
+		var appErr *apperr.Error
+		if !errors.As(err, &appErr) {
+			return true
+		}
+
+		switch appErr.Kind {
+		case apperr.KindConfig, apperr.KindAuth, apperr.KindCancel:
+			return false
+		}
+		err = appErr.Err
+	}
+
+	return true
+}
+
+// WithRetryPolicy sets how failed downloads are retried.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(s *settings) {
+		s.retry = policy.normalize()
+	}
+}
+
+// sleepContext waits for d or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
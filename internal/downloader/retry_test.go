@@ -0,0 +1,291 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gotd/td/tgerr"
+	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
+	"github.com/johnnyipcom/tgdownloader/pkg/telegram"
+	"github.com/spf13/afero"
+)
+
+func TestRetryPolicyBacksOffExponentiallyUpToMax(t *testing.T) {
+	t.Parallel()
+
+	policy := RetryPolicy{MaxAttempts: 5, Initial: 100 * time.Millisecond, Max: 300 * time.Millisecond, Multiplier: 2}.normalize()
+	b := policy.newBackOff()
+
+	want := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond, 300 * time.Millisecond}
+	for i, want := range want {
+		got, ok := policy.delay(b, errors.New("timeout"))
+		if !ok || got != want {
+			t.Fatalf("delay #%d = %v, %v, want %v", i+1, got, ok, want)
+		}
+	}
+}
+
+func TestRetryPolicyHonoursFloodWait(t *testing.T) {
+	t.Parallel()
+
+	policy := DefaultRetryPolicy()
+	err := apperr.New("telegram.file.download", apperr.KindNetwork, fmt.Errorf("get chunk: %w", tgerr.New(420, "FLOOD_WAIT_7")))
+	if got, ok := policy.delay(policy.newBackOff(), err); !ok || got != 7*time.Second {
+		t.Fatalf("delay = %v, %v, want 7s", got, ok)
+	}
+}
+
+func TestRetryableSkipsPermanentErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: errors.New("connection reset"), want: true},
+		{err: apperr.New("downloader.download", apperr.KindNetwork, errors.New("timeout")), want: true},
+		{err: apperr.New("downloader.download", apperr.KindIO, errors.New("disk full")), want: true},
+		{err: apperr.New("downloader.download", apperr.KindNetwork, apperr.New("telegram.auth", apperr.KindAuth, errors.New("AUTH_KEY_UNREGISTERED"))), want: false},
+		{err: apperr.New("downloader.options", apperr.KindConfig, errors.New("bad offset")), want: false},
+		{err: fmt.Errorf("download: %w", context.Canceled), want: false},
+	}
+	for _, tt := range tests {
+		if got := retryable(tt.err); got != tt.want {
+			t.Errorf("retryable(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestDownloaderDoesNotRetryConfigErrors(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	svc := &fakeFileService{errSeq: []error{apperr.New("telegram.file.download", apperr.KindConfig, errors.New("invalid location"))}}
+	d := New(afero.NewMemMapFs(), svc, WithNumWorkers(1), WithRetry(3, time.Millisecond))
+	d.SetOutputDir("/downloads")
+
+	q := make(chan File)
+	d.Start(ctx)
+	d.AddDownloadQueue(ctx, q)
+	q <- File{File: makeTelegramFile("a.txt")}
+	close(q)
+
+	if err := d.Stop(ctx); err == nil {
+		t.Fatal("Stop() succeeded despite a failed download")
+	}
+	if calls := svc.Calls(); calls != 1 {
+		t.Fatalf("Download() calls = %d, want 1", calls)
+	}
+}
+
+func TestDownloaderKeepsTheKindOfFailedDownloads(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		err  error
+		want apperr.Kind
+	}{
+		{err: apperr.New("telegram.file.download", apperr.KindAuth, errors.New("AUTH_KEY_UNREGISTERED")), want: apperr.KindAuth},
+		{err: apperr.New("telegram.file.download", apperr.KindIO, errors.New("disk full")), want: apperr.KindIO},
+		{err: errors.New("connection reset"), want: apperr.KindNetwork},
+	}
+
+	for _, tt := range tests {
+		ctx := context.Background()
+		svc := &fakeFileService{errSeq: []error{tt.err}}
+
+		var (
+			mu   sync.Mutex
+			kind apperr.Kind
+		)
+		d := New(afero.NewMemMapFs(), svc, WithNumWorkers(1), WithRetry(1, time.Millisecond), WithOnFileDone(func(_ File, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			kind = apperr.KindOf(err)
+		}))
+		d.SetOutputDir("/downloads")
+
+		q := make(chan File)
+		d.Start(ctx)
+		d.AddDownloadQueue(ctx, q)
+		q <- File{File: makeTelegramFile("a.txt")}
+		close(q)
+		_ = d.Stop(ctx)
+
+		mu.Lock()
+		if kind != tt.want {
+			t.Errorf("kind of %v = %q, want %q", tt.err, kind, tt.want)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestDownloaderRetryDelayStopsWithContext(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	svc := &fakeFileService{errSeq: []error{errors.New("timeout"), errors.New("timeout")}}
+	d := New(afero.NewMemMapFs(), svc, WithNumWorkers(1), WithRetry(2, time.Hour))
+	d.SetOutputDir("/downloads")
+
+	q := make(chan File)
+	d.Start(ctx)
+	d.AddDownloadQueue(ctx, q)
+	q <- File{File: makeTelegramFile("a.txt")}
+	close(q)
+
+	time.AfterFunc(20*time.Millisecond, cancel)
+	done := make(chan error)
+	go func() { done <- d.Stop(context.Background()) }()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Stop() error = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("retry delay ignored the canceled context")
+	}
+}
+
+// brokenStreamService breaks the first stream after half of the content.
+type brokenStreamService struct {
+	fakeFileService
+	resumed []int64
+}
+
+func (f *brokenStreamService) Download(ctx context.Context, file telegram.File, out io.Writer) error {
+	f.mu.Lock()
+	f.calls++
+	call := f.calls
+	f.mu.Unlock()
+
+	if call == 1 {
+		if _, err := out.Write(f.content[:len(f.content)/2]); err != nil {
+			return err
+		}
+		return errors.New("connection reset")
+	}
+
+	_, err := out.Write(f.content)
+	return err
+}
+
+func (f *brokenStreamService) DownloadFromOffset(ctx context.Context, file telegram.File, out io.Writer, offset int64) (int64, error) {
+	f.mu.Lock()
+	f.resumed = append(f.resumed, offset)
+	f.mu.Unlock()
+
+	return f.fakeFileService.DownloadFromOffset(ctx, file, out, offset)
+}
+
+// streamOnlyService hides DownloadFromOffset, retries download from the start.
+type streamOnlyService struct {
+	telegram.FileService
+}
+
+// brokenParallelService breaks the first parallel download after half of
+// the parts.
+type brokenParallelService struct {
+	fakeParallelFileService
+}
+
+func (f *brokenParallelService) DownloadParallel(ctx context.Context, file telegram.File, out io.WriterAt, threads int) error {
+	f.mu.Lock()
+	f.parallelCalls++
+	call := f.parallelCalls
+	f.mu.Unlock()
+
+	for off := 0; off < len(f.content); off += 2 {
+		if call == 1 && off >= len(f.content)/2 {
+			return errors.New("connection reset")
+		}
+
+		end := min(off+2, len(f.content))
+		if _, err := out.WriteAt(f.content[off:end], int64(off)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func TestDownloaderRetriesBrokenDownloads(t *testing.T) {
+	t.Parallel()
+
+	payload := []byte("a stream that breaks halfway through")
+	sum := sha256.Sum256(payload)
+
+	resumable := &brokenStreamService{fakeFileService: fakeFileService{content: payload}}
+	tests := []struct {
+		name    string
+		service telegram.FileService
+		threads int
+	}{
+		{name: "resumed", service: resumable},
+		{name: "restarted", service: streamOnlyService{&brokenStreamService{fakeFileService: fakeFileService{content: payload}}}},
+		{name: "parallel", service: &brokenParallelService{fakeParallelFileService{fakeFileService: fakeFileService{content: payload}}}, threads: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			fs := afero.NewMemMapFs()
+			tracker := &countingTracker{}
+
+			opts := []Option{WithNumWorkers(1), WithRetry(2, time.Millisecond), WithTracker(tracker)}
+			if tt.threads > 0 {
+				opts = append(opts, WithThreads(tt.threads))
+			}
+			d := New(fs, tt.service, opts...)
+			d.SetOutputDir("/downloads")
+
+			file := makeTelegramDocument("stream.bin", 101)
+			setUnexportedField(&file, "size", int64(len(payload)))
+
+			q := make(chan File)
+			d.Start(ctx)
+			d.AddDownloadQueue(ctx, q)
+			q <- NewFile(file)
+			close(q)
+
+			if err := d.Stop(ctx); err != nil {
+				t.Fatalf("Stop() unexpected error: %v", err)
+			}
+
+			got, err := afero.ReadFile(fs, "/downloads/stream.bin")
+			if err != nil {
+				t.Fatalf("ReadFile() error = %v", err)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Fatalf("saved %q, want %q", got, payload)
+			}
+
+			if tracker.written != int64(len(payload)) {
+				t.Fatalf("tracked %d bytes, want %d", tracker.written, len(payload))
+			}
+
+			manifest, err := loadFileManifest(fs, "/downloads/"+fileManifestName)
+			if err != nil {
+				t.Fatalf("loadFileManifest() error = %v", err)
+			}
+			if entry := manifest.Files["101"]; entry == nil || entry.State != fileDone {
+				t.Fatalf("manifest entry = %+v, want a finished download", entry)
+			} else if tt.threads == 0 && entry.Hash != hex.EncodeToString(sum[:]) {
+				t.Fatalf("manifest hash = %q, want the hash of the content", entry.Hash)
+			}
+		})
+	}
+
+	if want := []int64{int64(len(payload) / 2)}; fmt.Sprint(resumable.resumed) != fmt.Sprint(want) {
+		t.Fatalf("resumed from %v, want %v", resumable.resumed, want)
+	}
+}
@@ -0,0 +1,273 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/gotd/td/constant"
+	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
+)
+
+// defaultQueueBuffer is how many files every queue may have waiting for a
+// worker. It bounds how far ahead of the workers a history scan runs and how
+// many files can be reordered.
+const defaultQueueBuffer = 32
+
+// QueueOrder says which of the waiting files a free worker takes next.
+// Queues with a higher priority always go first.
+type QueueOrder string
+
+const (
+	// OrderFIFO downloads files in the order they were queued.
+	OrderFIFO QueueOrder = "fifo"
+	// OrderSmallest downloads the smallest waiting file first.
+	OrderSmallest QueueOrder = "smallest"
+	// OrderNewest downloads the file of the newest message first.
+	OrderNewest QueueOrder = "newest"
+	// OrderPeers takes turns between the peers with waiting files.
+	OrderPeers QueueOrder = "peers"
+)
+
+// ParseQueueOrder parses the downloader.queue.order setting. An empty value
+// is OrderFIFO.
+func ParseQueueOrder(value string) (QueueOrder, error) {
+	switch order := QueueOrder(strings.ToLower(strings.TrimSpace(value))); order {
+	case "":
+		return OrderFIFO, nil
+	case OrderFIFO, OrderSmallest, OrderNewest, OrderPeers:
+		return order, nil
+	default:
+		return OrderFIFO, apperr.New("downloader.queue.order", apperr.KindConfig, fmt.Errorf("invalid queue order %q, use fifo, smallest, newest or peers", value))
+	}
+}
+
+// WithQueueOrder sets the order in which workers take waiting files.
+func WithQueueOrder(order QueueOrder) Option {
+	return func(s *settings) {
+		s.queueOrder = order
+	}
+}
+
+// WithQueueBuffer sets how many files every queue may have waiting for a
+// worker. Larger buffers reorder more files but reserve their output paths
+// and budget earlier.
+func WithQueueBuffer(buffer int) Option {
+	return func(s *settings) {
+		s.queueBuffer = buffer
+	}
+}
+
+type queueSettings struct {
+	priority int
+}
+
+// QueueOption configures a single queue added with AddDownloadQueue.
+type QueueOption func(*queueSettings)
+
+// WithQueuePriority makes workers take the files of the queue before the
+// ones of queues with a lower priority. The default priority is zero.
+func WithQueuePriority(priority int) QueueOption {
+	return func(s *queueSettings) {
+		s.priority = priority
+	}
+}
+
+// fileQueue is a producer of files, with its own share of the buffer so that
+// a long history scan cannot crowd out other producers.
+type fileQueue struct {
+	priority int
+	waiting  int
+}
+
+type scheduledFile struct {
+	file  File
+	queue *fileQueue
+	seq   uint64
+}
+
+// scheduler hands waiting files to workers in the configured order.
+type scheduler struct {
+	order  QueueOrder
+	buffer int
+
+	mu      sync.Mutex
+	changed chan struct{}
+	files   []scheduledFile
+	served  map[constant.TDLibPeerID]uint64
+	seq     uint64
+	closed  bool
+}
+
+func newScheduler(order QueueOrder, buffer int) *scheduler {
+	if order == "" {
+		order = OrderFIFO
+	}
+
+	return &scheduler{
+		order:   order,
+		buffer:  max(buffer, 1),
+		changed: make(chan struct{}),
+		served:  make(map[constant.TDLibPeerID]uint64),
+	}
+}
+
+// notifyLocked wakes everyone waiting for a change.
+func (s *scheduler) notifyLocked() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// push waits until queue has room for another file and adds it. It reports
+// false when ctx is done, stop is closed or the scheduler is closed first.
+// Nothing is added once stop is closed, so draining after closing it leaves
+// no file behind.
+func (s *scheduler) push(ctx context.Context, stop <-chan struct{}, queue *fileQueue, file File) bool {
+	for {
+		s.mu.Lock()
+		if s.closed || isClosed(stop) {
+			s.mu.Unlock()
+			return false
+		}
+
+		if queue.waiting < s.buffer {
+			queue.waiting++
+			s.seq++
+			s.files = append(s.files, scheduledFile{file: file, queue: queue, seq: s.seq})
+			s.notifyLocked()
+			s.mu.Unlock()
+			return true
+		}
+
+		changed := s.changed
+		s.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-stop:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// pop waits for the next file. It reports false once the scheduler is closed
+// and drained, or when ctx is done.
+func (s *scheduler) pop(ctx context.Context) (File, bool) {
+	for {
+		s.mu.Lock()
+		if len(s.files) > 0 {
+			next := 0
+			for i := 1; i < len(s.files); i++ {
+				if s.before(s.files[i], s.files[next]) {
+					next = i
+				}
+			}
+
+			scheduled := s.files[next]
+			s.files = append(s.files[:next], s.files[next+1:]...)
+			scheduled.queue.waiting--
+			s.served[scheduled.file.PeerID()]++
+			s.notifyLocked()
+			s.mu.Unlock()
+			return scheduled.file, true
+		}
+
+		if s.closed {
+			s.mu.Unlock()
+			return File{}, false
+		}
+
+		changed := s.changed
+		s.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return File{}, false
+		}
+	}
+}
+
+// before reports whether a is due before b.
+func (s *scheduler) before(a, b scheduledFile) bool {
+	if a.queue.priority != b.queue.priority {
+		return a.queue.priority > b.queue.priority
+	}
+
+	switch s.order {
+	case OrderSmallest:
+		if a.file.Size() != b.file.Size() {
+			return a.file.Size() < b.file.Size()
+		}
+
+	case OrderNewest:
+		if !a.file.Date().Equal(b.file.Date()) {
+			return a.file.Date().After(b.file.Date())
+		}
+
+	case OrderPeers:
+		servedA, servedB := s.served[a.file.PeerID()], s.served[b.file.PeerID()]
+		if servedA != servedB {
+			return servedA < servedB
+		}
+	}
+
+	return a.seq < b.seq
+}
+
+// drop removes and returns the waiting files of queue, whose producer gave
+// up.
+func (s *scheduler) drop(queue *fileQueue) []File {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var dropped []File
+	s.files = slices.DeleteFunc(s.files, func(scheduled scheduledFile) bool {
+		if scheduled.queue != queue {
+			return false
+		}
+
+		dropped = append(dropped, scheduled.file)
+		return true
+	})
+	queue.waiting = 0
+	s.notifyLocked()
+	return dropped
+}
+
+// drain removes and returns all waiting files.
+func (s *scheduler) drain() []File {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files := make([]File, 0, len(s.files))
+	for _, scheduled := range s.files {
+		scheduled.queue.waiting--
+		files = append(files, scheduled.file)
+	}
+	s.files = nil
+	s.notifyLocked()
+	return files
+}
+
+// close lets pop report false once the waiting files are taken.
+func (s *scheduler) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	s.notifyLocked()
+}
+
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,119 @@
+package downloader
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gotd/td/constant"
+)
+
+func makeScheduledFile(name string, size int64, date time.Time, peerID constant.TDLibPeerID) File {
+	f := makeTelegramFile(name)
+	setUnexportedField(&f, "size", size)
+	setUnexportedField(&f, "date", int(date.Unix()))
+	setUnexportedField(&f, "peerID", peerID)
+	return File{File: f}
+}
+
+func popNames(t *testing.T, s *scheduler, n int) []string {
+	t.Helper()
+
+	names := make([]string, 0, n)
+	for range n {
+		file, ok := s.pop(context.Background())
+		if !ok {
+			t.Fatalf("pop() returned no file after %v", names)
+		}
+		names = append(names, file.Name())
+	}
+
+	return names
+}
+
+func pushAll(t *testing.T, s *scheduler, queue *fileQueue, files ...File) {
+	t.Helper()
+
+	for _, file := range files {
+		if !s.push(context.Background(), nil, queue, file) {
+			t.Fatalf("push(%s) was refused", file.Name())
+		}
+	}
+}
+
+func TestSchedulerOrders(t *testing.T) {
+	t.Parallel()
+
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	files := []File{
+		makeScheduledFile("old-large", 30, base, 1),
+		makeScheduledFile("new-small", 10, base.Add(2*time.Hour), 1),
+		makeScheduledFile("mid-medium", 20, base.Add(time.Hour), 2),
+	}
+
+	tests := []struct {
+		order QueueOrder
+		want  []string
+	}{
+		{OrderFIFO, []string{"old-large", "new-small", "mid-medium"}},
+		{OrderSmallest, []string{"new-small", "mid-medium", "old-large"}},
+		{OrderNewest, []string{"new-small", "mid-medium", "old-large"}},
+		{OrderPeers, []string{"old-large", "mid-medium", "new-small"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.order), func(t *testing.T) {
+			t.Parallel()
+
+			s := newScheduler(tt.order, 10)
+			pushAll(t, s, &fileQueue{}, files...)
+			got := popNames(t, s, len(files))
+			for i := range tt.want {
+				if got[i] != tt.want[i] {
+					t.Fatalf("order %s = %v, want %v", tt.order, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSchedulerPrefersHigherPriorityQueues(t *testing.T) {
+	t.Parallel()
+
+	s := newScheduler(OrderSmallest, 10)
+	history := &fileQueue{}
+	message := &fileQueue{priority: 1}
+
+	pushAll(t, s, history, makeScheduledFile("history-1", 1, time.Time{}, 1), makeScheduledFile("history-2", 2, time.Time{}, 1))
+	pushAll(t, s, message, makeScheduledFile("message", 100, time.Time{}, 2))
+
+	if got := popNames(t, s, 3); got[0] != "message" || got[1] != "history-1" || got[2] != "history-2" {
+		t.Fatalf("pop order = %v", got)
+	}
+}
+
+func TestSchedulerBuffersEveryQueueSeparately(t *testing.T) {
+	t.Parallel()
+
+	s := newScheduler(OrderFIFO, 1)
+	history := &fileQueue{}
+	pushAll(t, s, history, makeScheduledFile("history-1", 1, time.Time{}, 1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if s.push(ctx, nil, history, makeScheduledFile("history-2", 1, time.Time{}, 1)) {
+		t.Fatal("push() went over the buffer of the queue")
+	}
+
+	// A full history queue does not hold up other producers.
+	pushAll(t, s, &fileQueue{}, makeScheduledFile("message", 1, time.Time{}, 2))
+
+	s.drop(history)
+	s.close()
+	if got := popNames(t, s, 1); got[0] != "message" {
+		t.Fatalf("pop() = %v, want the file of the other queue", got)
+	}
+	if _, ok := s.pop(context.Background()); ok {
+		t.Fatal("pop() returned a file of a dropped queue")
+	}
+}
@@ -0,0 +1,187 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
+	"github.com/spf13/afero"
+)
+
+// FreeSpaceFunc returns the number of bytes that can still be written below
+// dir.
+type FreeSpaceFunc func(ctx context.Context, dir string) (uint64, error)
+
+// ErrInsufficientSpace is reported for a file that was not downloaded because
+// the output filesystem does not have room for it.
+var ErrInsufficientSpace = errors.New("not enough free disk space")
+
+// WithFreeSpace checks the free space of the output directory before the
+// downloader starts and before every file, and stops queuing files once it
+// would drop below reserve bytes.
+func WithFreeSpace(fn FreeSpaceFunc, reserve int64) Option {
+	return func(s *settings) {
+		s.freeSpace = fn
+		s.spaceReserve = max(reserve, 0)
+	}
+}
+
+// OutOfSpace returns a channel that is closed once the output filesystem ran
+// out of space, or its free space could not be checked at the start, and no
+// more files will be queued.
+func (d *Downloader) OutOfSpace() <-chan struct{} {
+	return d.outOfSpace
+}
+
+// checkFreeSpace makes sure that the reserve is still free before any file
+// is downloaded.
+func (d *Downloader) checkFreeSpace(ctx context.Context) error {
+	if d.freeSpace == nil || d.dryRun {
+		return nil
+	}
+
+	free, err := d.freeSpace(ctx, d.outputDir)
+	if err != nil {
+		return apperr.New("downloader.free_space", apperr.KindIO, fmt.Errorf("get free space of %q: %w", d.outputDir, err))
+	}
+
+	if int64(min(free, math.MaxInt64)) <= d.spaceReserve {
+		d.stopOnSpace()
+		return apperr.New("downloader.free_space", apperr.KindIO, fmt.Errorf(
+			"%w: %s free in %q, %s has to stay free",
+			ErrInsufficientSpace,
+			formatSize(int64(min(free, math.MaxInt64))),
+			d.outputDir,
+			formatSize(d.spaceReserve),
+		))
+	}
+
+	return nil
+}
+
+// reserveSpace makes sure that size more bytes fit on the output filesystem
+// next to the files being written already, and accounts them until release
+// is called. In a dry run it only adds size to the estimate.
+func (d *Downloader) reserveSpace(ctx context.Context, file File, size int64) (release func(), err error) {
+	if d.dryRun {
+		atomic.AddInt64(&d.needed, size)
+		return func() {}, nil
+	}
+
+	if d.freeSpace == nil || size <= 0 {
+		return func() {}, nil
+	}
+
+	d.spaceMu.Lock()
+	defer d.spaceMu.Unlock()
+
+	if isClosed(d.outOfSpace) {
+		return nil, apperr.New("downloader.free_space", apperr.KindIO, fmt.Errorf("%w for %q, downloads were stopped", ErrInsufficientSpace, file.Name()))
+	}
+
+	free, err := d.freeSpace(ctx, d.outputDir)
+	if err != nil {
+		return nil, apperr.New("downloader.free_space", apperr.KindIO, fmt.Errorf("get free space of %q: %w", d.outputDir, err))
+	}
+
+	// Files being written already took part of their size from free, so
+	// this errs on the safe side.
+	need := size + d.writing + d.spaceReserve
+	if available := int64(min(free, math.MaxInt64)); available < need {
+		d.stopOnSpace()
+		return nil, apperr.New("downloader.free_space", apperr.KindIO, fmt.Errorf(
+			"%w for %q: %s needed with the downloads in progress and %s kept free, but only %s is free in %q, %s short",
+			ErrInsufficientSpace,
+			file.Name(),
+			formatSize(size+d.writing),
+			formatSize(d.spaceReserve),
+			formatSize(available),
+			d.outputDir,
+			formatSize(need-available),
+		))
+	}
+
+	d.writing += size
+	var released atomic.Bool
+	return func() {
+		if released.Swap(true) {
+			return
+		}
+
+		d.spaceMu.Lock()
+		defer d.spaceMu.Unlock()
+		d.writing -= size
+	}, nil
+}
+
+func (d *Downloader) stopOnSpace() {
+	d.spaceOnce.Do(func() {
+		close(d.outOfSpace)
+	})
+}
+
+// measureFreeSpace records the free space a dry run is estimated against.
+func (d *Downloader) measureFreeSpace(ctx context.Context) {
+	if !d.dryRun || d.freeSpace == nil {
+		return
+	}
+
+	free, err := d.freeSpace(ctx, d.outputDir)
+	if err != nil {
+		return
+	}
+
+	atomic.StoreInt64(&d.measuredFree, int64(min(free, math.MaxInt64)))
+}
+
+// spaceStats fills in how much a dry run would download and how much space
+// is free for it.
+func (d *Downloader) spaceStats(stats *Stats) {
+	stats.Needed = atomic.LoadInt64(&d.needed)
+	stats.FreeSpace = atomic.LoadInt64(&d.measuredFree)
+	if stats.FreeSpace >= 0 {
+		stats.Shortfall = max(stats.Needed+d.spaceReserve-stats.FreeSpace, 0)
+	}
+}
+
+// spaceNeeded returns the bytes file takes in every output path that is
+// going to be written.
+func (d *Downloader) spaceNeeded(file File, outputPaths []string) (int64, error) {
+	var count int64
+	for _, outputPath := range outputPaths {
+		exists, err := afero.Exists(d.fs, outputPath)
+		if err != nil {
+			return 0, err
+		}
+
+		if !exists || d.rewrite {
+			count++
+		}
+	}
+
+	return max(file.Size(), 0) * count, nil
+}
+
+func formatSize(size int64) string {
+	units := []struct {
+		size int64
+		name string
+	}{
+		{1 << 40, "TiB"},
+		{1 << 30, "GiB"},
+		{1 << 20, "MiB"},
+		{1 << 10, "KiB"},
+	}
+	for _, unit := range units {
+		if size >= unit.size {
+			amount := math.Round(float64(size)/float64(unit.size)*100) / 100
+			return strconv.FormatFloat(amount, 'f', -1, 64) + unit.name
+		}
+	}
+
+	return fmt.Sprintf("%dB", size)
+}
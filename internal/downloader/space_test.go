@@ -0,0 +1,122 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
+	"github.com/spf13/afero"
+)
+
+func fixedFreeSpace(free uint64) FreeSpaceFunc {
+	return func(context.Context, string) (uint64, error) {
+		return free, nil
+	}
+}
+
+func TestDownloaderStopsWhenFileDoesNotFit(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	fs := afero.NewMemMapFs()
+	svc := &fakeFileService{}
+	d := New(fs, svc, WithNumWorkers(1), WithRetry(1, time.Millisecond), WithFreeSpace(fixedFreeSpace(12), 5))
+	d.SetOutputDir("/downloads")
+
+	small := makeTelegramDocument("small.bin", 1)
+	setUnexportedField(&small, "size", int64(5))
+	large := makeTelegramDocument("large.bin", 2)
+	setUnexportedField(&large, "size", int64(10))
+	next := makeTelegramDocument("next.bin", 3)
+	setUnexportedField(&next, "size", int64(1))
+
+	q := make(chan File, 3)
+	q <- File{File: small}
+	q <- File{File: large}
+	q <- File{File: next}
+	close(q)
+
+	d.Start(ctx)
+	d.AddDownloadQueue(ctx, q)
+	err := d.Stop(ctx)
+	if !errors.Is(err, ErrInsufficientSpace) || !apperr.IsKind(err, apperr.KindIO) {
+		t.Fatalf("Stop() error = %v, want an I/O error about free space", err)
+	}
+
+	select {
+	case <-d.OutOfSpace():
+	default:
+		t.Fatal("running out of space was not reported")
+	}
+
+	// The file waiting behind the one that did not fit fails without a try.
+	if stats := d.Stats(); stats.Downloaded != 1 || stats.Failed != 2 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	for _, name := range []string{"/downloads/large.bin", "/downloads/large.bin.part", "/downloads/next.bin"} {
+		if exists, _ := afero.Exists(fs, name); exists {
+			t.Fatalf("%s was written after the disk ran out of space", name)
+		}
+	}
+}
+
+func TestDownloaderDoesNotStartBelowReserve(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	svc := &fakeFileService{}
+	d := New(afero.NewMemMapFs(), svc, WithNumWorkers(1), WithFreeSpace(fixedFreeSpace(1<<20), 1<<30))
+	d.SetOutputDir("/downloads")
+
+	q := make(chan File, 1)
+	q <- File{File: makeTelegramFile("a.txt")}
+	close(q)
+
+	d.Start(ctx)
+	d.AddDownloadQueue(ctx, q)
+	if err := d.Stop(ctx); !errors.Is(err, ErrInsufficientSpace) {
+		t.Fatalf("Stop() error = %v, want %v", err, ErrInsufficientSpace)
+	}
+	if got := svc.Calls(); got != 0 {
+		t.Fatalf("download calls = %d, want none", got)
+	}
+}
+
+func TestDownloaderDryRunEstimatesNeededSpace(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	fs := afero.NewMemMapFs()
+	if err := afero.WriteFile(fs, "/downloads/existing.bin", []byte("0123456789"), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	d := New(fs, &fakeFileService{}, WithNumWorkers(1), WithDryRun(true), WithFreeSpace(fixedFreeSpace(20), 4))
+	d.SetOutputDir("/downloads")
+
+	existing := makeTelegramDocument("existing.bin", 1)
+	setUnexportedField(&existing, "size", int64(10))
+	fresh := makeTelegramDocument("fresh.bin", 2)
+	setUnexportedField(&fresh, "size", int64(10))
+	tagged := makeTelegramDocument("tagged.bin", 3)
+	setUnexportedField(&tagged, "size", int64(4))
+
+	q := make(chan File, 3)
+	q <- File{File: existing}
+	q <- File{File: fresh}
+	q <- NewFile(tagged, WithSubdirs("a", "b"))
+	close(q)
+
+	d.Start(ctx)
+	d.AddDownloadQueue(ctx, q)
+	if err := d.Stop(ctx); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+
+	stats := d.Stats()
+	if stats.Needed != 18 || stats.FreeSpace != 20 || stats.Shortfall != 2 {
+		t.Fatalf("unexpected estimate: needed=%d free=%d shortfall=%d", stats.Needed, stats.FreeSpace, stats.Shortfall)
+	}
+}
@@ -0,0 +1,166 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
+	"github.com/johnnyipcom/tgdownloader/pkg/telegram"
+	"github.com/spf13/afero"
+)
+
+// ErrCorruptFile means a downloaded file does not match the hashes Telegram
+// keeps for it.
+var ErrCorruptFile = errors.New("file does not match telegram hashes")
+
+type hashFileService interface {
+	FileHashes(ctx context.Context, file telegram.File) ([]telegram.FileHash, error)
+}
+
+// VerifyStatus is the outcome of checking a downloaded file.
+type VerifyStatus string
+
+const (
+	VerifyOK         VerifyStatus = "ok"
+	VerifyCorrupt    VerifyStatus = "corrupt"
+	VerifyMissing    VerifyStatus = "missing"
+	VerifyUnverified VerifyStatus = "unverified"
+)
+
+// Verification is the result of checking one recorded download of a file.
+type Verification struct {
+	// LogicalPath is where the file was asked to be saved and Path is where it
+	// was actually saved, both relative to the output directory.
+	LogicalPath string
+	Path        string
+	Status      VerifyStatus
+	Err         error
+}
+
+// Verify checks every download of file recorded in the file manifest of the
+// output directory. Files Telegram keeps no hashes for are only checked for
+// their size.
+func (d *Downloader) Verify(ctx context.Context, file telegram.File) ([]Verification, error) {
+	var verifications []Verification
+	identity := file.Identity()
+	d.manifestMu.Lock()
+	for logicalPath, identities := range d.manifest.Paths {
+		if actualPath, ok := identities[identity]; ok {
+			if actualPath, valid := cleanManifestPath(actualPath); valid {
+				verifications = append(verifications, Verification{LogicalPath: logicalPath, Path: actualPath})
+			}
+		}
+	}
+	d.manifestMu.Unlock()
+
+	if len(verifications) == 0 {
+		return nil, nil
+	}
+
+	sort.Slice(verifications, func(i, j int) bool {
+		return verifications[i].Path < verifications[j].Path
+	})
+
+	hashes, err := d.fileHashes(ctx, file)
+	if err != nil {
+		return nil, apperr.Wrap("downloader.verify", err)
+	}
+
+	for i := range verifications {
+		v := &verifications[i]
+		v.Err = verifyFile(d.fs, path.Join(d.outputDir, v.Path), file.Size(), hashes)
+		switch {
+		case v.Err == nil && len(hashes) == 0:
+			v.Status = VerifyUnverified
+		case v.Err == nil:
+			v.Status = VerifyOK
+		case errors.Is(v.Err, os.ErrNotExist):
+			v.Status = VerifyMissing
+		case errors.Is(v.Err, ErrCorruptFile):
+			v.Status = VerifyCorrupt
+		default:
+			return nil, v.Err
+		}
+	}
+
+	return verifications, nil
+}
+
+func (d *Downloader) fileHashes(ctx context.Context, file telegram.File) ([]telegram.FileHash, error) {
+	service, ok := d.service.(hashFileService)
+	if !ok {
+		return nil, nil
+	}
+
+	return service.FileHashes(ctx, file)
+}
+
+// verifyDownload checks the part files of a finished download before they
+// are moved into place.
+func (d *Downloader) verifyDownload(ctx context.Context, file File, saver MultiSaver) error {
+	files, ok := saver.(*aferoSaver)
+	if !d.verify || !ok {
+		return nil
+	}
+
+	if err := files.Close(); err != nil {
+		return apperr.New("downloader.verify.close", apperr.KindIO, err)
+	}
+
+	hashes, err := d.fileHashes(ctx, file.File)
+	if err != nil {
+		return apperr.Wrap("downloader.verify", err)
+	}
+
+	if len(hashes) == 0 {
+		return nil
+	}
+
+	for _, part := range files.files {
+		if err := verifyFile(d.fs, part.Name(), file.Size(), hashes); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// verifyFile compares the size of filename and the SHA-256 of each hashed
+// range with what Telegram reports.
+func verifyFile(fs afero.Fs, filename string, size int64, hashes []telegram.FileHash) error {
+	f, err := fs.Open(filename)
+	if err != nil {
+		return apperr.New("downloader.verify.open", apperr.KindIO, fmt.Errorf("open %q: %w", filename, err))
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return apperr.New("downloader.verify.stat", apperr.KindIO, fmt.Errorf("stat %q: %w", filename, err))
+	}
+
+	if size > 0 && info.Size() != size {
+		return apperr.New("downloader.verify", apperr.KindIO, fmt.Errorf("%w: %q has %d of %d bytes", ErrCorruptFile, filename, info.Size(), size))
+	}
+
+	sum := sha256.New()
+	for _, hash := range hashes {
+		sum.Reset()
+		if _, err := io.Copy(sum, io.NewSectionReader(f, hash.Offset, int64(hash.Limit))); err != nil {
+			return apperr.New("downloader.verify.read", apperr.KindIO, fmt.Errorf("read %q: %w", filename, err))
+		}
+
+		if !bytes.Equal(sum.Sum(nil), hash.Hash) {
+			return apperr.New("downloader.verify", apperr.KindIO, fmt.Errorf("%w: %q differs at bytes %d-%d", ErrCorruptFile, filename, hash.Offset, hash.Offset+int64(hash.Limit)))
+		}
+	}
+
+	return nil
+}
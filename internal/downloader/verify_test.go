@@ -0,0 +1,126 @@
+package downloader
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/johnnyipcom/tgdownloader/pkg/telegram"
+	"github.com/spf13/afero"
+)
+
+type hashingFileService struct {
+	fakeFileService
+	hashed []byte
+}
+
+// FileHashes hashes hashed in ranges of four bytes.
+func (f *hashingFileService) FileHashes(_ context.Context, _ telegram.File) ([]telegram.FileHash, error) {
+	var hashes []telegram.FileHash
+	for offset := 0; offset < len(f.hashed); offset += 4 {
+		end := min(offset+4, len(f.hashed))
+		sum := sha256.Sum256(f.hashed[offset:end])
+		hashes = append(hashes, telegram.FileHash{Offset: int64(offset), Limit: 4, Hash: sum[:]})
+	}
+
+	return hashes, nil
+}
+
+func downloadForVerify(t *testing.T, d *Downloader, files ...telegram.File) error {
+	t.Helper()
+
+	ctx := context.Background()
+	q := make(chan File)
+	d.Start(ctx)
+	d.AddDownloadQueue(ctx, q)
+	for _, file := range files {
+		q <- File{File: file}
+	}
+	close(q)
+
+	return d.Stop(ctx)
+}
+
+func TestDownloaderRejectsDownloadsThatFailVerification(t *testing.T) {
+	t.Parallel()
+
+	fs := afero.NewMemMapFs()
+	svc := &hashingFileService{
+		fakeFileService: fakeFileService{content: []byte("downloaded-bytes")},
+		hashed:          []byte("telegram's-bytes"),
+	}
+
+	d := New(fs, svc, WithNumWorkers(1), WithRetry(1, time.Millisecond), WithVerify(true))
+	d.SetOutputDir("/downloads")
+
+	file := makeTelegramDocument("video.mp4", 101)
+	setUnexportedField(&file, "size", int64(len(svc.content)))
+
+	if err := downloadForVerify(t, d, file); !errors.Is(err, ErrCorruptFile) {
+		t.Fatalf("Stop() error = %v, want ErrCorruptFile", err)
+	}
+
+	for _, name := range []string{"/downloads/video.mp4", "/downloads/video.mp4.part"} {
+		if exists, _ := afero.Exists(fs, name); exists {
+			t.Fatalf("%q exists after failed verification", name)
+		}
+	}
+}
+
+func TestDownloaderVerifyChecksRecordedFiles(t *testing.T) {
+	t.Parallel()
+
+	fs := afero.NewMemMapFs()
+	payload := []byte("telegram-payload")
+	svc := &hashingFileService{fakeFileService: fakeFileService{content: payload}, hashed: payload}
+
+	d := New(fs, svc, WithNumWorkers(1), WithVerify(true))
+	d.SetOutputDir("/downloads")
+
+	good := makeTelegramDocument("good.bin", 1)
+	corrupt := makeTelegramDocument("corrupt.bin", 2)
+	missing := makeTelegramDocument("missing.bin", 3)
+	unknown := makeTelegramDocument("unknown.bin", 4)
+	for _, file := range []*telegram.File{&good, &corrupt, &missing, &unknown} {
+		setUnexportedField(file, "size", int64(len(payload)))
+	}
+
+	if err := downloadForVerify(t, d, good, corrupt, missing); err != nil {
+		t.Fatalf("Stop() unexpected error: %v", err)
+	}
+
+	if err := afero.WriteFile(fs, "/downloads/corrupt.bin", []byte("telegram-pAyload"), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if err := fs.Remove("/downloads/missing.bin"); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+
+	verifier := New(fs, svc)
+	verifier.SetOutputDir("/downloads")
+
+	tests := []struct {
+		file telegram.File
+		want VerifyStatus
+	}{
+		{file: good, want: VerifyOK},
+		{file: corrupt, want: VerifyCorrupt},
+		{file: missing, want: VerifyMissing},
+	}
+	for _, tt := range tests {
+		verifications, err := verifier.Verify(context.Background(), tt.file)
+		if err != nil {
+			t.Fatalf("Verify(%s) error = %v", tt.file.Name(), err)
+		}
+
+		if len(verifications) != 1 || verifications[0].Path != tt.file.Name() || verifications[0].Status != tt.want {
+			t.Fatalf("Verify(%s) = %+v, want one %s result", tt.file.Name(), verifications, tt.want)
+		}
+	}
+
+	if verifications, err := verifier.Verify(context.Background(), unknown); err != nil || len(verifications) != 0 {
+		t.Fatalf("Verify() of a file never downloaded = %+v, %v", verifications, err)
+	}
+}
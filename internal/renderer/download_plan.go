@@ -43,14 +43,67 @@ func RenderDownloadPlan(writer io.Writer, plan DownloadPlan) {
 	fmt.Fprintln(outputWriter(writer), FormatDownloadPlan(plan))
 }
 
-func RenderDownloadSummaryDetails(writer io.Writer, downloaded, skipped, failed int64, elapsed time.Duration, outputDir string) {
+type DownloadSummary struct {
+	Downloaded     int64
+	Skipped        int64
+	Failed         int64
+	ExcludedBySize int64
+	BudgetUsed     int64
+	Budget         int64
+	Deduplicated   int64
+	SavedBytes     int64
+	// DryRun summaries estimate the space the download needs. FreeSpace is
+	// negative when it is unknown.
+	DryRun    bool
+	Needed    int64
+	FreeSpace int64
+	Shortfall int64
+	Elapsed   time.Duration
+	OutputDir string
+}
+
+func FormatDownloadSummary(summary DownloadSummary) string {
+	var b strings.Builder
 	fmt.Fprintf(
-		outputWriter(writer),
-		"Summary: downloaded=%d skipped=%d failed=%d | elapsed=%s | output=%s\n",
-		downloaded,
-		skipped,
-		failed,
-		elapsed.Round(time.Millisecond),
-		outputDir,
+		&b,
+		"Summary: downloaded=%d skipped=%d failed=%d",
+		summary.Downloaded,
+		summary.Skipped,
+		summary.Failed,
 	)
+	if summary.ExcludedBySize > 0 {
+		fmt.Fprintf(&b, " excluded_by_size=%d", summary.ExcludedBySize)
+	}
+	if summary.Deduplicated > 0 {
+		fmt.Fprintf(&b, " | deduplicated=%d saved=%s", summary.Deduplicated, formatProgressBytes(summary.SavedBytes))
+	}
+	if summary.Budget > 0 {
+		fmt.Fprintf(&b, " | budget=%s/%s", formatProgressBytes(summary.BudgetUsed), formatProgressBytes(summary.Budget))
+	}
+	if summary.DryRun {
+		b.WriteString(" | " + formatSpaceEstimate(summary.Needed, summary.FreeSpace, summary.Shortfall))
+	}
+	fmt.Fprintf(
+		&b,
+		" | elapsed=%s | output=%s",
+		summary.Elapsed.Round(time.Millisecond),
+		summary.OutputDir,
+	)
+	return b.String()
+}
+
+func RenderDownloadSummaryDetails(writer io.Writer, summary DownloadSummary) {
+	fmt.Fprintln(outputWriter(writer), FormatDownloadSummary(summary))
+}
+
+func formatSpaceEstimate(needed, free, shortfall int64) string {
+	estimate := "needed=" + formatProgressBytes(needed)
+	if free >= 0 {
+		estimate += " free=" + formatProgressBytes(free)
+	}
+	if shortfall > 0 {
+		estimate += " short=" + formatProgressBytes(shortfall)
+	}
+
+	return estimate
 }
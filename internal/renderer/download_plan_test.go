@@ -5,6 +5,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestFormatDownloadPlanShowsResolvedTargetAndPolicy(t *testing.T) {
@@ -49,3 +50,43 @@ func TestRenderDownloadSummaryPreservesOneShotText(t *testing.T) {
 		t.Fatalf("output = %q, want %q", got, want)
 	}
 }
+
+func TestFormatDownloadSummaryShowsSizeExclusionsAndBudget(t *testing.T) {
+	got := FormatDownloadSummary(DownloadSummary{
+		Downloaded:     4,
+		Skipped:        1,
+		ExcludedBySize: 7,
+		BudgetUsed:     1_500_000_000,
+		Budget:         2_000_000_000,
+		Elapsed:        1500 * time.Millisecond,
+		OutputDir:      "./downloads",
+	})
+
+	want := "Summary: downloaded=4 skipped=1 failed=0 excluded_by_size=7 | budget=1.50GB/2.00GB | elapsed=1.5s | output=./downloads"
+	if got != want {
+		t.Fatalf("summary = %q, want %q", got, want)
+	}
+}
+
+func TestFormatDownloadSummaryOmitsUnusedLimits(t *testing.T) {
+	got := FormatDownloadSummary(DownloadSummary{Downloaded: 1, OutputDir: "out"})
+
+	if want := "Summary: downloaded=1 skipped=0 failed=0 | elapsed=0s | output=out"; got != want {
+		t.Fatalf("summary = %q, want %q", got, want)
+	}
+}
+
+func TestFormatDownloadSummaryEstimatesDryRunSpace(t *testing.T) {
+	got := FormatDownloadSummary(DownloadSummary{
+		DryRun:    true,
+		Needed:    3_000_000_000,
+		FreeSpace: 2_500_000_000,
+		Shortfall: 500_000_000,
+		OutputDir: "out",
+	})
+
+	want := "Summary: downloaded=0 skipped=0 failed=0 | needed=3.00GB free=2.50GB short=500.00MB | elapsed=0s | output=out"
+	if got != want {
+		t.Fatalf("summary = %q, want %q", got, want)
+	}
+}
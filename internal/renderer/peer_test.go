@@ -6,6 +6,7 @@ import (
 
 	"github.com/gotd/td/telegram/peers"
 	"github.com/gotd/td/tg"
+	"github.com/johnnyipcom/tgdownloader/pkg/telegram"
 )
 
 func TestRenderPeerTableEmitsSortedStructuredRows(t *testing.T) {
@@ -40,3 +41,22 @@ func TestRenderUserEmitsStructuredTable(t *testing.T) {
 		t.Fatalf("events = %+v, want one structured user table", events)
 	}
 }
+
+func TestRenderTopicsTableKeepsTelegramOrder(t *testing.T) {
+	topics := []telegram.ForumTopic{
+		{ID: 42, Title: "Releases", Pinned: true, Closed: true},
+		{ID: telegram.GeneralTopicID, Title: "General"},
+	}
+	sink := &recordingSink{}
+
+	RenderTopicsTable(NewEventWriter(sink), topics)
+
+	events := sink.Events()
+	if len(events) != 1 || events[0].Table == nil {
+		t.Fatalf("events = %+v, want structured table", events)
+	}
+	rows := events[0].Table.Rows
+	if len(rows) != 2 || rows[0][1] != "42" || rows[0][3] != "pinned,closed" || rows[1][2] != "General" {
+		t.Fatalf("rows = %q", rows)
+	}
+}
@@ -63,6 +63,26 @@ func RenderDownloadSummary(writer io.Writer, downloaded, skipped, failed int64)
 	))
 }
 
+// RenderDedupSummary renders the files saved as copies of earlier downloads.
+func RenderDedupSummary(writer io.Writer, deduplicated, savedBytes int64) {
+	renderSimpleLine(writer, simpleCyanStyle, fmt.Sprintf(
+		"Deduplicated: files=%d saved=%s",
+		deduplicated,
+		formatProgressBytes(savedBytes),
+	))
+}
+
+// RenderSpaceEstimate renders the space a dry run estimates the download to
+// need, next to the free space when it is known.
+func RenderSpaceEstimate(writer io.Writer, needed, free, shortfall int64) {
+	renderSimpleLine(writer, simpleCyanStyle, "Estimate: "+formatSpaceEstimate(needed, free, shortfall))
+}
+
+// RenderRetryFailedEmpty reports that there are no failed downloads to retry.
+func RenderRetryFailedEmpty(writer io.Writer) {
+	renderSimpleLine(writer, simpleCyanStyle, "No failed downloads to retry")
+}
+
 func renderSimpleLine(writer io.Writer, style lipgloss.Style, value string) {
 	writer = outputWriter(writer)
 	if terminal, ok := writer.(interface{ Fd() uintptr }); ok && term.IsTerminal(terminal.Fd()) {
@@ -0,0 +1,44 @@
+package renderer
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/johnnyipcom/tgdownloader/pkg/telegram"
+)
+
+// RenderTopicsTable renders the topics of a forum in the order Telegram
+// returned them.
+func RenderTopicsTable(writer io.Writer, topics []telegram.ForumTopic) {
+	data := TableData{Columns: []TableColumn{
+		{Header: "#", MinWidth: 2, Priority: 1, Align: TableAlignRight},
+		{Header: "Topic ID", MinWidth: 8, Priority: 100, Required: true, Align: TableAlignRight},
+		{Header: "Title", MinWidth: 12, Priority: 100, Required: true},
+		{Header: "Flags", MinWidth: 5, Priority: 20},
+	}}
+	for i, topic := range topics {
+		data.Rows = append(data.Rows, []string{
+			fmt.Sprintf("%d", i+1),
+			fmt.Sprintf("%d", topic.ID),
+			topic.Title,
+			topicFlags(topic),
+		})
+	}
+	renderTableData(writer, data)
+}
+
+func topicFlags(topic telegram.ForumTopic) string {
+	var flags []string
+	if topic.Pinned {
+		flags = append(flags, "pinned")
+	}
+	if topic.Closed {
+		flags = append(flags, "closed")
+	}
+	if topic.Hidden {
+		flags = append(flags, "hidden")
+	}
+
+	return strings.Join(flags, ",")
+}
@@ -0,0 +1,48 @@
+package renderer
+
+import (
+	"fmt"
+	"io"
+)
+
+// VerifiedFile is a downloaded file checked by the verify command.
+type VerifiedFile struct {
+	Path   string
+	Status string
+	Detail string
+}
+
+// RenderVerifyTable renders the files that failed verification.
+func RenderVerifyTable(writer io.Writer, files []VerifiedFile) {
+	data := TableData{Columns: []TableColumn{
+		{Header: "#", MinWidth: 2, Priority: 1, Align: TableAlignRight},
+		{Header: "Status", MinWidth: 7, Priority: 100, Required: true},
+		{Header: "Path", MinWidth: 12, Priority: 100, Required: true},
+		{Header: "Detail", MinWidth: 12, Priority: 10},
+	}}
+	for i, file := range files {
+		data.Rows = append(data.Rows, []string{
+			fmt.Sprintf("%d", i+1),
+			file.Status,
+			file.Path,
+			file.Detail,
+		})
+	}
+	renderTableData(writer, data)
+}
+
+// RenderVerifySummary renders the number of checked files per status.
+func RenderVerifySummary(writer io.Writer, ok, unverified, corrupt, missing int) {
+	style := simpleCyanStyle
+	if corrupt > 0 || missing > 0 {
+		style = simpleYellowStyle
+	}
+
+	renderSimpleLine(writer, style, fmt.Sprintf(
+		"Verified: ok=%d unverified=%d corrupt=%d missing=%d",
+		ok,
+		unverified,
+		corrupt,
+		missing,
+	))
+}
@@ -108,3 +108,14 @@ func IsKind(err error, kind Kind) bool {
 
 	return e.Kind == kind
 }
+
+// KindOf returns the kind of the outermost application error in err, or
+// KindUnknown when there is none.
+func KindOf(err error) Kind {
+	var e *Error
+	if !errors.As(err, &e) || e.Kind == "" {
+		return KindUnknown
+	}
+
+	return e.Kind
+}
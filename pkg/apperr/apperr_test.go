@@ -2,6 +2,7 @@ package apperr
 
 import (
 	"errors"
+	"fmt"
 	"testing"
 )
 
@@ -57,3 +58,16 @@ func TestWrapAssignsUnknownKindForPlainErrors(t *testing.T) {
 		t.Fatalf("unexpected kind: got %q want %q", appErr.Kind, KindUnknown)
 	}
 }
+
+func TestKindOfReturnsOutermostKind(t *testing.T) {
+	t.Parallel()
+
+	wrapped := fmt.Errorf("context: %w", New("downloader.download", KindNetwork, errors.New("timeout")))
+	if kind := KindOf(wrapped); kind != KindNetwork {
+		t.Fatalf("unexpected kind: got %q want %q", kind, KindNetwork)
+	}
+
+	if kind := KindOf(errors.New("plain")); kind != KindUnknown {
+		t.Fatalf("unexpected kind: got %q want %q", kind, KindUnknown)
+	}
+}
@@ -34,7 +34,22 @@ func validateOAuthCallbackState(rawQuery string, cookie *http.Cookie) (url.Value
 	return values, nil
 }
 
+// RunOAuth2Server authorizes the user in the browser and returns a client
+// with the token.
 func RunOAuth2Server(ctx context.Context, writer io.Writer, port int, cfg oauth2.Config) (*http.Client, error) {
+	token, err := Authorize(ctx, writer, port, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg.Client(ctx, token), nil
+}
+
+// Authorize runs a local server that sends the user to the authorization
+// page of the provider and exchanges the code it redirects back with for a
+// token. PKCE protects the code, so a client secret is optional where the
+// provider allows it. opts add parameters to the authorization URL.
+func Authorize(ctx context.Context, writer io.Writer, port int, cfg oauth2.Config, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
 	if ctx == nil {
 		ctx = context.Background()
 	}
@@ -47,11 +62,10 @@ func RunOAuth2Server(ctx context.Context, writer io.Writer, port int, cfg oauth2
 		return nil, apperr.New("oauth2server.listen", apperr.KindNetwork, err)
 	}
 
-	type oauthResult struct {
-		client *http.Client
-		err    error
-	}
-	result := make(chan oauthResult, 1)
+	verifier := oauth2.GenerateVerifier()
+	authOptions := append([]oauth2.AuthCodeOption{oauth2.AccessTypeOffline, oauth2.S256ChallengeOption(verifier)}, opts...)
+
+	result := make(chan *oauth2.Token, 1)
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		cookie := &http.Cookie{
@@ -61,7 +75,7 @@ func RunOAuth2Server(ctx context.Context, writer io.Writer, port int, cfg oauth2
 			HttpOnly: true,
 		}
 		http.SetCookie(w, cookie)
-		authorizationURL := cfg.AuthCodeURL(cookie.Value, oauth2.AccessTypeOffline)
+		authorizationURL := cfg.AuthCodeURL(cookie.Value, authOptions...)
 		http.Redirect(w, r, authorizationURL, http.StatusFound)
 	})
 	mux.HandleFunc("/oauth2/callback", func(w http.ResponseWriter, r *http.Request) {
@@ -85,14 +99,14 @@ func RunOAuth2Server(ctx context.Context, writer io.Writer, port int, cfg oauth2
 			return
 		}
 
-		token, err := cfg.Exchange(r.Context(), values.Get("code"))
+		token, err := cfg.Exchange(r.Context(), values.Get("code"), oauth2.VerifierOption(verifier))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
 		select {
-		case result <- oauthResult{client: cfg.Client(ctx, token)}:
+		case result <- token:
 			w.WriteHeader(http.StatusOK)
 			_, _ = w.Write([]byte("Success"))
 		case <-ctx.Done():
@@ -118,15 +132,12 @@ func RunOAuth2Server(ctx context.Context, writer io.Writer, port int, cfg oauth2
 	actualPort := listener.Addr().(*net.TCPAddr).Port
 	_, _ = fmt.Fprintf(writer, "Go to http://localhost:%d to authorize client\n", actualPort)
 
-	var authorized *http.Client
+	var token *oauth2.Token
 	select {
 	case <-ctx.Done():
 		err = ctx.Err()
-	case res := <-result:
-		authorized, err = res.client, res.err
-		if err == nil {
-			_, _ = fmt.Fprintln(writer, "Client authorized")
-		}
+	case token = <-result:
+		_, _ = fmt.Fprintln(writer, "Client authorized")
 	case serveFailure := <-serveErr:
 		if serveFailure != nil {
 			err = apperr.New("oauth2server.serve", apperr.KindNetwork, serveFailure)
@@ -139,5 +150,5 @@ func RunOAuth2Server(ctx context.Context, writer io.Writer, port int, cfg oauth2
 	defer cancelShutdown()
 	_ = srv.Shutdown(shutdownCtx)
 	_ = listener.Close()
-	return authorized, err
+	return token, err
 }
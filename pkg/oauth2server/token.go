@@ -0,0 +1,135 @@
+package oauth2server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
+	"golang.org/x/oauth2"
+)
+
+// TokenStore persists tokens between runs under a name, such as the storage
+// they authorize.
+type TokenStore interface {
+	Get(ctx context.Context, name string) (*oauth2.Token, bool, error)
+	Put(ctx context.Context, name string, token *oauth2.Token) error
+	Delete(ctx context.Context, name string) error
+}
+
+// PersistentClient returns a client authorized with the token saved under
+// name, refreshing it when it expires. The browser flow of Authorize runs
+// only when there is no token or the provider refuses to refresh it, and
+// the token it gets is saved for the next run.
+func PersistentClient(ctx context.Context, writer io.Writer, port int, cfg oauth2.Config, store TokenStore, name string, opts ...oauth2.AuthCodeOption) (*http.Client, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if writer == nil {
+		writer = io.Discard
+	}
+
+	// The client outlives the context it was created with.
+	clientCtx := context.WithoutCancel(ctx)
+
+	token, err := storedToken(ctx, writer, cfg, store, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if token == nil {
+		token, err = Authorize(ctx, writer, port, cfg, opts...)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := store.Put(ctx, name, token); err != nil {
+			_, _ = fmt.Fprintf(writer, "Failed to save the %s token, you will be asked to authorize again: %v\n", name, err)
+		}
+	}
+
+	source := &savingTokenSource{
+		ctx:    clientCtx,
+		base:   cfg.TokenSource(clientCtx, token),
+		store:  store,
+		name:   name,
+		access: token.AccessToken,
+	}
+
+	return oauth2.NewClient(clientCtx, oauth2.ReuseTokenSource(token, source)), nil
+}
+
+// storedToken loads the token saved under name and refreshes it if it has
+// expired. It returns nil when the user has to authorize again.
+func storedToken(ctx context.Context, writer io.Writer, cfg oauth2.Config, store TokenStore, name string) (*oauth2.Token, error) {
+	token, found, err := store.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, nil
+	}
+
+	fresh, err := cfg.TokenSource(ctx, token).Token()
+	if err == nil {
+		if fresh.AccessToken != token.AccessToken {
+			if err := store.Put(ctx, name, fresh); err != nil {
+				_, _ = fmt.Fprintf(writer, "Failed to save the refreshed %s token: %v\n", name, err)
+			}
+		}
+
+		return fresh, nil
+	}
+
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, apperr.New("oauth2server.refresh_token", apperr.KindCancel, ctxErr)
+	}
+
+	var retrieveErr *oauth2.RetrieveError
+	if !errors.As(err, &retrieveErr) {
+		return nil, apperr.New("oauth2server.refresh_token", apperr.KindNetwork, err)
+	}
+
+	// The refresh token was revoked or has expired.
+	_, _ = fmt.Fprintf(writer, "The saved %s token is no longer valid, authorize the client again\n", name)
+	if err := store.Delete(ctx, name); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// savingTokenSource saves the tokens it refreshes, so the next run starts
+// with the latest one.
+type savingTokenSource struct {
+	ctx   context.Context
+	base  oauth2.TokenSource
+	store TokenStore
+	name  string
+
+	mu     sync.Mutex
+	access string
+}
+
+func (s *savingTokenSource) Token() (*oauth2.Token, error) {
+	token, err := s.base.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if token.AccessToken != s.access {
+		// The refresh token stays valid, a token that isn't saved is only
+		// refreshed again on the next run.
+		if err := s.store.Put(s.ctx, s.name, token); err == nil {
+			s.access = token.AccessToken
+		}
+	}
+
+	return token, nil
+}
@@ -0,0 +1,279 @@
+package oauth2server
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+type memoryTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]*oauth2.Token
+}
+
+func newMemoryTokenStore() *memoryTokenStore {
+	return &memoryTokenStore{tokens: map[string]*oauth2.Token{}}
+}
+
+func (s *memoryTokenStore) Get(_ context.Context, name string) (*oauth2.Token, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.tokens[name]
+	return token, ok, nil
+}
+
+func (s *memoryTokenStore) Put(_ context.Context, name string, token *oauth2.Token) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tokens[name] = token
+	return nil
+}
+
+func (s *memoryTokenStore) Delete(_ context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.tokens, name)
+	return nil
+}
+
+// provider is a fake authorization server that checks PKCE and hands out
+// numbered access tokens.
+type provider struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	challenge string
+	issued    int
+	refuse    bool
+}
+
+func newProvider(t *testing.T) *provider {
+	t.Helper()
+
+	p := &provider{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("code_challenge_method") != "S256" || query.Get("token_access_type") != "offline" {
+			http.Error(w, "unexpected authorization request", http.StatusBadRequest)
+			return
+		}
+
+		p.mu.Lock()
+		p.challenge = query.Get("code_challenge")
+		p.mu.Unlock()
+
+		http.Redirect(w, r, query.Get("redirect_uri")+"?code=code&state="+query.Get("state"), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		switch r.FormValue("grant_type") {
+		case "authorization_code":
+			sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+			if r.FormValue("code") != "code" || base64.RawURLEncoding.EncodeToString(sum[:]) != p.challenge {
+				http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+				return
+			}
+		case "refresh_token":
+			if p.refuse || r.FormValue("refresh_token") != "refresh" {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+				return
+			}
+		default:
+			http.Error(w, "unexpected grant", http.StatusBadRequest)
+			return
+		}
+
+		p.issued++
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"access_token":  fmt.Sprintf("access-%d", p.issued),
+			"refresh_token": "refresh",
+			"token_type":    "bearer",
+			"expires_in":    3600,
+		})
+	})
+	mux.HandleFunc("/api", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get("Authorization")))
+	})
+
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+
+	return p
+}
+
+func (p *provider) config() oauth2.Config {
+	return oauth2.Config{
+		ClientID: "client",
+		Endpoint: oauth2.Endpoint{
+			AuthURL:   p.URL + "/authorize",
+			TokenURL:  p.URL + "/token",
+			AuthStyle: oauth2.AuthStyleInParams,
+		},
+	}
+}
+
+func callAPI(t *testing.T, client *http.Client, p *provider) string {
+	t.Helper()
+
+	resp, err := client.Get(p.URL + "/api")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+
+	return string(data)
+}
+
+func TestPersistentClientReusesAndRefreshesToken(t *testing.T) {
+	t.Parallel()
+
+	p := newProvider(t)
+	store := newMemoryTokenStore()
+	cfg := p.config()
+
+	_ = store.Put(context.Background(), "dropbox", &oauth2.Token{AccessToken: "saved", RefreshToken: "refresh", Expiry: time.Now().Add(time.Hour)})
+	client, err := PersistentClient(context.Background(), io.Discard, 0, cfg, store, "dropbox")
+	if err != nil {
+		t.Fatalf("PersistentClient() error = %v", err)
+	}
+	if got := callAPI(t, client, p); got != "Bearer saved" {
+		t.Fatalf("Authorization = %q, want the saved token", got)
+	}
+
+	_ = store.Put(context.Background(), "dropbox", &oauth2.Token{AccessToken: "expired", RefreshToken: "refresh", Expiry: time.Now().Add(-time.Hour)})
+	client, err = PersistentClient(context.Background(), io.Discard, 0, cfg, store, "dropbox")
+	if err != nil {
+		t.Fatalf("PersistentClient() error = %v", err)
+	}
+	if got := callAPI(t, client, p); got != "Bearer access-1" {
+		t.Fatalf("Authorization = %q, want the refreshed token", got)
+	}
+
+	saved, _, _ := store.Get(context.Background(), "dropbox")
+	if saved.AccessToken != "access-1" || saved.RefreshToken != "refresh" {
+		t.Fatalf("saved token = %+v, want the refreshed one", saved)
+	}
+}
+
+func TestStoredTokenForgetsRefusedToken(t *testing.T) {
+	t.Parallel()
+
+	p := newProvider(t)
+	p.refuse = true
+	store := newMemoryTokenStore()
+	_ = store.Put(context.Background(), "dropbox", &oauth2.Token{AccessToken: "expired", RefreshToken: "refresh", Expiry: time.Now().Add(-time.Hour)})
+
+	token, err := storedToken(context.Background(), io.Discard, p.config(), store, "dropbox")
+	if err != nil || token != nil {
+		t.Fatalf("storedToken() = %v, %v, want to authorize again", token, err)
+	}
+	if _, found, _ := store.Get(context.Background(), "dropbox"); found {
+		t.Fatal("the refused token was kept")
+	}
+}
+
+func TestPersistentClientAuthorizesWithPKCEAndSavesToken(t *testing.T) {
+	t.Parallel()
+
+	p := newProvider(t)
+	store := newMemoryTokenStore()
+	reader, writer := io.Pipe()
+	defer reader.Close()
+
+	type result struct {
+		client *http.Client
+		err    error
+	}
+	done := make(chan result, 1)
+	addr := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(reader).ReadString('\n')
+		addr <- strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(line, "Go to "), " to authorize client\n"))
+		_, _ = io.Copy(io.Discard, reader)
+	}()
+
+	// The redirect URL isn't known before the server listens, the browser
+	// below fills it in.
+	cfg := p.config()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		client, err := PersistentClient(ctx, writer, 0, cfg, store, "dropbox", oauth2.SetAuthURLParam("token_access_type", "offline"))
+		done <- result{client: client, err: err}
+	}()
+
+	var base string
+	select {
+	case base = <-addr:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the authorization address was not printed")
+	}
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatalf("cookiejar.New() error = %v", err)
+	}
+	browser := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, _ []*http.Request) error {
+			// Point the provider back at the local server.
+			if req.URL.Path == "/authorize" {
+				query := req.URL.Query()
+				query.Set("redirect_uri", base+"/oauth2/callback")
+				req.URL.RawQuery = query.Encode()
+			}
+			return nil
+		},
+	}
+
+	resp, err := browser.Get(base)
+	if err != nil {
+		t.Fatalf("browser Get() error = %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("callback status = %d: %s", resp.StatusCode, body)
+	}
+
+	res := <-done
+	if res.err != nil {
+		t.Fatalf("PersistentClient() error = %v", res.err)
+	}
+	if got := callAPI(t, res.client, p); got != "Bearer access-1" {
+		t.Fatalf("Authorization = %q, want the new token", got)
+	}
+
+	saved, found, _ := store.Get(context.Background(), "dropbox")
+	if !found || saved.AccessToken != "access-1" || saved.RefreshToken != "refresh" {
+		t.Fatalf("saved token = %+v, want the new one", saved)
+	}
+}
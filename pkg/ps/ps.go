@@ -5,12 +5,21 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"slices"
+	"sync"
 
+	"github.com/shirou/gopsutil/v3/disk"
 	"github.com/shirou/gopsutil/v3/process"
 )
 
 var proc *process.Process
 
+var (
+	sourcesMu  sync.Mutex
+	sources    = make(map[int]func() string)
+	nextSource int
+)
+
 var (
 	unitScales = []int64{
 		1000000000000000,
@@ -54,9 +63,39 @@ func Humanize(ctx context.Context) []string {
 
 	str = append(str, fmt.Sprintf("Goroutines: %d", GetGoroutineNum()))
 
+	sourcesMu.Lock()
+	ids := make([]int, 0, len(sources))
+	for id := range sources {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	for _, id := range ids {
+		if part := sources[id](); part != "" {
+			str = append(str, part)
+		}
+	}
+	sourcesMu.Unlock()
+
 	return str
 }
 
+// AddSource appends what fn returns to the status line, unless it is empty.
+// The returned function removes fn again.
+func AddSource(fn func() string) func() {
+	sourcesMu.Lock()
+	defer sourcesMu.Unlock()
+
+	id := nextSource
+	nextSource++
+	sources[id] = fn
+
+	return func() {
+		sourcesMu.Lock()
+		defer sourcesMu.Unlock()
+		delete(sources, id)
+	}
+}
+
 func init() {
 	var err error
 	proc, err = process.NewProcess(int32(os.Getpid()))
@@ -83,6 +122,17 @@ func GetSelfMem(ctx context.Context) (*process.MemoryInfoStat, error) {
 	return m, nil
 }
 
+// GetDiskFree returns the bytes available to unprivileged users on the
+// filesystem that holds path.
+func GetDiskFree(ctx context.Context, path string) (uint64, error) {
+	usage, err := disk.UsageWithContext(ctx, path)
+	if err != nil {
+		return 0, err
+	}
+
+	return usage.Free, nil
+}
+
 func GetGoroutineNum() int {
 	return runtime.NumGoroutine()
 }
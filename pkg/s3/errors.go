@@ -0,0 +1,9 @@
+package s3
+
+import "errors"
+
+// ErrNotSupported is returned when this operation is not supported by S3.
+var ErrNotSupported = errors.New("s3 doesn't support this operation")
+
+// ErrAlreadyOpened is returned when the file is already opened.
+var ErrAlreadyOpened = errors.New("already opened")
@@ -0,0 +1,340 @@
+package s3
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer is an in-memory S3 API with just enough of the protocol for
+// the client calls Fs makes, addressed in path style.
+type fakeServer struct {
+	bucket string
+
+	mu         sync.Mutex
+	objects    map[string]fakeObject
+	uploads    map[string]map[int][]byte
+	nextUpload int
+	multiparts int
+}
+
+type fakeObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+func (o fakeObject) etag() string {
+	sum := md5.Sum(o.data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func newFakeServer(t *testing.T, bucket string) (*fakeServer, *httptest.Server) {
+	t.Helper()
+
+	fake := &fakeServer{
+		bucket:  bucket,
+		objects: map[string]fakeObject{},
+		uploads: map[string]map[int][]byte{},
+	}
+
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server
+}
+
+func (s *fakeServer) object(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	object, ok := s.objects[key]
+	return object.data, ok
+}
+
+func (s *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != s.bucket {
+		writeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	query := r.URL.Query()
+	switch {
+	case key == "" && r.Method == http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	case key == "" && r.Method == http.MethodGet:
+		s.list(w, query)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		s.createUpload(w)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		s.uploadPart(w, r, query)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		s.completeUpload(w, key, query.Get("uploadId"))
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		s.copy(w, r, key)
+	case r.Method == http.MethodPut:
+		data, err := readPayload(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		w.Header().Set("ETag", s.put(key, data).etag())
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		s.get(w, r, key)
+	case r.Method == http.MethodDelete:
+		s.mu.Lock()
+		delete(s.objects, key)
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (s *fakeServer) put(key string, data []byte) fakeObject {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	object := fakeObject{data: data, modTime: time.Now().UTC().Truncate(time.Second)}
+	s.objects[key] = object
+	return object
+}
+
+func (s *fakeServer) get(w http.ResponseWriter, r *http.Request, key string) {
+	s.mu.Lock()
+	object, ok := s.objects[key]
+	s.mu.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+
+	w.Header().Set("ETag", object.etag())
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, key, object.modTime, bytes.NewReader(object.data))
+}
+
+func (s *fakeServer) copy(w http.ResponseWriter, r *http.Request, key string) {
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+
+	source = strings.TrimPrefix(strings.TrimPrefix(source, "/"), s.bucket+"/")
+	data, ok := s.object(source)
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+
+	object := s.put(key, bytes.Clone(data))
+	writeXML(w, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		ETag         string
+		LastModified string
+	}{ETag: object.etag(), LastModified: object.modTime.Format(time.RFC3339)})
+}
+
+func (s *fakeServer) createUpload(w http.ResponseWriter) {
+	s.mu.Lock()
+	s.nextUpload++
+	id := strconv.Itoa(s.nextUpload)
+	s.uploads[id] = map[int][]byte{}
+	s.mu.Unlock()
+
+	writeXML(w, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		UploadID string   `xml:"UploadId"`
+	}{UploadID: id})
+}
+
+func (s *fakeServer) uploadPart(w http.ResponseWriter, r *http.Request, query url.Values) {
+	number, err := strconv.Atoi(query.Get("partNumber"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+
+	data, err := readPayload(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+
+	s.mu.Lock()
+	parts, ok := s.uploads[query.Get("uploadId")]
+	if ok {
+		parts[number] = data
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+
+	w.Header().Set("ETag", fakeObject{data: data}.etag())
+}
+
+func (s *fakeServer) completeUpload(w http.ResponseWriter, key, id string) {
+	s.mu.Lock()
+	parts, ok := s.uploads[id]
+	delete(s.uploads, id)
+	if ok {
+		s.multiparts++
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+
+	numbers := make([]int, 0, len(parts))
+	for number := range parts {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+
+	var data []byte
+	for _, number := range numbers {
+		data = append(data, parts[number]...)
+	}
+
+	object := s.put(key, data)
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Bucket  string
+		Key     string
+		ETag    string
+	}{Bucket: s.bucket, Key: key, ETag: object.etag()})
+}
+
+type fakeContents struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+}
+
+type fakePrefix struct {
+	Prefix string
+}
+
+func (s *fakeServer) list(w http.ResponseWriter, query url.Values) {
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+
+	s.mu.Lock()
+	keys := make([]string, 0, len(s.objects))
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var contents []fakeContents
+	var prefixes []fakePrefix
+	seen := map[string]bool{}
+	for _, key := range keys {
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				common := key[:len(prefix)+i+len(delimiter)]
+				if !seen[common] {
+					seen[common] = true
+					prefixes = append(prefixes, fakePrefix{Prefix: common})
+				}
+				continue
+			}
+		}
+
+		object := s.objects[key]
+		contents = append(contents, fakeContents{
+			Key:          key,
+			LastModified: object.modTime.Format(time.RFC3339),
+			ETag:         object.etag(),
+			Size:         int64(len(object.data)),
+		})
+	}
+	s.mu.Unlock()
+
+	writeXML(w, struct {
+		XMLName        xml.Name `xml:"ListBucketResult"`
+		Name           string
+		Prefix         string
+		Delimiter      string
+		KeyCount       int
+		IsTruncated    bool
+		Contents       []fakeContents
+		CommonPrefixes []fakePrefix
+	}{
+		Name:           s.bucket,
+		Prefix:         prefix,
+		Delimiter:      delimiter,
+		KeyCount:       len(contents) + len(prefixes),
+		Contents:       contents,
+		CommonPrefixes: prefixes,
+	})
+}
+
+// readPayload reads a request body, decoding the aws-chunked encoding the
+// client streams uploads with over plain HTTP.
+func readPayload(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+
+	var data []byte
+	reader := bufio.NewReader(r.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		sizeHex, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chunk size %q: %w", sizeHex, err)
+		}
+		if size == 0 {
+			return data, nil
+		}
+
+		chunk := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, chunk); err != nil {
+			return nil, err
+		}
+		data = append(data, chunk[:size]...)
+	}
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_ = xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: code})
+}
@@ -0,0 +1,348 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
+	"github.com/minio/minio-go/v7"
+	"github.com/spf13/afero"
+)
+
+const simulatedFileMode = 0777
+
+// File represents a file structure.
+type File struct {
+	fs   *Fs
+	name string
+	key  string
+
+	streamRead *minio.Object
+
+	// Written data is buffered until it fills a part, so that small files
+	// are uploaded with a single request and large ones as multipart
+	// uploads through streamWrite.
+	writing             bool
+	buffer              []byte
+	streamWrite         *io.PipeWriter
+	streamWriteCloseErr chan error
+
+	dirList   []os.FileInfo
+	dirListed bool
+
+	cachedInfo os.FileInfo
+}
+
+func newFile(fs *Fs, name string) *File {
+	return &File{
+		fs:   fs,
+		name: name,
+		key:  fs.key(name),
+	}
+}
+
+// Close closes the File, rendering it unusable for I/O. Closing a written
+// file completes its upload.
+func (f *File) Close() error {
+	if f.streamRead != nil {
+		defer func() {
+			f.streamRead = nil
+		}()
+
+		return f.streamRead.Close()
+	}
+
+	if !f.writing {
+		return nil
+	}
+	f.writing = false
+
+	if f.streamWrite != nil {
+		defer func() {
+			f.streamWrite = nil
+		}()
+
+		if err := f.streamWrite.Close(); err != nil {
+			return apperr.New("s3.file.close.write_stream", apperr.KindIO, fmt.Errorf("problem writing file: %w", err))
+		}
+
+		return <-f.streamWriteCloseErr
+	}
+
+	data := f.buffer
+	f.buffer = nil
+	_, err := f.fs.client.PutObject(context.Background(), f.fs.bucket, f.key, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{})
+	if err != nil {
+		return apperr.New("s3.file.close.upload", errorKind(err), fmt.Errorf("couldn't upload file: %w", err))
+	}
+
+	return nil
+}
+
+// Read reads up to len(b) bytes from the File.
+func (f *File) Read(p []byte) (int, error) {
+	if f.streamRead == nil {
+		return 0, afero.ErrFileClosed
+	}
+
+	n, err := f.streamRead.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return n, apperr.New("s3.file.read", apperr.KindIO, fmt.Errorf("couldn't read from stream: %w", err))
+	}
+
+	return n, err
+}
+
+// ReadAt reads len(p) bytes from the file starting at byte offset off.
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	if f.streamRead == nil {
+		return 0, afero.ErrFileClosed
+	}
+
+	n, err := f.streamRead.ReadAt(p, off)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return n, apperr.New("s3.file.read_at", apperr.KindIO, fmt.Errorf("couldn't read from stream: %w", err))
+	}
+
+	return n, err
+}
+
+// Seek sets the offset for the next Read. Written files can't seek.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	if f.writing {
+		return 0, apperr.New("s3.file.seek.write_stream", apperr.KindConfig, ErrNotSupported)
+	}
+
+	if f.streamRead == nil {
+		return 0, afero.ErrFileClosed
+	}
+
+	return f.streamRead.Seek(offset, whence)
+}
+
+// Write writes len(b) bytes to the File.
+func (f *File) Write(p []byte) (int, error) {
+	if !f.writing {
+		return 0, afero.ErrFileClosed
+	}
+
+	if f.streamWrite != nil {
+		return f.streamWrite.Write(p)
+	}
+
+	f.buffer = append(f.buffer, p...)
+	if int64(len(f.buffer)) > f.fs.partSize {
+		f.startMultipartUpload()
+	}
+
+	return len(p), nil
+}
+
+// WriteAt is not supported, objects are written in order.
+func (f *File) WriteAt([]byte, int64) (int, error) {
+	return 0, apperr.New("s3.file.write_at", apperr.KindConfig, ErrNotSupported)
+}
+
+// Name returns the file name.
+func (f *File) Name() string {
+	return f.name
+}
+
+// Readdir lists the files and directories directly inside a directory.
+func (f *File) Readdir(count int) ([]os.FileInfo, error) {
+	if !f.dirListed {
+		if err := f.readDir(); err != nil {
+			return nil, err
+		}
+	}
+
+	if count <= 0 {
+		list := f.dirList
+		f.dirList = nil
+		return list, nil
+	}
+
+	if len(f.dirList) == 0 {
+		return nil, io.EOF
+	}
+
+	count = min(count, len(f.dirList))
+	list := f.dirList[:count]
+	f.dirList = f.dirList[count:]
+	return list, nil
+}
+
+func (f *File) readDir() error {
+	prefix := f.key + "/"
+	if f.key == "" {
+		prefix = ""
+	}
+
+	objects := f.fs.client.ListObjects(context.Background(), f.fs.bucket, minio.ListObjectsOptions{Prefix: prefix})
+	for object := range objects {
+		if object.Err != nil {
+			return apperr.New("s3.file.readdir.fetch", errorKind(object.Err), fmt.Errorf("couldn't fetch files list: %w", object.Err))
+		}
+
+		if strings.HasSuffix(object.Key, "/") {
+			f.dirList = append(f.dirList, newDirInfo(object.Key))
+		} else {
+			f.dirList = append(f.dirList, newFileInfo(object))
+		}
+	}
+
+	f.dirListed = true
+	return nil
+}
+
+// Readdirnames reads and returns a slice of names from the directory f.
+func (f *File) Readdirnames(n int) ([]string, error) {
+	fi, err := f.Readdir(n)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(fi))
+	for i, f := range fi {
+		names[i] = f.Name()
+	}
+
+	return names, nil
+}
+
+// Stat fetches the file stat with a cache.
+func (f *File) Stat() (os.FileInfo, error) {
+	var err error
+
+	if f.cachedInfo == nil {
+		f.cachedInfo, err = f.fs.Stat(f.name)
+	}
+
+	return f.cachedInfo, err
+}
+
+// Sync doesn't do anything.
+func (f *File) Sync() error {
+	return nil
+}
+
+// Truncate is not supported, objects are replaced as a whole.
+func (f *File) Truncate(int64) error {
+	return apperr.New("s3.file.truncate", apperr.KindConfig, ErrNotSupported)
+}
+
+// WriteString writes a string.
+func (f *File) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *File) openWriteStream() error {
+	if f.writing {
+		return ErrAlreadyOpened
+	}
+
+	f.cachedInfo = nil
+	f.writing = true
+	return nil
+}
+
+// startMultipartUpload streams the buffered data and everything written
+// after it as a multipart upload.
+func (f *File) startMultipartUpload() {
+	reader, writer := io.Pipe()
+	data := f.buffer
+	f.buffer = nil
+
+	f.streamWrite = writer
+	f.streamWriteCloseErr = make(chan error, 1)
+
+	go func() {
+		_, err := f.fs.client.PutObject(
+			context.Background(),
+			f.fs.bucket,
+			f.key,
+			io.MultiReader(bytes.NewReader(data), reader),
+			-1,
+			minio.PutObjectOptions{PartSize: uint64(f.fs.partSize)},
+		)
+		if err != nil {
+			err = apperr.New("s3.file.upload", errorKind(err), fmt.Errorf("couldn't upload file: %w", err))
+			_ = reader.CloseWithError(err)
+		}
+
+		f.streamWriteCloseErr <- err
+	}()
+}
+
+func (f *File) openReadStream() error {
+	object, err := f.fs.client.GetObject(context.Background(), f.fs.bucket, f.key, minio.GetObjectOptions{})
+	if err != nil {
+		return apperr.New("s3.file.open_read", errorKind(err), fmt.Errorf("couldn't download file: %w", err))
+	}
+
+	f.streamRead = object
+	return nil
+}
+
+func newFileInfo(object minio.ObjectInfo) os.FileInfo {
+	return &FileInfo{
+		name:    path.Base(object.Key),
+		size:    object.Size,
+		modTime: object.LastModified,
+		object:  object,
+	}
+}
+
+func newDirInfo(key string) os.FileInfo {
+	return &FileInfo{name: path.Base("/" + strings.TrimSuffix(key, "/")), dir: true}
+}
+
+// FileInfo is S3 object description.
+type FileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+	object  minio.ObjectInfo
+}
+
+// Name returns the file name.
+func (f FileInfo) Name() string {
+	return f.name
+}
+
+// Size returns the file size.
+func (f FileInfo) Size() int64 {
+	return f.size
+}
+
+// Mode return the file mode.
+func (f FileInfo) Mode() os.FileMode {
+	if f.dir {
+		return os.ModeDir | simulatedFileMode
+	}
+
+	return simulatedFileMode
+}
+
+// ModTime returns the modification time.
+func (f FileInfo) ModTime() time.Time {
+	return f.modTime
+}
+
+// IsDir returns if it's a directory.
+func (f FileInfo) IsDir() bool {
+	return f.dir
+}
+
+// Sys returns the underlying object info.
+func (f FileInfo) Sys() interface{} {
+	return f.object
+}
@@ -0,0 +1,324 @@
+// Package s3 provides an afero implementation on top of S3-compatible object
+// storage, such as AWS S3 or MinIO.
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/spf13/afero"
+)
+
+const (
+	// DefaultPartSize is the size of the parts large files are uploaded in.
+	DefaultPartSize = 16 << 20
+	// minPartSize is the smallest part S3 accepts, except for the last one.
+	minPartSize = 5 << 20
+)
+
+// Config describes the bucket to store files in.
+type Config struct {
+	// Endpoint is the host, with an optional port, of the S3 API. An
+	// http:// prefix connects without TLS.
+	Endpoint string
+	Bucket   string
+	// Prefix is prepended to every object key.
+	Prefix string
+	Region string
+	// AccessKey and SecretKey are static credentials. Without them the
+	// AWS environment variables, the shared credentials file and the
+	// instance role are tried.
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	// PathStyle puts the bucket into the path instead of the host name, as
+	// MinIO and most other self-hosted servers expect.
+	PathStyle bool
+	// PartSize is the size of the parts of multipart uploads. Smaller files
+	// are uploaded at once.
+	PartSize int64
+	// Transport replaces the default HTTP transport.
+	Transport http.RoundTripper
+}
+
+// Fs is the S3 filesystem. Directories only exist as prefixes of object keys.
+type Fs struct {
+	client   *minio.Client
+	bucket   string
+	prefix   string
+	partSize int64
+	log      *log.Logger
+}
+
+// NewFs creates new S3 FS instance and checks that the bucket exists.
+func NewFs(ctx context.Context, cfg Config, log *log.Logger) (*Fs, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, apperr.New("s3.fs.config", apperr.KindConfig, errors.New("endpoint and bucket are required"))
+	}
+
+	endpoint, secure, err := parseEndpoint(cfg.Endpoint)
+	if err != nil {
+		return nil, apperr.New("s3.fs.config", apperr.KindConfig, err)
+	}
+
+	creds := credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, cfg.SessionToken)
+	if cfg.AccessKey == "" {
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.FileAWSCredentials{},
+			&credentials.IAM{},
+		})
+	}
+
+	lookup := minio.BucketLookupAuto
+	if cfg.PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:        creds,
+		Secure:       secure,
+		Region:       cfg.Region,
+		BucketLookup: lookup,
+		Transport:    cfg.Transport,
+	})
+	if err != nil {
+		return nil, apperr.New("s3.fs.client", apperr.KindConfig, fmt.Errorf("create s3 client: %w", err))
+	}
+
+	exists, err := client.BucketExists(ctx, cfg.Bucket)
+	if err != nil {
+		return nil, apperr.New("s3.fs.bucket", errorKind(err), fmt.Errorf("check bucket %q: %w", cfg.Bucket, err))
+	}
+	if !exists {
+		return nil, apperr.New("s3.fs.bucket", apperr.KindConfig, fmt.Errorf("bucket %q does not exist", cfg.Bucket))
+	}
+
+	partSize := cfg.PartSize
+	if partSize <= 0 {
+		partSize = DefaultPartSize
+	}
+
+	return &Fs{
+		client:   client,
+		bucket:   cfg.Bucket,
+		prefix:   strings.Trim(cfg.Prefix, "/"),
+		partSize: max(partSize, minPartSize),
+		log:      log,
+	}, nil
+}
+
+func parseEndpoint(endpoint string) (string, bool, error) {
+	if !strings.Contains(endpoint, "://") {
+		return strings.TrimSuffix(endpoint, "/"), true, nil
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", false, fmt.Errorf("invalid endpoint %q: %w", endpoint, err)
+	}
+
+	switch u.Scheme {
+	case "https":
+		return u.Host, true, nil
+	case "http":
+		return u.Host, false, nil
+	default:
+		return "", false, fmt.Errorf("invalid endpoint %q: unsupported scheme %q", endpoint, u.Scheme)
+	}
+}
+
+// key returns the object key of name.
+func (fs *Fs) key(name string) string {
+	return strings.TrimPrefix(path.Join(fs.prefix, path.Clean("/"+name)), "/")
+}
+
+// Create creates a file.
+func (fs *Fs) Create(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0777)
+}
+
+// Mkdir does nothing, directories are created with the objects inside them.
+func (fs *Fs) Mkdir(string, os.FileMode) error {
+	return nil
+}
+
+// MkdirAll does nothing, directories are created with the objects inside
+// them.
+func (fs *Fs) MkdirAll(string, os.FileMode) error {
+	return nil
+}
+
+// Open a file for reading.
+func (fs *Fs) Open(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0777)
+}
+
+// OpenFile opens a file. Writing always replaces the whole object, which is
+// uploaded when the file is closed.
+func (fs *Fs) OpenFile(name string, flag int, _ os.FileMode) (afero.File, error) {
+	file := newFile(fs, name)
+
+	if flag&os.O_RDWR != 0 {
+		return nil, apperr.New("s3.fs.open_file.read_write", apperr.KindConfig, ErrNotSupported)
+	}
+
+	if flag&os.O_APPEND != 0 {
+		return nil, apperr.New("s3.fs.open_file.append", apperr.KindConfig, ErrNotSupported)
+	}
+
+	if flag&(os.O_WRONLY|os.O_CREATE) != 0 {
+		return file, file.openWriteStream()
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		return file, nil
+	}
+
+	return file, file.openReadStream()
+}
+
+// Remove removes a file.
+func (fs *Fs) Remove(name string) error {
+	if err := fs.client.RemoveObject(context.Background(), fs.bucket, fs.key(name), minio.RemoveObjectOptions{}); err != nil {
+		return apperr.New("s3.fs.remove", errorKind(err), fmt.Errorf("couldn't remove a file: %w", err))
+	}
+
+	return nil
+}
+
+// RemoveAll removes a file or all files inside a directory.
+func (fs *Fs) RemoveAll(name string) error {
+	ctx := context.Background()
+	key := fs.key(name)
+
+	objects := fs.client.ListObjects(ctx, fs.bucket, minio.ListObjectsOptions{Prefix: key + "/", Recursive: true})
+	for object := range objects {
+		if object.Err != nil {
+			return apperr.New("s3.fs.remove_all", errorKind(object.Err), fmt.Errorf("couldn't list files: %w", object.Err))
+		}
+
+		if err := fs.client.RemoveObject(ctx, fs.bucket, object.Key, minio.RemoveObjectOptions{}); err != nil {
+			return apperr.New("s3.fs.remove_all", errorKind(err), fmt.Errorf("couldn't remove a file: %w", err))
+		}
+	}
+
+	return fs.Remove(name)
+}
+
+// Rename copies a file on the server and removes the original. Files must
+// be smaller than 5 GiB, the limit of a single copy, which Telegram files
+// always are.
+func (fs *Fs) Rename(oldname, newname string) error {
+	ctx := context.Background()
+
+	_, err := fs.client.CopyObject(ctx,
+		minio.CopyDestOptions{Bucket: fs.bucket, Object: fs.key(newname)},
+		minio.CopySrcOptions{Bucket: fs.bucket, Object: fs.key(oldname)},
+	)
+	if err != nil {
+		if isNotFound(err) {
+			return &os.PathError{Op: "rename", Path: oldname, Err: os.ErrNotExist}
+		}
+
+		return apperr.New("s3.fs.rename", errorKind(err), fmt.Errorf("couldn't rename file: %w", err))
+	}
+
+	return fs.Remove(oldname)
+}
+
+// Stat fetches the file info. A name that is a prefix of other objects is a
+// directory.
+func (fs *Fs) Stat(name string) (os.FileInfo, error) {
+	// Listing stops after the first object, cancelling lets the lister quit.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	key := fs.key(name)
+
+	if key != fs.prefix {
+		object, err := fs.client.StatObject(ctx, fs.bucket, key, minio.StatObjectOptions{})
+		if err == nil {
+			return newFileInfo(object), nil
+		}
+		if !isNotFound(err) {
+			return nil, apperr.New("s3.fs.stat", errorKind(err), fmt.Errorf("couldn't fetch file info: %w", err))
+		}
+	}
+
+	dirPrefix := key + "/"
+	if key == "" {
+		dirPrefix = ""
+	}
+
+	objects := fs.client.ListObjects(ctx, fs.bucket, minio.ListObjectsOptions{Prefix: dirPrefix, MaxKeys: 1})
+	for object := range objects {
+		if object.Err != nil {
+			return nil, apperr.New("s3.fs.stat", errorKind(object.Err), fmt.Errorf("couldn't fetch file info: %w", object.Err))
+		}
+
+		return newDirInfo(key), nil
+	}
+
+	if key == fs.prefix {
+		return newDirInfo(key), nil
+	}
+
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+// Name of the fs: s3.
+func (fs *Fs) Name() string {
+	return "s3"
+}
+
+// Chmod is not supported.
+func (fs *Fs) Chmod(string, os.FileMode) error {
+	return apperr.New("s3.fs.chmod", apperr.KindConfig, ErrNotSupported)
+}
+
+// Chown is not supported.
+func (fs *Fs) Chown(string, int, int) error {
+	return apperr.New("s3.fs.chown", apperr.KindConfig, ErrNotSupported)
+}
+
+// Chtimes is not supported because objects can't be modified.
+func (fs *Fs) Chtimes(string, time.Time, time.Time) error {
+	return apperr.New("s3.fs.chtimes", apperr.KindConfig, ErrNotSupported)
+}
+
+func isNotFound(err error) bool {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NotFound":
+		return true
+	default:
+		return false
+	}
+}
+
+// errorKind tells failed requests, which are worth retrying, from refused
+// ones.
+func errorKind(err error) apperr.Kind {
+	switch minio.ToErrorResponse(err).StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return apperr.KindAuth
+	default:
+		return apperr.KindNetwork
+	}
+}
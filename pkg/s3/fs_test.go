@@ -0,0 +1,233 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
+	"github.com/spf13/afero"
+)
+
+func newTestFs(t *testing.T, cfg Config) (*Fs, *fakeServer) {
+	t.Helper()
+
+	fake, server := newFakeServer(t, "archive")
+	cfg.Endpoint = server.URL
+	cfg.Bucket = "archive"
+	cfg.Region = "us-east-1"
+	cfg.AccessKey = "key"
+	cfg.SecretKey = "secret"
+	cfg.PathStyle = true
+
+	fs, err := NewFs(context.Background(), cfg, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewFs() error = %v", err)
+	}
+
+	return fs, fake
+}
+
+func TestFsWritesAndReadsFiles(t *testing.T) {
+	t.Parallel()
+
+	fs, fake := newTestFs(t, Config{Prefix: "/telegram/"})
+
+	f, err := fs.Create("/chat/photo.jpg.part")
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if _, err := f.Write([]byte("hello, ")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if _, err := f.WriteString("world"); err != nil {
+		t.Fatalf("WriteString() error = %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	if err := fs.Rename("/chat/photo.jpg.part", "/chat/photo.jpg"); err != nil {
+		t.Fatalf("Rename() error = %v", err)
+	}
+	if _, ok := fake.object("telegram/chat/photo.jpg.part"); ok {
+		t.Fatal("Rename() kept the old object")
+	}
+	if data, _ := fake.object("telegram/chat/photo.jpg"); string(data) != "hello, world" {
+		t.Fatalf("object = %q, want it under the prefix", data)
+	}
+
+	info, err := fs.Stat("/chat/photo.jpg")
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if info.IsDir() || info.Size() != 12 || info.Name() != "photo.jpg" {
+		t.Fatalf("Stat() = %s dir=%t size=%d", info.Name(), info.IsDir(), info.Size())
+	}
+
+	data, err := afero.ReadFile(fs, "/chat/photo.jpg")
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if string(data) != "hello, world" {
+		t.Fatalf("ReadFile() = %q", data)
+	}
+
+	f, err = fs.Open("/chat/photo.jpg")
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer f.Close()
+
+	part := make([]byte, 5)
+	if _, err := f.ReadAt(part, 7); err != nil && !errors.Is(err, io.EOF) {
+		t.Fatalf("ReadAt() error = %v", err)
+	}
+	if string(part) != "world" {
+		t.Fatalf("ReadAt() = %q", part)
+	}
+}
+
+func TestFsUploadsLargeFilesInParts(t *testing.T) {
+	t.Parallel()
+
+	fs, fake := newTestFs(t, Config{PartSize: minPartSize})
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), (minPartSize+minPartSize/2)/16)
+	f, err := fs.Create("large.bin")
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	for rest := data; len(rest) > 0; {
+		n := min(1<<20, len(rest))
+		if _, err := f.Write(rest[:n]); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		rest = rest[n:]
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	got, _ := fake.object("large.bin")
+	if !bytes.Equal(got, data) {
+		t.Fatalf("uploaded %d bytes, want %d", len(got), len(data))
+	}
+
+	fake.mu.Lock()
+	multiparts := fake.multiparts
+	fake.mu.Unlock()
+	if multiparts != 1 {
+		t.Fatalf("multipart uploads = %d, want 1", multiparts)
+	}
+}
+
+func TestFsStat(t *testing.T) {
+	t.Parallel()
+
+	fs, _ := newTestFs(t, Config{})
+	if err := afero.WriteFile(fs, "/downloads/chat/a.txt", []byte("a"), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	for _, name := range []string{"/", "/downloads", "/downloads/chat"} {
+		info, err := fs.Stat(name)
+		if err != nil {
+			t.Fatalf("Stat(%q) error = %v", name, err)
+		}
+		if !info.IsDir() {
+			t.Fatalf("Stat(%q) is not a directory", name)
+		}
+	}
+
+	_, err := fs.Stat("/downloads/missing.txt")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Stat() error = %v, want %v", err, os.ErrNotExist)
+	}
+	if exists, err := afero.Exists(fs, "/downloads/missing.txt"); err != nil || exists {
+		t.Fatalf("Exists() = %t, %v", exists, err)
+	}
+	if exists, err := afero.DirExists(fs, "/downloads"); err != nil || !exists {
+		t.Fatalf("DirExists() = %t, %v", exists, err)
+	}
+
+	if err := fs.Rename("/downloads/missing.txt", "/downloads/b.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Rename() error = %v, want %v", err, os.ErrNotExist)
+	}
+}
+
+func TestFsReadsDirectories(t *testing.T) {
+	t.Parallel()
+
+	fs, _ := newTestFs(t, Config{})
+	for _, name := range []string{"/out/a.txt", "/out/b.txt", "/out/chat/c.txt"} {
+		if err := afero.WriteFile(fs, name, []byte(name), 0644); err != nil {
+			t.Fatalf("WriteFile(%q) error = %v", name, err)
+		}
+	}
+
+	entries, err := afero.ReadDir(fs, "/out")
+	if err != nil {
+		t.Fatalf("ReadDir() error = %v", err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			name += "/"
+		}
+		names = append(names, name)
+	}
+	if got := strings.Join(names, ","); got != "a.txt,b.txt,chat/" {
+		t.Fatalf("ReadDir() = %s", got)
+	}
+
+	if err := fs.RemoveAll("/out"); err != nil {
+		t.Fatalf("RemoveAll() error = %v", err)
+	}
+	if exists, _ := afero.DirExists(fs, "/out"); exists {
+		t.Fatal("RemoveAll() left the directory")
+	}
+}
+
+func TestFsRejectsUnsupportedModes(t *testing.T) {
+	t.Parallel()
+
+	fs, _ := newTestFs(t, Config{})
+	for _, flag := range []int{os.O_RDWR, os.O_WRONLY | os.O_APPEND} {
+		_, err := fs.OpenFile("a.txt", flag, 0644)
+		if !errors.Is(err, ErrNotSupported) || !apperr.IsKind(err, apperr.KindConfig) {
+			t.Fatalf("OpenFile(%d) error = %v, want %v", flag, err, ErrNotSupported)
+		}
+	}
+}
+
+func TestNewFsChecksConfig(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	logger := log.New(io.Discard, "", 0)
+
+	if _, err := NewFs(ctx, Config{Bucket: "archive"}, logger); !apperr.IsKind(err, apperr.KindConfig) {
+		t.Fatalf("NewFs() without endpoint error = %v, want a config error", err)
+	}
+
+	_, server := newFakeServer(t, "archive")
+	_, err := NewFs(ctx, Config{
+		Endpoint:  server.URL,
+		Bucket:    "missing",
+		Region:    "us-east-1",
+		AccessKey: "key",
+		SecretKey: "secret",
+		PathStyle: true,
+	}, logger)
+	if !apperr.IsKind(err, apperr.KindConfig) {
+		t.Fatalf("NewFs() with a missing bucket error = %v, want a config error", err)
+	}
+}
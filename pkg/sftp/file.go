@@ -0,0 +1,97 @@
+package sftp
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+
+	"github.com/pkg/sftp"
+)
+
+// File is a remote file. Reads, writes, seeking and truncation go straight
+// to the server, so part files can be preallocated and resumed.
+type File struct {
+	*sftp.File
+	fs   *Fs
+	name string
+
+	dirList   []os.FileInfo
+	dirListed bool
+}
+
+// Name returns the name the file was opened with.
+func (f *File) Name() string {
+	return f.name
+}
+
+// Stat fetches the file info.
+func (f *File) Stat() (os.FileInfo, error) {
+	info, err := f.File.Stat()
+	if err != nil {
+		return nil, wrapError("sftp.file.stat", "stat", f.name, err)
+	}
+
+	return info, nil
+}
+
+// Sync flushes the file on servers that support it and does nothing on
+// the others.
+func (f *File) Sync() error {
+	err := f.File.Sync()
+
+	var statusErr *sftp.StatusError
+	if errors.As(err, &statusErr) && statusErr.FxCode() == sftp.ErrSSHFxOpUnsupported {
+		return nil
+	}
+
+	return err
+}
+
+// WriteString writes a string.
+func (f *File) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+// Readdir lists the files and directories inside a directory.
+func (f *File) Readdir(count int) ([]os.FileInfo, error) {
+	if !f.dirListed {
+		list, err := f.fs.readDir(f.name)
+		if err != nil {
+			return nil, wrapError("sftp.file.readdir", "readdir", f.name, err)
+		}
+
+		f.dirList = list
+		f.dirListed = true
+	}
+
+	if count <= 0 {
+		list := f.dirList
+		f.dirList = nil
+		return list, nil
+	}
+
+	if len(f.dirList) == 0 {
+		return nil, io.EOF
+	}
+
+	count = min(count, len(f.dirList))
+	list := f.dirList[:count]
+	f.dirList = f.dirList[count:]
+	return list, nil
+}
+
+// Readdirnames reads and returns a slice of names from the directory f.
+func (f *File) Readdirnames(n int) ([]string, error) {
+	fi, err := f.Readdir(n)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(fi))
+	for i, f := range fi {
+		names[i] = path.Base(f.Name())
+	}
+
+	return names, nil
+}
@@ -0,0 +1,522 @@
+// Package sftp provides an afero implementation on top of an SFTP server, such
+// as the SSH server of a NAS.
+package sftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
+	"github.com/mitchellh/go-homedir"
+	"github.com/pkg/sftp"
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// DefaultTimeout bounds connecting and the SSH handshake.
+const DefaultTimeout = 30 * time.Second
+
+// reconnectAttempts is how many times a lost connection is dialed again
+// before the operation fails, waiting reconnectDelay, then twice as long,
+// between the attempts.
+const (
+	reconnectAttempts = 4
+	reconnectDelay    = time.Second
+)
+
+// Config describes the server to store files on.
+type Config struct {
+	// Host is the host name with an optional port, 22 by default.
+	Host string
+	User string
+	// Password authenticates the user unless KeyFile is set, in which case it
+	// is tried after the key.
+	Password string
+	// KeyFile is a private key in OpenSSH or PEM format, KeyPassphrase
+	// decrypts it.
+	KeyFile       string
+	KeyPassphrase string
+	// KnownHostsFile lists the accepted host keys, ~/.ssh/known_hosts by
+	// default. InsecureIgnoreHostKey turns the check off.
+	KnownHostsFile        string
+	InsecureIgnoreHostKey bool
+	// Root is the directory all paths are relative to.
+	Root    string
+	Timeout time.Duration
+}
+
+// Fs is the SFTP filesystem. A lost connection, after the server rebooted
+// or the network dropped, is dialed again by the next operation.
+type Fs struct {
+	dial    func(ctx context.Context) (*ssh.Client, *sftp.Client, error)
+	timeout time.Duration
+	delay   time.Duration
+	root    string
+	log     *log.Logger
+
+	mu     sync.Mutex
+	conn   *ssh.Client
+	client *sftp.Client
+}
+
+// NewFs connects to the server and creates new SFTP FS instance.
+func NewFs(ctx context.Context, cfg Config, log *log.Logger) (*Fs, error) {
+	if cfg.Host == "" || cfg.User == "" {
+		return nil, apperr.New("sftp.fs.config", apperr.KindConfig, errors.New("host and user are required"))
+	}
+
+	auth, err := authMethods(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	hostKeyCallback, err := hostKeyCallback(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	addr := cfg.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+
+	clientConfig := &ssh.ClientConfig{
+		User:            cfg.User,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         timeout,
+	}
+
+	fs := &Fs{
+		dial: func(ctx context.Context) (*ssh.Client, *sftp.Client, error) {
+			return dial(ctx, addr, clientConfig)
+		},
+		timeout: timeout,
+		delay:   reconnectDelay,
+		log:     log,
+	}
+
+	fs.conn, fs.client, err = fs.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.root = cfg.Root
+	if fs.root == "" {
+		if fs.root, err = fs.client.Getwd(); err != nil {
+			_ = fs.Close()
+			return nil, apperr.New("sftp.fs.root", apperr.KindNetwork, fmt.Errorf("get working directory: %w", err))
+		}
+	}
+
+	return fs, nil
+}
+
+// dial connects to addr and starts an SFTP session.
+func dial(ctx context.Context, addr string, config *ssh.ClientConfig) (*ssh.Client, *sftp.Client, error) {
+	dialer := net.Dialer{Timeout: config.Timeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, nil, apperr.New("sftp.fs.dial", apperr.KindNetwork, fmt.Errorf("connect to %s: %w", addr, err))
+	}
+
+	// The handshake doesn't take a context, the deadline bounds it instead.
+	deadline := time.Now().Add(config.Timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	_ = netConn.SetDeadline(deadline)
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(netConn, addr, config)
+	if err != nil {
+		_ = netConn.Close()
+		return nil, nil, apperr.New("sftp.fs.handshake", handshakeErrorKind(err), fmt.Errorf("ssh handshake with %s: %w", addr, err))
+	}
+	_ = netConn.SetDeadline(time.Time{})
+
+	conn := ssh.NewClient(sshConn, chans, reqs)
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, apperr.New("sftp.fs.client", apperr.KindNetwork, fmt.Errorf("start sftp session: %w", err))
+	}
+
+	return conn, client, nil
+}
+
+// do runs op with the current session. When the connection turns out to be
+// lost, op runs once more on a new one.
+func (fs *Fs) do(op func(client *sftp.Client) error) error {
+	fs.mu.Lock()
+	client := fs.client
+	fs.mu.Unlock()
+
+	err := op(client)
+	if !connectionLost(err) {
+		return err
+	}
+
+	client, reconnectErr := fs.reconnect(client)
+	if reconnectErr != nil {
+		return errors.Join(err, reconnectErr)
+	}
+
+	return op(client)
+}
+
+// reconnect replaces the lost session stale with a new one. Operations that
+// lost the same session wait for it and share it.
+func (fs *Fs) reconnect(stale *sftp.Client) (*sftp.Client, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.client != stale {
+		return fs.client, nil
+	}
+
+	_ = fs.client.Close()
+	_ = fs.conn.Close()
+
+	var err error
+	delay := fs.delay
+	for attempt := 1; attempt <= reconnectAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), fs.timeout)
+		conn, client, dialErr := fs.dial(ctx)
+		cancel()
+		if dialErr == nil {
+			fs.log.Printf("sftp: reconnected after the connection was lost")
+			fs.conn, fs.client = conn, client
+			return client, nil
+		}
+
+		err = dialErr
+		if apperr.IsKind(err, apperr.KindAuth) {
+			break
+		}
+		fs.log.Printf("sftp: reconnect attempt %d of %d failed: %v", attempt, reconnectAttempts, err)
+	}
+
+	return stale, err
+}
+
+// connectionLost reports whether err means the session is gone rather than
+// that the server refused the operation.
+func connectionLost(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var statusErr *sftp.StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.FxCode() == sftp.ErrSSHFxConnectionLost
+	}
+
+	return errors.Is(err, sftp.ErrSSHFxConnectionLost) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) || strings.Contains(err.Error(), "ssh: unexpected packet")
+}
+
+func authMethods(cfg Config) ([]ssh.AuthMethod, error) {
+	var methods []ssh.AuthMethod
+
+	if cfg.KeyFile != "" {
+		keyFile, err := homedir.Expand(cfg.KeyFile)
+		if err != nil {
+			return nil, apperr.New("sftp.fs.key", apperr.KindConfig, fmt.Errorf("invalid key file %q: %w", cfg.KeyFile, err))
+		}
+
+		pem, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, apperr.New("sftp.fs.key", apperr.KindConfig, fmt.Errorf("read key file: %w", err))
+		}
+
+		var signer ssh.Signer
+		if cfg.KeyPassphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(pem, []byte(cfg.KeyPassphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(pem)
+		}
+		if err != nil {
+			return nil, apperr.New("sftp.fs.key", apperr.KindConfig, fmt.Errorf("parse key file %q: %w", cfg.KeyFile, err))
+		}
+
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+
+	if cfg.Password != "" {
+		password := cfg.Password
+		methods = append(methods,
+			ssh.Password(password),
+			ssh.KeyboardInteractive(func(_, _ string, questions []string, _ []bool) ([]string, error) {
+				answers := make([]string, len(questions))
+				for i := range answers {
+					answers[i] = password
+				}
+				return answers, nil
+			}),
+		)
+	}
+
+	if len(methods) == 0 {
+		return nil, apperr.New("sftp.fs.auth", apperr.KindConfig, errors.New("either password or key_file is required"))
+	}
+
+	return methods, nil
+}
+
+func hostKeyCallback(cfg Config) (ssh.HostKeyCallback, error) {
+	if cfg.InsecureIgnoreHostKey {
+		return ssh.InsecureIgnoreHostKey(), nil // #nosec G106 -- explicitly configured
+	}
+
+	file := cfg.KnownHostsFile
+	if file == "" {
+		file = "~/.ssh/known_hosts"
+	}
+
+	file, err := homedir.Expand(file)
+	if err != nil {
+		return nil, apperr.New("sftp.fs.known_hosts", apperr.KindConfig, fmt.Errorf("invalid known hosts file: %w", err))
+	}
+
+	callback, err := knownhosts.New(file)
+	if err != nil {
+		return nil, apperr.New("sftp.fs.known_hosts", apperr.KindConfig, fmt.Errorf("read known hosts: %w", err))
+	}
+
+	return callback, nil
+}
+
+// handshakeErrorKind tells refused host keys and credentials from network
+// failures.
+func handshakeErrorKind(err error) apperr.Kind {
+	var keyErr *knownhosts.KeyError
+	if errors.As(err, &keyErr) || strings.Contains(err.Error(), "unable to authenticate") {
+		return apperr.KindAuth
+	}
+
+	return apperr.KindNetwork
+}
+
+// Close ends the SFTP session and closes the connection.
+func (fs *Fs) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	err := fs.client.Close()
+	if cerr := fs.conn.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// remotePath returns the path of name on the server.
+func (fs *Fs) remotePath(name string) string {
+	return path.Join(fs.root, path.Clean("/"+filepath.ToSlash(name)))
+}
+
+// Create creates a file.
+func (fs *Fs) Create(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0)
+}
+
+// Mkdir creates a directory with the umask of the server.
+func (fs *Fs) Mkdir(name string, _ os.FileMode) error {
+	if err := fs.do(func(client *sftp.Client) error { return client.Mkdir(fs.remotePath(name)) }); err != nil {
+		return wrapError("sftp.fs.mkdir", "mkdir", name, err)
+	}
+
+	return nil
+}
+
+// MkdirAll creates a directory and all parent directories if necessary.
+func (fs *Fs) MkdirAll(name string, _ os.FileMode) error {
+	if err := fs.do(func(client *sftp.Client) error { return client.MkdirAll(fs.remotePath(name)) }); err != nil {
+		return wrapError("sftp.fs.mkdir_all", "mkdir", name, err)
+	}
+
+	return nil
+}
+
+// Open a file for reading.
+func (fs *Fs) Open(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile opens a file. Files opened with O_APPEND start at their end. The
+// mode is ignored, the server creates files with its umask.
+func (fs *Fs) OpenFile(name string, flag int, _ os.FileMode) (afero.File, error) {
+	var file *sftp.File
+	err := fs.do(func(client *sftp.Client) (err error) {
+		file, err = client.OpenFile(fs.remotePath(name), flag)
+		return err
+	})
+	if err != nil {
+		return nil, wrapError("sftp.fs.open_file", "open", name, err)
+	}
+
+	if flag&os.O_APPEND != 0 {
+		if _, err := file.Seek(0, io.SeekEnd); err != nil {
+			_ = file.Close()
+			return nil, wrapError("sftp.fs.open_file.append", "open", name, err)
+		}
+	}
+
+	return &File{File: file, fs: fs, name: name}, nil
+}
+
+// Remove removes a file or an empty directory.
+func (fs *Fs) Remove(name string) error {
+	if err := fs.do(func(client *sftp.Client) error { return client.Remove(fs.remotePath(name)) }); err != nil {
+		return wrapError("sftp.fs.remove", "remove", name, err)
+	}
+
+	return nil
+}
+
+// RemoveAll removes a file or a directory with everything inside it.
+func (fs *Fs) RemoveAll(name string) error {
+	var info os.FileInfo
+	err := fs.do(func(client *sftp.Client) (err error) {
+		info, err = client.Lstat(fs.remotePath(name))
+		return err
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return wrapError("sftp.fs.remove_all", "remove", name, err)
+	}
+
+	if info.IsDir() {
+		entries, err := fs.readDir(name)
+		if err != nil {
+			return wrapError("sftp.fs.remove_all", "remove", name, err)
+		}
+
+		for _, entry := range entries {
+			if err := fs.RemoveAll(path.Join(name, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return fs.Remove(name)
+}
+
+// Rename renames a file, replacing newname when the server supports POSIX
+// renames.
+func (fs *Fs) Rename(oldname, newname string) error {
+	err := fs.do(func(client *sftp.Client) error {
+		if _, ok := client.HasExtension("posix-rename@openssh.com"); ok {
+			return client.PosixRename(fs.remotePath(oldname), fs.remotePath(newname))
+		}
+		return client.Rename(fs.remotePath(oldname), fs.remotePath(newname))
+	})
+	if err != nil {
+		return wrapError("sftp.fs.rename", "rename", oldname, err)
+	}
+
+	return nil
+}
+
+// Stat fetches the file info.
+func (fs *Fs) Stat(name string) (os.FileInfo, error) {
+	var info os.FileInfo
+	err := fs.do(func(client *sftp.Client) (err error) {
+		info, err = client.Stat(fs.remotePath(name))
+		return err
+	})
+	if err != nil {
+		return nil, wrapError("sftp.fs.stat", "stat", name, err)
+	}
+
+	return info, nil
+}
+
+// readDir lists the directory name.
+func (fs *Fs) readDir(name string) ([]os.FileInfo, error) {
+	var list []os.FileInfo
+	err := fs.do(func(client *sftp.Client) (err error) {
+		list, err = client.ReadDir(fs.remotePath(name))
+		return err
+	})
+	return list, err
+}
+
+// Name of the fs: sftp.
+func (fs *Fs) Name() string {
+	return "sftp"
+}
+
+// Chmod changes the mode of a file.
+func (fs *Fs) Chmod(name string, mode os.FileMode) error {
+	if err := fs.do(func(client *sftp.Client) error { return client.Chmod(fs.remotePath(name), mode) }); err != nil {
+		return wrapError("sftp.fs.chmod", "chmod", name, err)
+	}
+
+	return nil
+}
+
+// Chown changes the owner of a file.
+func (fs *Fs) Chown(name string, uid, gid int) error {
+	if err := fs.do(func(client *sftp.Client) error { return client.Chown(fs.remotePath(name), uid, gid) }); err != nil {
+		return wrapError("sftp.fs.chown", "chown", name, err)
+	}
+
+	return nil
+}
+
+// Chtimes changes the access and modification times of a file.
+func (fs *Fs) Chtimes(name string, atime, mtime time.Time) error {
+	if err := fs.do(func(client *sftp.Client) error { return client.Chtimes(fs.remotePath(name), atime, mtime) }); err != nil {
+		return wrapError("sftp.fs.chtimes", "chtimes", name, err)
+	}
+
+	return nil
+}
+
+// wrapError keeps missing files recognizable by os.IsNotExist, which
+// afero.Exists relies on, and types everything else.
+func wrapError(op, pathOp, name string, err error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return &os.PathError{Op: pathOp, Path: name, Err: os.ErrNotExist}
+	}
+
+	return apperr.New(op, errorKind(err), fmt.Errorf("%s %q: %w", pathOp, name, err))
+}
+
+// errorKind tells errors of the server, which refused the operation, from a
+// lost connection.
+func errorKind(err error) apperr.Kind {
+	var statusErr *sftp.StatusError
+	if errors.As(err, &statusErr) || errors.Is(err, os.ErrPermission) || errors.Is(err, os.ErrExist) {
+		if statusErr != nil && statusErr.FxCode() == sftp.ErrSSHFxConnectionLost {
+			return apperr.KindNetwork
+		}
+		return apperr.KindIO
+	}
+
+	return apperr.KindNetwork
+}
@@ -0,0 +1,329 @@
+package sftp
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
+	"github.com/pkg/sftp"
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testServer is an SFTP server over a temporary directory that accepts user
+// "tg" with password "secret".
+type testServer struct {
+	addr    string
+	hostKey ssh.PublicKey
+	dir     string
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+// dropConnections cuts the connections of all clients, like a reboot.
+func (s *testServer) dropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.conns = nil
+}
+
+func startServer(t *testing.T) *testServer {
+	t.Helper()
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatalf("NewSignerFromKey() error = %v", err)
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if meta.User() == "tg" && string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, errors.New("access denied")
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	server := &testServer{addr: listener.Addr().String(), hostKey: signer.PublicKey(), dir: t.TempDir()}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			server.mu.Lock()
+			server.conns = append(server.conns, conn)
+			server.mu.Unlock()
+			go serveConn(conn, config, server.dir)
+		}
+	}()
+
+	return server
+}
+
+func serveConn(conn net.Conn, config *ssh.ServerConfig, dir string) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				_ = req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+
+				server, err := sftp.NewServer(channel, sftp.WithServerWorkingDirectory(dir))
+				if err != nil {
+					return
+				}
+				_ = server.Serve()
+				_ = channel.Close()
+			}
+		}()
+	}
+}
+
+func writeKnownHosts(t *testing.T, addr string, key ssh.PublicKey) string {
+	t.Helper()
+
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(addr)}, key)
+	if err := os.WriteFile(file, []byte(line+"\n"), 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	return file
+}
+
+func newTestFs(t *testing.T) (*Fs, *testServer) {
+	t.Helper()
+
+	server := startServer(t)
+	fs, err := NewFs(context.Background(), Config{
+		Host:           server.addr,
+		User:           "tg",
+		Password:       "secret",
+		KnownHostsFile: writeKnownHosts(t, server.addr, server.hostKey),
+		Root:           server.dir,
+	}, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewFs() error = %v", err)
+	}
+	t.Cleanup(func() { _ = fs.Close() })
+
+	return fs, server
+}
+
+func TestFsWritesResumesAndRenames(t *testing.T) {
+	t.Parallel()
+
+	fs, server := newTestFs(t)
+	dir := server.dir
+
+	if err := fs.MkdirAll("/chat/2024", 0755); err != nil {
+		t.Fatalf("MkdirAll() error = %v", err)
+	}
+	if err := afero.WriteFile(fs, "/chat/2024/a.bin.part", []byte("hello, wor"), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	f, err := fs.OpenFile("/chat/2024/a.bin.part", os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	if err := f.Truncate(7); err != nil {
+		t.Fatalf("Truncate() error = %v", err)
+	}
+	if _, err := f.Seek(7, io.SeekStart); err != nil {
+		t.Fatalf("Seek() error = %v", err)
+	}
+	if _, err := f.WriteString("world"); err != nil {
+		t.Fatalf("WriteString() error = %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	f, err = fs.OpenFile("/chat/2024/a.bin.part", os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile(O_APPEND) error = %v", err)
+	}
+	if _, err := f.Write([]byte("!")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	if err := afero.WriteFile(fs, "/chat/2024/a.bin", []byte("old"), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if err := fs.Rename("/chat/2024/a.bin.part", "/chat/2024/a.bin"); err != nil {
+		t.Fatalf("Rename() error = %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "chat", "2024", "a.bin"))
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if string(data) != "hello, world!" {
+		t.Fatalf("file = %q", data)
+	}
+
+	info, err := fs.Stat("/chat/2024/a.bin")
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if info.Size() != int64(len(data)) {
+		t.Fatalf("Stat() size = %d, want %d", info.Size(), len(data))
+	}
+
+	names, err := afero.ReadDir(fs, "/chat/2024")
+	if err != nil {
+		t.Fatalf("ReadDir() error = %v", err)
+	}
+	if len(names) != 1 || names[0].Name() != "a.bin" {
+		t.Fatalf("ReadDir() = %v", names)
+	}
+}
+
+func TestFsReportsMissingFiles(t *testing.T) {
+	t.Parallel()
+
+	fs, _ := newTestFs(t)
+
+	if _, err := fs.Stat("/missing.txt"); !os.IsNotExist(err) {
+		t.Fatalf("Stat() error = %v, want a missing file", err)
+	}
+	if exists, err := afero.Exists(fs, "/missing.txt"); err != nil || exists {
+		t.Fatalf("Exists() = %t, %v", exists, err)
+	}
+	if err := fs.Remove("/missing.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Remove() error = %v, want %v", err, os.ErrNotExist)
+	}
+	if err := fs.RemoveAll("/missing"); err != nil {
+		t.Fatalf("RemoveAll() error = %v", err)
+	}
+}
+
+func TestNewFsChecksHostKeyAndCredentials(t *testing.T) {
+	t.Parallel()
+
+	server, other := startServer(t), startServer(t)
+	addr, hostKey := server.addr, server.hostKey
+	otherAddr, otherKey := other.addr, other.hostKey
+	logger := log.New(io.Discard, "", 0)
+
+	_, err := NewFs(context.Background(), Config{
+		Host:           addr,
+		User:           "tg",
+		Password:       "secret",
+		KnownHostsFile: writeKnownHosts(t, addr, otherKey),
+	}, logger)
+	if !apperr.IsKind(err, apperr.KindAuth) {
+		t.Fatalf("NewFs() with an unknown host key error = %v, want an auth error", err)
+	}
+
+	_, err = NewFs(context.Background(), Config{
+		Host:           otherAddr,
+		User:           "tg",
+		Password:       "wrong",
+		KnownHostsFile: writeKnownHosts(t, otherAddr, otherKey),
+	}, logger)
+	if !apperr.IsKind(err, apperr.KindAuth) {
+		t.Fatalf("NewFs() with a wrong password error = %v, want an auth error", err)
+	}
+
+	_, err = NewFs(context.Background(), Config{Host: addr, User: "tg", KnownHostsFile: writeKnownHosts(t, addr, hostKey)}, logger)
+	if !apperr.IsKind(err, apperr.KindConfig) {
+		t.Fatalf("NewFs() without credentials error = %v, want a config error", err)
+	}
+}
+
+func TestFsReconnectsAfterTheConnectionIsLost(t *testing.T) {
+	t.Parallel()
+
+	fs, server := newTestFs(t)
+
+	if err := afero.WriteFile(fs, "/a.bin.part", []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	server.dropConnections()
+
+	if info, err := fs.Stat("/a.bin.part"); err != nil || info.Size() != 5 {
+		t.Fatalf("Stat() after the connection was lost = %v, %v", info, err)
+	}
+	if err := afero.WriteFile(fs, "/b.bin", []byte("world"), 0644); err != nil {
+		t.Fatalf("WriteFile() after the connection was lost error = %v", err)
+	}
+
+	server.dropConnections()
+
+	if err := fs.Rename("/a.bin.part", "/a.bin"); err != nil {
+		t.Fatalf("Rename() after the connection was lost error = %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(server.dir, "a.bin"))
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("ReadFile() = %q, %v", data, err)
+	}
+}
+
+func TestFsReportsAServerThatStaysDown(t *testing.T) {
+	t.Parallel()
+
+	fs, server := newTestFs(t)
+	fs.delay = time.Millisecond
+	fs.dial = func(context.Context) (*ssh.Client, *sftp.Client, error) {
+		return nil, nil, apperr.New("sftp.fs.dial", apperr.KindNetwork, errors.New("connection refused"))
+	}
+
+	server.dropConnections()
+
+	if _, err := fs.Stat("/a.bin"); !apperr.IsKind(err, apperr.KindNetwork) {
+		t.Fatalf("Stat() error = %v, want a network error", err)
+	}
+}
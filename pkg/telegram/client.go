@@ -28,6 +28,7 @@ import (
 	"github.com/gotd/td/tg"
 	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
 	"github.com/johnnyipcom/tgdownloader/pkg/config"
+	"github.com/johnnyipcom/tgdownloader/pkg/ps"
 	bboltdb "go.etcd.io/bbolt"
 	"go.uber.org/zap"
 	"golang.org/x/net/proxy"
@@ -62,20 +63,31 @@ type Client struct {
 	peerMgr        *peers.Manager
 	updMgr         *updates.Manager
 	dispatcher     tg.UpdateDispatcher
+	messages       *messageFanout
 	storage        storage.PeerStorage
 	dialogCache    *dialogCache
 	progress       Progress
 	codeProvider   CodeProvider
+	allowCDN       bool
+	downloads      *downloadPool
+	removeStatus   func()
+	// fileLocations holds the locations refreshed after their file reference
+	// expired, by file identity.
+	fileLocations sync.Map
 
 	common service // Reuse a single struct instead of allocating one for each service on the heap
 
 	// Add other services here
-	UserService   UserService
-	PeerService   PeerService
-	FileService   FileService
-	LinkService   LinkService
-	DialogService DialogService
-	DialogCache   DialogCache
+	UserService      UserService
+	PeerService      PeerService
+	FileService      FileService
+	LinkService      LinkService
+	DialogService    DialogService
+	DialogCache      DialogCache
+	SyncCheckpoints  SyncCheckpointStore
+	WatchCheckpoints SyncCheckpointStore
+	FailedDownloads  FailedDownloadStore
+	OAuth2Tokens     OAuth2TokenStore
 }
 
 type service struct {
@@ -111,7 +123,8 @@ func NewClient(cfg config.Config, log *zap.Logger, clientOpts ...ClientOption) (
 		_ = db.Close()
 		return nil, err
 	}
-	registerDialogCacheHandlers(dispatcher, dialogCache, log.Named("dialog_cache"))
+	messages := newMessageFanout(dispatcher)
+	registerDialogCacheHandlers(dispatcher, messages, dialogCache, log.Named("dialog_cache"))
 
 	floodWaiter := newFloodWaiter(cfg, log)
 
@@ -207,11 +220,15 @@ func NewClient(cfg config.Config, log *zap.Logger, clientOpts ...ClientOption) (
 		peerMgr:        peerMgr,
 		updMgr:         gaps,
 		dispatcher:     dispatcher,
+		messages:       messages,
 		storage:        peerStorage,
 		dialogCache:    dialogCache,
 		progress:       &progress{},
 		codeProvider:   settings.codeProvider,
+		allowCDN:       options.AllowCDN,
+		downloads:      newDownloadPool(cfg, c, c.API, log.Named("downloads"), middlewares...),
 	}
+	cli.removeStatus = ps.AddSource(cli.downloads.status)
 
 	// Set up services
 	cli.common.client = cli
@@ -222,6 +239,10 @@ func NewClient(cfg config.Config, log *zap.Logger, clientOpts ...ClientOption) (
 	cli.LinkService = (*linkService)(&cli.common)
 	cli.DialogService = (*dialogService)(&cli.common)
 	cli.DialogCache = dialogCache
+	cli.SyncCheckpoints = newBoltSyncCheckpointStore(db, syncCheckpointBucket)
+	cli.WatchCheckpoints = newBoltSyncCheckpointStore(db, watchCheckpointBucket)
+	cli.FailedDownloads = newBoltFailedDownloadStore(db)
+	cli.OAuth2Tokens = newBoltOAuth2TokenStore(db)
 	return cli, nil
 }
 
@@ -301,6 +322,9 @@ func newFloodWaiter(cfg config.Config, log *zap.Logger) *reentrantFloodWaiter {
 
 func (c *Client) runClient(ctx context.Context, fn func(context.Context) error) error {
 	run := func(runCtx context.Context) error {
+		if c.downloads != nil {
+			defer c.downloads.reset()
+		}
 		return c.client.Run(runCtx, fn)
 	}
 
@@ -638,7 +662,22 @@ func (c *Client) API() *tg.Client {
 	return c.client.API()
 }
 
+// LatestMessageID returns the ID of the newest message in the peer history.
+func (c *Client) LatestMessageID(ctx context.Context, p peers.Peer) (int, error) {
+	id, err := latestMessageID(ctx, c.API(), p)
+	if err != nil {
+		return 0, apperr.New("telegram.client.latest_message_id", apperr.KindNetwork, err)
+	}
+
+	return id, nil
+}
+
 func (c *Client) Close() error {
+	if c.removeStatus != nil {
+		c.removeStatus()
+		c.removeStatus = nil
+	}
+
 	if c.db == nil {
 		return nil
 	}
@@ -648,25 +687,51 @@ func (c *Client) Close() error {
 	return err
 }
 
+// MessageLink is a parsed t.me message link.
+type MessageLink struct {
+	Peer      peers.Peer
+	MessageID int
+	// TopicID is the forum topic named in the link, or zero.
+	TopicID int
+}
+
 // ParseMessageLink return peer, msgId, error
 func (c *Client) ParseMessageLink(ctx context.Context, s string) (peers.Peer, int, error) {
-	parse := func(from, msg string) (peers.Peer, int, error) {
+	link, err := c.ParseLink(ctx, s)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return link.Peer, link.MessageID, nil
+}
+
+// ParseLink parses a t.me message link, keeping the forum topic if the link
+// has one.
+func (c *Client) ParseLink(ctx context.Context, s string) (MessageLink, error) {
+	parse := func(from, topic, msg string) (MessageLink, error) {
 		ch, err := c.ResolvePeer(ctx, from)
 		if err != nil {
-			return nil, 0, err
+			return MessageLink{}, err
 		}
 
 		m, err := strconv.Atoi(msg)
 		if err != nil {
-			return nil, 0, err
+			return MessageLink{}, err
 		}
 
-		return ch, m, nil
+		link := MessageLink{Peer: ch, MessageID: m}
+		if topic != "" {
+			if link.TopicID, err = strconv.Atoi(topic); err != nil {
+				return MessageLink{}, err
+			}
+		}
+
+		return link, nil
 	}
 
 	u, err := url.Parse(s)
 	if err != nil {
-		return nil, 0, err
+		return MessageLink{}, err
 	}
 
 	paths := strings.Split(strings.TrimPrefix(u.Path, "/"), "/")
@@ -675,51 +740,51 @@ func (c *Client) ParseMessageLink(ctx context.Context, s string) (peers.Peer, in
 	if comment := u.Query().Get("comment"); comment != "" {
 		peer, err := c.ResolvePeer(ctx, paths[0])
 		if err != nil {
-			return nil, 0, err
+			return MessageLink{}, err
 		}
 
 		ch, ok := peer.(linkedChatPeer)
 		if !ok || !ch.IsBroadcast() {
-			return nil, 0, fmt.Errorf("comment links require a broadcast channel")
+			return MessageLink{}, fmt.Errorf("comment links require a broadcast channel")
 		}
 
 		raw, err := ch.FullRaw(ctx)
 		if err != nil {
-			return nil, 0, err
+			return MessageLink{}, err
 		}
 
 		linked, ok := raw.GetLinkedChatID()
 		if !ok {
-			return nil, 0, errors.New("no linked chat")
+			return MessageLink{}, errors.New("no linked chat")
 		}
 
-		return parse(strconv.FormatInt(linked, 10), comment)
+		return parse(strconv.FormatInt(linked, 10), "", comment)
 	}
 
 	switch len(paths) {
 	case 2:
 		// https://t.me/telegram/193
 		// https://t.me/myhostloc/1485524?thread=1485523
-		return parse(paths[0], paths[1])
+		return parse(paths[0], "", paths[1])
 	case 3:
 		// https://t.me/c/1697797156/151
 		// https://t.me/iFreeKnow/45662/55005
 		if paths[0] == "c" {
-			return parse(paths[1], paths[2])
+			return parse(paths[1], "", paths[2])
 		}
 
-		// "45662" means topic id, we don't need it
-		return parse(paths[0], paths[2])
+		// "45662" is the topic id
+		return parse(paths[0], paths[1], paths[2])
 	case 4:
 		// https://t.me/c/1492447836/251015/251021
 		if paths[0] != "c" {
-			return nil, 0, fmt.Errorf("invalid message link")
+			return MessageLink{}, fmt.Errorf("invalid message link")
 		}
 
-		// "251015" means topic id, we don't need it
-		return parse(paths[1], paths[3])
+		// "251015" is the topic id
+		return parse(paths[1], paths[2], paths[3])
 	default:
-		return nil, 0, fmt.Errorf("invalid message link: %s", s)
+		return MessageLink{}, fmt.Errorf("invalid message link: %s", s)
 	}
 }
 
@@ -35,6 +35,71 @@ func TestParseMessageLinkCommentRequiresBroadcastChannel(t *testing.T) {
 	}
 }
 
+func TestParseLinkKeepsTopicID(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		link      string
+		resolve   func(svc *telegrammocks.MockPeerService, p *telegrammocks.MocklinkedChatPeer)
+		wantMsg   int
+		wantTopic int
+	}{
+		{
+			link: "https://t.me/telegram/193",
+			resolve: func(svc *telegrammocks.MockPeerService, p *telegrammocks.MocklinkedChatPeer) {
+				svc.EXPECT().Resolve(gomock.Any(), "telegram").Return(p, nil)
+			},
+			wantMsg: 193,
+		},
+		{
+			link: "https://t.me/c/1697797156/151",
+			resolve: func(svc *telegrammocks.MockPeerService, p *telegrammocks.MocklinkedChatPeer) {
+				svc.EXPECT().ResolveID(gomock.Any(), int64(1697797156)).Return(p, nil)
+			},
+			wantMsg: 151,
+		},
+		{
+			link: "https://t.me/iFreeKnow/45662/55005",
+			resolve: func(svc *telegrammocks.MockPeerService, p *telegrammocks.MocklinkedChatPeer) {
+				svc.EXPECT().Resolve(gomock.Any(), "iFreeKnow").Return(p, nil)
+			},
+			wantMsg:   55005,
+			wantTopic: 45662,
+		},
+		{
+			link: "https://t.me/c/1492447836/251015/251021",
+			resolve: func(svc *telegrammocks.MockPeerService, p *telegrammocks.MocklinkedChatPeer) {
+				svc.EXPECT().ResolveID(gomock.Any(), int64(1492447836)).Return(p, nil)
+			},
+			wantMsg:   251021,
+			wantTopic: 251015,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.link, func(t *testing.T) {
+			t.Parallel()
+
+			ctrl := gomock.NewController(t)
+			p := telegrammocks.NewMocklinkedChatPeer(ctrl)
+			peerSvc := telegrammocks.NewMockPeerService(ctrl)
+			tt.resolve(peerSvc, p)
+
+			client := &Client{}
+			client.PeerService = peerSvc
+
+			link, err := client.ParseLink(context.Background(), tt.link)
+			if err != nil {
+				t.Fatalf("ParseLink() error = %v", err)
+			}
+			if link.MessageID != tt.wantMsg || link.TopicID != tt.wantTopic {
+				t.Fatalf("ParseLink() = message %d, topic %d, want %d, %d", link.MessageID, link.TopicID, tt.wantMsg, tt.wantTopic)
+			}
+		})
+	}
+}
+
 type recordingProgress struct {
 	trackers []string
 	done     []string
@@ -0,0 +1,96 @@
+package telegram
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/gotd/td/telegram/peers"
+	"github.com/gotd/td/telegram/query"
+	"github.com/gotd/td/telegram/query/messages"
+	"github.com/gotd/td/tg"
+	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
+)
+
+type getfileCommentsOption struct{}
+
+func (getfileCommentsOption) apply(opts *getAllFilesOption) error {
+	opts.comments = true
+	return nil
+}
+
+// GetFileWithComments makes GetAllFiles also return the files posted in the
+// comment thread of every channel post. Comments live in the discussion chat
+// linked to the channel.
+func GetFileWithComments() GetAllFilesOption {
+	return getfileCommentsOption{}
+}
+
+// checkDiscussionChat makes sure comments of p can be walked: p has to be a
+// broadcast channel with a linked discussion chat.
+func checkDiscussionChat(ctx context.Context, p peers.Peer) error {
+	ch, ok := p.(linkedChatPeer)
+	if !ok || !ch.IsBroadcast() {
+		return apperr.New("telegram.file.comments", apperr.KindConfig, fmt.Errorf("comments require a broadcast channel, %s is not one", p.VisibleName()))
+	}
+
+	raw, err := ch.FullRaw(ctx)
+	if err != nil {
+		return apperr.New("telegram.file.comments", apperr.KindNetwork, err)
+	}
+
+	if _, ok := raw.GetLinkedChatID(); !ok {
+		return apperr.New("telegram.file.comments", apperr.KindConfig, fmt.Errorf("%s has no linked discussion chat", p.VisibleName()))
+	}
+
+	return nil
+}
+
+// postCommentCount returns the number of comments under a channel post.
+func postCommentCount(msg tg.NotEmptyMessage) int {
+	post, ok := msg.(*tg.Message)
+	if !ok {
+		return 0
+	}
+
+	replies, ok := post.GetReplies()
+	if !ok || !replies.Comments {
+		return 0
+	}
+
+	return replies.Replies
+}
+
+// forEachComment calls fn for every comment under the post. Asking the
+// channel for the replies of a post makes the server walk the matching
+// thread of the discussion chat.
+func forEachComment(ctx context.Context, api *tg.Client, p peers.Peer, postID int, fn func(context.Context, messages.Elem) error) error {
+	return query.Messages(api).GetReplies(p.InputPeer()).MsgID(postID).BatchSize(historyBatchSize).ForEach(ctx, fn)
+}
+
+// sendCommentFiles extracts the files of every comment under the post and
+// passes them to send.
+func (s *fileService) sendCommentFiles(ctx context.Context, p peers.Peer, post tg.NotEmptyMessage, send func(context.Context, []*File, int64) error) error {
+	if postCommentCount(post) == 0 {
+		return nil
+	}
+
+	return forEachComment(ctx, s.client.API(), p, post.GetID(), func(ctx context.Context, elem messages.Elem) error {
+		files, peerID, err := s.extractFilesFromMessageElem(ctx, elem)
+		if err != nil {
+			if errors.Is(err, errNoFilesInMessage) || errors.Is(err, errPaidMediaLocked) {
+				return nil
+			}
+
+			return err
+		}
+
+		for _, file := range files {
+			if file != nil {
+				file.postID = post.GetID()
+			}
+		}
+
+		return send(ctx, files, peerID)
+	})
+}
@@ -0,0 +1,103 @@
+package telegram
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gotd/td/tg"
+	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
+	telegrammocks "github.com/johnnyipcom/tgdownloader/pkg/telegram/mocks"
+	"go.uber.org/mock/gomock"
+)
+
+func TestCheckDiscussionChat(t *testing.T) {
+	t.Parallel()
+
+	linked := &tg.ChannelFull{}
+	linked.SetLinkedChatID(77)
+
+	tests := []struct {
+		name     string
+		setup    func(p *telegrammocks.MocklinkedChatPeer)
+		wantKind apperr.Kind
+	}{
+		{
+			name: "NotBroadcast",
+			setup: func(p *telegrammocks.MocklinkedChatPeer) {
+				p.EXPECT().IsBroadcast().Return(false)
+			},
+			wantKind: apperr.KindConfig,
+		},
+		{
+			name: "NoLinkedChat",
+			setup: func(p *telegrammocks.MocklinkedChatPeer) {
+				p.EXPECT().IsBroadcast().Return(true)
+				p.EXPECT().FullRaw(gomock.Any()).Return(&tg.ChannelFull{}, nil)
+			},
+			wantKind: apperr.KindConfig,
+		},
+		{
+			name: "Linked",
+			setup: func(p *telegrammocks.MocklinkedChatPeer) {
+				p.EXPECT().IsBroadcast().Return(true)
+				p.EXPECT().FullRaw(gomock.Any()).Return(linked, nil)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctrl := gomock.NewController(t)
+			p := telegrammocks.NewMocklinkedChatPeer(ctrl)
+			p.EXPECT().VisibleName().Return("Cherry Channel").AnyTimes()
+			tt.setup(p)
+
+			err := checkDiscussionChat(context.Background(), p)
+			if tt.wantKind == "" {
+				if err != nil {
+					t.Fatalf("checkDiscussionChat() error = %v", err)
+				}
+				return
+			}
+
+			if !apperr.IsKind(err, tt.wantKind) {
+				t.Fatalf("checkDiscussionChat() error = %v, want %s", err, tt.wantKind)
+			}
+		})
+	}
+}
+
+func TestPostCommentCount(t *testing.T) {
+	t.Parallel()
+
+	withReplies := func(replies tg.MessageReplies) *tg.Message {
+		msg := &tg.Message{ID: 10}
+		msg.SetReplies(replies)
+		return msg
+	}
+
+	tests := []struct {
+		name string
+		msg  tg.NotEmptyMessage
+		want int
+	}{
+		{name: "NoReplies", msg: &tg.Message{ID: 10}, want: 0},
+		{name: "Service", msg: &tg.MessageService{ID: 10}, want: 0},
+		{name: "ThreadRepliesAreNotComments", msg: withReplies(tg.MessageReplies{Replies: 3}), want: 0},
+		{name: "Comments", msg: withReplies(tg.MessageReplies{Comments: true, Replies: 3}), want: 3},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := postCommentCount(tt.msg); got != tt.want {
+				t.Fatalf("postCommentCount() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
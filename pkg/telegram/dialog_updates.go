@@ -9,7 +9,7 @@ import (
 	"go.uber.org/zap"
 )
 
-func registerDialogCacheHandlers(dispatcher tg.UpdateDispatcher, cache *dialogCache, log *zap.Logger) {
+func registerDialogCacheHandlers(dispatcher tg.UpdateDispatcher, messages *messageFanout, cache *dialogCache, log *zap.Logger) {
 	upsertMessagePeer := func(ctx context.Context, entities tg.Entities, message tg.MessageClass) {
 		msg, ok := message.AsNotEmpty()
 		if !ok {
@@ -24,12 +24,8 @@ func registerDialogCacheHandlers(dispatcher tg.UpdateDispatcher, cache *dialogCa
 		}
 	}
 
-	dispatcher.OnNewMessage(func(ctx context.Context, entities tg.Entities, update *tg.UpdateNewMessage) error {
-		upsertMessagePeer(ctx, entities, update.Message)
-		return nil
-	})
-	dispatcher.OnNewChannelMessage(func(ctx context.Context, entities tg.Entities, update *tg.UpdateNewChannelMessage) error {
-		upsertMessagePeer(ctx, entities, update.Message)
+	messages.subscribe(func(ctx context.Context, entities tg.Entities, message tg.MessageClass) error {
+		upsertMessagePeer(ctx, entities, message)
 		return nil
 	})
 
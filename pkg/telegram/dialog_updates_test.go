@@ -28,7 +28,7 @@ func newDialogUpdateTestCache(t *testing.T) *dialogCache {
 func TestDialogUpdateHandlersAddDirectUserDialog(t *testing.T) {
 	cache := newDialogUpdateTestCache(t)
 	dispatcher := tg.NewUpdateDispatcher()
-	registerDialogCacheHandlers(dispatcher, cache, zap.NewNop())
+	registerDialogCacheHandlers(dispatcher, newMessageFanout(dispatcher), cache, zap.NewNop())
 
 	updates := &tg.Updates{
 		Updates: []tg.UpdateClass{
@@ -58,7 +58,7 @@ func TestDialogUpdateHandlersRefreshUserName(t *testing.T) {
 	}
 
 	dispatcher := tg.NewUpdateDispatcher()
-	registerDialogCacheHandlers(dispatcher, cache, zap.NewNop())
+	registerDialogCacheHandlers(dispatcher, newMessageFanout(dispatcher), cache, zap.NewNop())
 	updates := &tg.Updates{
 		Updates: []tg.UpdateClass{
 			&tg.UpdateUserName{
@@ -0,0 +1,221 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	tgclient "github.com/gotd/td/telegram"
+	"github.com/gotd/td/telegram/downloader"
+	"github.com/gotd/td/tg"
+	"github.com/johnnyipcom/tgdownloader/pkg/config"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultDCConnections = 4
+	defaultDCTransfers   = 4
+)
+
+// dcConnector opens connections to a DC. *tgclient.Client implements it.
+type dcConnector interface {
+	DC(ctx context.Context, dc int, max int64) (tgclient.CloseInvoker, error)
+}
+
+// downloadPool sends file downloads to the DC the file is stored on. It keeps
+// up to conns connections to every DC used so far and lets at most limit
+// transfers use a DC at once, so that raising the number of workers neither
+// migrates the main connection back and forth nor floods a single DC.
+type downloadPool struct {
+	connector   dcConnector
+	main        func() *tg.Client
+	middlewares []tgclient.Middleware
+	conns       int64
+	limit       int
+	logger      *zap.Logger
+
+	mu  sync.Mutex
+	dcs map[int]*dcDownloads
+}
+
+// dcDownloads are the connections and transfers of a single DC.
+type dcDownloads struct {
+	slots  chan struct{}
+	active atomic.Int64
+
+	mu      sync.Mutex
+	invoker tgclient.CloseInvoker
+	api     *tg.Client
+}
+
+func newDownloadPool(cfg config.Config, connector dcConnector, main func() *tg.Client, log *zap.Logger, middlewares ...tgclient.Middleware) *downloadPool {
+	pool := &downloadPool{
+		connector:   connector,
+		main:        main,
+		middlewares: middlewares,
+		conns:       defaultDCConnections,
+		limit:       defaultDCTransfers,
+		logger:      log,
+		dcs:         make(map[int]*dcDownloads),
+	}
+
+	if cfg.IsSet("download.dc_connections") {
+		pool.conns = cfg.GetInt64("download.dc_connections")
+	}
+	if cfg.IsSet("download.dc_transfers") {
+		pool.limit = cfg.GetInt("download.dc_transfers")
+	}
+	pool.limit = max(pool.limit, 1)
+
+	return pool
+}
+
+// acquire waits for a free transfer slot of dc and returns the API to
+// download through. release has to be called once the transfer is over.
+// Files of an unknown DC use the main connection right away; with
+// dc_connections set to zero all files do, still within the limit per DC.
+func (p *downloadPool) acquire(ctx context.Context, dc int) (api *tg.Client, release func(), err error) {
+	if dc <= 0 {
+		return p.main(), func() {}, nil
+	}
+
+	downloads := p.dc(dc)
+	select {
+	case downloads.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+	downloads.active.Add(1)
+
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			downloads.active.Add(-1)
+			<-downloads.slots
+		})
+	}
+
+	if p.conns <= 0 {
+		return p.main(), release, nil
+	}
+
+	api, err = p.open(ctx, dc, downloads)
+	if err != nil {
+		if ctx.Err() != nil {
+			release()
+			return nil, nil, ctx.Err()
+		}
+
+		p.logger.Warn("failed to connect to file DC, using the main connection", zap.Int("dc_id", dc), zap.Error(err))
+		return p.main(), release, nil
+	}
+
+	return api, release, nil
+}
+
+func (p *downloadPool) dc(dc int) *dcDownloads {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	downloads, ok := p.dcs[dc]
+	if !ok {
+		downloads = &dcDownloads{slots: make(chan struct{}, p.limit)}
+		p.dcs[dc] = downloads
+	}
+
+	return downloads
+}
+
+// open connects to dc the first time a transfer needs it. Failures are not
+// remembered, the next transfer tries again.
+func (p *downloadPool) open(ctx context.Context, dc int, downloads *dcDownloads) (*tg.Client, error) {
+	downloads.mu.Lock()
+	defer downloads.mu.Unlock()
+
+	if downloads.api != nil {
+		return downloads.api, nil
+	}
+
+	invoker, err := p.connector.DC(ctx, dc, p.conns)
+	if err != nil {
+		return nil, fmt.Errorf("connect to DC %d: %w", dc, err)
+	}
+
+	var chained tg.Invoker = invoker
+	for i := len(p.middlewares) - 1; i >= 0; i-- {
+		chained = p.middlewares[i].Handle(chained)
+	}
+
+	p.logger.Debug("connected to file DC", zap.Int("dc_id", dc), zap.Int64("connections", p.conns))
+	downloads.invoker = invoker
+	downloads.api = tg.NewClient(chained)
+	return downloads.api, nil
+}
+
+// reset closes the connections, which do not outlive the client run that
+// opened them.
+func (p *downloadPool) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for dc, downloads := range p.dcs {
+		downloads.mu.Lock()
+		if downloads.invoker != nil {
+			if err := downloads.invoker.Close(); err != nil {
+				p.logger.Debug("failed to close file DC connections", zap.Int("dc_id", dc), zap.Error(err))
+			}
+			downloads.invoker = nil
+			downloads.api = nil
+		}
+		downloads.mu.Unlock()
+	}
+}
+
+// status lists the active transfers by DC, or returns an empty string when
+// there are none.
+func (p *downloadPool) status() string {
+	p.mu.Lock()
+	dcs := make([]int, 0, len(p.dcs))
+	active := make(map[int]int64, len(p.dcs))
+	for dc, downloads := range p.dcs {
+		if n := downloads.active.Load(); n > 0 {
+			dcs = append(dcs, dc)
+			active[dc] = n
+		}
+	}
+	p.mu.Unlock()
+
+	if len(dcs) == 0 {
+		return ""
+	}
+
+	slices.Sort(dcs)
+	parts := make([]string, 0, len(dcs))
+	for _, dc := range dcs {
+		parts = append(parts, fmt.Sprintf("DC%d=%d", dc, active[dc]))
+	}
+
+	return "Transfers: " + strings.Join(parts, " ")
+}
+
+// poolDownloadClient downloads through a pooled API and keeps the CDN
+// redirects of the main client.
+type poolDownloadClient struct {
+	*tg.Client
+	cdn *tgclient.Client
+}
+
+var _ downloader.CDNProvider = poolDownloadClient{}
+
+func (c poolDownloadClient) CDN(ctx context.Context, dc int, max int64) (downloader.CDN, io.Closer, error) {
+	invoker, err := c.cdn.CDN(ctx, dc, max)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return tg.NewClient(invoker), invoker, nil
+}
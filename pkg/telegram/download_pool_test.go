@@ -0,0 +1,164 @@
+package telegram
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gotd/td/bin"
+	tgclient "github.com/gotd/td/telegram"
+	"github.com/gotd/td/tg"
+	"github.com/johnnyipcom/tgdownloader/pkg/config/viper"
+	"go.uber.org/zap"
+)
+
+type fakeDCInvoker struct {
+	closed bool
+}
+
+func (i *fakeDCInvoker) Invoke(context.Context, bin.Encoder, bin.Decoder) error { return nil }
+
+func (i *fakeDCInvoker) Close() error {
+	i.closed = true
+	return nil
+}
+
+type fakeDCConnector struct {
+	mu       sync.Mutex
+	opened   map[int]int
+	invokers []*fakeDCInvoker
+	err      error
+}
+
+func (c *fakeDCConnector) DC(_ context.Context, dc int, _ int64) (tgclient.CloseInvoker, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	if c.opened == nil {
+		c.opened = make(map[int]int)
+	}
+	c.opened[dc]++
+
+	invoker := &fakeDCInvoker{}
+	c.invokers = append(c.invokers, invoker)
+	return invoker, nil
+}
+
+func newTestDownloadPool(t *testing.T, connector dcConnector, transfers int) (*downloadPool, *tg.Client) {
+	t.Helper()
+
+	cfg := viper.NewConfig()
+	cfg.Set("download.dc_transfers", transfers)
+	main := tg.NewClient(&fakeDCInvoker{})
+	return newDownloadPool(cfg, connector, func() *tg.Client { return main }, zap.NewNop()), main
+}
+
+func TestDownloadPoolReusesConnectionsPerDC(t *testing.T) {
+	t.Parallel()
+
+	connector := &fakeDCConnector{}
+	pool, main := newTestDownloadPool(t, connector, 2)
+	ctx := context.Background()
+
+	first, releaseFirst, err := pool.acquire(ctx, 2)
+	if err != nil {
+		t.Fatalf("acquire() error = %v", err)
+	}
+	second, releaseSecond, err := pool.acquire(ctx, 2)
+	if err != nil {
+		t.Fatalf("acquire() error = %v", err)
+	}
+	other, releaseOther, err := pool.acquire(ctx, 4)
+	if err != nil {
+		t.Fatalf("acquire() error = %v", err)
+	}
+
+	if first != second || first == other || first == main {
+		t.Fatal("transfers of a DC do not share its connections")
+	}
+	if connector.opened[2] != 1 || connector.opened[4] != 1 {
+		t.Fatalf("opened = %v, want one pool per DC", connector.opened)
+	}
+	if got := pool.status(); got != "Transfers: DC2=2 DC4=1" {
+		t.Fatalf("status() = %q", got)
+	}
+
+	releaseFirst()
+	releaseFirst()
+	releaseSecond()
+	releaseOther()
+	if got := pool.status(); got != "" {
+		t.Fatalf("status() after release = %q, want empty", got)
+	}
+
+	pool.reset()
+	for _, invoker := range connector.invokers {
+		if !invoker.closed {
+			t.Fatal("reset() left a DC pool open")
+		}
+	}
+
+	if _, release, err := pool.acquire(ctx, 2); err != nil {
+		t.Fatalf("acquire() after reset error = %v", err)
+	} else {
+		release()
+	}
+	if connector.opened[2] != 2 {
+		t.Fatalf("DC 2 opened %d times, want a new pool after reset", connector.opened[2])
+	}
+}
+
+func TestDownloadPoolLimitsTransfersPerDC(t *testing.T) {
+	t.Parallel()
+
+	pool, _ := newTestDownloadPool(t, &fakeDCConnector{}, 1)
+
+	_, release, err := pool.acquire(context.Background(), 2)
+	if err != nil {
+		t.Fatalf("acquire() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, err := pool.acquire(ctx, 2); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("acquire() over the limit = %v, want to wait", err)
+	}
+
+	if _, releaseOther, err := pool.acquire(context.Background(), 4); err != nil {
+		t.Fatalf("acquire() on another DC error = %v", err)
+	} else {
+		releaseOther()
+	}
+
+	release()
+	if _, releaseAgain, err := pool.acquire(context.Background(), 2); err != nil {
+		t.Fatalf("acquire() after release error = %v", err)
+	} else {
+		releaseAgain()
+	}
+}
+
+func TestDownloadPoolFallsBackToMainConnection(t *testing.T) {
+	t.Parallel()
+
+	pool, main := newTestDownloadPool(t, &fakeDCConnector{err: errors.New("unknown DC")}, 1)
+
+	api, release, err := pool.acquire(context.Background(), 5)
+	if err != nil {
+		t.Fatalf("acquire() error = %v", err)
+	}
+	defer release()
+	if api != main {
+		t.Fatal("acquire() did not fall back to the main connection")
+	}
+
+	if api, _, err := pool.acquire(context.Background(), 0); err != nil || api != main {
+		t.Fatalf("acquire() of a file without DC = %v, %v; want the main connection", api, err)
+	}
+}
@@ -1,9 +1,21 @@
 package telegram
 
-import "errors"
+import (
+	"errors"
+	"time"
+
+	"github.com/gotd/td/tgerr"
+)
 
 var (
 	errNoFilesInMessage = errors.New("no files in message")
 	errPaidMediaLocked  = errors.New("paid media is locked (not purchased)")
 	errLimitReached     = errors.New("limit reached")
+	errRangeEnd         = errors.New("end of history range")
 )
+
+// AsFloodWait returns how long Telegram asked to wait before the request that
+// failed with err may be sent again.
+func AsFloodWait(err error) (time.Duration, bool) {
+	return tgerr.AsFloodWait(err)
+}
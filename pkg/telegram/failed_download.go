@@ -0,0 +1,117 @@
+package telegram
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
+	bolt "go.etcd.io/bbolt"
+)
+
+var failedDownloadBucket = []byte("failed_downloads")
+
+// FailedDownload is a file whose download failed, with what is needed to
+// fetch its message and download it again.
+type FailedDownload struct {
+	// PeerID is the TDLib-style ID of the chat the message belongs to.
+	PeerID    int64  `json:"peer_id"`
+	MessageID int    `json:"message_id"`
+	Identity  string `json:"identity"`
+	Name      string `json:"name"`
+	// Paths are the output paths of the file relative to the output
+	// directory.
+	Paths     []string    `json:"paths,omitempty"`
+	Kind      apperr.Kind `json:"kind"`
+	Error     string      `json:"error"`
+	Attempts  int         `json:"attempts"`
+	UpdatedAt time.Time   `json:"updated_at"`
+}
+
+// FailedDownloadStore persists failed downloads until they succeed.
+type FailedDownloadStore interface {
+	List(ctx context.Context) ([]FailedDownload, error)
+	Put(ctx context.Context, failed FailedDownload) error
+	Delete(ctx context.Context, failed FailedDownload) error
+}
+
+type boltFailedDownloadStore struct {
+	db *bolt.DB
+}
+
+var _ FailedDownloadStore = (*boltFailedDownloadStore)(nil)
+
+func newBoltFailedDownloadStore(db *bolt.DB) *boltFailedDownloadStore {
+	return &boltFailedDownloadStore{db: db}
+}
+
+func failedDownloadKey(failed FailedDownload) []byte {
+	key := append(int64Bytes(failed.PeerID), int64Bytes(int64(failed.MessageID))...)
+	return append(key, failed.Identity...)
+}
+
+func (s *boltFailedDownloadStore) List(_ context.Context) ([]FailedDownload, error) {
+	var failed []FailedDownload
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(failedDownloadBucket)
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(_, v []byte) error {
+			var entry FailedDownload
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return fmt.Errorf("decode failed download: %w", err)
+			}
+
+			failed = append(failed, entry)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, apperr.New("telegram.failed_download.list", apperr.KindIO, err)
+	}
+
+	return failed, nil
+}
+
+func (s *boltFailedDownloadStore) Put(_ context.Context, failed FailedDownload) error {
+	if failed.UpdatedAt.IsZero() {
+		failed.UpdatedAt = time.Now().UTC()
+	}
+
+	data, err := json.Marshal(failed)
+	if err != nil {
+		return apperr.New("telegram.failed_download.put", apperr.KindInternal, fmt.Errorf("encode failed download: %w", err))
+	}
+
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(failedDownloadBucket)
+		if err != nil {
+			return err
+		}
+
+		return b.Put(failedDownloadKey(failed), data)
+	}); err != nil {
+		return apperr.New("telegram.failed_download.put", apperr.KindIO, err)
+	}
+
+	return nil
+}
+
+func (s *boltFailedDownloadStore) Delete(_ context.Context, failed FailedDownload) error {
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(failedDownloadBucket)
+		if b == nil {
+			return nil
+		}
+
+		return b.Delete(failedDownloadKey(failed))
+	}); err != nil {
+		return apperr.New("telegram.failed_download.delete", apperr.KindIO, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,45 @@
+package telegram
+
+import (
+	"context"
+	"testing"
+
+	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
+)
+
+func TestBoltFailedDownloadStoreRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	store := newBoltFailedDownloadStore(openDialogCacheStoreTestDB(t))
+
+	if failed, err := store.List(ctx); err != nil || len(failed) != 0 {
+		t.Fatalf("List() on empty store = %+v, %v", failed, err)
+	}
+
+	first := FailedDownload{PeerID: -1001, MessageID: 42, Identity: "101", Kind: apperr.KindNetwork, Error: "timeout", Attempts: 1}
+	second := FailedDownload{PeerID: -1001, MessageID: 42, Identity: "202", Kind: apperr.KindIO, Error: "disk full", Attempts: 1}
+	for _, failed := range []FailedDownload{first, second} {
+		if err := store.Put(ctx, failed); err != nil {
+			t.Fatalf("Put() error = %v", err)
+		}
+	}
+
+	first.Attempts = 2
+	if err := store.Put(ctx, first); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	failed, err := store.List(ctx)
+	if err != nil || len(failed) != 2 {
+		t.Fatalf("List() = %+v, %v", failed, err)
+	}
+	if failed[0].Identity != "101" || failed[0].Attempts != 2 || failed[0].UpdatedAt.IsZero() {
+		t.Fatalf("List()[0] = %+v", failed[0])
+	}
+
+	if err := store.Delete(ctx, first); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if failed, _ := store.List(ctx); len(failed) != 1 || failed[0].Identity != "202" {
+		t.Fatalf("List() after Delete() = %+v", failed)
+	}
+}
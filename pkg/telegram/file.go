@@ -7,7 +7,10 @@ import (
 	"io"
 	"strconv"
 	"sync/atomic"
+	"time"
 
+	"github.com/gotd/td/constant"
+	"github.com/gotd/td/telegram/downloader"
 	"github.com/gotd/td/telegram/message/peer"
 	"github.com/gotd/td/telegram/peers"
 	"github.com/gotd/td/telegram/query"
@@ -19,11 +22,19 @@ import (
 )
 
 type File struct {
-	name     string
-	size     int64
-	dc       int
-	location tg.InputFileLocationClass
-	metadata map[string]interface{}
+	name      string
+	size      int64
+	dc        int
+	kind      MediaKind
+	messageID int
+	date      int
+	groupedID int64
+	senderID  int64
+	topicID   int
+	postID    int
+	peerID    constant.TDLibPeerID
+	location  tg.InputFileLocationClass
+	metadata  map[string]interface{}
 }
 
 func (f File) String() string {
@@ -42,6 +53,67 @@ func (f File) Size() int64 {
 	return f.size
 }
 
+// Kind returns the media kind of the file.
+func (f File) Kind() MediaKind {
+	return f.kind
+}
+
+// MessageID returns the ID of the message the file is attached to.
+func (f File) MessageID() int {
+	return f.messageID
+}
+
+// Date returns when the message was sent.
+func (f File) Date() time.Time {
+	return time.Unix(int64(f.date), 0)
+}
+
+// GroupedID returns the album the message belongs to, or zero.
+func (f File) GroupedID() int64 {
+	return f.groupedID
+}
+
+// SenderID returns the ID of the message author, or of the chat for posts
+// without an author.
+func (f File) SenderID() int64 {
+	return f.senderID
+}
+
+// Sender returns the visible name of the message author.
+func (f File) Sender() string {
+	sender, _ := f.metadata["peername"].(string)
+	return sender
+}
+
+// Hashtags returns the hashtags of the message text.
+func (f File) Hashtags() []string {
+	hashtags, _ := f.metadata["hashtags"].([]string)
+	return hashtags
+}
+
+// TopicID returns the forum topic the message belongs to, or zero outside
+// of forums.
+func (f File) TopicID() int {
+	return f.topicID
+}
+
+// PostID returns the channel post a comment file was posted under, or zero
+// for files that are not from comments.
+func (f File) PostID() int {
+	return f.postID
+}
+
+// PeerID returns the TDLib-style ID of the chat the message belongs to.
+func (f File) PeerID() constant.TDLibPeerID {
+	return f.peerID
+}
+
+// MIMEType returns the MIME type reported by Telegram.
+func (f File) MIMEType() string {
+	mimeType, _ := f.metadata["mime_type"].(string)
+	return mimeType
+}
+
 // Identity returns a stable identifier for distinguishing Telegram files that
 // happen to have the same display name.
 func (f File) Identity() string {
@@ -88,9 +160,19 @@ type fileService service
 var _ FileService = (*fileService)(nil)
 
 type getAllFilesOption struct {
-	userID     int64
-	limit      int
-	offsetDate int
+	userID      int64
+	limit       int
+	offsetDate  int
+	minDate     int
+	minID       int
+	maxID       int
+	oldestFirst bool
+	topicID     int
+	comments    bool
+	filter      FileFilter
+
+	backfill      bool
+	backfillAfter int
 }
 
 type GetAllFilesOption interface {
@@ -184,11 +266,15 @@ func (s *fileService) extractFilesFromMessageElem(ctx context.Context, elem mess
 	}
 
 	visibleName := peer.VisibleName()
+	chatID, _ := tdlibPeerID(elem.Msg.GetPeerID())
+	topicID := messageTopicID(elem.Msg, elem.Entities)
 
 	msg, ok := elem.Msg.(*tg.Message)
 	hashtags := []string{}
+	var groupedID int64
 	if ok {
 		hashtags = extractHashtags(msg.GetMessage())
+		groupedID, _ = msg.GetGroupedID()
 	}
 
 	for _, file := range files {
@@ -196,6 +282,12 @@ func (s *fileService) extractFilesFromMessageElem(ctx context.Context, elem mess
 			continue
 		}
 
+		file.messageID = elem.Msg.GetID()
+		file.date = elem.Msg.GetDate()
+		file.groupedID = groupedID
+		file.senderID = peer.ID()
+		file.topicID = topicID
+		file.peerID = chatID
 		file.metadata["peername"] = strconv.FormatInt(peer.ID(), 10)
 		if visibleName != "" {
 			file.metadata["peername"] = visibleName
@@ -220,56 +312,74 @@ func (s *fileService) GetAllFiles(ctx context.Context, peer peers.Peer, opts ...
 		}
 	}
 
+	if options.comments {
+		if err := checkDiscussionChat(ctx, peer); err != nil {
+			return nil, apperr.Wrap("telegram.file.get_all_files.comments", err)
+		}
+	}
+
 	var fileCounter int64
 	fileChan := make(chan File)
-	go func() {
-		defer close(fileChan)
 
-		queryBuilder := query.Messages(s.client.API()).GetHistory(peer.InputPeer())
-		queryBuilder = queryBuilder.OffsetDate(options.offsetDate)
-		queryBuilder = queryBuilder.BatchSize(100)
+	sendFiles := func(ctx context.Context, files []*File, peerID int64) error {
+		if len(files) == 0 || (options.userID > 0 && peerID != options.userID) {
+			return nil
+		}
+
+		for _, file := range files {
+			if file == nil || !options.filter.Match(*file) {
+				continue
+			}
 
-		if err := queryBuilder.ForEach(ctx, func(ctx context.Context, elem messages.Elem) error {
 			if atomic.LoadInt64(&fileCounter) >= int64(options.limit) {
 				s.logger.Info("limit reached", zap.Int64("limit", int64(options.limit)))
 				return errLimitReached
 			}
 
-			files, peerID, err := s.extractFilesFromMessageElem(ctx, elem)
-			if err != nil {
-				if errors.Is(err, errNoFilesInMessage) || errors.Is(err, errPaidMediaLocked) {
-					return nil
-				}
+			select {
+			case fileChan <- *file:
+				atomic.AddInt64(&fileCounter, 1)
 
-				return err
+			case <-ctx.Done():
+				return ctx.Err()
 			}
+		}
 
-			if len(files) == 0 || (options.userID > 0 && peerID != options.userID) {
-				return nil
-			}
+		return nil
+	}
 
-			for _, file := range files {
-				if file == nil {
-					continue
-				}
+	go func() {
+		defer close(fileChan)
 
-				if atomic.LoadInt64(&fileCounter) >= int64(options.limit) {
-					s.logger.Info("limit reached", zap.Int64("limit", int64(options.limit)))
-					return errLimitReached
-				}
+		if err := options.forEachHistory(ctx, s.client.API(), peer, func(ctx context.Context, elem messages.Elem) error {
+			if atomic.LoadInt64(&fileCounter) >= int64(options.limit) {
+				s.logger.Info("limit reached", zap.Int64("limit", int64(options.limit)))
+				return errLimitReached
+			}
 
-				select {
-				case fileChan <- *file:
-					atomic.AddInt64(&fileCounter, 1)
+			if inside, done := options.historyWindow(elem.Msg); done {
+				return errRangeEnd
+			} else if !inside {
+				return nil
+			}
 
-				case <-ctx.Done():
-					return ctx.Err()
+			files, peerID, err := s.extractFilesFromMessageElem(ctx, elem)
+			switch {
+			case err == nil:
+				if err := sendFiles(ctx, files, peerID); err != nil {
+					return err
 				}
+			case !errors.Is(err, errNoFilesInMessage) && !errors.Is(err, errPaidMediaLocked):
+				return err
+			}
+
+			if options.comments {
+				return s.sendCommentFiles(ctx, peer, elem.Msg, sendFiles)
 			}
 
 			return nil
 		}); err != nil {
-			if !errors.Is(err, errLimitReached) {
+			if !errors.Is(err, errLimitReached) && !errors.Is(err, errRangeEnd) && ctx.Err() == nil {
 				s.logger.Error("failed to get files", zap.Error(err))
 				return
 			}
@@ -281,7 +391,10 @@ func (s *fileService) GetAllFiles(ctx context.Context, peer peers.Peer, opts ...
 	return fileChan, nil
 }
 
-// GetAllFilesFromNewMessages returns files from new messages.
+// GetAllFilesFromNewMessages returns files from new messages. With
+// GetFileWithBackfillAfter it first replays the history missed since the
+// given message; live updates are queued until the replay is done and
+// messages it already covered are dropped.
 func (s *fileService) GetAllFilesFromNewMessages(ctx context.Context, p peers.Peer, opts ...GetAllFilesOption) (<-chan File, error) {
 	options := getAllFilesOption{
 		limit: int(^uint(0) >> 1), // MaxInt
@@ -292,31 +405,58 @@ func (s *fileService) GetAllFilesFromNewMessages(ctx context.Context, p peers.Pe
 		}
 	}
 
-	var fileCounter int64
+	var (
+		fileCounter    int64
+		lastBackfilled int64
+	)
 
 	fileChan := make(chan File)
+	backfillDone := make(chan struct{})
 
-	onNewMessage := func(ctx context.Context, e tg.Entities, msg tg.MessageClass) error {
-		if atomic.LoadInt64(&fileCounter) >= int64(options.limit) {
-			s.logger.Info("limit reached", zap.Int64("limit", int64(options.limit)))
-			return errLimitReached
+	sendFiles := func(ctx context.Context, files []*File, peerID int64) error {
+		if len(files) == 0 || (options.userID > 0 && peerID != options.userID) {
+			return nil
 		}
 
-		nonEmpty, ok := msg.AsNotEmpty()
-		if !ok {
-			s.logger.Debug("empty message")
+		for _, file := range files {
+			if file == nil || !options.filter.Match(*file) {
+				continue
+			}
+
+			if atomic.LoadInt64(&fileCounter) >= int64(options.limit) {
+				s.logger.Info("limit reached", zap.Int64("limit", int64(options.limit)))
+				return errLimitReached
+			}
+
+			select {
+			case fileChan <- *file:
+				atomic.AddInt64(&fileCounter, 1)
+
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		return nil
+	}
+
+	handleLive := func(m pendingMessage) error {
+		if int64(m.msg.GetID()) <= atomic.LoadInt64(&lastBackfilled) {
 			return nil
 		}
 
-		entities := peer.EntitiesFromUpdate(e)
+		entities := peer.EntitiesFromUpdate(m.entities)
+		if options.topicID > 0 && messageTopicID(m.msg, entities) != options.topicID {
+			return nil
+		}
 
-		msgPeer, err := entities.ExtractPeer(nonEmpty.GetPeerID())
+		msgPeer, err := entities.ExtractPeer(m.msg.GetPeerID())
 		if err != nil {
 			msgPeer = &tg.InputPeerEmpty{}
 		}
 
 		files, peerID, err := s.extractFilesFromMessageElem(ctx, messages.Elem{
-			Msg:      nonEmpty,
+			Msg:      m.msg,
 			Peer:     msgPeer,
 			Entities: entities,
 		})
@@ -329,39 +469,94 @@ func (s *fileService) GetAllFilesFromNewMessages(ctx context.Context, p peers.Pe
 			return err
 		}
 
-		if len(files) == 0 || peerID != p.ID() {
-			return nil
+		return sendFiles(ctx, files, peerID)
+	}
+
+	// Live messages are queued and processed here, after the backfill, so
+	// the dispatcher shared with other watches never waits for this one.
+	pending := newPendingMessages()
+	go func() {
+		select {
+		case <-backfillDone:
+		case <-ctx.Done():
+			return
 		}
 
-		for _, file := range files {
-			if file == nil {
-				continue
+		for {
+			batch, err := pending.next(ctx)
+			if err != nil {
+				return
 			}
 
-			if atomic.LoadInt64(&fileCounter) >= int64(options.limit) {
-				s.logger.Info("limit reached", zap.Int64("limit", int64(options.limit)))
-				return errLimitReached
+			for _, m := range batch {
+				if err := handleLive(m); err != nil {
+					if errors.Is(err, errLimitReached) || ctx.Err() != nil {
+						return
+					}
+
+					s.logger.Error("failed to get files from new message", zap.Error(err))
+				}
 			}
+		}
+	}()
 
-			select {
-			case fileChan <- *file:
-				atomic.AddInt64(&fileCounter, 1)
+	onNewMessage := func(_ context.Context, e tg.Entities, msg tg.MessageClass) error {
+		if atomic.LoadInt64(&fileCounter) >= int64(options.limit) {
+			s.logger.Info("limit reached", zap.Int64("limit", int64(options.limit)))
+			return errLimitReached
+		}
 
-			case <-ctx.Done():
-				return ctx.Err()
-			}
+		nonEmpty, ok := msg.AsNotEmpty()
+		if !ok {
+			s.logger.Debug("empty message")
+			return nil
+		}
+
+		if !isMessageInPeer(nonEmpty.GetPeerID(), p) || ctx.Err() != nil {
+			return nil
 		}
 
+		pending.push(pendingMessage{entities: e, msg: nonEmpty})
 		return nil
 	}
 
-	s.client.dispatcher.OnNewMessage(func(ctx context.Context, e tg.Entities, update *tg.UpdateNewMessage) error {
-		return onNewMessage(ctx, e, update.Message)
-	})
+	unsubscribe := s.client.messages.subscribe(onNewMessage)
+	go func() {
+		<-ctx.Done()
+		unsubscribe()
+	}()
 
-	s.client.dispatcher.OnNewChannelMessage(func(ctx context.Context, e tg.Entities, update *tg.UpdateNewChannelMessage) error {
-		return onNewMessage(ctx, e, update.Message)
-	})
+	if !options.backfill {
+		close(backfillDone)
+		return fileChan, nil
+	}
+
+	go func() {
+		defer close(backfillDone)
+
+		backfill := options
+		backfill.oldestFirst = true
+		backfill.minID = options.backfillAfter + 1
+		backfill.maxID = 0
+
+		s.logger.Info("backfilling missed messages", zap.Int("after_id", options.backfillAfter))
+		if err := backfill.forEachHistory(ctx, s.client.API(), p, func(ctx context.Context, elem messages.Elem) error {
+			defer atomic.StoreInt64(&lastBackfilled, int64(elem.Msg.GetID()))
+
+			files, peerID, err := s.extractFilesFromMessageElem(ctx, elem)
+			if err != nil {
+				if errors.Is(err, errNoFilesInMessage) || errors.Is(err, errPaidMediaLocked) {
+					return nil
+				}
+
+				return err
+			}
+
+			return sendFiles(ctx, files, peerID)
+		}); err != nil && !errors.Is(err, errLimitReached) && ctx.Err() == nil {
+			s.logger.Error("failed to backfill missed messages", zap.Error(err))
+		}
+	}()
 
 	return fileChan, nil
 }
@@ -454,9 +649,22 @@ func (s *fileService) GetFilesFromGroupedMessage(ctx context.Context, peer peers
 	return files, nil
 }
 
+// Download streams a Telegram file to out. When the file reference expires
+// midway, the location is refreshed from the source message and the download
+// continues from the bytes already written.
 func (s *fileService) Download(ctx context.Context, file File, out io.Writer) error {
-	builder := s.client.client.Download(file.location)
-	_, err := builder.Stream(ctx, out)
+	api, release, err := s.downloadAPI(ctx, file)
+	if err != nil {
+		return apperr.New("telegram.file.download", apperr.KindCancel, err)
+	}
+	defer release()
+
+	written := &countingWriter{w: out}
+	_, err = s.download(api, s.location(file)).Stream(ctx, written)
+	if isFileReferenceExpired(err) {
+		_, err = s.downloadFromOffset(ctx, api, file, out, written.n)
+		return apperr.Wrap("telegram.file.download", err)
+	}
 	if err != nil {
 		return apperr.New("telegram.file.download", apperr.KindNetwork, err)
 	}
@@ -464,6 +672,35 @@ func (s *fileService) Download(ctx context.Context, file File, out io.Writer) er
 	return nil
 }
 
+// DownloadParallel downloads a Telegram file with several upload.getFile
+// requests in flight at once. Parts arrive out of order and are written
+// with WriteAt, so out has to support random access. Parts cannot be told
+// apart once the file reference expires, so the file is downloaded again with
+// a refreshed location.
+func (s *fileService) DownloadParallel(ctx context.Context, file File, out io.WriterAt, threads int) error {
+	api, release, err := s.downloadAPI(ctx, file)
+	if err != nil {
+		return apperr.New("telegram.file.download_parallel", apperr.KindCancel, err)
+	}
+	defer release()
+
+	for refreshes := 0; ; refreshes++ {
+		builder := s.download(api, s.location(file)).WithThreads(threads)
+		_, err := builder.Parallel(ctx, out)
+		if err == nil {
+			return nil
+		}
+
+		if !isFileReferenceExpired(err) || refreshes == maxFileReferenceRefreshes {
+			return apperr.New("telegram.file.download_parallel", apperr.KindNetwork, err)
+		}
+
+		if _, refreshErr := s.refreshLocation(ctx, file); refreshErr != nil {
+			return apperr.New("telegram.file.download_parallel.refresh", apperr.KindNetwork, fmt.Errorf("%w: %w", err, refreshErr))
+		}
+	}
+}
+
 // DownloadFromOffset downloads a Telegram file starting from the given byte offset.
 // It is used by downloader resume logic when a partial file already exists on disk.
 func (s *fileService) DownloadFromOffset(ctx context.Context, file File, out io.Writer, offset int64) (int64, error) {
@@ -475,10 +712,38 @@ func (s *fileService) DownloadFromOffset(ctx context.Context, file File, out io.
 		return 0, nil
 	}
 
+	api, release, err := s.downloadAPI(ctx, file)
+	if err != nil {
+		return 0, apperr.New("telegram.file.download_from_offset", apperr.KindCancel, err)
+	}
+	defer release()
+
+	return s.downloadFromOffset(ctx, api, file, out, offset)
+}
+
+// downloadAPI waits until file may be downloaded from its DC and returns the
+// API to download it with.
+func (s *fileService) downloadAPI(ctx context.Context, file File) (*tg.Client, func(), error) {
+	if s.client.downloads == nil {
+		return s.client.API(), func() {}, nil
+	}
+
+	return s.client.downloads.acquire(ctx, file.dc)
+}
+
+func (s *fileService) download(api *tg.Client, location tg.InputFileLocationClass) *downloader.Builder {
+	client := poolDownloadClient{Client: api, cdn: s.client.client}
+	return downloader.NewDownloader().WithAllowCDN(s.client.allowCDN).Download(client, location)
+}
+
+func (s *fileService) downloadFromOffset(ctx context.Context, api *tg.Client, file File, out io.Writer, offset int64) (int64, error) {
 	const partSize = 512 * 1024
 
-	api := s.client.client.API()
-	var written int64
+	location := s.location(file)
+	var (
+		written   int64
+		refreshes int
+	)
 
 	for {
 		if err := ctx.Err(); err != nil {
@@ -489,12 +754,19 @@ func (s *fileService) DownloadFromOffset(ctx context.Context, file File, out io.
 		req := &tg.UploadGetFileRequest{
 			Offset:   currentOffset,
 			Limit:    partSize,
-			Location: file.location,
+			Location: location,
 		}
 		req.SetPrecise(true)
 		req.SetCDNSupported(false)
 
 		res, err := api.UploadGetFile(ctx, req)
+		if isFileReferenceExpired(err) && refreshes < maxFileReferenceRefreshes {
+			refreshes++
+			if location, err = s.refreshLocation(ctx, file); err != nil {
+				return written, apperr.New("telegram.file.download_from_offset.refresh", apperr.KindNetwork, fmt.Errorf("refresh expired file reference at offset %d: %w", currentOffset, err))
+			}
+			continue
+		}
 		if err != nil {
 			return written, apperr.New("telegram.file.download_from_offset.get_chunk", apperr.KindNetwork, fmt.Errorf("get chunk at offset %d: %w", currentOffset, err))
 		}
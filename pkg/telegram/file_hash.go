@@ -0,0 +1,67 @@
+package telegram
+
+import (
+	"context"
+
+	"github.com/gotd/td/tg"
+	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
+)
+
+// FileHash is the SHA-256 of a byte range of a Telegram file.
+type FileHash struct {
+	Offset int64
+	Limit  int
+	Hash   []byte
+}
+
+// FileHashes returns the hashes Telegram keeps for a document, in file order.
+// Photos and other files without hashes return none.
+func (s *fileService) FileHashes(ctx context.Context, file File) ([]FileHash, error) {
+	location, ok := s.location(file).(*tg.InputDocumentFileLocation)
+	if !ok {
+		return nil, nil
+	}
+
+	hashes, err := fileHashes(ctx, s.client.API(), location, file.size)
+	if err != nil {
+		return nil, apperr.New("telegram.file.hashes", apperr.KindNetwork, err)
+	}
+
+	return hashes, nil
+}
+
+// fileHashes pages upload.getFileHashes, which answers with a few ranges
+// starting at the requested offset, until the whole file is covered.
+func fileHashes(ctx context.Context, api *tg.Client, location tg.InputFileLocationClass, size int64) ([]FileHash, error) {
+	var (
+		hashes []FileHash
+		offset int64
+	)
+
+	for offset < size {
+		res, err := api.UploadGetFileHashes(ctx, &tg.UploadGetFileHashesRequest{
+			Location: location,
+			Offset:   offset,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		next := offset
+		for _, hash := range res {
+			if hash.Offset != next || hash.Limit <= 0 {
+				continue
+			}
+
+			hashes = append(hashes, FileHash{Offset: hash.Offset, Limit: hash.Limit, Hash: hash.Hash})
+			next = hash.Offset + int64(hash.Limit)
+		}
+
+		if next == offset {
+			break
+		}
+		offset = next
+	}
+
+	return hashes, nil
+}
@@ -0,0 +1,47 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/gotd/td/bin"
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgmock"
+)
+
+func TestFileHashesPagesUntilFileIsCovered(t *testing.T) {
+	t.Parallel()
+
+	const rangeSize = 128 * 1024
+
+	var offsets []int64
+	invoker := func(request bin.Encoder) (bin.Encoder, error) {
+		req, ok := request.(*tg.UploadGetFileHashesRequest)
+		if !ok {
+			return nil, fmt.Errorf("unexpected request %T", request)
+		}
+		offsets = append(offsets, req.Offset)
+
+		// Two ranges per answer, like Telegram does for large files.
+		var result tg.FileHashVector
+		for i := int64(0); i < 2; i++ {
+			offset := req.Offset + i*rangeSize
+			result.Elems = append(result.Elems, tg.FileHash{Offset: offset, Limit: rangeSize, Hash: []byte{byte(offset / rangeSize)}})
+		}
+		return &result, nil
+	}
+
+	hashes, err := fileHashes(context.Background(), tg.NewClient(tgmock.Invoker(invoker)), &tg.InputDocumentFileLocation{ID: 1}, 3*rangeSize+1)
+	if err != nil {
+		t.Fatalf("fileHashes() error = %v", err)
+	}
+
+	if len(hashes) != 4 || hashes[3].Offset != 3*rangeSize || hashes[3].Hash[0] != 3 {
+		t.Fatalf("hashes = %+v, want 4 consecutive ranges", hashes)
+	}
+
+	if len(offsets) != 2 || offsets[1] != 2*rangeSize {
+		t.Fatalf("requested offsets = %v, want [0 %d]", offsets, 2*rangeSize)
+	}
+}
@@ -0,0 +1,81 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// maxFileReferenceRefreshes bounds how often a single download fetches the
+// message of its file again.
+const maxFileReferenceRefreshes = 3
+
+// errNoSourceMessage is returned when the location of a file cannot be
+// refreshed because it is not known which message it came from.
+var errNoSourceMessage = errors.New("file has no source message")
+
+// isFileReferenceExpired reports whether Telegram rejected a file location
+// because its file reference is too old.
+func isFileReferenceExpired(err error) bool {
+	return tgerr.Is(err, "FILE_REFERENCE_EXPIRED")
+}
+
+// location returns the latest known location of file, which is newer than
+// the one it was listed with once its reference had to be refreshed.
+func (s *fileService) location(file File) tg.InputFileLocationClass {
+	if location, ok := s.client.fileLocations.Load(file.Identity()); ok {
+		return location.(tg.InputFileLocationClass)
+	}
+
+	return file.location
+}
+
+// refreshLocation fetches the source message of file again and remembers the
+// location with a fresh file reference it has for the same file.
+func (s *fileService) refreshLocation(ctx context.Context, file File) (tg.InputFileLocationClass, error) {
+	identity, stable := file.StableIdentity()
+	if file.messageID == 0 || file.peerID == 0 || !stable {
+		return nil, errNoSourceMessage
+	}
+
+	peer, err := s.client.peerMgr.ResolveTDLibID(ctx, file.peerID)
+	if err != nil {
+		return nil, fmt.Errorf("resolve source peer: %w", err)
+	}
+
+	files, err := s.GetFilesFromMessage(ctx, peer, file.messageID, GetFileWithGrouped(false))
+	if err != nil {
+		return nil, fmt.Errorf("fetch message %d: %w", file.messageID, err)
+	}
+
+	for _, fresh := range files {
+		if fresh == nil || fresh.messageID != file.messageID {
+			continue
+		}
+
+		if freshIdentity, _ := fresh.StableIdentity(); freshIdentity == identity {
+			s.logger.Info("refreshed expired file reference", zap.Int("message_id", file.messageID), zap.String("name", file.name))
+			s.client.fileLocations.Store(file.Identity(), fresh.location)
+			return fresh.location, nil
+		}
+	}
+
+	return nil, fmt.Errorf("file is no longer in message %d", file.messageID)
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,48 @@
+package telegram
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
+)
+
+func TestIsFileReferenceExpired(t *testing.T) {
+	t.Parallel()
+
+	expired := fmt.Errorf("get chunk: %w", tgerr.New(400, "FILE_REFERENCE_EXPIRED"))
+	if !isFileReferenceExpired(expired) {
+		t.Fatal("FILE_REFERENCE_EXPIRED was not recognized")
+	}
+
+	for _, err := range []error{nil, errors.New("timeout"), tgerr.New(400, "FILE_ID_INVALID")} {
+		if isFileReferenceExpired(err) {
+			t.Fatalf("isFileReferenceExpired(%v) = true", err)
+		}
+	}
+}
+
+func TestFileServicePrefersRefreshedLocation(t *testing.T) {
+	t.Parallel()
+
+	s := &fileService{client: &Client{}}
+	stale := &tg.InputDocumentFileLocation{ID: 7, FileReference: []byte("stale")}
+	file := File{location: stale}
+
+	if got := s.location(file); got != stale {
+		t.Fatalf("location() = %v, want the listed location", got)
+	}
+
+	fresh := &tg.InputDocumentFileLocation{ID: 7, FileReference: []byte("fresh")}
+	s.client.fileLocations.Store(file.Identity(), tg.InputFileLocationClass(fresh))
+	if got := s.location(file); got != fresh {
+		t.Fatalf("location() = %v, want the refreshed location", got)
+	}
+
+	if _, err := s.refreshLocation(context.Background(), file); !errors.Is(err, errNoSourceMessage) {
+		t.Fatalf("refreshLocation() of a file without message = %v, want errNoSourceMessage", err)
+	}
+}
@@ -0,0 +1,185 @@
+package telegram
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/gotd/td/tg"
+	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
+)
+
+// MediaKind is a coarse classification of Telegram media.
+type MediaKind string
+
+const (
+	MediaKindPhoto      MediaKind = "photo"
+	MediaKindVideo      MediaKind = "video"
+	MediaKindAudio      MediaKind = "audio"
+	MediaKindVoice      MediaKind = "voice"
+	MediaKindRoundVideo MediaKind = "round"
+	MediaKindSticker    MediaKind = "sticker"
+	MediaKindAnimation  MediaKind = "animation"
+	MediaKindDocument   MediaKind = "document"
+)
+
+var mediaKinds = []MediaKind{
+	MediaKindPhoto,
+	MediaKindVideo,
+	MediaKindAudio,
+	MediaKindVoice,
+	MediaKindRoundVideo,
+	MediaKindSticker,
+	MediaKindAnimation,
+	MediaKindDocument,
+}
+
+// ParseMediaKind parses a media kind name such as "video" or "voice".
+func ParseMediaKind(s string) (MediaKind, error) {
+	name := strings.ToLower(strings.TrimSpace(s))
+	switch name {
+	case "round_video", "video_note":
+		return MediaKindRoundVideo, nil
+	case "gif":
+		return MediaKindAnimation, nil
+	}
+
+	for _, kind := range mediaKinds {
+		if string(kind) == name {
+			return kind, nil
+		}
+	}
+
+	return "", apperr.New("telegram.filter.parse_media_kind", apperr.KindConfig, fmt.Errorf("unknown media type %q", s))
+}
+
+// FileFilter selects files by media kind, MIME type and file extension.
+// Values inside one category are alternatives, categories are combined, and an
+// empty category does not restrict anything.
+type FileFilter struct {
+	Kinds      []MediaKind
+	MIMETypes  []string // glob patterns, e.g. "video/*" or "application/pdf"
+	Extensions []string // with or without the leading dot
+}
+
+// IsEmpty reports whether the filter accepts every file.
+func (f FileFilter) IsEmpty() bool {
+	return len(f.Kinds) == 0 && len(f.MIMETypes) == 0 && len(f.Extensions) == 0
+}
+
+// Validate checks that all MIME patterns are well-formed.
+func (f FileFilter) Validate() error {
+	for _, pattern := range f.MIMETypes {
+		if _, err := path.Match(strings.ToLower(pattern), ""); err != nil {
+			return apperr.New("telegram.filter.mime_pattern", apperr.KindConfig, fmt.Errorf("invalid MIME pattern %q: %w", pattern, err))
+		}
+	}
+
+	return nil
+}
+
+// Match reports whether the file passes the filter.
+func (f FileFilter) Match(file File) bool {
+	if len(f.Kinds) > 0 && !f.matchKind(file.Kind()) {
+		return false
+	}
+
+	if len(f.MIMETypes) > 0 && !f.matchMIMEType(file.MIMEType()) {
+		return false
+	}
+
+	if len(f.Extensions) > 0 && !f.matchExtension(file.Name()) {
+		return false
+	}
+
+	return true
+}
+
+func (f FileFilter) matchKind(kind MediaKind) bool {
+	for _, want := range f.Kinds {
+		if want == kind {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f FileFilter) matchMIMEType(mimeType string) bool {
+	mimeType = strings.ToLower(mimeType)
+	for _, pattern := range f.MIMETypes {
+		if ok, _ := path.Match(strings.ToLower(pattern), mimeType); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f FileFilter) matchExtension(name string) bool {
+	ext := strings.TrimPrefix(strings.ToLower(path.Ext(name)), ".")
+	if ext == "" {
+		return false
+	}
+
+	for _, want := range f.Extensions {
+		if strings.TrimPrefix(strings.ToLower(strings.TrimSpace(want)), ".") == ext {
+			return true
+		}
+	}
+
+	return false
+}
+
+type getfileFilterOption struct {
+	filter FileFilter
+}
+
+func (o getfileFilterOption) apply(opts *getAllFilesOption) error {
+	if err := o.filter.Validate(); err != nil {
+		return err
+	}
+
+	opts.filter = o.filter
+	return nil
+}
+
+// GetFileWithFilter returns only files accepted by the filter.
+func GetFileWithFilter(filter FileFilter) GetAllFilesOption {
+	return getfileFilterOption{filter: filter}
+}
+
+func getDocumentMediaKind(doc *tg.Document) MediaKind {
+	var video, round, audio, voice, animated, sticker bool
+	for _, attr := range doc.Attributes {
+		switch v := attr.(type) {
+		case *tg.DocumentAttributeAnimated:
+			animated = true
+		case *tg.DocumentAttributeSticker:
+			sticker = true
+		case *tg.DocumentAttributeVideo:
+			video = true
+			round = v.RoundMessage
+		case *tg.DocumentAttributeAudio:
+			audio = true
+			voice = v.Voice
+		}
+	}
+
+	switch {
+	case sticker:
+		return MediaKindSticker
+	case animated:
+		return MediaKindAnimation
+	case round:
+		return MediaKindRoundVideo
+	case video:
+		return MediaKindVideo
+	case voice:
+		return MediaKindVoice
+	case audio:
+		return MediaKindAudio
+	default:
+		return MediaKindDocument
+	}
+}
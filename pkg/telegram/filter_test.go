@@ -0,0 +1,99 @@
+package telegram
+
+import (
+	"testing"
+
+	"github.com/gotd/td/tg"
+	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
+)
+
+func TestGetDocumentMediaKind(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		attrs []tg.DocumentAttributeClass
+		want  MediaKind
+	}{
+		{name: "Plain", attrs: []tg.DocumentAttributeClass{&tg.DocumentAttributeFilename{FileName: "a.pdf"}}, want: MediaKindDocument},
+		{name: "Video", attrs: []tg.DocumentAttributeClass{&tg.DocumentAttributeVideo{}}, want: MediaKindVideo},
+		{name: "RoundVideo", attrs: []tg.DocumentAttributeClass{&tg.DocumentAttributeVideo{RoundMessage: true}}, want: MediaKindRoundVideo},
+		{name: "Audio", attrs: []tg.DocumentAttributeClass{&tg.DocumentAttributeAudio{}}, want: MediaKindAudio},
+		{name: "Voice", attrs: []tg.DocumentAttributeClass{&tg.DocumentAttributeAudio{Voice: true}}, want: MediaKindVoice},
+		{name: "Animation", attrs: []tg.DocumentAttributeClass{&tg.DocumentAttributeVideo{}, &tg.DocumentAttributeAnimated{}}, want: MediaKindAnimation},
+		{name: "Sticker", attrs: []tg.DocumentAttributeClass{&tg.DocumentAttributeImageSize{}, &tg.DocumentAttributeSticker{}}, want: MediaKindSticker},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			file, err := getDocumentFile(&tg.Document{ID: 1, MimeType: "application/octet-stream", Attributes: tt.attrs})
+			if err != nil {
+				t.Fatalf("getDocumentFile() error = %v", err)
+			}
+
+			if got := file.Kind(); got != tt.want {
+				t.Fatalf("Kind() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileFilterMatch(t *testing.T) {
+	t.Parallel()
+
+	video := File{name: "clip.MP4", kind: MediaKindVideo, metadata: map[string]interface{}{"mime_type": "video/mp4"}}
+	pdf := File{name: "book.pdf", kind: MediaKindDocument, metadata: map[string]interface{}{"mime_type": "application/pdf"}}
+	photo := File{name: "photo1.jpg", kind: MediaKindPhoto, metadata: map[string]interface{}{"mime_type": "image/jpeg"}}
+
+	tests := []struct {
+		name   string
+		filter FileFilter
+		file   File
+		want   bool
+	}{
+		{name: "EmptyAcceptsAll", filter: FileFilter{}, file: pdf, want: true},
+		{name: "KindMatches", filter: FileFilter{Kinds: []MediaKind{MediaKindVideo}}, file: video, want: true},
+		{name: "KindRejects", filter: FileFilter{Kinds: []MediaKind{MediaKindVideo}}, file: photo, want: false},
+		{name: "MIMEGlob", filter: FileFilter{MIMETypes: []string{"video/*"}}, file: video, want: true},
+		{name: "MIMEGlobRejects", filter: FileFilter{MIMETypes: []string{"video/*"}}, file: pdf, want: false},
+		{name: "ExtensionCaseInsensitive", filter: FileFilter{Extensions: []string{".mp4"}}, file: video, want: true},
+		{name: "ExtensionWithoutDot", filter: FileFilter{Extensions: []string{"zip", "pdf"}}, file: pdf, want: true},
+		{name: "CategoriesCombine", filter: FileFilter{Kinds: []MediaKind{MediaKindDocument}, Extensions: []string{"zip"}}, file: pdf, want: false},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := tt.filter.Match(tt.file); got != tt.want {
+				t.Fatalf("Match(%s) = %v, want %v", tt.file.Name(), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMediaKind(t *testing.T) {
+	t.Parallel()
+
+	if got, err := ParseMediaKind(" Video_Note "); err != nil || got != MediaKindRoundVideo {
+		t.Fatalf("ParseMediaKind(video_note) = %q, %v", got, err)
+	}
+
+	if _, err := ParseMediaKind("hologram"); !apperr.IsKind(err, apperr.KindConfig) {
+		t.Fatalf("ParseMediaKind(hologram) error = %v, want config kind", err)
+	}
+}
+
+func TestGetFileWithFilterRejectsInvalidMIMEPattern(t *testing.T) {
+	t.Parallel()
+
+	var options getAllFilesOption
+	err := GetFileWithFilter(FileFilter{MIMETypes: []string{"video/["}}).apply(&options)
+	if !apperr.IsKind(err, apperr.KindConfig) {
+		t.Fatalf("apply() error = %v, want config kind", err)
+	}
+}
@@ -0,0 +1,294 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gotd/td/constant"
+	"github.com/gotd/td/telegram/message/peer"
+	"github.com/gotd/td/telegram/peers"
+	"github.com/gotd/td/telegram/query"
+	"github.com/gotd/td/telegram/query/messages"
+	"github.com/gotd/td/tg"
+	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
+)
+
+type getfileDateRangeOption struct {
+	since time.Time
+	until time.Time
+}
+
+func (o getfileDateRangeOption) apply(opts *getAllFilesOption) error {
+	if !o.since.IsZero() && !o.until.IsZero() && !o.since.Before(o.until) {
+		return apperr.New("telegram.history.date_range", apperr.KindConfig, fmt.Errorf("since %s is not before until %s", o.since, o.until))
+	}
+
+	if !o.since.IsZero() {
+		opts.minDate = int(o.since.Unix())
+	}
+
+	if !o.until.IsZero() {
+		opts.offsetDate = int(o.until.Unix())
+	}
+
+	return nil
+}
+
+// GetFileWithDateRange limits history to messages sent at or after since and
+// before until. A zero time leaves that end of the window open. A non-zero
+// until replaces the offset date of GetFileWithOffsetDate.
+func GetFileWithDateRange(since, until time.Time) GetAllFilesOption {
+	return getfileDateRangeOption{since: since, until: until}
+}
+
+type getfileIDRangeOption struct {
+	fromID int
+	toID   int
+}
+
+func (o getfileIDRangeOption) apply(opts *getAllFilesOption) error {
+	if o.fromID < 0 || o.toID < 0 || (o.toID > 0 && o.fromID > o.toID) {
+		return apperr.New("telegram.history.id_range", apperr.KindConfig, fmt.Errorf("invalid message ID range %d..%d", o.fromID, o.toID))
+	}
+
+	opts.minID = o.fromID
+	opts.maxID = o.toID
+	return nil
+}
+
+// GetFileWithIDRange limits history to message IDs in [fromID, toID].
+// Zero leaves that end of the window open.
+func GetFileWithIDRange(fromID, toID int) GetAllFilesOption {
+	return getfileIDRangeOption{fromID: fromID, toID: toID}
+}
+
+type getfileOldestFirstOption struct{}
+
+func (getfileOldestFirstOption) apply(opts *getAllFilesOption) error {
+	opts.oldestFirst = true
+	return nil
+}
+
+// GetFileWithOldestFirst walks history in publication order, so limits keep
+// the earliest files and results arrive oldest first.
+func GetFileWithOldestFirst() GetAllFilesOption {
+	return getfileOldestFirstOption{}
+}
+
+type getfileBackfillOption struct {
+	afterID int
+}
+
+func (o getfileBackfillOption) apply(opts *getAllFilesOption) error {
+	opts.backfill = true
+	opts.backfillAfter = o.afterID
+	return nil
+}
+
+// GetFileWithBackfillAfter makes GetAllFilesFromNewMessages first replay
+// history newer than afterID and then continue with live updates.
+func GetFileWithBackfillAfter(afterID int) GetAllFilesOption {
+	return getfileBackfillOption{afterID: afterID}
+}
+
+const historyBatchSize = 100
+
+// forEachHistory calls fn for every history message in the configured order.
+// With a topic set, only the replies of that forum topic are walked.
+func (o getAllFilesOption) forEachHistory(ctx context.Context, api *tg.Client, p peers.Peer, fn func(context.Context, messages.Elem) error) error {
+	if o.oldestFirst {
+		return o.forEachHistoryForward(ctx, api, p, fn)
+	}
+
+	if o.topicID > 0 {
+		return o.repliesQuery(api, p).ForEach(ctx, fn)
+	}
+
+	return o.historyQuery(api, p).ForEach(ctx, fn)
+}
+
+// historyQuery builds a newest-first history query that starts at the upper
+// end of the configured window.
+func (o getAllFilesOption) historyQuery(api *tg.Client, p peers.Peer) *messages.GetHistoryQueryBuilder {
+	queryBuilder := query.Messages(api).GetHistory(p.InputPeer())
+	queryBuilder = queryBuilder.OffsetDate(o.offsetDate)
+	if o.maxID > 0 {
+		queryBuilder = queryBuilder.OffsetID(o.maxID + 1)
+	}
+
+	return queryBuilder.BatchSize(historyBatchSize)
+}
+
+// repliesQuery is historyQuery for the messages of a forum topic.
+func (o getAllFilesOption) repliesQuery(api *tg.Client, p peers.Peer) *messages.GetRepliesQueryBuilder {
+	queryBuilder := query.Messages(api).GetReplies(p.InputPeer()).MsgID(o.topicID)
+	queryBuilder = queryBuilder.OffsetDate(o.offsetDate)
+	if o.maxID > 0 {
+		queryBuilder = queryBuilder.OffsetID(o.maxID + 1)
+	}
+
+	return queryBuilder.BatchSize(historyBatchSize)
+}
+
+// forEachHistoryForward pages history from the lower end of the window
+// upwards. Every request asks for the batch right after the last seen ID
+// using a negative add_offset, and min_id keeps already seen messages out.
+func (o getAllFilesOption) forEachHistoryForward(ctx context.Context, api *tg.Client, p peers.Peer, fn func(context.Context, messages.Elem) error) error {
+	lastID := 0
+	if o.minID > 0 {
+		lastID = o.minID - 1
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		offsetID, offsetDate := lastID+1, 0
+		if lastID == 0 && o.minDate > 0 {
+			// Nothing to anchor on yet, so start from the first message
+			// sent after the lower date bound.
+			offsetID, offsetDate = 0, o.minDate
+		}
+
+		res, err := o.forwardPage(ctx, api, p, offsetID, offsetDate, lastID)
+		if err != nil {
+			return err
+		}
+
+		var (
+			batch    tg.MessageClassArray
+			entities peer.Entities
+		)
+		switch r := res.(type) {
+		case *tg.MessagesMessages:
+			batch, entities = r.Messages, peer.EntitiesFromResult(r)
+		case *tg.MessagesMessagesSlice:
+			batch, entities = r.Messages, peer.EntitiesFromResult(r)
+		case *tg.MessagesChannelMessages:
+			batch, entities = r.Messages, peer.EntitiesFromResult(r)
+		default:
+			return fmt.Errorf("unexpected history response %T", res)
+		}
+
+		batch = batch.SortStable(func(a, b tg.MessageClass) bool {
+			return a.GetID() < b.GetID()
+		})
+
+		advanced := false
+		for _, msg := range batch {
+			nonEmpty, ok := msg.AsNotEmpty()
+			if !ok || nonEmpty.GetID() <= lastID {
+				continue
+			}
+
+			inputPeer, err := entities.ExtractPeer(nonEmpty.GetPeerID())
+			if err != nil {
+				inputPeer = &tg.InputPeerEmpty{}
+			}
+
+			if err := fn(ctx, messages.Elem{Msg: nonEmpty, Peer: inputPeer, Entities: entities}); err != nil {
+				return err
+			}
+
+			lastID = nonEmpty.GetID()
+			advanced = true
+		}
+
+		if !advanced {
+			return nil
+		}
+	}
+}
+
+// forwardPage requests the batch of history, or of topic replies, that
+// follows offsetID.
+func (o getAllFilesOption) forwardPage(ctx context.Context, api *tg.Client, p peers.Peer, offsetID, offsetDate, minID int) (tg.MessagesMessagesClass, error) {
+	if o.topicID > 0 {
+		return api.MessagesGetReplies(ctx, &tg.MessagesGetRepliesRequest{
+			Peer:       p.InputPeer(),
+			MsgID:      o.topicID,
+			OffsetID:   offsetID,
+			OffsetDate: offsetDate,
+			AddOffset:  -historyBatchSize,
+			Limit:      historyBatchSize,
+			MinID:      minID,
+		})
+	}
+
+	return api.MessagesGetHistory(ctx, &tg.MessagesGetHistoryRequest{
+		Peer:       p.InputPeer(),
+		OffsetID:   offsetID,
+		OffsetDate: offsetDate,
+		AddOffset:  -historyBatchSize,
+		Limit:      historyBatchSize,
+		MinID:      minID,
+	})
+}
+
+// historyWindow reports whether the message is inside the configured window.
+// When done is true, iteration has moved past the window in its walking
+// direction and can stop.
+func (o getAllFilesOption) historyWindow(msg tg.NotEmptyMessage) (inside, done bool) {
+	date := 0
+	if dated, ok := msg.(interface{ GetDate() int }); ok {
+		date = dated.GetDate()
+	}
+
+	below := (o.minID > 0 && msg.GetID() < o.minID) || (o.minDate > 0 && date > 0 && date < o.minDate)
+	above := (o.maxID > 0 && msg.GetID() > o.maxID) || (o.offsetDate > 0 && date >= o.offsetDate)
+
+	if o.oldestFirst {
+		return !below && !above, above
+	}
+
+	return !below && !above, below
+}
+
+// latestMessageID returns the ID of the newest message in the peer history,
+// or zero when the history is empty.
+func latestMessageID(ctx context.Context, api *tg.Client, p peers.Peer) (int, error) {
+	res, err := api.MessagesGetHistory(ctx, &tg.MessagesGetHistoryRequest{
+		Peer:  p.InputPeer(),
+		Limit: 1,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	modified, ok := res.AsModified()
+	if !ok {
+		return 0, fmt.Errorf("unexpected history response %T", res)
+	}
+
+	latest := 0
+	for _, msg := range modified.GetMessages() {
+		latest = max(latest, msg.GetID())
+	}
+
+	return latest, nil
+}
+
+// isMessageInPeer reports whether a message with the given peer ID belongs to
+// the chat of p.
+func isMessageInPeer(peerID tg.PeerClass, p peers.Peer) bool {
+	id, ok := tdlibPeerID(peerID)
+	return ok && id == p.TDLibPeerID()
+}
+
+func tdlibPeerID(peerID tg.PeerClass) (constant.TDLibPeerID, bool) {
+	var id constant.TDLibPeerID
+	switch v := peerID.(type) {
+	case *tg.PeerUser:
+		id.User(v.UserID)
+	case *tg.PeerChat:
+		id.Chat(v.ChatID)
+	case *tg.PeerChannel:
+		id.Channel(v.ChannelID)
+	default:
+		return 0, false
+	}
+
+	return id, true
+}
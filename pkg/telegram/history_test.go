@@ -0,0 +1,215 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/gotd/td/bin"
+	"github.com/gotd/td/constant"
+	"github.com/gotd/td/telegram/query/messages"
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgmock"
+	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
+	telegrammocks "github.com/johnnyipcom/tgdownloader/pkg/telegram/mocks"
+	"go.uber.org/mock/gomock"
+)
+
+func TestHistoryWindow(t *testing.T) {
+	t.Parallel()
+
+	since := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	until := time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)
+
+	var options getAllFilesOption
+	for _, opt := range []GetAllFilesOption{GetFileWithDateRange(since, until), GetFileWithIDRange(1200, 1800)} {
+		if err := opt.apply(&options); err != nil {
+			t.Fatalf("apply() error = %v", err)
+		}
+	}
+
+	inRange := int(time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC).Unix())
+
+	tests := []struct {
+		name       string
+		msg        tg.NotEmptyMessage
+		wantInside bool
+		wantDone   bool
+	}{
+		{name: "Inside", msg: &tg.Message{ID: 1500, Date: inRange}, wantInside: true},
+		{name: "LowerIDInclusive", msg: &tg.Message{ID: 1200, Date: inRange}, wantInside: true},
+		{name: "UpperIDInclusive", msg: &tg.Message{ID: 1800, Date: inRange}, wantInside: true},
+		{name: "AboveID", msg: &tg.Message{ID: 1801, Date: inRange}},
+		{name: "AtUntil", msg: &tg.Message{ID: 1500, Date: int(until.Unix())}},
+		{name: "BelowID", msg: &tg.Message{ID: 1199, Date: inRange}, wantDone: true},
+		{name: "BeforeSince", msg: &tg.Message{ID: 1500, Date: int(since.Unix()) - 1}, wantDone: true},
+		{name: "ServiceMessage", msg: &tg.MessageService{ID: 1300, Date: inRange}, wantInside: true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			inside, done := options.historyWindow(tt.msg)
+			if inside != tt.wantInside || done != tt.wantDone {
+				t.Fatalf("historyWindow() = (%v, %v), want (%v, %v)", inside, done, tt.wantInside, tt.wantDone)
+			}
+		})
+	}
+}
+
+func TestHistoryRangeOptionsRejectInvertedBounds(t *testing.T) {
+	t.Parallel()
+
+	day := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, opt := range []GetAllFilesOption{
+		GetFileWithDateRange(day, day.Add(-time.Hour)),
+		GetFileWithIDRange(1800, 1200),
+		GetFileWithIDRange(-1, 0),
+	} {
+		var options getAllFilesOption
+		if err := opt.apply(&options); !apperr.IsKind(err, apperr.KindConfig) {
+			t.Fatalf("apply(%#v) error = %v, want config kind", opt, err)
+		}
+	}
+}
+
+// fakeHistory answers messages.getHistory for a chat whose message IDs and
+// dates are 1..count, following the server's offset_id/add_offset/min_id
+// windowing rules.
+func fakeHistory(count int) tgmock.Invoker {
+	return func(request bin.Encoder) (bin.Encoder, error) {
+		req, ok := request.(*tg.MessagesGetHistoryRequest)
+		if !ok {
+			return nil, fmt.Errorf("unexpected request %T", request)
+		}
+
+		// Position of the first message older than the offset in the
+		// newest-first list.
+		start := 0
+		for id := count; id >= 1; id-- {
+			if (req.OffsetID > 0 && id < req.OffsetID) || (req.OffsetID == 0 && (req.OffsetDate == 0 || id < req.OffsetDate)) {
+				break
+			}
+			start++
+		}
+
+		from := max(start+req.AddOffset, 0)
+		to := min(from+req.Limit, count)
+
+		result := &tg.MessagesMessagesSlice{Count: count}
+		for pos := from; pos < to; pos++ {
+			id := count - pos
+			if id <= req.MinID {
+				continue
+			}
+
+			result.Messages = append(result.Messages, &tg.Message{ID: id, Date: id, PeerID: &tg.PeerUser{UserID: 1}})
+		}
+
+		return result, nil
+	}
+}
+
+func TestForEachHistoryForward(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		opts    []GetAllFilesOption
+		wantLen int
+		wantIDs [2]int
+	}{
+		{name: "FromStart", opts: nil, wantLen: 250, wantIDs: [2]int{1, 250}},
+		{name: "AfterID", opts: []GetAllFilesOption{GetFileWithIDRange(121, 0)}, wantLen: 130, wantIDs: [2]int{121, 250}},
+		{name: "SinceDate", opts: []GetAllFilesOption{GetFileWithDateRange(time.Unix(200, 0), time.Time{})}, wantLen: 51, wantIDs: [2]int{200, 250}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctrl := gomock.NewController(t)
+			p := telegrammocks.NewMocklinkedChatPeer(ctrl)
+			p.EXPECT().InputPeer().Return(&tg.InputPeerSelf{}).AnyTimes()
+
+			options := getAllFilesOption{oldestFirst: true}
+			for _, opt := range tt.opts {
+				if err := opt.apply(&options); err != nil {
+					t.Fatalf("apply() error = %v", err)
+				}
+			}
+
+			var ids []int
+			err := options.forEachHistory(context.Background(), tg.NewClient(fakeHistory(250)), p, func(_ context.Context, elem messages.Elem) error {
+				if inside, _ := options.historyWindow(elem.Msg); inside {
+					ids = append(ids, elem.Msg.GetID())
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("forEachHistory() error = %v", err)
+			}
+
+			if len(ids) != tt.wantLen || ids[0] != tt.wantIDs[0] || ids[len(ids)-1] != tt.wantIDs[1] {
+				t.Fatalf("got %d messages %v..%v, want %d messages %v", len(ids), ids[0], ids[len(ids)-1], tt.wantLen, tt.wantIDs)
+			}
+
+			if !sort.IntsAreSorted(ids) {
+				t.Fatalf("messages are not in publication order: %v", ids)
+			}
+		})
+	}
+}
+
+func TestHistoryWindowOldestFirstStopsAboveUpperBound(t *testing.T) {
+	t.Parallel()
+
+	options := getAllFilesOption{oldestFirst: true}
+	if err := GetFileWithIDRange(10, 20).apply(&options); err != nil {
+		t.Fatalf("apply() error = %v", err)
+	}
+
+	if inside, done := options.historyWindow(&tg.Message{ID: 5}); inside || done {
+		t.Fatalf("historyWindow(5) = (%v, %v), want skip", inside, done)
+	}
+
+	if inside, done := options.historyWindow(&tg.Message{ID: 21}); inside || !done {
+		t.Fatalf("historyWindow(21) = (%v, %v), want done", inside, done)
+	}
+}
+
+func TestLatestMessageID(t *testing.T) {
+	t.Parallel()
+
+	ctrl := gomock.NewController(t)
+	p := telegrammocks.NewMocklinkedChatPeer(ctrl)
+	p.EXPECT().InputPeer().Return(&tg.InputPeerSelf{}).AnyTimes()
+
+	got, err := latestMessageID(context.Background(), tg.NewClient(fakeHistory(250)), p)
+	if err != nil || got != 250 {
+		t.Fatalf("latestMessageID() = %d, %v, want 250", got, err)
+	}
+}
+
+func TestIsMessageInPeer(t *testing.T) {
+	t.Parallel()
+
+	ctrl := gomock.NewController(t)
+	p := telegrammocks.NewMocklinkedChatPeer(ctrl)
+
+	var channelID constant.TDLibPeerID
+	channelID.Channel(77)
+	p.EXPECT().TDLibPeerID().Return(channelID).AnyTimes()
+
+	if !isMessageInPeer(&tg.PeerChannel{ChannelID: 77}, p) {
+		t.Fatal("channel message was not matched")
+	}
+	if isMessageInPeer(&tg.PeerUser{UserID: 77}, p) {
+		t.Fatal("user message with the same raw ID was matched")
+	}
+}
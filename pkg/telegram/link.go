@@ -8,7 +8,6 @@ import (
 	"sync/atomic"
 
 	"github.com/gotd/td/telegram/peers"
-	"github.com/gotd/td/telegram/query"
 	"github.com/gotd/td/telegram/query/messages"
 	"github.com/gotd/td/tg"
 	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
@@ -72,16 +71,18 @@ func (s *linkService) GetYandexDiskLinks(ctx context.Context, p peers.Peer, opts
 	go func() {
 		defer close(linkChan)
 
-		queryBuilder := query.Messages(s.client.API()).GetHistory(p.InputPeer())
-		queryBuilder = queryBuilder.OffsetDate(options.offsetDate)
-		queryBuilder = queryBuilder.BatchSize(100)
-
-		if err := queryBuilder.ForEach(ctx, func(ctx context.Context, elem messages.Elem) error {
+		if err := options.forEachHistory(ctx, s.client.API(), p, func(ctx context.Context, elem messages.Elem) error {
 			if atomic.LoadInt64(&linkCounter) >= int64(options.limit) {
 				s.logger.Info("limit reached", zap.Int64("limit", int64(options.limit)))
 				return errLimitReached
 			}
 
+			if inside, done := options.historyWindow(elem.Msg); done {
+				return errRangeEnd
+			} else if !inside {
+				return nil
+			}
+
 			message, ok := elem.Msg.(*tg.Message)
 			if !ok {
 				return nil
@@ -127,7 +128,7 @@ func (s *linkService) GetYandexDiskLinks(ctx context.Context, p peers.Peer, opts
 
 			return nil
 		}); err != nil {
-			if !errors.Is(err, errLimitReached) {
+			if !errors.Is(err, errLimitReached) && !errors.Is(err, errRangeEnd) {
 				s.logger.Error("failed to get yandex disk links", zap.Error(apperr.New("telegram.link.get_yadisk_links.iterate", apperr.KindNetwork, err)))
 			}
 		}
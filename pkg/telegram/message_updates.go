@@ -0,0 +1,127 @@
+package telegram
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/gotd/td/tg"
+)
+
+// newMessageHandler handles messages from both new message update kinds.
+type newMessageHandler func(ctx context.Context, e tg.Entities, msg tg.MessageClass) error
+
+// messageFanout delivers new messages to every subscriber. The update
+// dispatcher keeps a single handler per update type, so subscribers must not
+// register there directly or they would replace each other.
+type messageFanout struct {
+	mu       sync.RWMutex
+	nextID   int
+	handlers map[int]newMessageHandler
+	order    []int
+}
+
+func newMessageFanout(dispatcher tg.UpdateDispatcher) *messageFanout {
+	f := &messageFanout{handlers: map[int]newMessageHandler{}}
+
+	dispatcher.OnNewMessage(func(ctx context.Context, e tg.Entities, update *tg.UpdateNewMessage) error {
+		return f.handle(ctx, e, update.Message)
+	})
+	dispatcher.OnNewChannelMessage(func(ctx context.Context, e tg.Entities, update *tg.UpdateNewChannelMessage) error {
+		return f.handle(ctx, e, update.Message)
+	})
+
+	return f
+}
+
+// subscribe adds a handler and returns a function that removes it again.
+func (f *messageFanout) subscribe(handler newMessageHandler) func() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := f.nextID
+	f.nextID++
+	f.handlers[id] = handler
+	f.order = append(f.order, id)
+
+	return func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		delete(f.handlers, id)
+		for i, candidate := range f.order {
+			if candidate == id {
+				f.order = append(f.order[:i], f.order[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+func (f *messageFanout) handle(ctx context.Context, e tg.Entities, msg tg.MessageClass) error {
+	f.mu.RLock()
+	handlers := make([]newMessageHandler, 0, len(f.order))
+	for _, id := range f.order {
+		handlers = append(handlers, f.handlers[id])
+	}
+	f.mu.RUnlock()
+
+	var errs []error
+	for _, handler := range handlers {
+		if err := handler(ctx, e, msg); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// pendingMessage is a live message waiting to be processed by a watch.
+type pendingMessage struct {
+	entities tg.Entities
+	msg      tg.NotEmptyMessage
+}
+
+// pendingMessages queues the live messages of one watch, so the shared
+// dispatcher never waits for a slow or backfilling watch.
+type pendingMessages struct {
+	mu    sync.Mutex
+	queue []pendingMessage
+	wake  chan struct{}
+}
+
+func newPendingMessages() *pendingMessages {
+	return &pendingMessages{wake: make(chan struct{}, 1)}
+}
+
+// push queues a message without blocking.
+func (q *pendingMessages) push(m pendingMessage) {
+	q.mu.Lock()
+	q.queue = append(q.queue, m)
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next waits for queued messages and takes all of them, in arrival order.
+func (q *pendingMessages) next(ctx context.Context) ([]pendingMessage, error) {
+	for {
+		q.mu.Lock()
+		batch := q.queue
+		q.queue = nil
+		q.mu.Unlock()
+
+		if len(batch) > 0 {
+			return batch, nil
+		}
+
+		select {
+		case <-q.wake:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
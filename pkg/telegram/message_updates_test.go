@@ -0,0 +1,65 @@
+package telegram
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gotd/td/tg"
+)
+
+func TestMessageFanoutDeliversToAllSubscribers(t *testing.T) {
+	dispatcher := tg.NewUpdateDispatcher()
+	fanout := newMessageFanout(dispatcher)
+
+	var first, second []int
+	fanout.subscribe(func(_ context.Context, _ tg.Entities, msg tg.MessageClass) error {
+		first = append(first, msg.GetID())
+		return nil
+	})
+	unsubscribe := fanout.subscribe(func(_ context.Context, _ tg.Entities, msg tg.MessageClass) error {
+		second = append(second, msg.GetID())
+		return nil
+	})
+
+	handle := func(id int) {
+		t.Helper()
+		if err := dispatcher.Handle(context.Background(), &tg.Updates{
+			Updates: []tg.UpdateClass{
+				&tg.UpdateNewChannelMessage{Message: &tg.Message{ID: id, PeerID: &tg.PeerChannel{ChannelID: 1}}},
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	handle(1)
+	unsubscribe()
+	handle(2)
+
+	if len(first) != 2 || len(second) != 1 || second[0] != 1 {
+		t.Fatalf("first = %v, second = %v", first, second)
+	}
+}
+
+func TestPendingMessagesQueueWithoutBlocking(t *testing.T) {
+	pending := newPendingMessages()
+
+	// Nobody takes messages while a backfill runs; pushing must not wait.
+	for id := 1; id <= 100; id++ {
+		pending.push(pendingMessage{msg: &tg.Message{ID: id}})
+	}
+
+	batch, err := pending.next(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batch) != 100 || batch[0].msg.GetID() != 1 || batch[99].msg.GetID() != 100 {
+		t.Fatalf("batch = %d messages, want 100 in arrival order", len(batch))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := pending.next(ctx); err == nil {
+		t.Fatal("next() on an empty queue ignored cancellation")
+	}
+}
@@ -0,0 +1,94 @@
+package telegram
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/oauth2"
+)
+
+var oauth2TokenBucket = []byte("oauth2_tokens")
+
+// OAuth2TokenStore persists the OAuth2 tokens of storages, including their
+// refresh tokens, by storage name.
+type OAuth2TokenStore interface {
+	Get(ctx context.Context, name string) (*oauth2.Token, bool, error)
+	Put(ctx context.Context, name string, token *oauth2.Token) error
+	Delete(ctx context.Context, name string) error
+}
+
+type boltOAuth2TokenStore struct {
+	db *bolt.DB
+}
+
+var _ OAuth2TokenStore = (*boltOAuth2TokenStore)(nil)
+
+func newBoltOAuth2TokenStore(db *bolt.DB) *boltOAuth2TokenStore {
+	return &boltOAuth2TokenStore{db: db}
+}
+
+func (s *boltOAuth2TokenStore) Get(_ context.Context, name string) (*oauth2.Token, bool, error) {
+	var token *oauth2.Token
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(oauth2TokenBucket)
+		if b == nil {
+			return nil
+		}
+
+		v := b.Get([]byte(name))
+		if v == nil {
+			return nil
+		}
+
+		token = &oauth2.Token{}
+		if err := json.Unmarshal(v, token); err != nil {
+			return fmt.Errorf("decode %s token: %w", name, err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, false, apperr.New("telegram.oauth2_token.get", apperr.KindIO, err)
+	}
+
+	return token, token != nil, nil
+}
+
+func (s *boltOAuth2TokenStore) Put(_ context.Context, name string, token *oauth2.Token) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return apperr.New("telegram.oauth2_token.put", apperr.KindInternal, fmt.Errorf("encode %s token: %w", name, err))
+	}
+
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(oauth2TokenBucket)
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(name), data)
+	}); err != nil {
+		return apperr.New("telegram.oauth2_token.put", apperr.KindIO, err)
+	}
+
+	return nil
+}
+
+func (s *boltOAuth2TokenStore) Delete(_ context.Context, name string) error {
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(oauth2TokenBucket)
+		if b == nil {
+			return nil
+		}
+
+		return b.Delete([]byte(name))
+	}); err != nil {
+		return apperr.New("telegram.oauth2_token.delete", apperr.KindIO, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,38 @@
+package telegram
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestBoltOAuth2TokenStoreRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	store := newBoltOAuth2TokenStore(openDialogCacheStoreTestDB(t))
+
+	if _, found, err := store.Get(ctx, "dropbox"); err != nil || found {
+		t.Fatalf("Get() on empty store = found %v, err %v", found, err)
+	}
+
+	expiry := time.Now().Add(time.Hour).Round(time.Second)
+	if err := store.Put(ctx, "dropbox", &oauth2.Token{AccessToken: "access", RefreshToken: "refresh", Expiry: expiry}); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	got, found, err := store.Get(ctx, "dropbox")
+	if err != nil || !found {
+		t.Fatalf("Get() = found %v, err %v", found, err)
+	}
+	if got.AccessToken != "access" || got.RefreshToken != "refresh" || !got.Expiry.Equal(expiry) {
+		t.Fatalf("Get() = %+v", got)
+	}
+
+	if err := store.Delete(ctx, "dropbox"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, found, _ := store.Get(ctx, "dropbox"); found {
+		t.Fatal("token still present after Delete()")
+	}
+}
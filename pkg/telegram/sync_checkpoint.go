@@ -0,0 +1,116 @@
+package telegram
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	syncCheckpointBucket  = []byte("sync_checkpoints")
+	watchCheckpointBucket = []byte("watch_checkpoints")
+)
+
+// SyncCheckpoint is the high-water mark of an incremental history download
+// or of a watcher.
+type SyncCheckpoint struct {
+	// PeerID is the TDLib-style ID of the synced peer.
+	PeerID int64 `json:"peer_id"`
+	// MessageID is the last message whose files were all processed.
+	MessageID int `json:"message_id"`
+	// Options describes the download options the checkpoint was made with.
+	Options   string    `json:"options,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// SyncCheckpointStore persists per-peer sync checkpoints.
+type SyncCheckpointStore interface {
+	Get(ctx context.Context, peerID int64) (SyncCheckpoint, bool, error)
+	Put(ctx context.Context, checkpoint SyncCheckpoint) error
+	Delete(ctx context.Context, peerID int64) error
+}
+
+type boltSyncCheckpointStore struct {
+	db     *bolt.DB
+	bucket []byte
+}
+
+var _ SyncCheckpointStore = (*boltSyncCheckpointStore)(nil)
+
+func newBoltSyncCheckpointStore(db *bolt.DB, bucket []byte) *boltSyncCheckpointStore {
+	return &boltSyncCheckpointStore{db: db, bucket: bucket}
+}
+
+func (s *boltSyncCheckpointStore) Get(_ context.Context, peerID int64) (SyncCheckpoint, bool, error) {
+	var (
+		checkpoint SyncCheckpoint
+		found      bool
+	)
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+		if b == nil {
+			return nil
+		}
+
+		v := b.Get(int64Bytes(peerID))
+		if v == nil {
+			return nil
+		}
+
+		if err := json.Unmarshal(v, &checkpoint); err != nil {
+			return fmt.Errorf("decode sync checkpoint: %w", err)
+		}
+
+		found = true
+		return nil
+	})
+	if err != nil {
+		return SyncCheckpoint{}, false, apperr.New("telegram.sync_checkpoint.get", apperr.KindIO, err)
+	}
+
+	return checkpoint, found, nil
+}
+
+func (s *boltSyncCheckpointStore) Put(_ context.Context, checkpoint SyncCheckpoint) error {
+	if checkpoint.UpdatedAt.IsZero() {
+		checkpoint.UpdatedAt = time.Now().UTC()
+	}
+
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return apperr.New("telegram.sync_checkpoint.put", apperr.KindInternal, fmt.Errorf("encode sync checkpoint: %w", err))
+	}
+
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(s.bucket)
+		if err != nil {
+			return err
+		}
+
+		return b.Put(int64Bytes(checkpoint.PeerID), data)
+	}); err != nil {
+		return apperr.New("telegram.sync_checkpoint.put", apperr.KindIO, err)
+	}
+
+	return nil
+}
+
+func (s *boltSyncCheckpointStore) Delete(_ context.Context, peerID int64) error {
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+		if b == nil {
+			return nil
+		}
+
+		return b.Delete(int64Bytes(peerID))
+	}); err != nil {
+		return apperr.New("telegram.sync_checkpoint.delete", apperr.KindIO, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,34 @@
+package telegram
+
+import (
+	"context"
+	"testing"
+)
+
+func TestBoltSyncCheckpointStoreRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	store := newBoltSyncCheckpointStore(openDialogCacheStoreTestDB(t), syncCheckpointBucket)
+
+	if _, found, err := store.Get(ctx, -1001); err != nil || found {
+		t.Fatalf("Get() on empty store = found %v, err %v", found, err)
+	}
+
+	if err := store.Put(ctx, SyncCheckpoint{PeerID: -1001, MessageID: 42, Options: "type=video"}); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	got, found, err := store.Get(ctx, -1001)
+	if err != nil || !found {
+		t.Fatalf("Get() = found %v, err %v", found, err)
+	}
+	if got.MessageID != 42 || got.Options != "type=video" || got.UpdatedAt.IsZero() {
+		t.Fatalf("Get() = %+v", got)
+	}
+
+	if err := store.Delete(ctx, -1001); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, found, _ := store.Get(ctx, -1001); found {
+		t.Fatal("checkpoint still present after Delete()")
+	}
+}
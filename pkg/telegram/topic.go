@@ -0,0 +1,138 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gotd/td/telegram/message/peer"
+	"github.com/gotd/td/telegram/peers"
+	"github.com/gotd/td/tg"
+	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
+)
+
+// GeneralTopicID is the ID of the General topic every forum has. Its
+// messages carry no topic reference.
+const GeneralTopicID = 1
+
+const forumTopicsBatchSize = 100
+
+// ForumTopic is a topic (thread) of a forum supergroup.
+type ForumTopic struct {
+	ID     int
+	Title  string
+	Closed bool
+	Pinned bool
+	Hidden bool
+}
+
+type getfileTopicOption struct {
+	topicID int
+}
+
+func (o getfileTopicOption) apply(opts *getAllFilesOption) error {
+	if o.topicID < 0 {
+		return apperr.New("telegram.history.topic", apperr.KindConfig, fmt.Errorf("invalid topic ID %d", o.topicID))
+	}
+
+	opts.topicID = o.topicID
+	return nil
+}
+
+// GetFileWithTopic limits history to one topic of a forum supergroup. Zero
+// walks the whole history.
+func GetFileWithTopic(topicID int) GetAllFilesOption {
+	return getfileTopicOption{topicID: topicID}
+}
+
+// GetForumTopics returns all topics of a forum supergroup.
+func (c *Client) GetForumTopics(ctx context.Context, p peers.Peer) ([]ForumTopic, error) {
+	if !p.TDLibPeerID().IsChannel() {
+		return nil, apperr.New("telegram.client.forum_topics", apperr.KindConfig, fmt.Errorf("%s is not a forum supergroup", p.VisibleName()))
+	}
+
+	topics, err := forumTopics(ctx, c.API(), p)
+	if err != nil {
+		return nil, apperr.New("telegram.client.forum_topics", apperr.KindNetwork, err)
+	}
+
+	return topics, nil
+}
+
+// forumTopics pages messages.getForumTopics. Each page continues after the
+// last topic, anchored on the date and ID of that topic's latest message.
+func forumTopics(ctx context.Context, api *tg.Client, p peers.Peer) ([]ForumTopic, error) {
+	var (
+		topics []ForumTopic
+		req    = &tg.MessagesGetForumTopicsRequest{
+			Peer:  p.InputPeer(),
+			Limit: forumTopicsBatchSize,
+		}
+	)
+
+	for {
+		res, err := api.MessagesGetForumTopics(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+
+		var last *tg.ForumTopic
+		for _, class := range res.Topics {
+			topic, ok := class.(*tg.ForumTopic)
+			if !ok {
+				continue
+			}
+
+			topics = append(topics, ForumTopic{
+				ID:     topic.ID,
+				Title:  topic.Title,
+				Closed: topic.Closed,
+				Pinned: topic.Pinned,
+				Hidden: topic.Hidden,
+			})
+			last = topic
+		}
+
+		if last == nil || len(res.Topics) < req.Limit || len(topics) >= res.Count {
+			return topics, nil
+		}
+
+		req.OffsetTopic = last.ID
+		req.OffsetID = last.TopMessage
+		req.OffsetDate = 0
+		for _, msg := range res.Messages {
+			if dated, ok := msg.(interface{ GetDate() int }); ok && msg.GetID() == last.TopMessage {
+				req.OffsetDate = dated.GetDate()
+				break
+			}
+		}
+	}
+}
+
+// messageTopicID returns the forum topic of a message, or zero when the
+// message is not in a forum.
+func messageTopicID(msg tg.NotEmptyMessage, entities peer.Entities) int {
+	channel, ok := msg.GetPeerID().(*tg.PeerChannel)
+	if !ok {
+		return 0
+	}
+
+	if raw, ok := entities.Channel(channel.ChannelID); !ok || !raw.Forum {
+		return 0
+	}
+
+	replyTo, ok := msg.GetReplyTo()
+	if !ok {
+		return GeneralTopicID
+	}
+
+	header, ok := replyTo.(*tg.MessageReplyHeader)
+	if !ok || !header.ForumTopic {
+		return GeneralTopicID
+	}
+
+	if header.ReplyToTopID != 0 {
+		return header.ReplyToTopID
+	}
+
+	return header.ReplyToMsgID
+}
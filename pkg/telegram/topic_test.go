@@ -0,0 +1,175 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/gotd/td/bin"
+	"github.com/gotd/td/telegram/message/peer"
+	"github.com/gotd/td/telegram/query/messages"
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgmock"
+	telegrammocks "github.com/johnnyipcom/tgdownloader/pkg/telegram/mocks"
+	"go.uber.org/mock/gomock"
+)
+
+func TestMessageTopicID(t *testing.T) {
+	t.Parallel()
+
+	forum := peer.NewEntities(nil, nil, map[int64]*tg.Channel{10: {ID: 10, Forum: true}})
+	plain := peer.NewEntities(nil, nil, map[int64]*tg.Channel{10: {ID: 10}})
+	inForum := &tg.PeerChannel{ChannelID: 10}
+	reply := func(header *tg.MessageReplyHeader) *tg.Message {
+		msg := &tg.Message{ID: 5, PeerID: inForum}
+		msg.SetReplyTo(header)
+		return msg
+	}
+
+	tests := []struct {
+		name     string
+		msg      tg.NotEmptyMessage
+		entities peer.Entities
+		want     int
+	}{
+		{name: "NotAForum", msg: &tg.Message{ID: 5, PeerID: inForum}, entities: plain, want: 0},
+		{name: "User", msg: &tg.Message{ID: 5, PeerID: &tg.PeerUser{UserID: 1}}, entities: forum, want: 0},
+		{name: "General", msg: &tg.Message{ID: 5, PeerID: inForum}, entities: forum, want: GeneralTopicID},
+		{
+			name:     "TopicRoot",
+			msg:      reply(&tg.MessageReplyHeader{ForumTopic: true, ReplyToMsgID: 3}),
+			entities: forum,
+			want:     3,
+		},
+		{
+			name:     "ReplyInsideTopic",
+			msg:      reply(&tg.MessageReplyHeader{ForumTopic: true, ReplyToMsgID: 4, ReplyToTopID: 3}),
+			entities: forum,
+			want:     3,
+		},
+		{
+			name:     "ReplyInGeneral",
+			msg:      reply(&tg.MessageReplyHeader{ReplyToMsgID: 4}),
+			entities: forum,
+			want:     GeneralTopicID,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := messageTopicID(tt.msg, tt.entities); got != tt.want {
+				t.Fatalf("messageTopicID() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func testForumTopic(id int, title string, topMessage int) *tg.ForumTopic {
+	return &tg.ForumTopic{
+		ID:         id,
+		Title:      title,
+		TopMessage: topMessage,
+		Peer:       &tg.PeerChannel{ChannelID: 10},
+		FromID:     &tg.PeerUser{UserID: 1},
+	}
+}
+
+func TestForumTopicsPagesAfterLastTopic(t *testing.T) {
+	t.Parallel()
+
+	var requests []tg.MessagesGetForumTopicsRequest
+	invoker := func(request bin.Encoder) (bin.Encoder, error) {
+		req, ok := request.(*tg.MessagesGetForumTopicsRequest)
+		if !ok {
+			return nil, fmt.Errorf("unexpected request %T", request)
+		}
+		requests = append(requests, *req)
+
+		result := &tg.MessagesForumTopics{Count: forumTopicsBatchSize + 1}
+		if req.OffsetTopic == 0 {
+			for id := forumTopicsBatchSize; id >= 1; id-- {
+				result.Topics = append(result.Topics, testForumTopic(id, fmt.Sprintf("topic %d", id), id+1000))
+			}
+			result.Messages = []tg.MessageClass{&tg.Message{ID: 1001, Date: 77, PeerID: &tg.PeerChannel{ChannelID: 10}}}
+			return result, nil
+		}
+
+		result.Topics = []tg.ForumTopicClass{&tg.ForumTopicDeleted{ID: 500}, testForumTopic(101, "old", 0)}
+		return result, nil
+	}
+
+	ctrl := gomock.NewController(t)
+	p := telegrammocks.NewMocklinkedChatPeer(ctrl)
+	p.EXPECT().InputPeer().Return(&tg.InputPeerSelf{}).AnyTimes()
+
+	topics, err := forumTopics(context.Background(), tg.NewClient(tgmock.Invoker(invoker)), p)
+	if err != nil {
+		t.Fatalf("forumTopics() error = %v", err)
+	}
+
+	if len(topics) != forumTopicsBatchSize+1 || topics[0].Title != "topic 100" || topics[len(topics)-1].Title != "old" {
+		t.Fatalf("topics = %d, first %+v, last %+v", len(topics), topics[0], topics[len(topics)-1])
+	}
+
+	if len(requests) != 2 {
+		t.Fatalf("requests = %d, want 2", len(requests))
+	}
+	if next := requests[1]; next.OffsetTopic != 1 || next.OffsetID != 1001 || next.OffsetDate != 77 {
+		t.Fatalf("second request offsets = topic %d, id %d, date %d", next.OffsetTopic, next.OffsetID, next.OffsetDate)
+	}
+}
+
+func TestForEachHistoryWalksTopicReplies(t *testing.T) {
+	t.Parallel()
+
+	for _, oldestFirst := range []bool{false, true} {
+		oldestFirst := oldestFirst
+		t.Run(fmt.Sprintf("OldestFirst=%v", oldestFirst), func(t *testing.T) {
+			t.Parallel()
+
+			history := fakeHistory(30)
+			invoker := func(request bin.Encoder) (bin.Encoder, error) {
+				req, ok := request.(*tg.MessagesGetRepliesRequest)
+				if !ok {
+					return nil, fmt.Errorf("unexpected request %T", request)
+				}
+				if req.MsgID != 7 {
+					return nil, fmt.Errorf("replies of message %d, want topic 7", req.MsgID)
+				}
+
+				return history(&tg.MessagesGetHistoryRequest{
+					OffsetID:   req.OffsetID,
+					OffsetDate: req.OffsetDate,
+					AddOffset:  req.AddOffset,
+					Limit:      req.Limit,
+					MaxID:      req.MaxID,
+					MinID:      req.MinID,
+				})
+			}
+
+			ctrl := gomock.NewController(t)
+			p := telegrammocks.NewMocklinkedChatPeer(ctrl)
+			p.EXPECT().InputPeer().Return(&tg.InputPeerSelf{}).AnyTimes()
+
+			options := getAllFilesOption{oldestFirst: oldestFirst}
+			if err := GetFileWithTopic(7).apply(&options); err != nil {
+				t.Fatalf("apply() error = %v", err)
+			}
+
+			seen := 0
+			err := options.forEachHistory(context.Background(), tg.NewClient(tgmock.Invoker(invoker)), p, func(context.Context, messages.Elem) error {
+				seen++
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("forEachHistory() error = %v", err)
+			}
+			if seen != 30 {
+				t.Fatalf("messages = %d, want 30", seen)
+			}
+		})
+	}
+}
@@ -188,6 +188,7 @@ func getPhotoFile(photoClass tg.PhotoClass) (*File, error) {
 		name: name,
 		size: int64(size),
 		dc:   photo.DCID,
+		kind: MediaKindPhoto,
 
 		location: &tg.InputPhotoFileLocation{
 			ID:            photo.ID,
@@ -198,6 +199,7 @@ func getPhotoFile(photoClass tg.PhotoClass) (*File, error) {
 
 		metadata: map[string]interface{}{
 			"mime_type":  "image/jpeg",
+			"media_type": string(MediaKindPhoto),
 			"thumb_size": thumbSize,
 		},
 	}, nil
@@ -266,10 +268,13 @@ func getDocumentFile(docClass tg.DocumentClass) (*File, error) {
 		return nil, errNoFilesInMessage
 	}
 
+	kind := getDocumentMediaKind(doc)
+
 	return &File{
 		name: name,
 		size: doc.Size,
 		dc:   doc.DCID,
+		kind: kind,
 
 		location: &tg.InputDocumentFileLocation{
 			ID:            doc.ID,
@@ -278,7 +283,8 @@ func getDocumentFile(docClass tg.DocumentClass) (*File, error) {
 		},
 
 		metadata: map[string]interface{}{
-			"mime_type": doc.MimeType,
+			"mime_type":  doc.MimeType,
+			"media_type": string(kind),
 		},
 	}, nil
 }
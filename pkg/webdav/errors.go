@@ -0,0 +1,9 @@
+package webdav
+
+import "errors"
+
+// ErrNotSupported is returned when this operation is not supported by WebDAV.
+var ErrNotSupported = errors.New("webdav doesn't support this operation")
+
+// ErrNotAtEnd is returned when a file is written anywhere but at its end.
+var ErrNotAtEnd = errors.New("webdav files can only be written at their end")
@@ -0,0 +1,357 @@
+package webdav
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
+	"github.com/spf13/afero"
+)
+
+// uploadSuffix names the copy a file is rebuilt in when its existing
+// content is kept, so the original stays readable until it is replaced.
+const uploadSuffix = ".upload"
+
+// File represents a file structure.
+//
+// A written file is streamed to the server with a single PUT. Existing
+// content can be kept by opening the file without O_TRUNC, cutting it with
+// Truncate and seeking to its end, or with O_APPEND: the kept bytes are then
+// uploaded again, read back from the server, before the new ones. That's how
+// part files of interrupted downloads are resumed.
+type File struct {
+	fs     *Fs
+	name   string
+	remote string
+
+	// reading
+	streamRead io.ReadCloser
+	size       int64
+	offset     int64
+
+	// writing
+	writing     bool
+	existing    int64 // size of the file when it was opened, -1 if it was created
+	kept        int64 // bytes of the existing file that stay in front
+	end         int64
+	pos         int64
+	streamWrite *io.PipeWriter
+	uploadErr   chan error
+
+	dir       bool
+	dirList   []os.FileInfo
+	dirListed bool
+}
+
+func newFile(fs *Fs, name string) *File {
+	return &File{
+		fs:     fs,
+		name:   name,
+		remote: remotePath(name),
+	}
+}
+
+func (f *File) openRead(info os.FileInfo) {
+	f.dir = info.IsDir()
+	f.size = info.Size()
+}
+
+func (f *File) openWrite(existing int64, flag int) {
+	f.writing = true
+	f.existing = existing
+	if existing > 0 && flag&os.O_TRUNC == 0 {
+		f.kept = existing
+	}
+	f.end = f.kept
+
+	if flag&os.O_APPEND != 0 {
+		f.pos = f.end
+	}
+}
+
+// Close closes the File, rendering it unusable for I/O. Closing a written
+// file completes its upload.
+func (f *File) Close() error {
+	if f.streamRead != nil {
+		defer func() {
+			f.streamRead = nil
+		}()
+
+		return f.streamRead.Close()
+	}
+
+	if !f.writing {
+		return nil
+	}
+	f.writing = false
+
+	if f.streamWrite == nil {
+		if f.kept == f.existing {
+			// Nothing was written or cut.
+			return nil
+		}
+
+		if err := f.startUpload(); err != nil {
+			return err
+		}
+	}
+
+	defer func() {
+		f.streamWrite = nil
+	}()
+
+	if err := f.streamWrite.Close(); err != nil {
+		return apperr.New("webdav.file.close.write_stream", apperr.KindIO, err)
+	}
+
+	return <-f.uploadErr
+}
+
+// startUpload streams the kept content and everything written after it to
+// the server.
+func (f *File) startUpload() error {
+	reader, writer := io.Pipe()
+	target := f.remote
+	var body io.Reader = reader
+
+	var prefix io.ReadCloser
+	if f.kept > 0 {
+		var err error
+		prefix, err = f.fs.client.ReadStreamRange(f.remote, 0, f.kept)
+		if err != nil {
+			return wrapError("webdav.file.upload.read_kept", "open", f.name, err)
+		}
+
+		target = f.remote + uploadSuffix
+		body = io.MultiReader(io.LimitReader(prefix, f.kept), reader)
+	}
+
+	f.streamWrite = writer
+	f.uploadErr = make(chan error, 1)
+
+	go func() {
+		// The length is unknown, the request body is sent chunked.
+		err := f.fs.client.WriteStreamWithLength(target, body, -1, 0)
+		if prefix != nil {
+			_ = prefix.Close()
+		}
+		if err == nil && target != f.remote {
+			err = f.fs.client.Rename(target, f.remote, true)
+		}
+
+		if err != nil {
+			err = wrapError("webdav.file.upload", "write", f.name, err)
+			_ = reader.CloseWithError(err)
+		}
+
+		f.uploadErr <- err
+	}()
+
+	return nil
+}
+
+// Read reads up to len(b) bytes from the File.
+func (f *File) Read(p []byte) (int, error) {
+	if f.writing || f.dir {
+		return 0, apperr.New("webdav.file.read", apperr.KindConfig, ErrNotSupported)
+	}
+
+	if f.offset >= f.size {
+		return 0, io.EOF
+	}
+
+	if f.streamRead == nil {
+		stream, err := f.fs.client.ReadStreamRange(f.remote, f.offset, 0)
+		if err != nil {
+			return 0, wrapError("webdav.file.read", "read", f.name, err)
+		}
+		f.streamRead = stream
+	}
+
+	n, err := f.streamRead.Read(p)
+	f.offset += int64(n)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return n, apperr.New("webdav.file.read", apperr.KindNetwork, err)
+	}
+
+	return n, err
+}
+
+// ReadAt reads len(p) bytes from the file starting at byte offset off.
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	if f.writing || f.dir {
+		return 0, apperr.New("webdav.file.read_at", apperr.KindConfig, ErrNotSupported)
+	}
+
+	if off >= f.size {
+		return 0, io.EOF
+	}
+
+	length := min(int64(len(p)), f.size-off)
+	stream, err := f.fs.client.ReadStreamRange(f.remote, off, length)
+	if err != nil {
+		return 0, wrapError("webdav.file.read_at", "read", f.name, err)
+	}
+	defer stream.Close()
+
+	n, err := io.ReadFull(stream, p[:length])
+	if err != nil {
+		return n, apperr.New("webdav.file.read_at", apperr.KindNetwork, err)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// Seek sets the offset for the next Read. A written file can only seek to
+// where it can be written, its end.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	current, end := f.offset, f.size
+	if f.writing {
+		current, end = f.pos, f.end
+	}
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += current
+	case io.SeekEnd:
+		offset += end
+	default:
+		return 0, apperr.New("webdav.file.seek", apperr.KindInternal, ErrNotSupported)
+	}
+
+	if offset < 0 {
+		return 0, apperr.New("webdav.file.seek", apperr.KindInternal, errors.New("negative position"))
+	}
+
+	if f.writing {
+		if offset != f.pos && offset != f.end {
+			return 0, apperr.New("webdav.file.seek.write_stream", apperr.KindConfig, ErrNotAtEnd)
+		}
+
+		f.pos = offset
+		return offset, nil
+	}
+
+	if offset != f.offset && f.streamRead != nil {
+		_ = f.streamRead.Close()
+		f.streamRead = nil
+	}
+	f.offset = offset
+
+	return offset, nil
+}
+
+// Write writes len(b) bytes to the end of the File.
+func (f *File) Write(p []byte) (int, error) {
+	if !f.writing {
+		return 0, afero.ErrFileClosed
+	}
+
+	if f.pos != f.end {
+		return 0, apperr.New("webdav.file.write", apperr.KindConfig, ErrNotAtEnd)
+	}
+
+	if f.streamWrite == nil {
+		if err := f.startUpload(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.streamWrite.Write(p)
+	f.pos += int64(n)
+	f.end += int64(n)
+	return n, err
+}
+
+// WriteAt is not supported, files are written in order.
+func (f *File) WriteAt([]byte, int64) (int, error) {
+	return 0, apperr.New("webdav.file.write_at", apperr.KindConfig, ErrNotSupported)
+}
+
+// Truncate cuts the existing content of a file opened for writing before
+// anything is written to it. Files can't grow this way.
+func (f *File) Truncate(size int64) error {
+	if !f.writing {
+		return apperr.New("webdav.file.truncate", apperr.KindConfig, ErrNotSupported)
+	}
+
+	if size == f.end {
+		return nil
+	}
+
+	if f.streamWrite != nil || size < 0 || size > f.kept {
+		return apperr.New("webdav.file.truncate", apperr.KindConfig, ErrNotSupported)
+	}
+
+	f.kept = size
+	f.end = size
+	return nil
+}
+
+// Name returns the file name.
+func (f *File) Name() string {
+	return f.name
+}
+
+// Readdir lists the files and directories inside a directory.
+func (f *File) Readdir(count int) ([]os.FileInfo, error) {
+	if !f.dirListed {
+		list, err := f.fs.client.ReadDir(f.remote)
+		if err != nil {
+			return nil, wrapError("webdav.file.readdir", "readdir", f.name, err)
+		}
+
+		f.dirList = list
+		f.dirListed = true
+	}
+
+	if count <= 0 {
+		list := f.dirList
+		f.dirList = nil
+		return list, nil
+	}
+
+	if len(f.dirList) == 0 {
+		return nil, io.EOF
+	}
+
+	count = min(count, len(f.dirList))
+	list := f.dirList[:count]
+	f.dirList = f.dirList[count:]
+	return list, nil
+}
+
+// Readdirnames reads and returns a slice of names from the directory f.
+func (f *File) Readdirnames(n int) ([]string, error) {
+	fi, err := f.Readdir(n)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(fi))
+	for i, f := range fi {
+		names[i] = f.Name()
+	}
+
+	return names, nil
+}
+
+// Stat fetches the file info.
+func (f *File) Stat() (os.FileInfo, error) {
+	return f.fs.Stat(f.name)
+}
+
+// Sync doesn't do anything.
+func (f *File) Sync() error {
+	return nil
+}
+
+// WriteString writes a string.
+func (f *File) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
@@ -0,0 +1,258 @@
+// Package webdav provides an afero implementation on top of a WebDAV server,
+// such as Nextcloud or a NAS.
+package webdav
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"time"
+
+	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
+	"github.com/spf13/afero"
+	"github.com/studio-b12/gowebdav"
+)
+
+// Config describes the server to store files on.
+type Config struct {
+	// URL is the root collection, for Nextcloud
+	// https://host/remote.php/dav/files/<user>/.
+	URL      string
+	User     string
+	Password string
+	// Transport replaces the default HTTP transport.
+	Transport http.RoundTripper
+}
+
+// Fs is the WebDAV filesystem.
+type Fs struct {
+	client *gowebdav.Client
+	log    *log.Logger
+}
+
+// NewFs creates new WebDAV FS instance and checks that the server accepts
+// the credentials.
+func NewFs(cfg Config, log *log.Logger) (*Fs, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, apperr.New("webdav.fs.config", apperr.KindConfig, fmt.Errorf("invalid url %q, want http(s)://host/path", cfg.URL))
+	}
+
+	// Credentials are sent with every request: negotiating them would
+	// buffer whole uploads in memory to send them again.
+	client := gowebdav.NewAuthClient(cfg.URL, gowebdav.NewPreemptiveAuth(&basicAuth{user: cfg.User, password: cfg.Password}))
+	if cfg.Transport != nil {
+		client.SetTransport(cfg.Transport)
+	}
+
+	if err := client.Connect(); err != nil {
+		return nil, apperr.New("webdav.fs.connect", errorKind(err), fmt.Errorf("connect to %s: %w", u.Redacted(), err))
+	}
+
+	return &Fs{
+		client: client,
+		log:    log,
+	}, nil
+}
+
+// basicAuth authenticates every request with the user and password.
+type basicAuth struct {
+	user     string
+	password string
+}
+
+func (a *basicAuth) Authorize(_ *http.Client, rq *http.Request, _ string) error {
+	rq.SetBasicAuth(a.user, a.password)
+	return nil
+}
+
+func (a *basicAuth) Verify(_ *http.Client, rs *http.Response, path string) (bool, error) {
+	if rs.StatusCode == http.StatusUnauthorized {
+		return false, gowebdav.NewPathError("Authorize", path, rs.StatusCode)
+	}
+
+	return false, nil
+}
+
+func (a *basicAuth) Close() error {
+	return nil
+}
+
+func (a *basicAuth) Clone() gowebdav.Authenticator {
+	return a
+}
+
+func (a *basicAuth) String() string {
+	return "BasicAuth login: " + a.user
+}
+
+// remotePath returns the path of name on the server.
+func remotePath(name string) string {
+	return path.Clean("/" + name)
+}
+
+// Create creates a file.
+func (fs *Fs) Create(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0)
+}
+
+// Mkdir creates a directory.
+func (fs *Fs) Mkdir(name string, _ os.FileMode) error {
+	if err := fs.client.Mkdir(remotePath(name), 0); err != nil {
+		return wrapError("webdav.fs.mkdir", "mkdir", name, err)
+	}
+
+	return nil
+}
+
+// MkdirAll creates a directory and all parent directories if necessary.
+func (fs *Fs) MkdirAll(name string, _ os.FileMode) error {
+	if err := fs.client.MkdirAll(remotePath(name), 0); err != nil {
+		return wrapError("webdav.fs.mkdir_all", "mkdir", name, err)
+	}
+
+	return nil
+}
+
+// Open a file for reading.
+func (fs *Fs) Open(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile opens a file. Written files are uploaded while they are written
+// and complete when they are closed. WebDAV can't change a part of a file,
+// so writing is only possible at the end of it, see File.
+func (fs *Fs) OpenFile(name string, flag int, _ os.FileMode) (afero.File, error) {
+	if flag&os.O_RDWR != 0 {
+		return nil, apperr.New("webdav.fs.open_file.read_write", apperr.KindConfig, ErrNotSupported)
+	}
+
+	file := newFile(fs, name)
+
+	info, err := fs.Stat(name)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	exists := err == nil
+
+	if flag&(os.O_WRONLY|os.O_CREATE|os.O_APPEND|os.O_TRUNC) == 0 {
+		if !exists {
+			return nil, err
+		}
+
+		file.openRead(info)
+		return file, nil
+	}
+
+	switch {
+	case !exists && flag&os.O_CREATE == 0:
+		return nil, err
+	case exists && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case exists && info.IsDir():
+		return nil, apperr.New("webdav.fs.open_file", apperr.KindIO, fmt.Errorf("open %q: is a directory", name))
+	}
+
+	size := int64(-1)
+	if exists {
+		size = info.Size()
+	}
+
+	file.openWrite(size, flag)
+	return file, nil
+}
+
+// Remove removes a file or a directory.
+func (fs *Fs) Remove(name string) error {
+	if err := fs.client.Remove(remotePath(name)); err != nil {
+		return wrapError("webdav.fs.remove", "remove", name, err)
+	}
+
+	return nil
+}
+
+// RemoveAll removes a file or a directory with everything inside it.
+func (fs *Fs) RemoveAll(name string) error {
+	if err := fs.client.RemoveAll(remotePath(name)); err != nil {
+		return wrapError("webdav.fs.remove_all", "remove", name, err)
+	}
+
+	return nil
+}
+
+// Rename moves a file, replacing newname.
+func (fs *Fs) Rename(oldname, newname string) error {
+	if err := fs.client.Rename(remotePath(oldname), remotePath(newname), true); err != nil {
+		// Servers refuse to move a missing file with different statuses.
+		if _, statErr := fs.Stat(oldname); errors.Is(statErr, os.ErrNotExist) {
+			return &os.PathError{Op: "rename", Path: oldname, Err: os.ErrNotExist}
+		}
+
+		return wrapError("webdav.fs.rename", "rename", oldname, err)
+	}
+
+	return nil
+}
+
+// Stat fetches the file info.
+func (fs *Fs) Stat(name string) (os.FileInfo, error) {
+	info, err := fs.client.Stat(remotePath(name))
+	if err != nil {
+		return nil, wrapError("webdav.fs.stat", "stat", name, err)
+	}
+
+	// Servers don't have to return a display name.
+	return &fileInfo{FileInfo: info, name: path.Base(remotePath(name))}, nil
+}
+
+// Name of the fs: webdav.
+func (fs *Fs) Name() string {
+	return "webdav"
+}
+
+// Chmod is not supported.
+func (fs *Fs) Chmod(string, os.FileMode) error {
+	return apperr.New("webdav.fs.chmod", apperr.KindConfig, ErrNotSupported)
+}
+
+// Chown is not supported.
+func (fs *Fs) Chown(string, int, int) error {
+	return apperr.New("webdav.fs.chown", apperr.KindConfig, ErrNotSupported)
+}
+
+// Chtimes is not supported.
+func (fs *Fs) Chtimes(string, time.Time, time.Time) error {
+	return apperr.New("webdav.fs.chtimes", apperr.KindConfig, ErrNotSupported)
+}
+
+type fileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (f *fileInfo) Name() string {
+	return f.name
+}
+
+// wrapError keeps missing files recognizable by os.IsNotExist, which
+// afero.Exists relies on, and types everything else.
+func wrapError(op, pathOp, name string, err error) error {
+	if gowebdav.IsErrNotFound(err) {
+		return &os.PathError{Op: pathOp, Path: name, Err: os.ErrNotExist}
+	}
+
+	return apperr.New(op, errorKind(err), fmt.Errorf("%s %q: %w", pathOp, name, err))
+}
+
+// errorKind tells refused credentials from failed requests.
+func errorKind(err error) apperr.Kind {
+	if gowebdav.IsErrCode(err, http.StatusUnauthorized) || gowebdav.IsErrCode(err, http.StatusForbidden) {
+		return apperr.KindAuth
+	}
+
+	return apperr.KindNetwork
+}
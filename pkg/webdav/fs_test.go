@@ -0,0 +1,224 @@
+package webdav
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/johnnyipcom/tgdownloader/pkg/apperr"
+	"github.com/spf13/afero"
+	"golang.org/x/net/webdav"
+)
+
+// newTestFs serves a temporary directory over WebDAV behind basic auth and
+// counts the PUT requests.
+func newTestFs(t *testing.T) (*Fs, string, *atomic.Int32) {
+	t.Helper()
+
+	dir := t.TempDir()
+	handler := &webdav.Handler{
+		FileSystem: webdav.Dir(dir),
+		LockSystem: webdav.NewMemLS(),
+	}
+
+	var puts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "tg" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Method == http.MethodPut {
+			puts.Add(1)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	fs, err := NewFs(Config{URL: server.URL + "/", User: "tg", Password: "secret"}, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewFs() error = %v", err)
+	}
+
+	return fs, dir, &puts
+}
+
+func readLocal(t *testing.T, name string) string {
+	t.Helper()
+
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+
+	return string(data)
+}
+
+func TestFsWritesAndRenames(t *testing.T) {
+	t.Parallel()
+
+	fs, dir, _ := newTestFs(t)
+
+	if err := fs.MkdirAll("/chat/2024", 0755); err != nil {
+		t.Fatalf("MkdirAll() error = %v", err)
+	}
+
+	f, err := fs.Create("/chat/2024/a.bin.part")
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if _, err := f.Seek(0, io.SeekCurrent); err != nil {
+		t.Fatalf("Seek() error = %v", err)
+	}
+	if err := f.Truncate(12); !errors.Is(err, ErrNotSupported) {
+		t.Fatalf("Truncate() error = %v, want %v to stream the download", err, ErrNotSupported)
+	}
+	if _, err := f.Write([]byte("hello, ")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if _, err := f.WriteString("world"); err != nil {
+		t.Fatalf("WriteString() error = %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	info, err := fs.Stat("/chat/2024/a.bin.part")
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if info.Size() != 12 || info.Name() != "a.bin.part" || info.IsDir() {
+		t.Fatalf("Stat() = %s dir=%t size=%d", info.Name(), info.IsDir(), info.Size())
+	}
+
+	if err := afero.WriteFile(fs, "/chat/2024/a.bin", []byte("old"), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if err := fs.Rename("/chat/2024/a.bin.part", "/chat/2024/a.bin"); err != nil {
+		t.Fatalf("Rename() error = %v", err)
+	}
+	if got := readLocal(t, filepath.Join(dir, "chat", "2024", "a.bin")); got != "hello, world" {
+		t.Fatalf("file = %q", got)
+	}
+
+	data, err := afero.ReadFile(fs, "/chat/2024/a.bin")
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if string(data) != "hello, world" {
+		t.Fatalf("ReadFile() = %q", data)
+	}
+
+	entries, err := afero.ReadDir(fs, "/chat")
+	if err != nil {
+		t.Fatalf("ReadDir() error = %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "2024" || !entries[0].IsDir() {
+		t.Fatalf("ReadDir() = %v", entries)
+	}
+}
+
+func TestFsResumesAndAppends(t *testing.T) {
+	t.Parallel()
+
+	fs, dir, puts := newTestFs(t)
+	if err := afero.WriteFile(fs, "/a.bin.part", []byte("hello, wor"), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	// Resuming a download cuts the part file to the last good offset.
+	f, err := fs.OpenFile("/a.bin.part", os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	if _, err := f.Write([]byte("x")); !errors.Is(err, ErrNotAtEnd) {
+		t.Fatalf("Write() at the start error = %v, want %v", err, ErrNotAtEnd)
+	}
+	if err := f.Truncate(7); err != nil {
+		t.Fatalf("Truncate() error = %v", err)
+	}
+	if _, err := f.Seek(7, io.SeekStart); err != nil {
+		t.Fatalf("Seek() error = %v", err)
+	}
+	if _, err := f.WriteString("world"); err != nil {
+		t.Fatalf("WriteString() error = %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	f, err = fs.OpenFile("/a.bin.part", os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile(O_APPEND) error = %v", err)
+	}
+	if _, err := f.Write([]byte("!")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	if got := readLocal(t, filepath.Join(dir, "a.bin.part")); got != "hello, world!" {
+		t.Fatalf("file = %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.bin.part"+uploadSuffix)); !os.IsNotExist(err) {
+		t.Fatalf("the upload copy was left behind: %v", err)
+	}
+
+	// Opening a file without changing it doesn't upload it again.
+	before := puts.Load()
+	f, err = fs.OpenFile("/a.bin.part", os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile(O_APPEND) error = %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if got := puts.Load(); got != before {
+		t.Fatalf("PUT requests = %d, want %d", got, before)
+	}
+}
+
+func TestFsReportsMissingFiles(t *testing.T) {
+	t.Parallel()
+
+	fs, _, _ := newTestFs(t)
+
+	if _, err := fs.Stat("/missing.txt"); !os.IsNotExist(err) {
+		t.Fatalf("Stat() error = %v, want a missing file", err)
+	}
+	if exists, err := afero.Exists(fs, "/missing.txt"); err != nil || exists {
+		t.Fatalf("Exists() = %t, %v", exists, err)
+	}
+	if _, err := fs.Open("/missing.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Open() error = %v, want %v", err, os.ErrNotExist)
+	}
+	if err := fs.Rename("/missing.txt", "/b.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Rename() error = %v, want %v", err, os.ErrNotExist)
+	}
+	if _, err := fs.OpenFile("/missing.txt", os.O_RDWR, 0644); !errors.Is(err, ErrNotSupported) {
+		t.Fatalf("OpenFile(O_RDWR) error = %v, want %v", err, ErrNotSupported)
+	}
+}
+
+func TestNewFsChecksCredentials(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	logger := log.New(io.Discard, "", 0)
+	if _, err := NewFs(Config{URL: server.URL, User: "tg", Password: "wrong"}, logger); !apperr.IsKind(err, apperr.KindAuth) {
+		t.Fatalf("NewFs() error = %v, want an auth error", err)
+	}
+	if _, err := NewFs(Config{URL: "ftp://nas"}, logger); !apperr.IsKind(err, apperr.KindConfig) {
+		t.Fatalf("NewFs() error = %v, want a config error", err)
+	}
+}